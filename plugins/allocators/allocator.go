@@ -31,6 +31,12 @@ type Allocator interface {
 	// Free may return a DoubleFreeError if the prefix being returned was not
 	// previously allocated
 	Free(net.IPNet) error
+
+	// Allocated returns the prefixes currently allocated, in ascending order.
+	//
+	// The result is a consistent snapshot: it reflects no partial allocation or
+	// free, and later changes to the allocator don't affect it
+	Allocated() []net.IPNet
 }
 
 // ErrDoubleFree is an error type returned by Allocator.Free() when a
@@ -105,6 +105,23 @@ func (a *Allocator) Free(prefix net.IPNet) error {
 	return nil
 }
 
+// Allocated returns the allocated prefixes, in ascending order
+func (a *Allocator) Allocated() []net.IPNet {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	ret := make([]net.IPNet, 0, a.bitmap.Count())
+	for idx, ok := a.bitmap.NextSet(0); ok; idx, ok = a.bitmap.NextSet(idx + 1) {
+		ip, err := a.toPrefix(idx)
+		if err != nil {
+			// Every index set in the bitmap was allocated from a valid prefix
+			panic(fmt.Sprintf("BUG: could not get prefix from allocation: %v", err))
+		}
+		ret = append(ret, net.IPNet{IP: ip, Mask: net.CIDRMask(a.page, 128)})
+	}
+	return ret
+}
+
 // NewBitmapAllocator creates a new allocator, allocating /`size` prefixes
 // carved out of the given `pool` prefix
 func NewBitmapAllocator(pool net.IPNet, size int) (*Allocator, error) {
@@ -13,6 +13,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/bits-and-blooms/bitset"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
@@ -32,6 +33,10 @@ type IPv4Allocator struct {
 	// until we can swap for another concurrent implementation
 	bitmap *bitset.BitSet
 	l      sync.Mutex
+
+	// used mirrors the number of set bits, so utilization can be read without the lock.
+	// It is only written with the lock held.
+	used atomic.Uint32
 }
 
 func (a *IPv4Allocator) toIP(offset uint32) net.IP {
@@ -81,6 +86,34 @@ func (a *IPv4Allocator) Allocate(hint net.IPNet) (n net.IPNet, err error) {
 	}
 
 	a.bitmap.Set(next)
+	a.used.Add(1)
+	n.IP = a.toIP(uint32(next))
+	return
+}
+
+// AllocateWithin reserves the lowest free IP between first and last, inclusive.
+// Bounds outside of the allocator's range are clamped to it.
+func (a *IPv4Allocator) AllocateWithin(first, last net.IP) (n net.IPNet, err error) {
+	n.Mask = net.CIDRMask(32, 32)
+	if first.To4() == nil || last.To4() == nil {
+		return n, errInvalidIP
+	}
+	lo, hi := binary.BigEndian.Uint32(first.To4()), binary.BigEndian.Uint32(last.To4())
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	lo, hi = max(lo, a.start), min(hi, a.end)
+	if lo > hi {
+		return n, allocators.ErrNoAddrAvail
+	}
+	next, ok := a.bitmap.NextClear(uint(lo - a.start))
+	if !ok || next > uint(hi-a.start) {
+		return n, allocators.ErrNoAddrAvail
+	}
+
+	a.bitmap.Set(next)
+	a.used.Add(1)
 	n.IP = a.toIP(uint32(next))
 	return
 }
@@ -99,9 +132,54 @@ func (a *IPv4Allocator) Free(n net.IPNet) error {
 		return &allocators.ErrDoubleFree{Loc: n}
 	}
 	a.bitmap.Clear(offset)
+	a.used.Add(^uint32(0))
 	return nil
 }
 
+// Allocated returns the allocated IPs, in ascending order
+func (a *IPv4Allocator) Allocated() []net.IPNet {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	ret := make([]net.IPNet, 0, a.used.Load())
+	for i, ok := a.bitmap.NextSet(0); ok && i < a.bitmap.Len(); i, ok = a.bitmap.NextSet(i + 1) {
+		ret = append(ret, net.IPNet{IP: a.toIP(uint32(i)), Mask: net.CIDRMask(32, 32)})
+	}
+	return ret
+}
+
+// SetEnd moves the end of the allocatable range, growing or shrinking it
+// without disturbing existing allocations. Shrinking fails if any address
+// beyond the new end is still allocated.
+func (a *IPv4Allocator) SetEnd(end net.IP) error {
+	if end.To4() == nil {
+		return errInvalidIP
+	}
+	newEnd := binary.BigEndian.Uint32(end.To4())
+	if newEnd < a.start {
+		return errors.New("no IPs in the given range to allocate")
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	size := uint(newEnd - a.start + 1)
+	if offset, ok := a.bitmap.NextSet(size); ok && offset < a.bitmap.Len() {
+		return fmt.Errorf("cannot shrink range, %s is still allocated", a.toIP(uint32(offset)))
+	}
+	resized := bitset.New(size)
+	a.bitmap.Copy(resized)
+	a.bitmap = resized
+	a.end = newEnd
+	return nil
+}
+
+// Used returns the number of allocated addresses. It doesn't take the allocator
+// lock, so it can be polled without contending with allocations.
+func (a *IPv4Allocator) Used() uint32 {
+	return a.used.Load()
+}
+
 // NewIPv4Allocator creates a new allocator suitable for giving out IPv4 addresses
 func NewIPv4Allocator(start, end net.IP) (*IPv4Allocator, error) {
 	if start.To4() == nil || end.To4() == nil {
@@ -5,8 +5,12 @@
 package bitmap
 
 import (
+	"errors"
 	"net"
+	"sync"
 	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
 )
 
 func getv4Allocator() *IPv4Allocator {
@@ -61,3 +65,177 @@ func Test4OutOfPool(t *testing.T) {
 		t.Fatalf("Prefixes have wrong size %d/%d", prefLen, totalLen)
 	}
 }
+
+func Test4Used(t *testing.T) {
+	alloc := getv4Allocator()
+
+	ips := make([]net.IPNet, 0, 10)
+	for i := 0; i < 10; i++ {
+		ip, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, ip)
+	}
+	if used := alloc.Used(); used != 10 {
+		t.Fatalf("Expected 10 used addresses, got %d", used)
+	}
+
+	if err := alloc.Free(ips[0]); err != nil {
+		t.Fatal(err)
+	}
+	// A failed free must not change the count
+	if err := alloc.Free(ips[0]); err == nil {
+		t.Fatal("Expected DoubleFree error")
+	}
+	if used := alloc.Used(); used != 9 {
+		t.Fatalf("Expected 9 used addresses, got %d", used)
+	}
+}
+
+// Test4UsedConcurrent hammers the allocator while reading the counter, and is
+// meant to be run with the race detector
+func Test4UsedConcurrent(t *testing.T) {
+	alloc := getv4Allocator()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				ip, err := alloc.Allocate(net.IPNet{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := alloc.Free(ip); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			if used := alloc.Used(); used != 0 {
+				t.Fatalf("Expected no used addresses after all frees, got %d", used)
+			}
+			return
+		default:
+			if used := alloc.Used(); used > 8 {
+				t.Fatalf("Counter out of bounds with 8 workers: %d", used)
+			}
+		}
+	}
+}
+
+func Test4SetEnd(t *testing.T) {
+	alloc, err := NewIPv4Allocator(net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := alloc.Allocate(net.IPNet{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := alloc.Allocate(net.IPNet{}); err == nil {
+		t.Fatal("Expected the pool to be exhausted")
+	}
+
+	if err := alloc.SetEnd(net.IPv4(192, 0, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	ip, err := alloc.Allocate(net.IPNet{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IP.Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Fatalf("Expected 192.0.2.2 from the grown range, got %s", ip.IP)
+	}
+	if used := alloc.Used(); used != 3 {
+		t.Fatalf("Expected 3 used addresses, got %d", used)
+	}
+
+	// 192.0.2.2 is allocated, so the range can't shrink below it
+	if err := alloc.SetEnd(net.IPv4(192, 0, 2, 1)); err == nil {
+		t.Fatal("Expected shrinking over an allocated address to fail")
+	}
+	if err := alloc.SetEnd(net.IPv4(192, 0, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alloc.Allocate(net.IPNet{}); err == nil {
+		t.Fatal("Expected the shrunk pool to be exhausted")
+	}
+}
+
+func Test4AllocateWithin(t *testing.T) {
+	alloc, err := NewIPv4Allocator(net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []net.IP{net.IPv4(192, 0, 2, 5), net.IPv4(192, 0, 2, 6)} {
+		ip, err := alloc.AllocateWithin(net.IPv4(192, 0, 2, 5), net.IPv4(192, 0, 2, 6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.IP.Equal(want) {
+			t.Fatalf("Expected %s, got %s", want, ip.IP)
+		}
+	}
+	if _, err := alloc.AllocateWithin(net.IPv4(192, 0, 2, 5), net.IPv4(192, 0, 2, 6)); !errors.Is(err, allocators.ErrNoAddrAvail) {
+		t.Fatalf("Expected the sub-range to be exhausted, got %v", err)
+	}
+	// The rest of the range is still available, and bounds are clamped to it
+	ip, err := alloc.AllocateWithin(net.IPv4(192, 0, 2, 8), net.IPv4(192, 0, 3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IP.Equal(net.IPv4(192, 0, 2, 8)) {
+		t.Fatalf("Expected 192.0.2.8, got %s", ip.IP)
+	}
+	if used := alloc.Used(); used != 3 {
+		t.Fatalf("Expected 3 used addresses, got %d", used)
+	}
+	if _, err := alloc.AllocateWithin(net.IPv4(192, 0, 3, 0), net.IPv4(192, 0, 3, 9)); !errors.Is(err, allocators.ErrNoAddrAvail) {
+		t.Fatalf("Expected no address outside the range, got %v", err)
+	}
+}
+
+func Test4Allocated(t *testing.T) {
+	alloc := getv4Allocator()
+	if got := alloc.Allocated(); len(got) != 0 {
+		t.Fatalf("Expected no allocated addresses, got %v", got)
+	}
+
+	for _, ip := range []net.IP{net.IPv4(192, 0, 2, 200), net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 255), net.IPv4(192, 0, 2, 7)} {
+		if _, err := alloc.Allocate(net.IPNet{IP: ip}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alloc.Free(net.IPNet{IP: net.IPv4(192, 0, 2, 200)}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []net.IP{net.IPv4(192, 0, 2, 0), net.IPv4(192, 0, 2, 7), net.IPv4(192, 0, 2, 255)}
+	got := alloc.Allocated()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d allocated addresses, got %v", len(want), got)
+	}
+	for i, n := range got {
+		if !n.IP.Equal(want[i]) {
+			t.Fatalf("Expected %s at position %d, got %s", want[i], i, n.IP)
+		}
+		if prefLen, totalLen := n.Mask.Size(); prefLen != 32 || totalLen != 32 {
+			t.Fatalf("Addresses have wrong size %d/%d", prefLen, totalLen)
+		}
+	}
+}
@@ -76,6 +76,33 @@ func TestExhaust(t *testing.T) {
 
 }
 
+func TestAllocated(t *testing.T) {
+	alloc := getAllocator(8)
+
+	var want []net.IPNet
+	for i := 0; i < 3; i++ {
+		n, err := alloc.Allocate(net.IPNet{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, n)
+	}
+	if err := alloc.Free(want[1]); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want[:1], want[2])
+
+	got := alloc.Allocated()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d allocated prefixes, got %v", len(want), got)
+	}
+	for i := range got {
+		if got[i].String() != want[i].String() {
+			t.Fatalf("Expected %s at position %d, got %s", &want[i], i, &got[i])
+		}
+	}
+}
+
 func TestOutOfPool(t *testing.T) {
 	alloc := getAllocator(8)
 	_, prefix, _ := net.ParseCIDR("fe80:abcd::/48")
@@ -0,0 +1,105 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxFormerLeases bounds the number of clients whose former address is remembered
+const maxFormerLeases = 4096
+
+// formerLease is the address a client held until its lease ended
+type formerLease struct {
+	ip    net.IP
+	until time.Time
+}
+
+// leaseHistory remembers the addresses of leases that expired or were
+// released for a while, so that their clients get them back when they return.
+// It is protected by the plugin lock.
+type leaseHistory struct {
+	ttl    time.Duration
+	former map[string]formerLease
+}
+
+func parseLeaseAffinityOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("lease affinity must be positive: %s", d)
+	}
+	p.affinity.ttl = d
+	return nil
+}
+
+// remember records that mac held ip until now. If too many clients are
+// remembered once stale entries are pruned, mac is not remembered.
+func (h *leaseHistory) remember(mac string, ip net.IP, now time.Time) {
+	if h.ttl == 0 {
+		return
+	}
+	if h.former == nil {
+		h.former = make(map[string]formerLease)
+	}
+	if _, ok := h.former[mac]; !ok && len(h.former) >= maxFormerLeases {
+		for m, f := range h.former {
+			if !now.Before(f.until) {
+				delete(h.former, m)
+			}
+		}
+		if len(h.former) >= maxFormerLeases {
+			return
+		}
+	}
+	h.former[mac] = formerLease{ip: ip, until: now.Add(h.ttl)}
+}
+
+// recall returns and forgets the address mac held within the affinity
+// window, or nil
+func (h *leaseHistory) recall(mac string, now time.Time) net.IP {
+	f, ok := h.former[mac]
+	if !ok {
+		return nil
+	}
+	delete(h.former, mac)
+	if !now.Before(f.until) {
+		return nil
+	}
+	return f.ip
+}
+
+// inPool reports whether ip belongs to pool, or to the default pool if pool is nil.
+// Must be called with the plugin lock held.
+func (p *PluginState) inPool(ip net.IP, pool *classPool) bool {
+	ranges := p.defaultPool()
+	if pool != nil {
+		ranges = [][2]net.IP{{pool.start, pool.end}}
+	}
+	for _, r := range ranges {
+		if compareIP(r[0], ip) <= 0 && compareIP(ip, r[1]) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// allocateAffine allocates the address mac held before its lease ended again,
+// with lease-affinity set, if it is still free and in pool. It returns nil
+// otherwise.
+// Must be called with the plugin lock held.
+func (p *PluginState) allocateAffine(mac string, pool *classPool) net.IP {
+	ip := p.affinity.recall(mac, p.now())
+	if ip == nil || !p.inPool(ip, pool) {
+		return nil
+	}
+	got, err := p.allocateFormer(ip, mac)
+	if err != nil || got == nil {
+		log.Debugf("Former address %s of MAC %s is taken, allocating another one", ip, p.logMAC(mac))
+		return nil
+	}
+	log.Debugf("Allocating former address %s to MAC %s again", ip, p.logMAC(mac))
+	return got
+}
@@ -0,0 +1,66 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseAffinityAcrossExpiry(t *testing.T) {
+	for _, tc := range []struct {
+		affinity string
+		// away is how long the client stays away once its lease was swept
+		away time.Duration
+		want net.IP
+	}{
+		{"", time.Hour, net.IPv4(10, 0, 0, 2)},
+		{"24h", time.Hour, net.IPv4(10, 0, 0, 3)},
+		// Forgotten once the affinity window passed
+		{"24h", 25 * time.Hour, net.IPv4(10, 0, 0, 2)},
+	} {
+		p := testPluginState(t)
+		if tc.affinity != "" {
+			require.NoError(t, parseLeaseAffinityOption(p, tc.affinity))
+		}
+		clock := newFakeClock()
+		p.clock = clock.Now
+		lease := func(last byte) net.IP {
+			req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, last})
+			resp, _ := p.Handler4(req, stub)
+			require.NotNil(t, resp)
+			return resp.YourIPAddr
+		}
+		for last := range byte(3) {
+			lease(last + 1)
+		}
+		require.True(t, p.Recordsv4["02:00:00:00:00:03"].IP.Equal(net.IPv4(10, 0, 0, 3)))
+
+		clock.Advance(2 * time.Hour)
+		assert.Equal(t, 3, p.sweep(context.Background()))
+		clock.Advance(tc.away)
+		// Another client takes the first free address
+		assert.True(t, lease(9).Equal(net.IPv4(10, 0, 0, 1)))
+		got := lease(3)
+		assert.True(t, got.Equal(tc.want), "lease-affinity=%s after %s: got %s, want %s", tc.affinity, tc.away, got, tc.want)
+	}
+}
+
+func TestLeaseAffinityAddressTaken(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseLeaseAffinityOption(p, "1h"))
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	p.affinity.remember(mac.String(), net.IPv4(10, 0, 0, 5).To4(), clock.Now())
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 5))
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 1)), "a former address leased to another client must not be taken from it")
+	assert.Empty(t, p.affinity.former)
+}
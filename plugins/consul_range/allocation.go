@@ -0,0 +1,71 @@
+package consulrangeplugin
+
+import (
+	"errors"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+// allocFailure is the reason an address could not be allocated
+type allocFailure string
+
+const (
+	// allocExhausted means every address of the pool is allocated
+	allocExhausted allocFailure = "exhausted"
+	// allocPeerHeld means the free addresses were skipped because peers hold offers on them
+	allocPeerHeld allocFailure = "peer_held"
+	// allocError means the allocator or Consul failed
+	allocError allocFailure = "error"
+)
+
+// allocationError is returned when no address could be allocated, and tells why
+type allocationError struct {
+	reason allocFailure
+	err    error
+}
+
+func (e *allocationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *allocationError) Unwrap() error {
+	return e.err
+}
+
+// errPeerHeld is wrapped by allocation errors when all free addresses are offered by peers
+var errPeerHeld = errors.New("all free addresses are offered by peers")
+
+// newAllocationError classifies an error returned while allocating an address
+func newAllocationError(err error) *allocationError {
+	var aerr *allocationError
+	if errors.As(err, &aerr) {
+		return aerr
+	}
+	if errors.Is(err, allocators.ErrNoAddrAvail) {
+		return &allocationError{reason: allocExhausted, err: err}
+	}
+	return &allocationError{reason: allocError, err: err}
+}
+
+// allocationFailure returns why an allocation failed with err
+func allocationFailure(err error) allocFailure {
+	return newAllocationError(err).reason
+}
+
+// allocationFailed logs and counts an allocation failure for mac by reason, so
+// that exhaustion can be told apart from faults. A client finding the pool
+// exhausted is remembered in the deny cache.
+func (p *PluginState) allocationFailed(mac string, err error) {
+	switch reason := allocationFailure(err); reason {
+	case allocExhausted:
+		p.metrics.poolExhausted.Inc()
+		p.denials.deny(mac, p.now())
+		log.Warningf("Could not allocate IP for MAC %s, the pool is exhausted", p.logMAC(mac))
+	case allocPeerHeld:
+		p.metrics.peerHeld.Inc()
+		log.Warningf("Could not allocate IP for MAC %s: %v", p.logMAC(mac), err)
+	default:
+		p.metrics.allocationErrors.Inc()
+		log.Errorf("Could not allocate IP for MAC %s: %v", p.logMAC(mac), err)
+	}
+}
@@ -0,0 +1,108 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingAllocator is an allocator whose every call fails
+type failingAllocator struct{}
+
+var errAllocatorBroken = errors.New("allocator broken")
+
+func (failingAllocator) Allocate(net.IPNet) (net.IPNet, error) {
+	return net.IPNet{}, errAllocatorBroken
+}
+
+func (failingAllocator) Free(net.IPNet) error {
+	return errAllocatorBroken
+}
+
+func (failingAllocator) Allocated() []net.IPNet {
+	return nil
+}
+
+// requireAllocationError checks that err is an *allocationError with the given reason
+func requireAllocationError(t *testing.T, err error, reason allocFailure) {
+	t.Helper()
+	var aerr *allocationError
+	require.ErrorAs(t, err, &aerr)
+	assert.Equal(t, reason, aerr.reason)
+}
+
+func TestAllocateExhausted(t *testing.T) {
+	p := testPluginState(t)
+	for i := 0; i < 10; i++ {
+		_, err := p.allocate(nil)
+		require.NoError(t, err)
+	}
+	_, err := p.allocate(nil)
+	requireAllocationError(t, err, allocExhausted)
+	assert.ErrorIs(t, err, allocators.ErrNoAddrAvail)
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, uint64(1), p.metrics.poolExhausted.Value())
+	assert.Equal(t, uint64(0), p.metrics.allocationErrors.Value())
+}
+
+func TestAllocateAllocatorError(t *testing.T) {
+	p := testPluginState(t)
+	p.allocator = failingAllocator{}
+	_, err := p.allocate(nil)
+	requireAllocationError(t, err, allocError)
+	assert.ErrorIs(t, err, errAllocatorBroken)
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	resp, _ := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.Equal(t, uint64(1), p.metrics.allocationErrors.Value())
+	assert.Equal(t, uint64(0), p.metrics.poolExhausted.Value())
+}
+
+func TestAllocatePeerHeld(t *testing.T) {
+	kv := newMemKV()
+	sessions := &memSessions{kv: kv}
+	peer := testOfferPluginState(t, kv, sessions)
+	p := testOfferPluginState(t, kv, sessions)
+
+	// The peer offers the whole range
+	for i := 0; i < 10; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 1, byte(i)}, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+		resp, _ := peer.Handler4(req, stub)
+		require.NotNil(t, resp)
+	}
+
+	p.Lock()
+	_, err := p.pendingOffer(context.Background(), "02:00:00:00:00:01", nil)
+	p.Unlock()
+	requireAllocationError(t, err, allocPeerHeld)
+	assert.ErrorIs(t, err, errPeerHeld)
+
+	// Skipped addresses aren't left allocated
+	assert.Zero(t, p.poolUsed())
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2}, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.Equal(t, uint64(1), p.metrics.peerHeld.Value())
+	assert.Zero(t, p.poolUsed())
+
+	// Once the peer's offers lapse, the addresses are offered again
+	for _, o := range peer.offers {
+		_, err := sessions.Destroy(o.session, nil)
+		require.NoError(t, err)
+	}
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2}, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+}
@@ -0,0 +1,63 @@
+package consulrangeplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+)
+
+// defaultAllocator is the name of the allocator used unless another is selected
+const defaultAllocator = "bitmap"
+
+// AllocatorFactory creates an allocator of the IPv4 addresses from start to
+// end, both included. Some options need more of the allocator: class pools and
+// offset need withinAllocator, and resizing the range endSetter.
+type AllocatorFactory func(start, end net.IP) (allocators.Allocator, error)
+
+// allocatorFactories maps the names of the registered allocators to their factory
+var allocatorFactories = map[string]AllocatorFactory{
+	defaultAllocator: func(start, end net.IP) (allocators.Allocator, error) {
+		return bitmap.NewIPv4Allocator(start, end)
+	},
+}
+
+// RegisterAllocator makes an allocator selectable by name with the allocator
+// option. It is meant to be called from the init function of the package
+// providing it, before plugins are set up.
+func RegisterAllocator(name string, factory AllocatorFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("cannot register an allocator without a name or factory")
+	}
+	if _, ok := allocatorFactories[name]; ok {
+		return fmt.Errorf("allocator %q is already registered", name)
+	}
+	allocatorFactories[name] = factory
+	return nil
+}
+
+func parseAllocatorOption(p *PluginState, value string) error {
+	if _, ok := allocatorFactories[value]; !ok {
+		names := make([]string, 0, len(allocatorFactories))
+		for name := range allocatorFactories {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("unknown allocator %q, want one of %s", value, strings.Join(names, ", "))
+	}
+	p.allocatorName = value
+	return nil
+}
+
+// newAllocator creates an allocator from start to end with the selected factory
+func (p *PluginState) newAllocator(start, end net.IP) (allocators.Allocator, error) {
+	name := p.allocatorName
+	if name == "" {
+		name = defaultAllocator
+	}
+	return allocatorFactories[name](start, end)
+}
@@ -0,0 +1,78 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lastFitAllocator hands out the highest free address first
+type lastFitAllocator struct {
+	start, end uint32
+	used       map[uint32]bool
+}
+
+func (a *lastFitAllocator) Allocate(hint net.IPNet) (net.IPNet, error) {
+	if ip := hint.IP.To4(); ip != nil {
+		if n := ipToUint32(ip); n >= a.start && n <= a.end && !a.used[n] {
+			a.used[n] = true
+			return net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+		}
+	}
+	for n := a.end; n >= a.start; n-- {
+		if !a.used[n] {
+			a.used[n] = true
+			return net.IPNet{IP: uint32ToIP(n), Mask: net.CIDRMask(32, 32)}, nil
+		}
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+func (a *lastFitAllocator) Free(ip net.IPNet) error {
+	n := ipToUint32(ip.IP.To4())
+	if !a.used[n] {
+		return &allocators.ErrDoubleFree{Loc: ip}
+	}
+	delete(a.used, n)
+	return nil
+}
+
+func (a *lastFitAllocator) Allocated() []net.IPNet {
+	var ret []net.IPNet
+	for n := a.start; n <= a.end && n >= a.start; n++ {
+		if a.used[n] {
+			ret = append(ret, net.IPNet{IP: uint32ToIP(n), Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	return ret
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+func TestCustomAllocator(t *testing.T) {
+	require.NoError(t, RegisterAllocator("last-fit", func(start, end net.IP) (allocators.Allocator, error) {
+		return &lastFitAllocator{start: ipToUint32(start), end: ipToUint32(end), used: make(map[uint32]bool)}, nil
+	}))
+	t.Cleanup(func() { delete(allocatorFactories, "last-fit") })
+	assert.Error(t, RegisterAllocator("last-fit", nil))
+	assert.Error(t, RegisterAllocator(defaultAllocator, func(start, end net.IP) (allocators.Allocator, error) { return nil, nil }))
+
+	p := testPluginState(t)
+	require.NoError(t, parseAllocatorOption(p, "last-fit"))
+	alloc, err := p.newAllocator(p.rangeStart, p.rangeEnd)
+	require.NoError(t, err)
+	require.IsType(t, &lastFitAllocator{}, alloc)
+	p.allocator = alloc
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.10", resp.YourIPAddr.String())
+
+	assert.ErrorContains(t, parseAllocatorOption(p, "tree"), "bitmap, last-fit")
+}
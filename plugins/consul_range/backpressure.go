@@ -0,0 +1,75 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultBackpressureFactor is the fraction of the lease time granted while
+// backpressure is active, unless configured
+const defaultBackpressureFactor = 0.25
+
+func parseBackpressureOption(p *PluginState, value string) error {
+	percent, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if percent <= 0 || percent >= 100 {
+		return fmt.Errorf("free pool threshold must be a percentage between 0 and 100, got %s", value)
+	}
+	p.backpressureFree = percent
+	return nil
+}
+
+func parseBackpressureLeaseOption(p *PluginState, value string) error {
+	factor, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	if factor <= 0 || factor > 1 {
+		return fmt.Errorf("lease time fraction must be within (0, 1], got %s", value)
+	}
+	p.backpressureFactor = factor
+	return nil
+}
+
+// grantedLeaseTime returns the lease time to grant to the client of req: the
+// one configured for its subnet, see leaseTimeFor, or a fraction of it while the share of free addresses is below the backpressure
+// threshold, so that addresses recycle faster. Backpressure never shortens it
+// below floor, the sticky floor of the client's lease. The lease time requested
+// by the client, if any, is ignored.
+// Must be called with the plugin lock held.
+func (p *PluginState) grantedLeaseTime(req *dhcpv4.DHCPv4, floor time.Duration) time.Duration {
+	if req.Options.Has(dhcpv4.OptionIPAddressLeaseTime) && req.IPAddressLeaseTime(time.Second) == 0 {
+		// Requested lease times aren't honored, a zero one is a client bug worth noting
+		log.Debugf("MAC %s requested a lease time of 0, granting the server's", p.logMAC(req.ClientHWAddr.String()))
+	}
+	leaseTime := p.leaseTimeFor(req)
+	if p.backpressureFree == 0 {
+		return leaseTime
+	}
+	size := p.poolSize()
+	used := p.usedLocked()
+	free := 0.0
+	if used < size {
+		free = float64(size-used) * 100 / float64(size)
+	}
+	active := free < p.backpressureFree
+	if active != p.backpressureActive {
+		p.backpressureActive = active
+		if active {
+			log.Warningf("Only %.1f%% of the pool is free, backpressure active: granting %.0f%% of the lease time", free, p.backpressureFactor*100)
+		} else {
+			log.Printf("%.1f%% of the pool is free, backpressure lifted", free)
+		}
+	}
+	if !active {
+		return leaseTime
+	}
+	// Never round down to a zero lease
+	shortened := max(time.Duration(float64(leaseTime)*p.backpressureFactor).Round(time.Second), time.Second)
+	return max(shortened, min(floor, leaseTime))
+}
@@ -0,0 +1,64 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// grantedLease requests a lease for mac and returns the lease time of the reply
+func grantedLease(t *testing.T, p *PluginState, mac net.HardwareAddr) time.Duration {
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	return resp.IPAddressLeaseTime(0)
+}
+
+func TestBackpressure(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseBackpressureOption(p, "30"))
+	p.backpressureFactor = 0.25
+
+	// 10 addresses, statically leased from the top so dynamic leases start at 10.0.0.1
+	static := func(i byte) {
+		testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i}, net.IPv4(10, 0, 0, 11-i))
+	}
+	for i := byte(1); i <= 3; i++ {
+		static(i)
+	}
+	assert.Equal(t, time.Hour, grantedLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}), "70% free")
+	assert.False(t, p.backpressureActive)
+
+	for i := byte(4); i <= 6; i++ {
+		static(i)
+	}
+	assert.Equal(t, time.Hour, grantedLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}), "30% free is not below the threshold")
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 3}
+	assert.Equal(t, 15*time.Minute, grantedLease(t, p, mac), "20% free")
+	assert.True(t, p.backpressureActive)
+	rec := p.Recordsv4[mac.String()]
+	assert.InDelta(t, time.Now().Add(15*time.Minute).Unix(), rec.Expires, 2, "the shortened lease must be persisted")
+
+	// Freeing addresses lifts the backpressure
+	for i := byte(1); i <= 6; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 1, i},
+			dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease), dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 11-i)))
+		_, _ = p.Handler4(req, stub)
+	}
+	assert.Equal(t, time.Hour, grantedLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 4}))
+	assert.False(t, p.backpressureActive)
+}
+
+func TestParseBackpressureOptions(t *testing.T) {
+	var p PluginState
+	assert.Error(t, parseBackpressureOption(&p, "0"))
+	assert.Error(t, parseBackpressureOption(&p, "100"))
+	assert.Error(t, parseBackpressureLeaseOption(&p, "0"))
+	assert.Error(t, parseBackpressureLeaseOption(&p, "1.5"))
+	require.NoError(t, parseBackpressureLeaseOption(&p, "0.5"))
+	assert.Equal(t, 0.5, p.backpressureFactor)
+}
@@ -0,0 +1,74 @@
+package consulrangeplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// errInvalidReservation is returned when reserving an address outside the range
+var errInvalidReservation = errors.New("invalid reservation")
+
+// reserveByIP sets ip aside for the first new client asking for a lease, whose
+// lease on it is pinned, turning it into a permanent reservation. ip must be
+// free and within the range. It is allocated right away so no other client
+// gets it. Like staged moves, claimable addresses are held in memory only.
+func (p *PluginState) reserveByIP(ip net.IP) error {
+	p.Lock()
+	defer p.Unlock()
+	if !p.inRange(ip) {
+		return fmt.Errorf("%w: %s is not within range %s-%s", errInvalidReservation, ip, p.rangeStart, p.rangeEnd)
+	}
+	for _, c := range p.claimable {
+		if c.Equal(ip) {
+			return fmt.Errorf("%w: %s is already reserved for the first claimer", errMoveConflict, ip)
+		}
+	}
+	if p.isReserved(ip) {
+		return fmt.Errorf("%w: %s is reserved", errMoveConflict, ip)
+	}
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errMoveConflict, ip, err)
+	}
+	if !got.IP.Equal(ip) {
+		_ = p.allocator.Free(got)
+		return fmt.Errorf("%w: %s", errMoveConflict, ip)
+	}
+	p.claimable = append(p.claimable, ip)
+	log.Printf("Reserving %s for the next new client", ip)
+	return nil
+}
+
+// claimByIP hands the oldest address set aside by reserveByIP to a new client.
+// Must be called with the plugin lock held.
+func (p *PluginState) claimByIP() (net.IP, bool) {
+	if len(p.claimable) == 0 {
+		return nil, false
+	}
+	ip := p.claimable[0]
+	p.claimable = p.claimable[1:]
+	return ip, true
+}
+
+// serveReserveByIP sets the address in the ip query parameter aside for the
+// first new client, see reserveByIP
+func (p *PluginState) serveReserveByIP(w http.ResponseWriter, r *http.Request) {
+	ip, err := parseIPv4(r.URL.Query().Get("ip"))
+	if err != nil {
+		http.Error(w, "missing or invalid ip", http.StatusBadRequest)
+		return
+	}
+	err = p.reserveByIP(ip)
+	switch {
+	case errors.Is(err, errInvalidReservation):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errMoveConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
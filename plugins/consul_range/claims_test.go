@@ -0,0 +1,86 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postReserveByIP POSTs a reservation of ip for the first claimer and returns the status
+func postReserveByIP(t *testing.T, srv *httptest.Server, ip string) int {
+	t.Helper()
+	res, err := authorizedPost(srv.URL+"/reservations/by-ip?ip="+ip, "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestReserveByIPClaimed(t *testing.T) {
+	p := testPluginState(t)
+	holder := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, holder, net.IPv4(10, 0, 0, 1))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusConflict, postReserveByIP(t, srv, "10.0.0.1"))
+	assert.Equal(t, http.StatusBadRequest, postReserveByIP(t, srv, "10.0.1.1"))
+	assert.Equal(t, http.StatusBadRequest, postReserveByIP(t, srv, "bogus"))
+	require.Equal(t, http.StatusAccepted, postReserveByIP(t, srv, "10.0.0.7"))
+	assert.Equal(t, http.StatusConflict, postReserveByIP(t, srv, "10.0.0.7"))
+
+	// Existing clients keep their lease
+	req, stub := testRequest(t, holder, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+
+	// The first new client claims the address, for good
+	claimer := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	req, stub = testRequest(t, claimer, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.7", resp.YourIPAddr.String())
+	assert.True(t, p.Recordsv4[claimer.String()].Pinned)
+	assert.Empty(t, p.claimable)
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.True(t, stored[claimer.String()].Pinned, "the claim was not persisted")
+
+	// The next one gets a dynamic lease
+	other := net.HardwareAddr{2, 0, 0, 0, 0, 3}
+	req, stub = testRequest(t, other, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.NotEqual(t, "10.0.0.7", resp.YourIPAddr.String())
+	assert.False(t, p.Recordsv4[other.String()].Pinned)
+}
+
+func TestReserveByIPSurvivesReconcile(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, p.reserveByIP(net.IPv4(10, 0, 0, 7)))
+
+	repairs, err := p.reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, repairs)
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 7))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.True(t, allocated, "the address set aside was freed")
+
+	// No other client gets it in the meantime
+	for i := byte(1); i <= 9; i++ {
+		ip := leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i})
+		if i == 1 {
+			assert.Equal(t, "10.0.0.7", ip.String(), "the first new client claims it")
+			continue
+		}
+		assert.NotEqual(t, "10.0.0.7", ip.String())
+	}
+}
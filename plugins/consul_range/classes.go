@@ -0,0 +1,208 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// classPool is a sub-range of the range reserved to clients of a user class
+type classPool struct {
+	class string
+	start net.IP
+	end   net.IP
+}
+
+// withinAllocator is implemented by allocators able to allocate within a sub-range
+type withinAllocator interface {
+	AllocateWithin(first, last net.IP) (net.IPNet, error)
+}
+
+// parseClassOption adds the sub-pool of a user class, given as
+// "<class>:<start IP>-<end IP>". Pools may not overlap.
+func parseClassOption(p *PluginState, value string) error {
+	i := strings.LastIndexByte(value, ':')
+	if i <= 0 {
+		return fmt.Errorf("invalid class pool %q, want <class>:<start IP>-<end IP>", value)
+	}
+	class, bounds := value[:i], value[i+1:]
+	first, last, ok := strings.Cut(bounds, "-")
+	if !ok {
+		return fmt.Errorf("invalid class pool range %q, want <start IP>-<end IP>", bounds)
+	}
+	start, err := parseIPv4(first)
+	if err != nil {
+		return err
+	}
+	end, err := parseIPv4(last)
+	if err != nil {
+		return err
+	}
+	if compareIP(start, end) > 0 {
+		return fmt.Errorf("start of class pool %s is higher than its end", class)
+	}
+	pool := &classPool{class: class, start: start, end: end}
+	for _, other := range p.classes {
+		if other.class == class {
+			return fmt.Errorf("duplicate pool for class %s", class)
+		}
+		if compareIP(pool.start, other.end) <= 0 && compareIP(other.start, pool.end) <= 0 {
+			return fmt.Errorf("pool of class %s overlaps the pool of class %s", class, other.class)
+		}
+	}
+	p.classes = append(p.classes, pool)
+	slices.SortFunc(p.classes, func(a, b *classPool) int { return compareIP(a.start, b.start) })
+	return nil
+}
+
+// applyClasses checks that the class pools, if any, lie within the range and
+// that the allocator can allocate within them
+func (p *PluginState) applyClasses() error {
+	if len(p.classes) == 0 {
+		return nil
+	}
+	if _, ok := p.allocator.(withinAllocator); !ok {
+		return fmt.Errorf("allocator %T does not support class pools", p.allocator)
+	}
+	for _, pool := range p.classes {
+		if compareIP(pool.start, p.rangeStart) < 0 || compareIP(pool.end, p.rangeEnd) > 0 {
+			return fmt.Errorf("pool %s-%s of class %s is not within range %s-%s", pool.start, pool.end, pool.class, p.rangeStart, p.rangeEnd)
+		}
+	}
+	return nil
+}
+
+// classPoolFor returns the pool of the first user class of req that has one,
+// or nil if the client falls in the default pool
+func (p *PluginState) classPoolFor(req *dhcpv4.DHCPv4) *classPool {
+	if len(p.classes) == 0 {
+		return nil
+	}
+	for _, class := range req.UserClass() {
+		for _, pool := range p.classes {
+			if pool.class == class {
+				return pool
+			}
+		}
+	}
+	return nil
+}
+
+// allocate reserves an address from pool, or from the default pool made of
+// the addresses of the range outside of all class pools if pool is nil.
+// Failures are returned as an *allocationError.
+// Must be called with the plugin lock held.
+func (p *PluginState) allocate(pool *classPool) (net.IPNet, error) {
+	ip, err := p.allocateFrom(pool)
+	if err != nil {
+		return ip, newAllocationError(err)
+	}
+	return ip, nil
+}
+
+// allocateFrom is allocate, with the allocator's errors returned as is. The
+// default pool is tried one sub-range after the other, so that it is only
+// exhausted once all of them are full.
+func (p *PluginState) allocateFrom(pool *classPool) (net.IPNet, error) {
+	if p.migration != nil {
+		// The range is being drained
+		return p.migration.allocator.Allocate(net.IPNet{})
+	}
+	if len(p.classes) == 0 && p.offset == 0 {
+		return p.allocator.Allocate(net.IPNet{})
+	}
+	within := p.allocator.(withinAllocator)
+	if pool != nil {
+		return within.AllocateWithin(pool.start, pool.end)
+	}
+	for _, gap := range p.defaultPool() {
+		ip, err := within.AllocateWithin(gap[0], gap[1])
+		if !errors.Is(err, allocators.ErrNoAddrAvail) {
+			return ip, err
+		}
+	}
+	return net.IPNet{}, allocators.ErrNoAddrAvail
+}
+
+// defaultPool returns the sub-ranges of the range not covered by a class pool,
+// from the start of dynamic allocation.
+// Must be called with the plugin lock held, the range can be resized.
+func (p *PluginState) defaultPool() [][2]net.IP {
+	var gaps [][2]net.IP
+	next := binary.BigEndian.Uint32(p.dynamicStart())
+	for _, pool := range p.classes {
+		if start := binary.BigEndian.Uint32(pool.start); start > next {
+			gaps = append(gaps, [2]net.IP{uint32ToIP(next), uint32ToIP(start - 1)})
+		}
+		next = max(next, binary.BigEndian.Uint32(pool.end)+1)
+	}
+	if end := binary.BigEndian.Uint32(p.rangeEnd); next <= end {
+		gaps = append(gaps, [2]net.IP{uint32ToIP(next), uint32ToIP(end)})
+	}
+	return gaps
+}
+
+// uint32ToIP is the inverse of binary.BigEndian.Uint32 on an IPv4 address
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// subRangeUsage is the utilization of a sub-range of the range: a class pool,
+// or a sub-range of the default pool, whose class is empty
+type subRangeUsage struct {
+	class string
+	start net.IP
+	end   net.IP
+	size  uint32
+	used  uint32
+}
+
+// subRangeUsages returns the utilization of the sub-ranges of the range, in
+// address order. Addresses below the offset belong to none.
+func (p *PluginState) subRangeUsages() []subRangeUsage {
+	p.Lock()
+	defer p.Unlock()
+	var usages []subRangeUsage
+	add := func(class string, start, end net.IP) {
+		size := binary.BigEndian.Uint32(end.To4()) - binary.BigEndian.Uint32(start.To4()) + 1
+		usages = append(usages, subRangeUsage{class: class, start: start, end: end, size: size})
+	}
+	for _, pool := range p.classes {
+		add(pool.class, pool.start, pool.end)
+	}
+	for _, gap := range p.defaultPool() {
+		add("", gap[0], gap[1])
+	}
+	slices.SortFunc(usages, func(a, b subRangeUsage) int { return compareIP(a.start, b.start) })
+	for _, ip := range p.allocator.Allocated() {
+		for i := range usages {
+			if compareIP(ip.IP, usages[i].start) >= 0 && compareIP(ip.IP, usages[i].end) <= 0 {
+				usages[i].used++
+				break
+			}
+		}
+	}
+	return usages
+}
+
+// subRangeSamples returns the value of each sub-range of the range, labeled
+// by its class and bounds
+func (p *PluginState) subRangeSamples(value func(subRangeUsage) uint32) []gaugeSample {
+	usages := p.subRangeUsages()
+	samples := make([]gaugeSample, 0, len(usages))
+	for _, u := range usages {
+		samples = append(samples, gaugeSample{
+			labels: fmt.Sprintf("class=%q,range=\"%s-%s\"", u.class, u.start, u.end),
+			value:  float64(value(u)),
+		})
+	}
+	return samples
+}
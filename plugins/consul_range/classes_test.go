@@ -0,0 +1,111 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testClassPluginState is a testPluginState whose 10.0.0.1-10.0.0.10 range is
+// split between guests (.1-.3), staff (.8-.10) and the default pool (.4-.7)
+func testClassPluginState(t *testing.T) *PluginState {
+	p := testPluginState(t)
+	require.NoError(t, parseClassOption(p, "staff:10.0.0.8-10.0.0.10"))
+	require.NoError(t, parseClassOption(p, "guest:10.0.0.1-10.0.0.3"))
+	require.NoError(t, p.applyClasses())
+	return p
+}
+
+// classLease requests a lease for mac with the given user class, "" for none,
+// and returns the leased address or nil
+func classLease(t *testing.T, p *PluginState, mac net.HardwareAddr, class string) net.IP {
+	var mods []dhcpv4.Modifier
+	if class != "" {
+		mods = append(mods, dhcpv4.WithUserClass(class, false))
+	}
+	req, stub := testRequest(t, mac, mods...)
+	resp, _ := p.Handler4(req, stub)
+	if resp == nil {
+		return nil
+	}
+	return resp.YourIPAddr
+}
+
+func TestClassPlacement(t *testing.T) {
+	p := testClassPluginState(t)
+	assert.Equal(t, net.IPv4(10, 0, 0, 1).To4(), classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, "guest").To4())
+	assert.Equal(t, net.IPv4(10, 0, 0, 8).To4(), classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, "staff").To4())
+	assert.Equal(t, net.IPv4(10, 0, 0, 4).To4(), classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 3}, "").To4())
+	assert.Equal(t, net.IPv4(10, 0, 0, 5).To4(), classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 4}, "unknown").To4())
+}
+
+func TestClassPoolsExhaustIndependently(t *testing.T) {
+	p := testClassPluginState(t)
+	for i := byte(1); i <= 3; i++ {
+		require.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i}, "guest"))
+	}
+	assert.Nil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, 4}, "guest"), "guest pool should be exhausted")
+
+	// The other pools are unaffected
+	assert.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 2, 1}, "staff"))
+	for i := byte(1); i <= 4; i++ {
+		ip := classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 3, i}, "")
+		require.NotNil(t, ip)
+		assert.True(t, compareIP(ip, net.IPv4(10, 0, 0, 4)) >= 0 && compareIP(ip, net.IPv4(10, 0, 0, 7)) <= 0, "%s is not in the default pool", ip)
+	}
+	assert.Nil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 3, 5}, ""), "default pool should be exhausted")
+	assert.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 2, 2}, "staff"))
+}
+
+func TestDefaultPoolSpillsAcrossGaps(t *testing.T) {
+	p := testPluginState(t)
+	// The default pool is split in two by the class pool: .1-.3 and .7-.10
+	require.NoError(t, parseClassOption(p, "guest:10.0.0.4-10.0.0.6"))
+	require.NoError(t, p.applyClasses())
+
+	var got []string
+	for i := byte(1); i <= 7; i++ {
+		ip := classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, i}, "")
+		require.NotNil(t, ip)
+		got = append(got, ip.String())
+	}
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.7", "10.0.0.8", "10.0.0.9", "10.0.0.10"}, got)
+	assert.Nil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 8}, ""), "default pool should be exhausted")
+	assert.Equal(t, uint64(1), p.metrics.poolExhausted.Value())
+	// The class pool never serves clients of the default pool
+	assert.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, 1}, "guest"))
+}
+
+func TestParseClassOption(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseClassOption(p, "guest:10.0.0.1-10.0.0.5"))
+	assert.Error(t, parseClassOption(p, "staff:10.0.0.5-10.0.0.10"), "overlapping pools")
+	assert.Error(t, parseClassOption(p, "guest:10.0.0.6-10.0.0.7"), "duplicate class")
+	assert.Error(t, parseClassOption(p, "staff:10.0.0.9-10.0.0.8"), "reversed bounds")
+	assert.Error(t, parseClassOption(p, "staff"))
+	assert.Error(t, parseClassOption(p, "staff:10.0.0.9"))
+	require.NoError(t, parseClassOption(p, "staff:10.0.0.6-10.0.0.11"))
+	assert.Error(t, p.applyClasses(), "pool beyond the range")
+}
+
+func TestSubRangeMetrics(t *testing.T) {
+	p := testClassPluginState(t)
+	p.metrics.registerPoolGauges(p)
+	for i := byte(1); i <= 2; i++ {
+		require.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i}, "guest"))
+	}
+	require.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 2, 1}, "staff"))
+	require.NotNil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 3, 1}, ""))
+
+	var b strings.Builder
+	require.NoError(t, p.metrics.writeText(&b))
+	assert.Contains(t, b.String(), "# TYPE consulrange_subrange_used gauge\n"+
+		`consulrange_subrange_used{class="guest",range="10.0.0.1-10.0.0.3"} 2`+"\n"+
+		`consulrange_subrange_used{class="",range="10.0.0.4-10.0.0.7"} 1`+"\n"+
+		`consulrange_subrange_used{class="staff",range="10.0.0.8-10.0.0.10"} 1`+"\n")
+	assert.Contains(t, b.String(), `consulrange_subrange_size{class="",range="10.0.0.4-10.0.0.7"} 4`+"\n")
+}
@@ -0,0 +1,136 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock only moving forward when told to
+type fakeClock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func TestSweepWithInjectedClock(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	ctx := context.Background()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, int(clock.Now().Add(time.Hour).Unix()), p.Recordsv4[mac.String()].Expires)
+
+	clock.Advance(30 * time.Minute)
+	assert.Equal(t, 0, p.sweep(ctx), "a lease is live until its expiry")
+
+	// Renewing half way through extends the lease from the renewal
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, int(clock.Now().Add(time.Hour).Unix()), p.Recordsv4[mac.String()].Expires)
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, 0, p.sweep(ctx))
+	clock.Advance(time.Second)
+	assert.Equal(t, 1, p.sweep(ctx))
+	assert.Empty(t, p.Recordsv4)
+}
+
+func TestOfferExpiresWithInjectedClock(t *testing.T) {
+	kv := newMemKV()
+	p := testOfferPluginState(t, kv, &memSessions{kv: kv})
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+
+	clock.Advance(p.offerTTL - time.Second)
+	p.sweep(context.Background())
+	assert.Len(t, p.offers, 1)
+
+	clock.Advance(time.Second)
+	p.sweep(context.Background())
+	assert.Empty(t, p.offers)
+}
+
+func TestDiscoverDebounceWithInjectedClock(t *testing.T) {
+	p := testPluginState(t)
+	p.debounce.seen.ttl, p.debounce.seen.size = time.Second, maxDebounced
+	clock := newFakeClock()
+	p.clock = clock.Now
+	kv := p.kv.(*memKV)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	discover := func() {
+		req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+	}
+
+	discover()
+	clock.Advance(999 * time.Millisecond)
+	discover()
+	assert.Equal(t, 1, kv.puts, "retransmission within the window was written")
+	clock.Advance(time.Second)
+	discover()
+	assert.Equal(t, 2, kv.puts)
+}
+
+func TestRenewalEchoesRemainingLeaseTime(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, time.Hour, resp.IPAddressLeaseTime(0))
+	expires := p.Recordsv4[mac.String()].Expires
+
+	// Leases now granted are shorter than the one held, which isn't cut short
+	p.LeaseTime = 30 * time.Minute
+	clock.Advance(10 * time.Minute)
+	puts := p.kv.(*memKV).puts
+	req, stub = testRequest(t, mac)
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, expires, p.Recordsv4[mac.String()].Expires)
+	assert.Equal(t, p.kv.(*memKV).puts, puts, "an unchanged lease must not be written")
+	assert.Equal(t, 50*time.Minute, resp.IPAddressLeaseTime(0), "the echoed lease time must match the record")
+
+	// Once the held lease runs out before a new one would, it is extended
+	clock.Advance(25 * time.Minute)
+	req, stub = testRequest(t, mac)
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, int(clock.Now().Add(30*time.Minute).Unix()), p.Recordsv4[mac.String()].Expires)
+	assert.Equal(t, 30*time.Minute, resp.IPAddressLeaseTime(0))
+}
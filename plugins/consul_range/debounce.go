@@ -0,0 +1,44 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultDiscoverDebounce is the window within which repeated DISCOVERs from a
+// client reuse the lease just offered to it
+const defaultDiscoverDebounce = time.Second
+
+// maxDebounced bounds the number of clients tracked for debouncing
+const maxDebounced = 4096
+
+// debouncer remembers the clients whose DISCOVER recently caused a write to
+// Consul, so that retransmissions don't write again.
+// It is protected by the plugin lock.
+type debouncer struct {
+	seen ttlSet[string]
+}
+
+func parseDiscoverDebounceOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("debounce window cannot be negative: %s", d)
+	}
+	p.debounce.seen.ttl = d
+	return nil
+}
+
+// recent reports whether mac was marked within the debounce window
+func (d *debouncer) recent(mac string, now time.Time) bool {
+	_, ok := d.seen.get(mac, now)
+	return ok
+}
+
+// mark records that mac caused a write at now. If too many clients are
+// tracked once expired entries are pruned, mac is not tracked.
+func (d *debouncer) mark(mac string, now time.Time) {
+	d.seen.add(mac, now)
+}
@@ -0,0 +1,54 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverDebounce(t *testing.T) {
+	p := testPluginState(t)
+	p.debounce.seen.ttl, p.debounce.seen.size = time.Minute, maxDebounced
+	kv := p.kv.(*memKV)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	var ips []string
+	for i := 0; i < 3; i++ {
+		req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		ips = append(ips, resp.YourIPAddr.String())
+	}
+	assert.Equal(t, 1, kv.puts, "retransmitted DISCOVERs must not write to Consul")
+	assert.Equal(t, []string{ips[0], ips[0], ips[0]}, ips)
+
+	// A REQUEST still extends the lease
+	req, stub := testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, 2, kv.puts)
+}
+
+func TestDebouncerExpiresAndIsBounded(t *testing.T) {
+	d := debouncer{seen: ttlSet[string]{ttl: time.Second, size: maxDebounced}}
+	now := time.Now()
+	d.mark("02:00:00:00:00:01", now)
+	assert.True(t, d.recent("02:00:00:00:00:01", now.Add(500*time.Millisecond)))
+	assert.False(t, d.recent("02:00:00:00:00:01", now.Add(time.Second)))
+
+	for i := 0; i < maxDebounced+10; i++ {
+		d.mark(fmt.Sprintf("mac-%d", i), now)
+	}
+	assert.Equal(t, maxDebounced, d.seen.len())
+	// Expired entries make room again
+	d.mark("02:00:00:00:00:02", now.Add(2*time.Second))
+	assert.Equal(t, 1, d.seen.len())
+
+	disabled := debouncer{}
+	disabled.mark("02:00:00:00:00:01", now)
+	assert.False(t, disabled.recent("02:00:00:00:00:01", now))
+}
@@ -0,0 +1,64 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// decision is the path taken to answer a client, logged at debug level with
+// its rationale so that the address a client got can be traced
+type decision string
+
+const (
+	// decisionReservation leases the address statically reserved for the client
+	decisionReservation decision = "matched reservation"
+	// decisionClaimed leases an address reserved by IP to its first claimer
+	decisionClaimed decision = "claimed reservation by IP"
+	// decisionFresh leases or offers the next free address to a new client
+	decisionFresh decision = "fresh allocation"
+	// decisionRenewed extends, or echoes, the existing lease of the client
+	decisionRenewed decision = "renewed existing lease"
+	// decisionReused echoes the lease just written for a retransmission
+	decisionReused decision = "reused lease just offered"
+	// decisionReallocated moves an expired lease whose address was reassigned
+	decisionReallocated decision = "reallocated expired lease"
+	// decisionMoved applies a move staged through the HTTP API
+	decisionMoved decision = "applied staged move"
+	// decisionMigrated moves the lease along a range migration
+	decisionMigrated decision = "migrated lease"
+	// decisionRenumbered moves a lease left outside of a shrunk range
+	decisionRenumbered decision = "renumbered out of range lease"
+	// decisionFailed answers nothing, no address could be allocated
+	decisionFailed decision = "allocation failed"
+)
+
+// denied is the decision not to lease the client an address, for reason
+func denied(reason string) decision {
+	return decision("denied by policy: " + reason)
+}
+
+// keySourceName names what keys the leases, as given to the key-source option
+func (p *PluginState) keySourceName() string {
+	switch p.keySource {
+	case nil:
+		return "mac"
+	case dhcpv4.OptionClientIdentifier:
+		return "client-id"
+	}
+	return fmt.Sprintf("option %d", p.keySource.Code())
+}
+
+// rationale explains decision d about the lease of mac, resulting in ip if any
+func (p *PluginState) rationale(mac string, d decision, ip net.IP) string {
+	if ip == nil {
+		return fmt.Sprintf("MAC %s keyed by %s: %s", p.logMAC(mac), p.keySourceName(), d)
+	}
+	return fmt.Sprintf("MAC %s keyed by %s: %s, IP %s", p.logMAC(mac), p.keySourceName(), d, ip)
+}
+
+// logDecision logs the rationale of decision d at debug level
+func (p *PluginState) logDecision(mac string, d decision, ip net.IP) {
+	log.Debugf("Decision for %s", p.rationale(mac, d, ip))
+}
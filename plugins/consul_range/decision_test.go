@@ -0,0 +1,73 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decisions returns the rationales logged by hook since it was last reset
+func decisions(hook *test.Hook) []string {
+	var logged []string
+	for _, e := range hook.AllEntries() {
+		if r, ok := strings.CutPrefix(e.Message, "Decision for "); ok {
+			logged = append(logged, r)
+		}
+	}
+	hook.Reset()
+	return logged
+}
+
+func TestDecisionRationale(t *testing.T) {
+	p := testPluginState(t)
+	hook := test.NewLocal(log.Logger)
+	defer hook.Reset()
+	log.Logger.SetLevel(logrus.DebugLevel)
+	handle := func(mac net.HardwareAddr, mods ...dhcpv4.Modifier) {
+		t.Helper()
+		req, stub := testRequest(t, mac, mods...)
+		_, _ = p.Handler4(req, stub)
+	}
+
+	fresh := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	handle(fresh)
+	assert.Equal(t, []string{"MAC 02:00:00:00:00:01 keyed by mac: fresh allocation, IP 10.0.0.1"}, decisions(hook))
+
+	handle(fresh, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)))
+	assert.Equal(t, []string{"MAC 02:00:00:00:00:01 keyed by mac: renewed existing lease, IP 10.0.0.1"}, decisions(hook))
+
+	p.Lock()
+	require.NoError(t, p.applyReservations(map[string]net.IP{"02:00:00:00:00:02": net.IPv4(10, 0, 0, 9).To4()}))
+	p.Unlock()
+	handle(net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	assert.Equal(t, []string{"MAC 02:00:00:00:00:02 keyed by mac: matched reservation, IP 10.0.0.9"}, decisions(hook))
+
+	require.NoError(t, p.reserveByIP(net.IPv4(10, 0, 0, 7).To4()))
+	hook.Reset()
+	handle(net.HardwareAddr{2, 0, 0, 0, 0, 3})
+	assert.Equal(t, []string{"MAC 02:00:00:00:00:03 keyed by mac: claimed reservation by IP, IP 10.0.0.7"}, decisions(hook))
+
+	p.awaitingHandoff = true
+	handle(net.HardwareAddr{2, 0, 0, 0, 0, 4})
+	assert.Equal(t, []string{"MAC 02:00:00:00:00:04 keyed by mac: denied by policy: awaiting handoff"}, decisions(hook))
+	p.awaitingHandoff = false
+
+	require.NoError(t, parseKeySourceOption(p, "client-id"))
+	handle(net.HardwareAddr{2, 0, 0, 0, 0, 5}, dhcpv4.WithOption(dhcpv4.OptClientIdentifier([]byte{1, 2, 0, 0, 0, 0, 5})))
+	assert.Equal(t, []string{"MAC 01:02:00:00:00:00:05 keyed by client-id: fresh allocation, IP 10.0.0.2"}, decisions(hook))
+}
+
+func TestKeySourceName(t *testing.T) {
+	p := &PluginState{}
+	assert.Equal(t, "mac", p.keySourceName())
+	require.NoError(t, parseKeySourceOption(p, "client-id"))
+	assert.Equal(t, "client-id", p.keySourceName())
+	require.NoError(t, parseKeySourceOption(p, "82"))
+	assert.Equal(t, "option 82", p.keySourceName())
+}
@@ -0,0 +1,220 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// declinesConfigKey is the name of the plugin state entry holding the declines
+const declinesConfigKey = "declines"
+
+// errNoDeclines is returned when clearing an address that was never declined
+var errNoDeclines = errors.New("no declines")
+
+// declines counts the DHCPDECLINEs of an address, which a client sends when it
+// finds the address in use, e.g. by a statically configured host
+type declines struct {
+	Count int `json:"count"`
+	// Abandoned addresses are never allocated until an operator clears them
+	Abandoned bool `json:"abandoned,omitempty"`
+}
+
+func parseDeclineLimitOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("limit must be positive, got %d", n)
+	}
+	p.declineLimit = n
+	return nil
+}
+
+// loadDeclines reads the declines persisted in Consul, keyed by address
+func (p *PluginState) loadDeclines() (map[string]*declines, error) {
+	key := p.configKey(declinesConfigKey)
+	pair, _, err := p.kv.Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key %q: %w", key, err)
+	}
+	d := make(map[string]*declines)
+	if pair == nil {
+		return d, nil
+	}
+	if err := json.Unmarshal(pair.Value, &d); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal declines from key %q: %w", key, err)
+	}
+	return d, nil
+}
+
+// saveDeclines persists the declines to Consul.
+// Must be called with the plugin lock held.
+func (p *PluginState) saveDeclines(ctx context.Context) error {
+	data, err := json.Marshal(p.declines)
+	if err != nil {
+		return fmt.Errorf("failed to marshal declines: %w", err)
+	}
+	if _, err := p.kv.Put(&api.KVPair{Key: p.configKey(declinesConfigKey), Value: data}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to store declines in consul: %w", err)
+	}
+	return nil
+}
+
+// abandon keeps ip allocated without a lease, so that it is never handed out.
+// Must be called with the plugin lock held.
+func (p *PluginState) abandon(ip net.IP) error {
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return fmt.Errorf("could not abandon %s: %w", ip, err)
+	}
+	if !got.IP.Equal(ip) {
+		_ = p.allocator.Free(got)
+		return fmt.Errorf("could not abandon %s, it is in use", ip)
+	}
+	return nil
+}
+
+// abandoned reports whether ip was abandoned after too many declines.
+// Must be called with the plugin lock held.
+func (p *PluginState) abandoned(ip net.IP) bool {
+	d, ok := p.declines[ip.String()]
+	return ok && d.Abandoned
+}
+
+// abandonedAddresses returns how many addresses are abandoned
+func (p *PluginState) abandonedAddresses() int {
+	p.Lock()
+	defer p.Unlock()
+	n := 0
+	for _, d := range p.declines {
+		if d.Abandoned {
+			n++
+		}
+	}
+	return n
+}
+
+// handleDecline ends the lease of a client that found its address in use, and
+// counts the decline. Once an address is declined decline-limit times, it is
+// abandoned.
+// Must be called with the plugin lock held.
+func (p *PluginState) handleDecline(ctx context.Context, req *dhcpv4.DHCPv4, mac string) {
+	ip := req.RequestedIPAddress().To4()
+	rec, ok := p.Recordsv4[mac]
+	if ip == nil || !ok || !rec.IP.Equal(ip) {
+		log.Printf("Ignoring decline of %s not leased to MAC %s", req.RequestedIPAddress(), p.logMAC(mac))
+		return
+	}
+	p.metrics.declines.Inc()
+	if p.declines == nil {
+		p.declines = make(map[string]*declines)
+	}
+	d, ok := p.declines[ip.String()]
+	if !ok {
+		d = &declines{}
+		p.declines[ip.String()] = d
+	}
+	d.Count++
+	d.Abandoned = d.Count >= p.declineLimit
+	if err := p.saveDeclines(ctx); err != nil {
+		log.Errorf("Could not persist declines of %s: %v", ip, err)
+	}
+	// An abandoned address stays allocated when the lease ends
+	if err := p.removeLease(ctx, mac, rec); err != nil {
+		log.Errorf("Could not end declined lease %s for MAC %s: %v", ip, p.logMAC(mac), err)
+		return
+	}
+	if d.Abandoned {
+		log.Warningf("Abandoned %s after %d declines, clear it once the conflict is resolved", ip, d.Count)
+	} else {
+		log.Warningf("MAC %s declined %s, %d of %d declines", p.logMAC(mac), ip, d.Count, p.declineLimit)
+	}
+}
+
+// holdAbandoned allocates the abandoned addresses at startup, unless leased.
+// Must be called with the plugin lock held.
+func (p *PluginState) holdAbandoned() {
+	for key, d := range p.declines {
+		ip := net.ParseIP(key).To4()
+		if !d.Abandoned || ip == nil || !p.inRange(ip) || p.isReserved(ip) {
+			continue
+		}
+		if holder, leased := p.byIP.Lookup(ip); leased {
+			log.Warningf("Abandoned address %s is leased to MAC %s, abandoning it once the lease ends", ip, p.logMAC(holder))
+			continue
+		}
+		if err := p.abandon(ip); err != nil {
+			log.Errorf("%v", err)
+		}
+	}
+}
+
+// clearDeclines forgets the declines of ip, returning it to allocation if it
+// was abandoned
+func (p *PluginState) clearDeclines(ctx context.Context, ip net.IP) error {
+	p.Lock()
+	defer p.Unlock()
+	d, ok := p.declines[ip.String()]
+	if !ok {
+		return fmt.Errorf("%w of %s", errNoDeclines, ip)
+	}
+	delete(p.declines, ip.String())
+	if err := p.saveDeclines(ctx); err != nil {
+		p.declines[ip.String()] = d
+		return err
+	}
+	if _, leased := p.byIP.Lookup(ip); d.Abandoned && !leased && !p.isReserved(ip) && p.inRange(ip) {
+		if err := p.free(ip); err != nil {
+			log.Warningf("Could not free %s: %v", ip, err)
+		}
+	}
+	log.Printf("Cleared %d declines of %s", d.Count, ip)
+	return nil
+}
+
+// serveDeclines writes the declined addresses as a JSON object
+func (p *PluginState) serveDeclines(w http.ResponseWriter, _ *http.Request) {
+	p.Lock()
+	all := p.declines
+	if all == nil {
+		all = map[string]*declines{}
+	}
+	data, err := json.Marshal(all)
+	p.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(data); err != nil {
+		log.Warningf("Failed to write declines: %v", err)
+	}
+}
+
+// serveClearDeclines clears the declines of the address in the path, see clearDeclines
+func (p *PluginState) serveClearDeclines(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip")).To4()
+	if ip == nil {
+		http.Error(w, "invalid IPv4 address", http.StatusBadRequest)
+		return
+	}
+	err := p.clearDeclines(r.Context(), ip)
+	if errors.Is(err, errNoDeclines) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeclinesAbandonAddress(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseDeclineLimitOption(p, "2"))
+	lease := func(mac net.HardwareAddr) string {
+		req, stub := testRequest(t, mac)
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		return resp.YourIPAddr.String()
+	}
+	decline := func(mac net.HardwareAddr, ip string) {
+		req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+			dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP(ip))))
+		resp, stop := p.Handler4(req, stub)
+		assert.Nil(t, resp)
+		assert.True(t, stop)
+	}
+
+	// The first decline frees the address, which is handed out again
+	first, second := net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	require.Equal(t, "10.0.0.1", lease(first))
+	decline(first, "10.0.0.1")
+	assert.NotContains(t, p.Recordsv4, first.String())
+	require.Equal(t, "10.0.0.1", lease(second))
+
+	// The second one abandons it
+	decline(second, "10.0.0.1")
+	assert.Equal(t, "10.0.0.2", lease(second))
+	assert.Equal(t, "10.0.0.3", lease(first))
+	assert.Equal(t, 1, p.abandonedAddresses())
+	assert.Equal(t, uint64(2), p.metrics.declines.Value())
+
+	stored, err := p.loadDeclines()
+	require.NoError(t, err)
+	assert.Equal(t, &declines{Count: 2, Abandoned: true}, stored["10.0.0.1"])
+
+	// Reconciliation doesn't free it
+	_, err = p.reconcile(context.Background())
+	require.NoError(t, err)
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 1))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.True(t, allocated)
+
+	// Until an operator clears it
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	clearDeclines := func() int {
+		req, err := http.NewRequest(http.MethodDelete, srv.URL+"/declines/10.0.0.1", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+testHTTPToken)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusNoContent, clearDeclines())
+	assert.Equal(t, http.StatusNotFound, clearDeclines())
+	assert.Equal(t, "10.0.0.1", lease(net.HardwareAddr{2, 0, 0, 0, 0, 3}))
+	stored, err = p.loadDeclines()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestDeclineOfUnleasedAddressIgnored(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseDeclineLimitOption(p, "1"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+	req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 0, 2))))
+	_, _ = p.Handler4(req, stub)
+	assert.Contains(t, p.Recordsv4, mac.String())
+	assert.Empty(t, p.declines)
+}
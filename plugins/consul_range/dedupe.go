@@ -0,0 +1,68 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+)
+
+func parseDedupeWritesOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.dedupeWrites = enabled
+	return nil
+}
+
+// recordDigest returns a hash of the serialized record, or false if it can't
+// be serialized
+func recordDigest(rec *Record) (uint64, bool) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return 0, false
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	return h.Sum64(), true
+}
+
+// unchanged reports whether rec is the same as the record last written to
+// Consul for mac, so that writing it again can be skipped. It is always false
+// unless the dedupe-writes option is set.
+// Must be called with the plugin lock held.
+func (p *PluginState) unchanged(mac string, rec *Record) bool {
+	if !p.dedupeWrites {
+		return false
+	}
+	if _, ok := p.dirty[mac]; ok {
+		return false
+	}
+	written, ok := p.written[mac]
+	if !ok {
+		return false
+	}
+	digest, ok := recordDigest(rec)
+	return ok && digest == written
+}
+
+// noteWritten remembers what was last written to Consul for mac, rec being nil
+// if its record was deleted or the write failed.
+// Must be called with the plugin lock held.
+func (p *PluginState) noteWritten(mac string, rec *Record) {
+	if !p.dedupeWrites {
+		return
+	}
+	digest, ok := uint64(0), false
+	if rec != nil {
+		digest, ok = recordDigest(rec)
+	}
+	if !ok {
+		delete(p.written, mac)
+		return
+	}
+	if p.written == nil {
+		p.written = make(map[string]uint64)
+	}
+	p.written[mac] = digest
+}
@@ -0,0 +1,65 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeWritesSkipsNoopRenewal(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseDedupeWritesOption(p, "true"))
+	clock := newFakeClock()
+	p.clock = clock.Now
+	kv := p.kv.(*memKV)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	renew := func() {
+		req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+	}
+
+	renew()
+	puts := kv.puts
+
+	// Within the same second, the extended expiry is the same
+	clock.Advance(500 * time.Millisecond)
+	renew()
+	assert.Equal(t, puts, kv.puts, "a no-op renewal must not write to Consul")
+	assert.Equal(t, uint64(1), p.metrics.writesDeduplicated.Value())
+
+	clock.Advance(time.Second)
+	renew()
+	assert.Equal(t, puts+1, kv.puts, "an advanced expiry must be written")
+
+	// A record deleted from Consul behind our back is written again by reconciliation
+	kv.Lock()
+	delete(kv.data, p.recordKey(mac))
+	kv.Unlock()
+	repairs, err := p.reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, repairs)
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Contains(t, stored, mac.String())
+}
+
+func TestNoDedupeByDefault(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	puts := p.kv.(*memKV).puts
+
+	clock.Advance(500 * time.Millisecond)
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, puts+1, p.kv.(*memKV).puts)
+}
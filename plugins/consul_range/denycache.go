@@ -0,0 +1,55 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultDenyCacheSize bounds the number of denied clients remembered unless
+// set otherwise
+const defaultDenyCacheSize = 1024
+
+// denyCache remembers the clients recently refused a new lease, so that their
+// retransmissions are dropped without evaluating the policy again. Entries
+// expire after ttl so that policy changes eventually take effect.
+// It is protected by the plugin lock.
+type denyCache struct {
+	denied ttlSet[string]
+}
+
+func parseDenyCacheTTLOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("deny cache TTL cannot be negative: %s", d)
+	}
+	p.denials.denied.ttl = d
+	return nil
+}
+
+func parseDenyCacheSizeOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("deny cache size must be positive, got %d", n)
+	}
+	p.denials.denied.size = n
+	return nil
+}
+
+// hit reports whether mac was denied less than ttl before now
+func (c *denyCache) hit(mac string, now time.Time) bool {
+	_, ok := c.denied.get(mac, now)
+	return ok
+}
+
+// deny records that mac was denied at now. If the cache is full once expired
+// entries are pruned, mac is not remembered.
+func (c *denyCache) deny(mac string, now time.Time) {
+	c.denied.add(mac, now)
+}
@@ -0,0 +1,60 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeniedClientHitsCache(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	require.NoError(t, parseMaxPerHostnameOption(p, "1"))
+	require.NoError(t, parseDenyCacheTTLOption(p, "10s"))
+	require.NoError(t, parseDenyCacheSizeOption(p, "16"))
+	request := func(mac net.HardwareAddr) *dhcpv4.DHCPv4 {
+		req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName("printer")))
+		resp, _ := p.Handler4(req, stub)
+		return resp
+	}
+
+	require.NotNil(t, request(net.HardwareAddr{2, 0, 0, 0, 0, 1}))
+	denied := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	assert.Nil(t, request(denied))
+	assert.Equal(t, uint64(1), p.metrics.hostnameCapped.Value())
+
+	// The retransmission is dropped without checking the hostname cap again
+	assert.Nil(t, request(denied))
+	assert.Equal(t, uint64(1), p.metrics.hostnameCapped.Value())
+	assert.Equal(t, uint64(1), p.metrics.denyCacheHits.Value())
+
+	// Once the entry expires, the policy is evaluated again
+	clock.Advance(10 * time.Second)
+	assert.Nil(t, request(denied))
+	assert.Equal(t, uint64(2), p.metrics.hostnameCapped.Value())
+	assert.Equal(t, uint64(1), p.metrics.denyCacheHits.Value())
+}
+
+func TestDenyCacheIsBounded(t *testing.T) {
+	c := denyCache{denied: ttlSet[string]{ttl: time.Second, size: 10}}
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		c.deny(fmt.Sprintf("mac-%d", i), now)
+	}
+	assert.Equal(t, 10, c.denied.len())
+	assert.False(t, c.hit("mac-15", now))
+	// Expired entries make room again
+	c.deny("mac-15", now.Add(time.Second))
+	assert.Equal(t, 1, c.denied.len())
+	assert.True(t, c.hit("mac-15", now.Add(time.Second)))
+
+	disabled := denyCache{}
+	disabled.deny("mac-1", now)
+	assert.False(t, disabled.hit("mac-1", now))
+}
@@ -0,0 +1,58 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// parseDomainDNSName checks that name is a valid DNS domain name, ignoring a
+// trailing dot
+func parseDomainDNSName(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if !validHostname.MatchString(name) || len(name) > maxHostname {
+		return "", fmt.Errorf("invalid domain name %q", name)
+	}
+	return name, nil
+}
+
+// parseDomainOption sets the domain name (option 15) clients build their FQDN with
+func parseDomainOption(p *PluginState, value string) error {
+	name, err := parseDomainDNSName(value)
+	if err != nil {
+		return err
+	}
+	p.domain = name
+	return nil
+}
+
+// parseSearchDomainsOption sets the domain search list (option 119), given as
+// comma separated domain names
+func parseSearchDomainsOption(p *PluginState, value string) error {
+	var search []string
+	for _, d := range strings.Split(value, ",") {
+		name, err := parseDomainDNSName(d)
+		if err != nil {
+			return err
+		}
+		search = append(search, name)
+	}
+	p.searchDomains = search
+	return nil
+}
+
+// setDomainOptions sets the domain name and search list of resp, unless a
+// previous plugin already set them
+func (p *PluginState) setDomainOptions(resp *dhcpv4.DHCPv4) {
+	if p.domain != "" && !resp.Options.Has(dhcpv4.OptionDomainName) {
+		resp.UpdateOption(dhcpv4.OptDomainName(p.domain))
+	}
+	if len(p.searchDomains) > 0 && !resp.Options.Has(dhcpv4.OptionDNSDomainSearchList) {
+		// Copied, so that later plugins can't change the configured list
+		resp.UpdateOption(dhcpv4.OptDomainSearch(&rfc1035label.Labels{
+			Labels: append([]string(nil), p.searchDomains...),
+		}))
+	}
+}
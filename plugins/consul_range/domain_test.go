@@ -0,0 +1,37 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDomainOptions(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseDomainOption(p, "lab.example.com."))
+	require.NoError(t, parseSearchDomainsOption(p, "lab.example.com,example.com"))
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1}, dhcpv4.WithOption(dhcpv4.OptHostName("printer")))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "lab.example.com", resp.DomainName())
+	require.NotNil(t, resp.DomainSearch())
+	assert.Equal(t, []string{"lab.example.com", "example.com"}, resp.DomainSearch().Labels)
+
+	// Options set by a previous plugin are kept
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	stub.UpdateOption(dhcpv4.OptDomainName("other.example.net"))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "other.example.net", resp.DomainName())
+}
+
+func TestParseDomainOptions(t *testing.T) {
+	for _, value := range []string{"", "bad domain", "-lab.example.com"} {
+		assert.Error(t, parseDomainOption(&PluginState{}, value), value)
+	}
+	assert.Error(t, parseSearchDomainsOption(&PluginState{}, "example.com,,lab.example.com"))
+}
@@ -0,0 +1,85 @@
+package consulrangeplugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// sealedMagic leads encrypted values, which neither JSON nor protobuf records
+// nor gzip-compressed batches begin with
+const sealedMagic = 0x01
+
+// errNoEncryptionKey is returned when reading an encrypted value without a key
+var errNoEncryptionKey = errors.New("value is encrypted but no encryption-key is set")
+
+// recordSealer encrypts the lease records stored in Consul with AES-GCM. The
+// name of a value under the prefix is authenticated with it, so that values
+// can't be swapped between clients. A nil recordSealer stores plaintext.
+type recordSealer struct {
+	aead cipher.AEAD
+}
+
+// parseEncryptionKeyOption sets the base64 encoded AES-128, AES-192 or
+// AES-256 key lease records are encrypted with
+func parseEncryptionKeyOption(p *PluginState, value string) error {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("encryption key must be base64 encoded: %w", err)
+	}
+	s, err := newRecordSealer(key)
+	if err != nil {
+		return err
+	}
+	p.sealer = s
+	return nil
+}
+
+func newRecordSealer(key []byte) (*recordSealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key, want 16, 24 or 32 bytes: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &recordSealer{aead: aead}, nil
+}
+
+// seal encrypts the value named name, the key relative to the prefix. It
+// returns plain as is without a key.
+func (s *recordSealer) seal(name string, plain []byte) ([]byte, error) {
+	if s == nil {
+		return plain, nil
+	}
+	out := make([]byte, 1+s.aead.NonceSize(), 1+s.aead.NonceSize()+len(plain)+s.aead.Overhead())
+	out[0] = sealedMagic
+	if _, err := rand.Read(out[1:]); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	return s.aead.Seal(out, out[1:], plain, []byte(name)), nil
+}
+
+// open decrypts the value named name sealed by seal. Plaintext values, e.g.
+// stored before encryption was enabled, are returned as is.
+func (s *recordSealer) open(name string, data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != sealedMagic {
+		return data, nil
+	}
+	if s == nil {
+		return nil, errNoEncryptionKey
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(data) < 1+nonceSize {
+		return nil, errors.New("truncated encrypted value")
+	}
+	plain, err := s.aead.Open(nil, data[1:1+nonceSize], data[1+nonceSize:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt value, wrong encryption-key? %w", err)
+	}
+	return plain, nil
+}
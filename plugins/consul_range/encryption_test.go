@@ -0,0 +1,94 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey is a base64 encoded AES-256 key whose bytes are all b
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestEncryptedRecordsRoundTrip(t *testing.T) {
+	for _, format := range []storageFormat{storageJSON, storageBatched, storageProtobuf} {
+		kv := newMemKV()
+		p := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: format, metrics: newMetrics()}
+		require.NoError(t, parseEncryptionKeyOption(p, testKey(1)))
+		mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+		rec := &Record{IP: net.IPv4(10, 0, 0, 1).To4(), Expires: expire, Hostname: "alices-laptop"}
+		p.Recordsv4[mac.String()] = rec
+		require.NoError(t, p.saveIPAddress(context.Background(), mac, rec))
+
+		for key, value := range kv.data {
+			assert.Equal(t, byte(sealedMagic), value[0], key)
+			assert.NotContains(t, string(value), "alices-laptop", "hostname stored in plaintext")
+		}
+		stored, skipped, err := p.loadRecords()
+		require.NoError(t, err)
+		assert.Zero(t, skipped)
+		require.Contains(t, stored, mac.String(), format)
+		assert.True(t, stored[mac.String()].IP.Equal(rec.IP), format)
+		assert.Equal(t, rec.Hostname, stored[mac.String()].Hostname, format)
+	}
+}
+
+func TestEncryptionReadsPlaintext(t *testing.T) {
+	kv := newMemKV()
+	plain := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", metrics: newMetrics()}
+	old := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	require.NoError(t, plain.saveIPAddress(context.Background(), old, &Record{IP: net.IPv4(10, 0, 0, 1).To4(), Expires: expire}))
+
+	p := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", metrics: newMetrics()}
+	require.NoError(t, parseEncryptionKeyOption(p, testKey(1)))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	require.NoError(t, p.saveIPAddress(context.Background(), mac, &Record{IP: net.IPv4(10, 0, 0, 2).To4(), Expires: expire}))
+	stored, _, err := p.loadRecords()
+	require.NoError(t, err)
+	assert.Len(t, stored, 2, "records written before encryption was enabled must load")
+
+	// Without the key, encrypted records are skipped
+	stored, skipped, err := plain.loadRecords()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, 1, skipped)
+}
+
+func TestEncryptionWrongKey(t *testing.T) {
+	kv := newMemKV()
+	p := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", metrics: newMetrics()}
+	require.NoError(t, parseEncryptionKeyOption(p, testKey(1)))
+	one, two := net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	require.NoError(t, p.saveIPAddress(context.Background(), one, &Record{IP: net.IPv4(10, 0, 0, 1).To4(), Expires: expire}))
+	require.NoError(t, p.saveIPAddress(context.Background(), two, &Record{IP: net.IPv4(10, 0, 0, 2).To4(), Expires: expire}))
+
+	other := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", metrics: newMetrics()}
+	require.NoError(t, parseEncryptionKeyOption(other, testKey(2)))
+	stored, skipped, err := other.loadRecords()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+	assert.Equal(t, 2, skipped)
+	assert.Equal(t, uint64(2), other.metrics.invalidRecords.Value())
+
+	// A value copied to the key of another client doesn't decrypt either
+	kv.data[p.recordKey(two)] = kv.data[p.recordKey(one)]
+	stored, skipped, err = p.loadRecords()
+	require.NoError(t, err)
+	assert.Len(t, stored, 1)
+	assert.Equal(t, 1, skipped)
+}
+
+func TestParseEncryptionKeyOption(t *testing.T) {
+	for _, value := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		assert.Error(t, parseEncryptionKeyOption(&PluginState{}, value), value)
+	}
+	for _, size := range []int{16, 24, 32} {
+		assert.NoError(t, parseEncryptionKeyOption(&PluginState{}, base64.StdEncoding.EncodeToString(make([]byte, size))))
+	}
+}
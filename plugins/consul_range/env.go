@@ -0,0 +1,59 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandArgs replaces ${VAR} references in the plugin arguments with the value
+// of the environment variable VAR, so secrets need not appear in the config.
+// ${VAR:-default} expands to default when VAR is unset or empty. Referencing
+// an undefined variable without a default is an error.
+func expandArgs(args []string) ([]string, error) {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		s, err := expandEnv(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i+1, err)
+		}
+		expanded[i] = s
+	}
+	return expanded, nil
+}
+
+// expandEnv expands the ${VAR} and ${VAR:-default} references in s. A '$' not
+// followed by '{' is kept as is.
+func expandEnv(s string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", s[start:])
+		}
+		end += start
+		b.WriteString(s[:start])
+
+		name, def, hasDefault := strings.Cut(s[start+2:end], ":-")
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in %q", s[start:end+1])
+		}
+		value, ok := os.LookupEnv(name)
+		switch {
+		case ok && value != "":
+			b.WriteString(value)
+		case hasDefault:
+			b.WriteString(def)
+		case ok:
+			// Set but empty, without a default
+		default:
+			return "", fmt.Errorf("environment variable %s is not defined", name)
+		}
+		s = s[end+1:]
+	}
+}
@@ -0,0 +1,51 @@
+package consulrangeplugin
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("CONSULRANGE_TEST_SECRET", "s3cret")
+	t.Setenv("CONSULRANGE_TEST_EMPTY", "")
+
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"${CONSULRANGE_TEST_SECRET}", "s3cret"},
+		{"webhook-secret=${CONSULRANGE_TEST_SECRET}", "webhook-secret=s3cret"},
+		{"${CONSULRANGE_TEST_SECRET}-${CONSULRANGE_TEST_SECRET}", "s3cret-s3cret"},
+		{"${CONSULRANGE_TEST_UNSET:-127.0.0.1:8500}", "127.0.0.1:8500"},
+		{"${CONSULRANGE_TEST_SECRET:-fallback}", "s3cret"},
+		{"${CONSULRANGE_TEST_EMPTY:-fallback}", "fallback"},
+		{"${CONSULRANGE_TEST_EMPTY}", ""},
+		{"${CONSULRANGE_TEST_UNSET:-}", ""},
+		{"cost$5", "cost$5"},
+	} {
+		got, err := expandEnv(tc.in)
+		if assert.NoError(t, err, tc.in) {
+			assert.Equal(t, tc.out, got, tc.in)
+		}
+	}
+}
+
+func TestExpandEnvErrors(t *testing.T) {
+	for _, in := range []string{
+		"${CONSULRANGE_TEST_UNSET}",
+		"${CONSULRANGE_TEST_UNSET",
+		"${}",
+		"${:-default}",
+	} {
+		_, err := expandEnv(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestSetupUndefinedVariable(t *testing.T) {
+	_, err := setupConsulRange("127.0.0.1:8500", "leases", "10.0.0.1", "10.0.0.10", "1h", "webhook-secret=${CONSULRANGE_TEST_UNSET}")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CONSULRANGE_TEST_UNSET is not defined")
+}
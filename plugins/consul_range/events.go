@@ -0,0 +1,70 @@
+package consulrangeplugin
+
+import (
+	"net"
+)
+
+// eventType identifies what happened to a lease
+type eventType string
+
+const (
+	eventAllocate eventType = "allocate"
+	eventRenew    eventType = "renew"
+	eventRelease  eventType = "release"
+	eventExpire   eventType = "expire"
+	// eventHostname is emitted when a client renews with another hostname,
+	// under the hostname-policy never or log
+	eventHostname eventType = "hostname"
+)
+
+// leaseEvent describes a change to a lease
+type leaseEvent struct {
+	Type     eventType `json:"type"`
+	Time     int64     `json:"time"`
+	MAC      string    `json:"mac"`
+	IP       net.IP    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  int       `json:"expires"`
+	// ClientHostname is the hostname the client renewed with, for hostname events
+	ClientHostname string `json:"client_hostname,omitempty"`
+}
+
+// leaseHook is notified of lease events.
+// Hooks are called with the plugin lock held, and must not block.
+type leaseHook interface {
+	LeaseEvent(ev leaseEvent)
+}
+
+// addHook registers a hook to be notified of lease events
+func (p *PluginState) addHook(h leaseHook) {
+	p.hooks = append(p.hooks, h)
+}
+
+// emit notifies all hooks of an event on the lease held by mac.
+// Must be called with the plugin lock held.
+func (p *PluginState) emit(t eventType, mac string, rec *Record) {
+	if len(p.hooks) == 0 {
+		return
+	}
+	p.emitEvent(p.leaseEvent(t, mac, rec))
+}
+
+// leaseEvent describes an event of type t on the lease held by mac
+func (p *PluginState) leaseEvent(t eventType, mac string, rec *Record) leaseEvent {
+	return leaseEvent{
+		Type:     t,
+		Time:     p.now().Unix(),
+		MAC:      p.logMAC(mac),
+		IP:       rec.IP,
+		Hostname: rec.Hostname,
+		Expires:  rec.Expires,
+	}
+}
+
+// emitEvent notifies all hooks of ev.
+// Must be called with the plugin lock held.
+func (p *PluginState) emitEvent(ev leaseEvent) {
+	for _, h := range p.hooks {
+		h.LeaseEvent(ev)
+	}
+}
@@ -0,0 +1,131 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+)
+
+// eventStreamBuffer bounds the number of events waiting to be written to a
+// subscriber, past which its events are dropped
+const eventStreamBuffer = 256
+
+func parseEventSocketOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("event socket path cannot be empty")
+	}
+	p.eventSocket = value
+	return nil
+}
+
+// eventStream is a leaseHook streaming lease events as newline delimited JSON
+// to the clients connected to a Unix socket. Events are written in the
+// background, those of subscribers too slow to keep up are dropped.
+type eventStream struct {
+	listener net.Listener
+	dropped  *counter
+
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+// newEventStream listens on the Unix socket at path, replacing a socket left
+// over by a previous run
+func newEventStream(path string, dropped *counter) (*eventStream, error) {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &eventStream{
+		listener:    l,
+		dropped:     dropped,
+		subscribers: make(map[chan []byte]struct{}),
+	}
+	go s.accept()
+	return s, nil
+}
+
+// accept serves subscribers until the listener is closed
+func (s *eventStream) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Event socket stopped accepting subscribers: %v", err)
+			}
+			return
+		}
+		events := make(chan []byte, eventStreamBuffer)
+		s.mu.Lock()
+		s.subscribers[events] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			// Subscribers aren't expected to send anything, this notices them leaving
+			_, _ = io.Copy(io.Discard, conn)
+			s.unsubscribe(events)
+		}()
+		go func() {
+			defer conn.Close()
+			for line := range events {
+				if _, err := conn.Write(line); err != nil {
+					s.unsubscribe(events)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// unsubscribe stops sending events to a subscriber
+func (s *eventStream) unsubscribe(events chan []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscribers[events]; ok {
+		delete(s.subscribers, events)
+		close(events)
+	}
+}
+
+// LeaseEvent queues ev for every subscriber
+func (s *eventStream) LeaseEvent(ev leaseEvent) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("Could not marshal lease event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for events := range s.subscribers {
+		select {
+		case events <- line:
+		default:
+			s.dropped.Inc()
+		}
+	}
+}
+
+// Close stops listening and disconnects all subscribers
+func (s *eventStream) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for events := range s.subscribers {
+		delete(s.subscribers, events)
+		close(events)
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package consulrangeplugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// subscriberCount returns the number of subscribers of s
+func (s *eventStream) subscriberCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers)
+}
+
+func TestEventStreamDeliversEvents(t *testing.T) {
+	p := testPluginState(t)
+	path := filepath.Join(t.TempDir(), "events.sock")
+	stream, err := newEventStream(path, p.metrics.eventsDropped)
+	require.NoError(t, err)
+	defer stream.Close()
+	p.addHook(stream)
+
+	var readers []*bufio.Scanner
+	for range 2 {
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		readers = append(readers, bufio.NewScanner(conn))
+	}
+	require.Eventually(t, func() bool { return stream.subscriberCount() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	req, stub = testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease), dhcpv4.WithClientIP(resp.YourIPAddr))
+	_, _ = p.Handler4(req, stub)
+
+	for _, r := range readers {
+		var got []eventType
+		for range 2 {
+			require.True(t, r.Scan(), "event not received: %v", r.Err())
+			var ev leaseEvent
+			require.NoError(t, json.Unmarshal(r.Bytes(), &ev))
+			assert.Equal(t, mac.String(), ev.MAC)
+			assert.Equal(t, resp.YourIPAddr.String(), ev.IP.String())
+			got = append(got, ev.Type)
+		}
+		assert.Equal(t, []eventType{eventAllocate, eventRelease}, got)
+	}
+}
+
+func TestEventStreamDropsForSlowSubscribers(t *testing.T) {
+	p := testPluginState(t)
+	stream, err := newEventStream(filepath.Join(t.TempDir(), "events.sock"), p.metrics.eventsDropped)
+	require.NoError(t, err)
+	defer stream.Close()
+
+	// A subscriber whose buffer is full
+	slow := make(chan []byte, 1)
+	stream.mu.Lock()
+	stream.subscribers[slow] = struct{}{}
+	stream.mu.Unlock()
+	stream.LeaseEvent(leaseEvent{Type: eventRenew})
+	stream.LeaseEvent(leaseEvent{Type: eventRenew})
+	assert.Len(t, slow, 1)
+	assert.Equal(t, uint64(1), p.metrics.eventsDropped.Value())
+}
+
+func TestEventStreamRefusesNonSocket(t *testing.T) {
+	_, err := newEventStream(t.TempDir(), newMetrics().eventsDropped)
+	assert.ErrorContains(t, err, "not a socket")
+}
@@ -0,0 +1,102 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// expiredRenewalPolicy selects what happens when a client comes back for a
+// lease that expired, but wasn't reclaimed yet
+type expiredRenewalPolicy int
+
+const (
+	// expiredRenewalReallocate allocates the lease again if its address may
+	// have been handed to another client since it expired
+	expiredRenewalReallocate expiredRenewalPolicy = iota
+	// expiredRenewalExtend extends the lease as if it hadn't expired
+	expiredRenewalExtend
+)
+
+func parseExpiredRenewalOption(p *PluginState, value string) error {
+	switch value {
+	case "reallocate":
+		p.expiredRenewal = expiredRenewalReallocate
+	case "extend":
+		p.expiredRenewal = expiredRenewalExtend
+	default:
+		return fmt.Errorf("unknown expired renewal policy %q, want reallocate or extend", value)
+	}
+	return nil
+}
+
+// reassigned reports whether the address of the expired record of mac may
+// no longer be its own: it is indexed to another client, reserved for another
+// client, or was freed.
+// Must be called with the plugin lock held.
+func (p *PluginState) reassigned(mac string, record *Record) bool {
+	if p.expiredRenewal == expiredRenewalExtend || !record.expiredAt(p.now()) {
+		return false
+	}
+	if holder, ok := p.byIP.Lookup(record.IP); !ok || holder != mac {
+		return true
+	}
+	if p.isReserved(record.IP) && !p.reservations[mac].Equal(record.IP) {
+		return true
+	}
+	if p.inRange(record.IP) {
+		allocated, err := p.isAllocated(record.IP)
+		return err != nil || !allocated
+	}
+	return false
+}
+
+// reallocateExpired gives the expired record of mac a new address for leaseTime,
+// its former one if it is free, and persists it.
+// Must be called with the plugin lock held.
+func (p *PluginState) reallocateExpired(ctx context.Context, mac net.HardwareAddr, record *Record, pool *classPool, leaseTime time.Duration) error {
+	ip, err := p.allocateFormer(record.IP, mac.String())
+	if err != nil {
+		return err
+	}
+	if ip == nil {
+		got, err := p.allocate(pool)
+		if err != nil {
+			return err
+		}
+		ip = got.IP.To4()
+	}
+	if ip.Equal(record.IP) {
+		log.Printf("Allocated expired lease %s for MAC %s again", ip, p.logMAC(mac.String()))
+	} else {
+		log.Warningf("Expired lease %s for MAC %s may have been reassigned, moving it to %s", record.IP, p.logMAC(mac.String()), ip)
+	}
+	p.setRecordIP(mac.String(), record, ip)
+	record.Expires = expiresAt(p.now(), leaseTime)
+	if err := p.persist(ctx, mac, record); err != nil {
+		log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+	}
+	p.emit(eventAllocate, mac.String(), record)
+	return nil
+}
+
+// allocateFormer allocates ip, formerly leased to mac, again if it is free,
+// returning nil if it isn't.
+// Must be called with the plugin lock held.
+func (p *PluginState) allocateFormer(ip net.IP, mac string) (net.IP, error) {
+	if p.migration != nil || !p.inRange(ip) || p.isReserved(ip) {
+		return nil, nil
+	}
+	if holder, ok := p.byIP.Lookup(ip); ok && holder != mac {
+		return nil, nil
+	}
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return nil, newAllocationError(err)
+	}
+	if !got.IP.Equal(ip) {
+		return nil, p.allocator.Free(got)
+	}
+	return got.IP.To4(), nil
+}
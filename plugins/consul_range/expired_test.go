@@ -0,0 +1,68 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiredLeaseReassigned(t *testing.T) {
+	p := testPluginState(t)
+	stale := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, stale, net.IPv4(10, 0, 0, 1))
+	rec.Expires = int(time.Now().Add(-time.Minute).Unix())
+	// Another client got the address, e.g. from a peer, before the sweeper ran
+	other := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	p.setRecord(other.String(), &Record{IP: rec.IP, Expires: int(time.Now().Add(time.Hour).Unix())})
+
+	req, stub := testRequest(t, stale, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(rec.IP)))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType(), "the client must not be acked an address it lost")
+	assert.False(t, p.Recordsv4[stale.String()].IP.Equal(net.IPv4(10, 0, 0, 1)))
+	holder, _ := p.byIP.Lookup(net.IPv4(10, 0, 0, 1))
+	assert.Equal(t, other.String(), holder)
+
+	// Restarting, the client is offered its new address
+	req, stub = testRequest(t, stale, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, p.Recordsv4[stale.String()].IP.String(), resp.YourIPAddr.String())
+}
+
+func TestExpiredLeaseFreedGetsSameAddress(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 3))
+	rec.Expires = int(time.Now().Add(-time.Minute).Unix())
+	require.NoError(t, p.allocator.Free(net.IPNet{IP: rec.IP, Mask: net.CIDRMask(32, 32)}))
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.3", resp.YourIPAddr.String())
+	allocated, err := p.isAllocated(rec.IP)
+	require.NoError(t, err)
+	assert.True(t, allocated)
+	assert.False(t, p.Recordsv4[mac.String()].expiredAt(time.Now()))
+}
+
+func TestExpiredRenewalExtend(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseExpiredRenewalOption(p, "extend"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+	rec.Expires = int(time.Now().Add(-time.Minute).Unix())
+	p.setRecord("02:00:00:00:00:02", &Record{IP: rec.IP, Expires: int(time.Now().Add(time.Hour).Unix())})
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+
+	assert.Error(t, parseExpiredRenewalOption(p, "ignore"))
+}
@@ -0,0 +1,160 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dirtyRetryDelay is how long to wait between attempts at flushing the dirty
+// records on shutdown
+const dirtyRetryDelay = 500 * time.Millisecond
+
+func parseDirtyFlushIntervalOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("dirty flush interval must be positive: %s", d)
+	}
+	p.dirtyFlushInterval = d
+	return nil
+}
+
+func parseDirtyFlushTimeoutOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("dirty flush timeout cannot be negative: %s", d)
+	}
+	p.dirtyFlushTimeout = d
+	return nil
+}
+
+// registerDirtyGauge exports the number of records of p that failed to be persisted
+func (m *metrics) registerDirtyGauge(p *PluginState) {
+	m.newGauge("consulrange_records_dirty", "Number of lease records whose last write to Consul failed, held in memory until flushed", func() float64 {
+		return float64(p.dirtyCount())
+	})
+}
+
+// dirtyCount returns the number of dirty records
+func (p *PluginState) dirtyCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.dirty)
+}
+
+// startDirtyFlusher retries writing the dirty records, e.g. renewals
+// extended in memory while Consul was unavailable, so that they aren't lost if
+// the instance crashes: shortly after a write fails transiently, and every
+// dirty-flush-interval if set.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) startDirtyFlusher() {
+	var tick <-chan time.Time
+	if p.dirtyFlushInterval > 0 {
+		tick = time.NewTicker(p.dirtyFlushInterval).C
+	}
+	go func() {
+		for {
+			select {
+			case <-p.retryKick:
+				p.retryDirty()
+			case <-tick:
+				ctx, cancel := context.WithTimeout(context.Background(), p.dirtyFlushInterval)
+				if err := p.flushDirty(ctx); err != nil {
+					log.Warningf("Could not flush dirty leases: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+// pendingWrite is the write of a dirty record, and the digest of the record
+// it persists
+type pendingWrite struct {
+	mac    net.HardwareAddr
+	write  recordWrite
+	digest uint64
+}
+
+// flushDirty writes the dirty records to Consul, stopping at the first that
+// fails. The writes are prepared under the plugin lock but made without it,
+// so that requests are not stalled by a slow Consul. A record changed while
+// it was written stays dirty. Must be called without the plugin lock held.
+func (p *PluginState) flushDirty(ctx context.Context) error {
+	p.flushMu.Lock()
+	defer p.flushMu.Unlock()
+
+	p.Lock()
+	writes := make([]pendingWrite, 0, len(p.dirty))
+	for mac := range p.dirty {
+		hw, err := parseClientKey(mac)
+		if err != nil {
+			// Can't happen, dirty MACs come from requests
+			delete(p.dirty, mac)
+			continue
+		}
+		// A record no longer held in memory is deleted
+		rec := p.Recordsv4[mac]
+		w, err := p.prepareWrite(hw, rec)
+		if err != nil {
+			p.Unlock()
+			return fmt.Errorf("could not flush lease for MAC %s: %w", p.logMAC(mac), err)
+		}
+		digest, _ := recordDigest(rec)
+		writes = append(writes, pendingWrite{mac: hw, write: w, digest: digest})
+	}
+	p.Unlock()
+
+	flushed := 0
+	defer func() {
+		if flushed > 0 {
+			log.Printf("Flushed %d dirty leases", flushed)
+		}
+	}()
+	for _, w := range writes {
+		p.metrics.consulWriteRetries.Inc()
+		if err := p.applyWrite(ctx, w.write); err != nil {
+			return fmt.Errorf("could not flush lease for MAC %s: %w", p.logMAC(w.mac.String()), err)
+		}
+		mac := w.mac.String()
+		p.Lock()
+		rec := p.Recordsv4[mac]
+		if digest, ok := recordDigest(rec); ok && digest == w.digest {
+			delete(p.dirty, mac)
+			p.noteWritten(mac, rec)
+			flushed++
+		}
+		p.Unlock()
+	}
+	return nil
+}
+
+// flushDirtyWithin flushes the dirty records, retrying for up to the dirty
+// flush timeout. Must be called without the plugin lock held.
+func (p *PluginState) flushDirtyWithin(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.dirtyFlushTimeout)
+	defer cancel()
+	for {
+		err := p.flushDirty(ctx)
+		if err == nil && p.dirtyCount() > 0 {
+			err = errors.New("records changed while they were flushed")
+		}
+		if err == nil || p.dirtyFlushTimeout == 0 {
+			return err
+		}
+		log.Warningf("Retrying to flush dirty leases: %v", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(dirtyRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDirtyRenewalFlushed(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	p.metrics.registerDirtyGauge(p)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	renew := func() {
+		req, stub := testRequest(t, mac)
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+	}
+	stored := func() *Record {
+		records, err := loadRecords(p.kv, p.consulKVPrefix)
+		require.NoError(t, err)
+		return records[mac.String()]
+	}
+	renew()
+	granted := stored().Expires
+
+	// The renewal is extended in memory but its write fails
+	kv := &failingKV{memKV: p.kv.(*memKV), failures: 1, err: api.StatusError{Code: http.StatusForbidden, Body: "Permission denied"}}
+	p.kv = kv
+	clock.Advance(time.Minute)
+	renew()
+	p.Lock()
+	extended := p.Recordsv4[mac.String()].Expires
+	p.Unlock()
+	assert.Greater(t, extended, granted)
+	assert.Equal(t, granted, stored().Expires)
+	var buf bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&buf))
+	assert.Contains(t, buf.String(), "consulrange_records_dirty 1\n")
+
+	// Once Consul recovers, the flusher writes it
+	p.dirtyFlushInterval = 10 * time.Millisecond
+	p.startDirtyFlusher()
+	assert.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return len(p.dirty) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, extended, stored().Expires)
+	buf.Reset()
+	require.NoError(t, p.metrics.writeText(&buf))
+	assert.Contains(t, buf.String(), "consulrange_records_dirty 0\n")
+}
+
+func TestCloseWaitsForDirtyRecords(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 5))
+	p.dirty = map[string]struct{}{mac.String(): {}}
+	kv := &failingKV{memKV: p.kv.(*memKV), failures: 1, err: api.StatusError{Code: http.StatusForbidden, Body: "Permission denied"}}
+	p.kv = kv
+	require.NoError(t, parseDirtyFlushTimeoutOption(p, "5s"))
+
+	require.NoError(t, p.Close())
+	assert.Empty(t, p.dirty)
+	assert.Contains(t, kv.data, p.recordKey(mac))
+	assert.True(t, p.draining)
+}
+
+func TestCloseGivesUpOnDirtyRecords(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 5))
+	p.dirty = map[string]struct{}{mac.String(): {}}
+	p.kv = &failingKV{memKV: p.kv.(*memKV), failures: 1000, err: api.StatusError{Code: http.StatusForbidden, Body: "Permission denied"}}
+	require.NoError(t, parseDirtyFlushTimeoutOption(p, "100ms"))
+
+	start := time.Now()
+	assert.Error(t, p.Close())
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Contains(t, p.dirty, mac.String())
+	assert.False(t, p.draining, "an instance that failed to flush must keep serving")
+}
+
+func TestParseDirtyFlushOptions(t *testing.T) {
+	p := &PluginState{}
+	assert.Error(t, parseDirtyFlushIntervalOption(p, "0s"))
+	assert.Error(t, parseDirtyFlushTimeoutOption(p, "-1s"))
+	require.NoError(t, parseDirtyFlushIntervalOption(p, "5s"))
+	assert.Equal(t, 5*time.Second, p.dirtyFlushInterval)
+}
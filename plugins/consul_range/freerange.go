@@ -0,0 +1,77 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// errInvalidFreeRange is returned when the block to free isn't a block of the range
+var errInvalidFreeRange = errors.New("invalid block")
+
+// freeRange ends all leases of addresses from start to end, pinned ones
+// included, deleting their records from memory and Consul and returning their
+// addresses to the pool, e.g. to retire a block of the range. It returns the
+// number of leases freed, which may be short of them all if Consul fails.
+func (p *PluginState) freeRange(ctx context.Context, start, end net.IP) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	if compareIP(start, end) > 0 {
+		return 0, fmt.Errorf("%w: start %s is above end %s", errInvalidFreeRange, start, end)
+	}
+	if !p.inRange(start) || !p.inRange(end) {
+		return 0, fmt.Errorf("%w: %s-%s is not within range %s-%s", errInvalidFreeRange, start, end, p.rangeStart, p.rangeEnd)
+	}
+	var macs []string
+	for mac, rec := range p.Recordsv4 {
+		if compareIP(start, rec.IP) <= 0 && compareIP(rec.IP, end) <= 0 {
+			macs = append(macs, mac)
+		}
+	}
+	sort.Slice(macs, func(i, j int) bool {
+		return compareIP(p.Recordsv4[macs[i]].IP, p.Recordsv4[macs[j]].IP) < 0
+	})
+	for n, mac := range macs {
+		rec := p.Recordsv4[mac]
+		if err := p.removeLease(ctx, mac, rec); err != nil {
+			return n, fmt.Errorf("could not free lease %s for MAC %s: %w", rec.IP, p.logMAC(mac), err)
+		}
+		p.emit(eventRelease, mac, rec)
+	}
+	log.Printf("Freed %d leases in %s-%s", len(macs), start, end)
+	return len(macs), nil
+}
+
+// serveFreeRange frees the leases of the block from the "start" to the "end"
+// query parameters, see freeRange
+func (p *PluginState) serveFreeRange(w http.ResponseWriter, r *http.Request) {
+	start, err := parseIPv4(r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "missing or invalid start", http.StatusBadRequest)
+		return
+	}
+	end, err := parseIPv4(r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "missing or invalid end", http.StatusBadRequest)
+		return
+	}
+	n, err := p.freeRange(r.Context(), start, end)
+	switch {
+	case errors.Is(err, errInvalidFreeRange):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("freed %d leases, then %v", n, err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Freed int `json:"freed"`
+	}{n}); err != nil {
+		log.Warningf("Failed to write free-range response: %v", err)
+	}
+}
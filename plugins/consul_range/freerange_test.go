@@ -0,0 +1,72 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFreeRange(t *testing.T) {
+	p := testPluginState(t)
+	var macs []net.HardwareAddr
+	for i := range 5 {
+		mac := net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)}
+		req, stub := testRequest(t, mac)
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		macs = append(macs, mac)
+	}
+	p.Recordsv4[macs[2].String()].Pinned = true
+	hook := &recordingHook{}
+	p.addHook(hook)
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	res, err := authorizedPost(srv.URL+"/leases/free-range?start=10.0.0.2&end=10.0.0.4", "", nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var body struct {
+		Freed int `json:"freed"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, 3, body.Freed)
+
+	kv := p.kv.(*memKV)
+	for i, mac := range macs {
+		freed := i >= 1 && i <= 3
+		_, held := p.Recordsv4[mac.String()]
+		assert.Equal(t, !freed, held, mac)
+		_, stored := kv.data[p.recordKey(mac)]
+		assert.Equal(t, !freed, stored, mac)
+	}
+	assert.Equal(t, []eventType{eventRelease, eventRelease, eventRelease}, hook.types())
+	for _, last := range []byte{2, 3, 4} {
+		ip, err := p.allocator.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, last)})
+		require.NoError(t, err)
+		assert.True(t, ip.IP.Equal(net.IPv4(10, 0, 0, last)), "a freed address must be allocatable")
+	}
+}
+
+func TestFreeRangeInvalid(t *testing.T) {
+	p := testPluginState(t)
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	for _, query := range []string{
+		"",
+		"?start=10.0.0.2",
+		"?start=10.0.0.5&end=10.0.0.2",
+		"?start=10.0.0.5&end=10.0.0.20",
+		"?start=9.255.255.255&end=10.0.0.2",
+	} {
+		res, err := authorizedPost(srv.URL+"/leases/free-range"+query, "", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+	}
+}
@@ -0,0 +1,198 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// handoffConfigKey is the name of the plugin state entry holding the handoff marker
+const handoffConfigKey = "handoff"
+
+// handoffMarker is written by an instance once it has handed its leases over
+type handoffMarker struct {
+	Generation uint64    `json:"generation"`
+	Time       time.Time `json:"time"`
+}
+
+func parseAwaitHandoffOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("handoff timeout must be positive: %s", d)
+	}
+	p.awaitHandoff = d
+	return nil
+}
+
+// persist saves a lease record to Consul, remembering it as dirty if that
+// fails so that it gets flushed on handoff. With the dedupe-writes option, a
+// record identical to the one last written isn't written again.
+// Must be called with the plugin lock held.
+func (p *PluginState) persist(ctx context.Context, mac net.HardwareAddr, record *Record) error {
+	if p.unchanged(mac.String(), record) {
+		p.metrics.writesDeduplicated.Inc()
+		return nil
+	}
+	if err := p.saveIPAddress(ctx, mac, record); err != nil {
+		p.markDirty(mac.String(), err)
+		return err
+	}
+	delete(p.dirty, mac.String())
+	delete(p.merged, mac.String())
+	return nil
+}
+
+// Close hands the leases of a draining instance over to a peer: it stops
+// serving requests, flushes the records whose writes to Consul failed, and
+// bumps the handoff generation a peer started with await-handoff waits for.
+// Flushing is retried for up to dirty-flush-timeout; if it fails, the instance
+// keeps serving.
+func (p *PluginState) Close() error {
+	return p.handoff(context.Background())
+}
+
+func (p *PluginState) handoff(ctx context.Context) error {
+	// Requests are dropped from now on, the records can only change in the
+	// background while they are flushed
+	p.Lock()
+	p.draining = true
+	p.Unlock()
+	err := p.flushDirtyWithin(ctx)
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		p.draining = false
+		return err
+	}
+
+	key := p.configKey(handoffConfigKey)
+	var marker handoffMarker
+	pair, _, err := p.kv.Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		p.draining = false
+		return fmt.Errorf("failed to read handoff marker from consul: %w", err)
+	}
+	if pair != nil {
+		if err := json.Unmarshal(pair.Value, &marker); err != nil {
+			log.Warningf("Overwriting invalid handoff marker %s: %v", key, err)
+		}
+	}
+	marker.Generation++
+	marker.Time = p.now().UTC()
+	data, err := json.Marshal(marker)
+	if err != nil {
+		p.draining = false
+		return err
+	}
+	if _, err := p.kv.Put(&api.KVPair{Key: key, Value: data}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		p.draining = false
+		return fmt.Errorf("failed to store handoff marker in consul: %w", err)
+	}
+	log.Printf("Handed off %d leases, generation %d", len(p.Recordsv4), marker.Generation)
+	return nil
+}
+
+// handoffWatch is the handoff marker as read at startup
+type handoffWatch struct {
+	// baseline is the ModifyIndex of the marker, 0 if there was none
+	baseline uint64
+	// index is the Consul index to watch the marker from
+	index uint64
+}
+
+// readHandoffMarker blocks allocation of new leases until a peer hands its
+// leases over by bumping the handoff marker, or until the timeout elapses.
+// The current marker is read synchronously, before the records are loaded, so
+// that no handoff is missed. The marker is then watched by startHandoffWatch.
+func (p *PluginState) readHandoffMarker() (handoffWatch, error) {
+	pair, meta, err := p.kv.Get(p.configKey(handoffConfigKey), nil)
+	if err != nil {
+		return handoffWatch{}, fmt.Errorf("failed to read handoff marker from consul: %w", err)
+	}
+	w := handoffWatch{index: meta.LastIndex}
+	if pair != nil {
+		w.baseline = pair.ModifyIndex
+	}
+	p.awaitingHandoff = true
+	log.Printf("Waiting up to %s for a peer to hand its leases over", p.awaitHandoff)
+	return w, nil
+}
+
+// startHandoffWatch adopts the leases of a peer once it bumps the handoff
+// marker past w. It must be started once the records are loaded and their
+// addresses re-allocated, adopting them would race with setup otherwise.
+func (p *PluginState) startHandoffWatch(w handoffWatch) {
+	key := p.configKey(handoffConfigKey)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.awaitHandoff)
+		defer cancel()
+		index := w.index
+		for {
+			pair, meta, err := p.kv.Get(key, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				log.Warningf("No handoff after %s, allocating anyway", p.awaitHandoff)
+				break
+			}
+			if err != nil {
+				log.Warningf("Could not watch handoff marker: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			if pair != nil && pair.ModifyIndex > w.baseline {
+				if err := p.adoptHandoff(ctx); err != nil {
+					log.Errorf("Could not load handed over leases: %v", err)
+				}
+				break
+			}
+			index = meta.LastIndex
+		}
+		p.Lock()
+		p.awaitingHandoff = false
+		p.Unlock()
+	}()
+}
+
+// adoptHandoff loads the leases handed over by a peer, which supersede the
+// copies read at startup
+func (p *PluginState) adoptHandoff(ctx context.Context) error {
+	stored, _, err := p.loadRecords()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	for mac, rec := range stored {
+		if cur, ok := p.Recordsv4[mac]; ok {
+			if cur.IP.Equal(rec.IP) {
+				*cur = *rec
+				continue
+			}
+			if p.inRange(cur.IP) {
+				if err := p.allocator.Free(net.IPNet{IP: cur.IP, Mask: net.CIDRMask(32, 32)}); err != nil {
+					log.Warningf("Could not free %s for MAC %s: %v", cur.IP, p.logMAC(mac), err)
+				}
+			}
+		}
+		if p.inRange(rec.IP) {
+			ip, err := p.allocator.Allocate(net.IPNet{IP: rec.IP})
+			if err != nil {
+				return fmt.Errorf("could not allocate handed over ip %s: %w", rec.IP, err)
+			}
+			if !ip.IP.Equal(rec.IP) {
+				_ = p.allocator.Free(ip)
+				log.Errorf("Handed over lease %s for MAC %s is already allocated", rec.IP, p.logMAC(mac))
+			}
+		}
+		p.setRecord(mac, rec)
+	}
+	log.Printf("Adopted %d handed over leases", len(stored))
+	return nil
+}
@@ -0,0 +1,112 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandoff(t *testing.T) {
+	kv := newMemKV()
+	draining := testPluginState(t)
+	draining.kv = kv
+	persisted := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, persisted)
+	resp, _ := draining.Handler4(req, stub)
+	require.NotNil(t, resp)
+	persistedIP := resp.YourIPAddr
+	// A lease whose write to Consul failed
+	dirty := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	testLease(t, draining, dirty, net.IPv4(10, 0, 0, 5))
+	draining.dirty = map[string]struct{}{dirty.String(): {}}
+
+	incoming := testPluginState(t)
+	incoming.kv = kv
+	incoming.awaitHandoff = 5 * time.Second
+	w, err := incoming.readHandoffMarker()
+	require.NoError(t, err)
+	incoming.startHandoffWatch(w)
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3})
+	resp, _ = incoming.Handler4(req, stub)
+	assert.Nil(t, resp, "allocation must wait for the handoff")
+
+	require.NoError(t, draining.Close())
+	assert.Empty(t, draining.dirty)
+	req, stub = testRequest(t, persisted)
+	resp, _ = draining.Handler4(req, stub)
+	assert.Nil(t, resp, "a drained instance must not serve")
+
+	require.Eventually(t, func() bool {
+		incoming.Lock()
+		defer incoming.Unlock()
+		return !incoming.awaitingHandoff
+	}, 5*time.Second, 10*time.Millisecond)
+	incoming.Lock()
+	require.Contains(t, incoming.Recordsv4, persisted.String())
+	assert.True(t, incoming.Recordsv4[persisted.String()].IP.Equal(persistedIP))
+	require.Contains(t, incoming.Recordsv4, dirty.String(), "the dirty lease was not flushed")
+	assert.True(t, incoming.Recordsv4[dirty.String()].IP.Equal(net.IPv4(10, 0, 0, 5)))
+	incoming.Unlock()
+
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3})
+	resp, _ = incoming.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.False(t, resp.YourIPAddr.Equal(persistedIP))
+	assert.False(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 5)))
+}
+
+func TestHandoffDuringStartup(t *testing.T) {
+	kv := newMemKV()
+	draining := testPluginState(t)
+	draining.kv = kv
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, draining, mac, net.IPv4(10, 0, 0, 5))
+	draining.dirty = map[string]struct{}{mac.String(): {}}
+
+	incoming := testPluginState(t)
+	incoming.kv = kv
+	incoming.awaitHandoff = 5 * time.Second
+	w, err := incoming.readHandoffMarker()
+	require.NoError(t, err)
+	// The peer hands over while the records are being loaded
+	require.NoError(t, draining.Close())
+	incoming.startHandoffWatch(w)
+
+	require.Eventually(t, func() bool {
+		incoming.Lock()
+		defer incoming.Unlock()
+		return !incoming.awaitingHandoff
+	}, 5*time.Second, 10*time.Millisecond)
+	incoming.Lock()
+	defer incoming.Unlock()
+	require.Contains(t, incoming.Recordsv4, mac.String(), "the handoff was missed")
+	assert.True(t, incoming.Recordsv4[mac.String()].IP.Equal(net.IPv4(10, 0, 0, 5)))
+}
+
+func TestHandoffFlushFailure(t *testing.T) {
+	p := testPluginState(t)
+	p.kv = denyingKV{newMemKV()}
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+	p.dirty = map[string]struct{}{mac.String(): {}}
+
+	assert.Error(t, p.Close())
+	assert.False(t, p.draining, "an instance that failed to hand over must keep serving")
+	assert.Contains(t, p.dirty, mac.String())
+}
+
+func TestAwaitHandoffTimeout(t *testing.T) {
+	p := testPluginState(t)
+	p.awaitHandoff = 50 * time.Millisecond
+	w, err := p.readHandoffMarker()
+	require.NoError(t, err)
+	p.startHandoffWatch(w)
+	assert.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return !p.awaitingHandoff
+	}, 5*time.Second, 10*time.Millisecond)
+}
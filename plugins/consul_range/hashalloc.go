@@ -0,0 +1,72 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"strconv"
+)
+
+func parseHashAllocationOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.hashAllocation = enabled
+	return nil
+}
+
+// allocateFor is allocate for the client of lease key mac. With
+// lease-affinity set, a client whose lease recently ended first gets its
+// former address back. With hash-allocation set, the client then gets the
+// address its key hashes to within pool, so that it tends to get the same
+// address even if its lease record is lost; if that address is taken, the
+// next free one is allocated as usual.
+// Must be called with the plugin lock held.
+func (p *PluginState) allocateFor(mac string, pool *classPool) (net.IPNet, error) {
+	if ip := p.allocateAffine(mac, pool); ip != nil {
+		return net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	if p.hashAllocation && p.migration == nil {
+		if ip := p.hashedAddress(mac, pool); ip != nil {
+			got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+			if err == nil && got.IP.Equal(ip) {
+				return got, nil
+			}
+			if err == nil {
+				_ = p.allocator.Free(got)
+			}
+			log.Debugf("Address %s hashed from MAC %s is taken, allocating the next free one", ip, p.logMAC(mac))
+		}
+	}
+	return p.allocate(pool)
+}
+
+// hashedAddress maps the hash of lease key mac into pool, or into the default
+// pool if pool is nil. It returns nil if the pool is empty.
+// Must be called with the plugin lock held.
+func (p *PluginState) hashedAddress(mac string, pool *classPool) net.IP {
+	ranges := p.defaultPool()
+	if pool != nil {
+		ranges = [][2]net.IP{{pool.start, pool.end}}
+	}
+	var size uint64
+	for _, r := range ranges {
+		size += uint64(binary.BigEndian.Uint32(r[1].To4())-binary.BigEndian.Uint32(r[0].To4())) + 1
+	}
+	if size == 0 {
+		return nil
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(mac))
+	n := h.Sum64() % size
+	for _, r := range ranges {
+		start := binary.BigEndian.Uint32(r[0].To4())
+		if span := uint64(binary.BigEndian.Uint32(r[1].To4())-start) + 1; n >= span {
+			n -= span
+			continue
+		}
+		return uint32ToIP(start + uint32(n))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hashLease leases an address to mac with hash-allocation enabled
+func hashLease(t *testing.T, p *PluginState, mac net.HardwareAddr) net.IP {
+	t.Helper()
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	return resp.YourIPAddr
+}
+
+func TestHashAllocationDeterministic(t *testing.T) {
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 42}
+	var first net.IP
+	for range 2 {
+		// A fresh state each time, as if the lease records were lost
+		p := testPluginState(t)
+		require.NoError(t, parseHashAllocationOption(p, "true"))
+		p.Lock()
+		want := p.hashedAddress(mac.String(), nil)
+		p.Unlock()
+		ip := hashLease(t, p, mac)
+		assert.Equal(t, want.String(), ip.String())
+		if first != nil {
+			assert.Equal(t, first.String(), ip.String())
+		}
+		first = ip
+	}
+}
+
+func TestHashAllocationCollisionFallsBack(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseHashAllocationOption(p, "true"))
+
+	// Find two clients hashing to the same address
+	seen := make(map[string]net.HardwareAddr)
+	var a, b net.HardwareAddr
+	for i := 0; b == nil; i++ {
+		mac := net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)}
+		p.Lock()
+		ip := p.hashedAddress(mac.String(), nil).String()
+		p.Unlock()
+		if other, ok := seen[ip]; ok {
+			a, b = other, mac
+		}
+		seen[ip] = mac
+	}
+	p.Lock()
+	hashed := p.hashedAddress(a.String(), nil)
+	p.Unlock()
+	assert.Equal(t, hashed.String(), hashLease(t, p, a).String())
+	got := hashLease(t, p, b)
+	assert.NotEqual(t, hashed.String(), got.String())
+	assert.True(t, p.inRange(got))
+}
+
+func TestHashAllocationWithinClassPool(t *testing.T) {
+	p := testClassPluginState(t)
+	require.NoError(t, parseHashAllocationOption(p, "true"))
+	for i := byte(1); i <= 3; i++ {
+		ip := classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 9, i}, "staff").To4()
+		require.NotNil(t, ip)
+		assert.True(t, compareIP(ip, net.IPv4(10, 0, 0, 8)) >= 0 && compareIP(ip, net.IPv4(10, 0, 0, 10)) <= 0, "%s is outside the staff pool", ip)
+	}
+	// The pool is full, there is no fallback outside of it
+	assert.Nil(t, classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 9, 4}, "staff"))
+	ip := classLease(t, p, net.HardwareAddr{2, 0, 0, 0, 9, 5}, "")
+	assert.True(t, compareIP(ip, net.IPv4(10, 0, 0, 4)) >= 0 && compareIP(ip, net.IPv4(10, 0, 0, 7)) <= 0, "%s is outside the default pool", ip)
+}
@@ -0,0 +1,147 @@
+package consulrangeplugin
+
+import (
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// maxHistoryClients bounds the number of clients whose requests are kept
+	maxHistoryClients = 4096
+	// maxRequestHistory bounds the number of requests kept per client
+	maxRequestHistory = 64
+)
+
+// requestDump is a request as received from a client, for forensic analysis
+type requestDump struct {
+	Time        time.Time `json:"time"`
+	MessageType string    `json:"message_type"`
+	// Options are the raw options of the request, hex encoded
+	Options string `json:"options"`
+}
+
+// requestRing holds the last requests of a client, overwriting the oldest
+type requestRing struct {
+	mac   string
+	dumps []requestDump
+	next  int
+}
+
+// requestHistory keeps the last size requests of each client, so that the
+// requests leading to an intermittent issue can be replayed. It is protected
+// by the plugin lock.
+type requestHistory struct {
+	size    int
+	clients map[string]*list.Element
+	// recent orders the requestRings of clients, heard from most recently first
+	recent *list.List
+}
+
+// identifyingOptions are the options identifying a client besides its MAC
+// address: the client identifier and the relay agent information, holding
+// e.g. the circuit and subscriber the client connects through
+var identifyingOptions = []dhcpv4.OptionCode{dhcpv4.OptionClientIdentifier, dhcpv4.OptionRelayAgentInformation}
+
+func parseRequestHistoryOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 || n > maxRequestHistory {
+		return fmt.Errorf("request history must be between 1 and %d, got %d", maxRequestHistory, n)
+	}
+	p.history.size = n
+	return nil
+}
+
+// historyOptions returns the options of req as kept in the request history.
+// When MAC addresses are anonymized, so is the content of the options
+// identifying the client, replaced by its truncated HMAC.
+func (p *PluginState) historyOptions(req *dhcpv4.DHCPv4) dhcpv4.Options {
+	if p.history.size == 0 || len(p.macHashKey) == 0 {
+		return req.Options
+	}
+	opts := make(dhcpv4.Options, len(req.Options))
+	for code, value := range req.Options {
+		opts[code] = value
+	}
+	for _, code := range identifyingOptions {
+		if value, ok := opts[code.Code()]; ok {
+			opts[code.Code()] = p.keyedHash(value)
+		}
+	}
+	return opts
+}
+
+// record keeps a request of mac with options as its latest. When too many
+// clients are tracked, the one heard from least recently is forgotten.
+func (h *requestHistory) record(mac string, req *dhcpv4.DHCPv4, options dhcpv4.Options, now time.Time) {
+	if h.size == 0 {
+		return
+	}
+	if h.clients == nil {
+		h.clients = make(map[string]*list.Element)
+		h.recent = list.New()
+	}
+	var ring *requestRing
+	if e, ok := h.clients[mac]; ok {
+		h.recent.MoveToFront(e)
+		ring = e.Value.(*requestRing)
+	} else {
+		if len(h.clients) >= maxHistoryClients {
+			oldest := h.recent.Back()
+			delete(h.clients, h.recent.Remove(oldest).(*requestRing).mac)
+		}
+		ring = &requestRing{mac: mac, dumps: make([]requestDump, 0, h.size)}
+		h.clients[mac] = h.recent.PushFront(ring)
+	}
+	dump := requestDump{
+		Time:        now,
+		MessageType: req.MessageType().String(),
+		Options:     hex.EncodeToString(options.ToBytes()),
+	}
+	if len(ring.dumps) < h.size {
+		ring.dumps = append(ring.dumps, dump)
+	} else {
+		ring.dumps[ring.next] = dump
+	}
+	ring.next = (ring.next + 1) % h.size
+}
+
+// requests returns the requests kept for mac, oldest first
+func (h *requestHistory) requests(mac string) []requestDump {
+	e, ok := h.clients[mac]
+	if !ok {
+		return nil
+	}
+	ring := e.Value.(*requestRing)
+	if len(ring.dumps) < h.size {
+		return append([]requestDump(nil), ring.dumps...)
+	}
+	return append(append([]requestDump(nil), ring.dumps[ring.next:]...), ring.dumps[:ring.next]...)
+}
+
+func (p *PluginState) serveHistory(w http.ResponseWriter, r *http.Request) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	p.Lock()
+	dumps := p.history.requests(mac.String())
+	p.Unlock()
+	if dumps == nil {
+		http.Error(w, "no request history", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dumps); err != nil {
+		log.Warningf("Failed to write request history: %v", err)
+	}
+}
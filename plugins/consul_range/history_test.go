@@ -0,0 +1,139 @@
+package consulrangeplugin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestHistory(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	require.NoError(t, parseRequestHistoryOption(p, "3"))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	var sent []*dhcpv4.DHCPv4
+	for i := range 5 {
+		req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName(fmt.Sprintf("host%d", i))))
+		_, _ = p.Handler4(req, stub)
+		sent = append(sent, req)
+		clock.Advance(time.Second)
+	}
+
+	res, err := http.Get(srv.URL + "/leases/" + mac.String() + "/history")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var dumps []requestDump
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dumps))
+
+	// Only the last 3 requests are kept, oldest first
+	require.Len(t, dumps, 3)
+	for i, d := range dumps {
+		req := sent[i+2]
+		assert.Equal(t, "REQUEST", d.MessageType)
+		assert.True(t, d.Time.Equal(newFakeClock().Now().Add(time.Duration(i+2)*time.Second)))
+		raw, err := hex.DecodeString(d.Options)
+		require.NoError(t, err)
+		assert.Equal(t, req.Options.ToBytes(), raw)
+		// The dump can be replayed
+		opts := dhcpv4.Options{}
+		require.NoError(t, opts.FromBytes(raw))
+		assert.Equal(t, req.HostName(), dhcpv4.GetString(dhcpv4.OptionHostName, opts))
+	}
+
+	res, err = http.Get(srv.URL + "/leases/02:00:00:00:00:02/history")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestRequestHistoryBoundsClients(t *testing.T) {
+	h := requestHistory{size: 1}
+	req, _ := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	now := time.Now()
+	for i := range maxHistoryClients + 1 {
+		h.record(net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)}.String(), req, req.Options, now.Add(time.Duration(i)*time.Second))
+	}
+	assert.Len(t, h.clients, maxHistoryClients)
+	// The client heard from least recently was forgotten
+	assert.Nil(t, h.requests("02:00:00:00:00:00"))
+	assert.Len(t, h.requests("02:00:00:00:00:01"), 1)
+}
+
+func TestRequestHistoryKeepsRecentClients(t *testing.T) {
+	h := requestHistory{size: 1}
+	req, _ := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	now := time.Now()
+	for i := range maxHistoryClients {
+		h.record(net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)}.String(), req, req.Options, now)
+	}
+	// Hearing from the first client again makes the second the oldest
+	h.record("02:00:00:00:00:00", req, req.Options, now)
+	h.record("02:00:00:00:ff:ff", req, req.Options, now)
+	assert.Len(t, h.clients, maxHistoryClients)
+	assert.Len(t, h.requests("02:00:00:00:00:00"), 1)
+	assert.Nil(t, h.requests("02:00:00:00:00:01"))
+}
+
+func TestRequestHistoryAnonymized(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseRequestHistoryOption(p, "1"))
+	require.NoError(t, parseMACHashKeyOption(p, "secret"))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	clientID := []byte{1, 2, 0, 0, 0, 0, 1}
+	circuit := dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth0/1/subscriber-42")))
+	req, stub := testRequest(t, mac,
+		dhcpv4.WithOption(dhcpv4.OptClientIdentifier(clientID)),
+		dhcpv4.WithOption(circuit),
+		dhcpv4.WithOption(dhcpv4.OptHostName("host")))
+	_, _ = p.Handler4(req, stub)
+
+	res, err := http.Get(srv.URL + "/leases/" + mac.String() + "/history")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var dumps []requestDump
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dumps))
+	require.Len(t, dumps, 1)
+	raw, err := hex.DecodeString(dumps[0].Options)
+	require.NoError(t, err)
+	opts := dhcpv4.Options{}
+	require.NoError(t, opts.FromBytes(raw))
+
+	assert.Equal(t, p.keyedHash(clientID), opts.Get(dhcpv4.OptionClientIdentifier))
+	assert.Equal(t, p.keyedHash(circuit.Value.ToBytes()), opts.Get(dhcpv4.OptionRelayAgentInformation))
+	assert.NotContains(t, string(raw), "subscriber-42")
+	// Other options are kept as received
+	assert.Equal(t, "host", dhcpv4.GetString(dhcpv4.OptionHostName, opts))
+	// The request itself is left alone
+	assert.Equal(t, clientID, req.Options.Get(dhcpv4.OptionClientIdentifier))
+}
+
+func TestRequestHistoryDisabled(t *testing.T) {
+	p := testPluginState(t)
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	_, _ = p.Handler4(req, stub)
+	assert.Empty(t, p.history.clients)
+}
+
+func TestParseRequestHistoryOption(t *testing.T) {
+	p := &PluginState{}
+	assert.Error(t, parseRequestHistoryOption(p, "0"))
+	assert.Error(t, parseRequestHistoryOption(p, "65"))
+	assert.Error(t, parseRequestHistoryOption(p, "all"))
+}
@@ -0,0 +1,48 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func parseMaxPerHostnameOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("maximum must be positive, got %d", n)
+	}
+	p.maxPerHostname = n
+	return nil
+}
+
+// hostnameLeases returns how many leases are recorded under hostname, compared
+// case-insensitively as DNS names are.
+// Must be called with the plugin lock held.
+func (p *PluginState) hostnameLeases(hostname string) int {
+	n := 0
+	for _, rec := range p.Recordsv4 {
+		if strings.EqualFold(rec.Hostname, hostname) {
+			n++
+		}
+	}
+	return n
+}
+
+// hostnameCapped reports whether a new lease for a client sending hostname
+// must be refused because as many leases as allowed already use it. Generated
+// hostnames are unique, so only those sent by clients are capped.
+// Must be called with the plugin lock held.
+func (p *PluginState) hostnameCapped(mac, hostname string) bool {
+	if p.maxPerHostname == 0 || hostname == "" {
+		return false
+	}
+	if n := p.hostnameLeases(hostname); n >= p.maxPerHostname {
+		p.metrics.hostnameCapped.Inc()
+		log.Warningf("Refusing a lease to MAC %s, %d leases already use hostname %q", p.logMAC(mac), n, hostname)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxLeasesPerHostname(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseMaxPerHostnameOption(p, "2"))
+	request := func(mac net.HardwareAddr, hostname string) *dhcpv4.DHCPv4 {
+		req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+		resp, _ := p.Handler4(req, stub)
+		return resp
+	}
+
+	require.NotNil(t, request(net.HardwareAddr{2, 0, 0, 0, 0, 1}, "printer"))
+	require.NotNil(t, request(net.HardwareAddr{2, 0, 0, 0, 0, 2}, "printer"))
+	third := net.HardwareAddr{2, 0, 0, 0, 0, 3}
+	assert.Nil(t, request(third, "Printer"), "the third MAC sharing the hostname must be refused")
+	assert.NotContains(t, p.Recordsv4, third.String())
+	assert.Equal(t, uint64(1), p.metrics.hostnameCapped.Value())
+
+	// Existing leases renew, other hostnames are unaffected
+	assert.NotNil(t, request(net.HardwareAddr{2, 0, 0, 0, 0, 1}, "printer"))
+	assert.NotNil(t, request(third, "scanner"))
+}
+
+func TestParseMaxPerHostnameOption(t *testing.T) {
+	for _, value := range []string{"0", "-1", "many"} {
+		assert.Error(t, parseMaxPerHostnameOption(&PluginState{}, value), value)
+	}
+}
@@ -0,0 +1,196 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// hostnamePlaceholders are the placeholders substituted in hostname templates
+var hostnamePlaceholders = []string{"{ip}", "{octet}", "{offset}"}
+
+// validHostname matches dot separated labels of letters, digits and hyphens
+var validHostname = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+func parseHostnameOption(p *PluginState, value string) error {
+	found := false
+	for _, placeholder := range hostnamePlaceholders {
+		found = found || strings.Contains(value, placeholder)
+	}
+	if !found {
+		return fmt.Errorf("template %q has no placeholder, want one of %s", value, strings.Join(hostnamePlaceholders, ", "))
+	}
+	// Substituted values are made of digits and hyphens, a sample catches the rest
+	if sample := expandHostname(value, net.IPv4(10, 0, 0, 1), 0); !validHostname.MatchString(sample) || len(sample) > 253 {
+		return fmt.Errorf("template %q does not produce valid hostnames, e.g. %q", value, sample)
+	}
+	p.hostnameTemplate = value
+	return nil
+}
+
+// expandHostname substitutes the placeholders of a hostname template for ip,
+// at offset from the start of the range
+func expandHostname(template string, ip net.IP, offset uint32) string {
+	ip = ip.To4()
+	return strings.NewReplacer(
+		"{ip}", strings.ReplaceAll(ip.String(), ".", "-"),
+		"{octet}", strconv.Itoa(int(ip[3])),
+		"{offset}", strconv.FormatUint(uint64(offset), 10),
+	).Replace(template)
+}
+
+// invalidHostname selects what to do with client hostnames that aren't valid DNS names
+type invalidHostname int
+
+const (
+	// invalidHostnameSanitize replaces invalid characters and truncates overlong names
+	invalidHostnameSanitize invalidHostname = iota
+	// invalidHostnameDrop records no hostname
+	invalidHostnameDrop
+	// invalidHostnameKeep records the hostname as sent
+	invalidHostnameKeep
+)
+
+func parseInvalidHostnameOption(p *PluginState, value string) error {
+	switch value {
+	case "sanitize":
+		p.invalidHostname = invalidHostnameSanitize
+	case "drop":
+		p.invalidHostname = invalidHostnameDrop
+	case "keep":
+		p.invalidHostname = invalidHostnameKeep
+	default:
+		return fmt.Errorf("unknown behavior %q, want sanitize, drop or keep", value)
+	}
+	return nil
+}
+
+// maxHostnameLabel and maxHostname are the DNS limits on the length of a label and a name
+const (
+	maxHostnameLabel = 63
+	maxHostname      = 253
+)
+
+// sanitizeHostname turns name into a valid DNS name: characters other than
+// letters, digits and hyphens are replaced by hyphens, runs of them are
+// collapsed, labels are trimmed to 63 characters and the name to 253 by
+// dropping trailing labels. It returns "" if nothing valid is left.
+func sanitizeHostname(name string) string {
+	var labels []string
+	size := -1
+	for _, label := range strings.Split(name, ".") {
+		var b strings.Builder
+		hyphen := false
+		for _, r := range label {
+			if r < 0x80 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				b.WriteRune(r)
+				hyphen = false
+			} else if !hyphen {
+				b.WriteByte('-')
+				hyphen = true
+			}
+		}
+		label = b.String()
+		if len(label) > maxHostnameLabel {
+			label = label[:maxHostnameLabel]
+		}
+		label = strings.Trim(label, "-")
+		if label == "" {
+			continue
+		}
+		if size+1+len(label) > maxHostname {
+			break
+		}
+		size += 1 + len(label)
+		labels = append(labels, label)
+	}
+	return strings.Join(labels, ".")
+}
+
+// clientHostname returns the hostname sent by the client of req, handled per
+// the invalid-hostname option if it isn't a valid DNS name
+func (p *PluginState) clientHostname(req *dhcpv4.DHCPv4) string {
+	raw := req.HostName()
+	if raw == "" || p.invalidHostname == invalidHostnameKeep || validHostname.MatchString(raw) && len(raw) <= maxHostname {
+		return raw
+	}
+	name := ""
+	if p.invalidHostname == invalidHostnameSanitize {
+		name = sanitizeHostname(raw)
+	}
+	log.Debugf("Replacing invalid hostname %q of MAC %s with %q", raw, p.logMAC(req.ClientHWAddr.String()), name)
+	return name
+}
+
+// hostnameFor returns the hostname to record for the client of req leased ip:
+// the one it sent, or one generated from the hostname template if it sent
+// none, or an invalid one that was dropped.
+// Must be called with the plugin lock held.
+func (p *PluginState) hostnameFor(req *dhcpv4.DHCPv4, ip net.IP) string {
+	if name := p.clientHostname(req); name != "" || p.hostnameTemplate == "" {
+		return name
+	}
+	offset := binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(p.rangeStart)
+	return expandHostname(p.hostnameTemplate, ip, offset)
+}
+
+// hostnamePolicy selects how a renewal updates the hostname recorded for a
+// client that renews with another one
+type hostnamePolicy int
+
+const (
+	// hostnameAlways records the hostname of every renewal
+	hostnameAlways hostnamePolicy = iota
+	// hostnameNever keeps the first hostname recorded for the lease
+	hostnameNever
+	// hostnameLog records the hostname of every renewal, logging changes
+	hostnameLog
+)
+
+func parseHostnamePolicyOption(p *PluginState, value string) error {
+	switch value {
+	case "always":
+		p.hostnamePolicy = hostnameAlways
+	case "never":
+		p.hostnamePolicy = hostnameNever
+	case "log":
+		p.hostnamePolicy = hostnameLog
+	default:
+		return fmt.Errorf("unknown hostname-policy %q, want always, never or log", value)
+	}
+	return nil
+}
+
+// renewHostname updates the hostname of the renewed lease of mac to name as
+// the hostname policy says. Under the never and log policies, renewing with
+// another hostname than the one recorded emits a hostname event.
+// Must be called with the plugin lock held.
+func (p *PluginState) renewHostname(mac string, rec *Record, name string) {
+	if rec.Hostname == "" || name == "" || name == rec.Hostname {
+		// A client that stops sending its hostname keeps it under never
+		if p.hostnamePolicy != hostnameNever || rec.Hostname == "" {
+			rec.Hostname = name
+		}
+		return
+	}
+	if p.hostnamePolicy == hostnameAlways {
+		rec.Hostname = name
+		return
+	}
+	ev := p.leaseEvent(eventHostname, mac, rec)
+	ev.ClientHostname = name
+	switch p.hostnamePolicy {
+	case hostnameNever:
+		log.Printf("MAC %s renewed as %q, keeping hostname %q", p.logMAC(mac), name, rec.Hostname)
+	case hostnameLog:
+		log.Printf("MAC %s renamed itself from %q to %q", p.logMAC(mac), rec.Hostname, name)
+		rec.Hostname = name
+		ev.Hostname = name
+	}
+	p.emitEvent(ev)
+}
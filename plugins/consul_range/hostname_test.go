@@ -0,0 +1,154 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4GeneratesHostname(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseHostnameOption(p, "dhcp-{octet}.example.com"))
+
+	unnamed := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, unnamed)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "dhcp-1.example.com", resp.HostName())
+	assert.Equal(t, "dhcp-1.example.com", p.Recordsv4[unnamed.String()].Hostname)
+
+	named := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	req, stub = testRequest(t, named, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "laptop", p.Recordsv4[named.String()].Hostname, "client provided names must be preserved")
+
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, "dhcp-1.example.com", stored[unnamed.String()].Hostname, "generated name was not persisted")
+	assert.Equal(t, "laptop", stored[named.String()].Hostname)
+}
+
+func TestExpandHostname(t *testing.T) {
+	assert.Equal(t, "host-10-0-0-42", expandHostname("host-{ip}", net.IPv4(10, 0, 0, 42), 41))
+	assert.Equal(t, "n41.lan", expandHostname("n{offset}.lan", net.IPv4(10, 0, 0, 42), 41))
+}
+
+func TestParseHostnameOption(t *testing.T) {
+	for _, template := range []string{"static.example.com", "dhcp_{octet}", "-{ip}", "{ip}..lan"} {
+		assert.Error(t, parseHostnameOption(&PluginState{}, template), template)
+	}
+	assert.NoError(t, parseHostnameOption(&PluginState{}, "dhcp-{octet}.example.com"))
+}
+
+func TestHandler4SanitizesHostname(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName("evil host\x00\n/../leases.Ünïcode")))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "evil-host.leases.n-code", p.Recordsv4[mac.String()].Hostname)
+	assert.Equal(t, "evil-host.leases.n-code", resp.HostName(), "the sanitized name must be returned to the client")
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, "evil-host.leases.n-code", stored[mac.String()].Hostname)
+}
+
+func TestHandler4InvalidHostnameDrop(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseInvalidHostnameOption(p, "drop"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName("bad name")))
+	_, _ = p.Handler4(req, stub)
+	assert.Empty(t, p.Recordsv4[mac.String()].Hostname)
+}
+
+func TestSanitizeHostname(t *testing.T) {
+	for in, want := range map[string]string{
+		"laptop":                  "laptop",
+		"My Laptop":               "My-Laptop",
+		"--a__b--":                "a-b",
+		"host.example.com.":       "host.example.com",
+		"\x01\x02":                "",
+		strings.Repeat("a", 70):   strings.Repeat("a", 63),
+		strings.Repeat("ab.", 90): strings.TrimSuffix(strings.Repeat("ab.", 84), "."),
+	} {
+		got := sanitizeHostname(in)
+		assert.Equal(t, want, got, "%q", in)
+		assert.LessOrEqual(t, len(got), maxHostname)
+	}
+}
+
+func TestHostnamePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   string
+		events []leaseEvent
+	}{
+		{"always", "desktop", nil},
+		{"never", "laptop", []leaseEvent{{Type: eventHostname, Hostname: "laptop", ClientHostname: "desktop"}}},
+		{"log", "desktop", []leaseEvent{{Type: eventHostname, Hostname: "desktop", ClientHostname: "desktop"}}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			p := testPluginState(t)
+			require.NoError(t, parseHostnamePolicyOption(p, tc.policy))
+			clock := newFakeClock()
+			p.clock = clock.Now
+			mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+			renew := func(name string) {
+				req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName(name)))
+				resp, _ := p.Handler4(req, stub)
+				require.NotNil(t, resp)
+			}
+			renew("laptop")
+			hook := &recordingHook{}
+			p.addHook(hook)
+
+			clock.Advance(time.Minute)
+			renew("desktop")
+			assert.Equal(t, tc.want, p.Recordsv4[mac.String()].Hostname)
+			stored, err := loadRecords(p.kv, p.consulKVPrefix)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, stored[mac.String()].Hostname)
+
+			var events []leaseEvent
+			for _, ev := range hook.events {
+				if ev.Type == eventHostname {
+					events = append(events, leaseEvent{Type: ev.Type, Hostname: ev.Hostname, ClientHostname: ev.ClientHostname})
+				}
+			}
+			assert.Equal(t, tc.events, events)
+		})
+	}
+}
+
+func TestHostnamePolicyNeverRecordsFirst(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseHostnamePolicyOption(p, "never"))
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Empty(t, p.Recordsv4[mac.String()].Hostname)
+
+	// The first hostname sent is recorded, and kept when the client stops sending it
+	clock.Advance(time.Minute)
+	req, stub = testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptHostName("laptop")))
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, "laptop", p.Recordsv4[mac.String()].Hostname)
+	clock.Advance(time.Minute)
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, "laptop", p.Recordsv4[mac.String()].Hostname)
+
+	assert.Error(t, parseHostnamePolicyOption(p, "sometimes"))
+}
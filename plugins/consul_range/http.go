@@ -0,0 +1,216 @@
+package consulrangeplugin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func parseHTTPOption(p *PluginState, value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return err
+	}
+	p.httpAddr = value
+	return nil
+}
+
+func parseHTTPTokenOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("http-token must not be empty")
+	}
+	p.httpToken = value
+	return nil
+}
+
+// httpHandler returns the handler serving the plugin's HTTP API. Requests
+// other than GET and HEAD change leases or the pool, and are only served when
+// authorized with http-token, see authorize: the listener is shared with
+// read-only consumers such as metrics scrapers.
+func (p *PluginState) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", p.serveMetrics)
+	mux.HandleFunc("GET /healthz", p.serveHealthz)
+	mux.HandleFunc("GET /leases", p.serveLeases)
+	mux.HandleFunc("GET /leases.isc", p.serveISCLeases)
+	mux.HandleFunc("GET /leases/{ip}", p.serveLease)
+	mux.HandleFunc("POST /leases/{mac}/pin", p.servePin)
+	mux.HandleFunc("POST /leases/{mac}/unpin", p.serveUnpin)
+	mux.HandleFunc("PUT /leases/{mac}/tags", p.serveTags)
+	mux.HandleFunc("POST /leases/{mac}/move", p.serveMove)
+	mux.HandleFunc("POST /leases/free-range", p.serveFreeRange)
+	mux.HandleFunc("POST /leases/{mac}/touch", p.serveTouch)
+	mux.HandleFunc("PUT /leases/{mac}/sticky-floor", p.serveStickyFloor)
+	mux.HandleFunc("GET /leases/{mac}/history", p.serveHistory)
+	mux.HandleFunc("POST /reservations/by-ip", p.serveReserveByIP)
+	mux.HandleFunc("POST /resize", p.serveResize)
+	mux.HandleFunc("POST /handoff", p.serveHandoff)
+	mux.HandleFunc("POST /lease-time", p.serveLeaseTime)
+	mux.HandleFunc("POST /maintenance", p.serveMaintenance)
+	mux.HandleFunc("GET /declines", p.serveDeclines)
+	mux.HandleFunc("DELETE /declines/{ip}", p.serveClearDeclines)
+	return p.authorize(mux)
+}
+
+// authorize serves the requests of h that don't modify anything, and those
+// that do if they carry http-token as a bearer token. Without http-token,
+// the latter are refused.
+func (p *PluginState) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if p.httpToken == "" {
+			http.Error(w, "modifying endpoints are disabled, set http-token", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.httpToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// startHTTP serves the plugin's HTTP API on addr in the background.
+// Listening happens synchronously so that address conflicts fail the setup.
+func (p *PluginState) startHTTP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen for HTTP on %s: %w", addr, err)
+	}
+	log.Printf("Serving HTTP API on %s", ln.Addr())
+	if p.httpToken == "" {
+		log.Printf("No http-token set, the HTTP API is read-only")
+	}
+	go func() {
+		if err := http.Serve(ln, p.httpHandler()); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP API on %s stopped: %v", addr, err)
+		}
+	}()
+	return nil
+}
+
+// serveLease dumps the lease of the IP address in the path as JSON
+func (p *PluginState) serveLease(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip.To4() == nil {
+		http.Error(w, "invalid IPv4 address", http.StatusBadRequest)
+		return
+	}
+	p.Lock()
+	l, ok := p.leaseByIP(ip)
+	p.Unlock()
+	if !ok {
+		http.Error(w, "no lease for "+ip.String(), http.StatusNotFound)
+		return
+	}
+	l.MAC = p.logMAC(l.MAC)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Warningf("Failed to write lease: %v", err)
+	}
+}
+
+// queryInt parses the non-negative integer query parameter key, which
+// defaults to 0
+func queryInt(q url.Values, key string) (int, error) {
+	v := q.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q, want a non-negative integer", key, v)
+	}
+	return n, nil
+}
+
+// serveMetrics renders the plugin metrics in the Prometheus text exposition format
+func (p *PluginState) serveMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := p.metrics.writeText(w); err != nil {
+		log.Warningf("Failed to write metrics: %v", err)
+	}
+}
+
+// serveLeases dumps the current leases as JSON. The "sort" query parameter
+// orders them by ip (the default), mac or expiry, and "offset" and "limit"
+// select a page of them. The total number of leases is returned in the
+// X-Total-Count header.
+func (p *PluginState) serveLeases(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, err := queryInt(q, "offset")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(q, "limit")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	leases := p.dumpLeases()
+	if err := sortLeases(leases, q.Get("sort")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(leases)))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(paginate(leases, offset, limit)); err != nil {
+		log.Warningf("Failed to write leases: %v", err)
+	}
+}
+
+// serveISCLeases renders the current leases in ISC dhcpd.leases syntax
+func (p *PluginState) serveISCLeases(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// The lease time can be changed at runtime
+	p.Lock()
+	leaseTime := p.LeaseTime
+	p.Unlock()
+	if err := writeISCLeases(w, p.dumpLeases(), leaseTime); err != nil {
+		log.Warningf("Failed to write ISC leases: %v", err)
+	}
+}
+
+// serveResize moves the end of the range to the "end" query parameter
+func (p *PluginState) serveResize(w http.ResponseWriter, r *http.Request) {
+	end := net.ParseIP(r.URL.Query().Get("end"))
+	if end.To4() == nil {
+		http.Error(w, "missing or invalid end IPv4 address", http.StatusBadRequest)
+		return
+	}
+	if err := p.resize(r.Context(), end); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errResizeStrands) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	p.Lock()
+	r2 := persistedRange{Start: p.rangeStart, End: p.rangeEnd}
+	p.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r2); err != nil {
+		log.Warningf("Failed to write resize response: %v", err)
+	}
+}
+
+// serveHandoff hands the leases over to a peer, see Close
+func (p *PluginState) serveHandoff(w http.ResponseWriter, r *http.Request) {
+	if err := p.handoff(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
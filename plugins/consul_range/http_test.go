@@ -0,0 +1,202 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHTTPToken is the http-token of testPluginState
+const testHTTPToken = "test-token"
+
+// authorizedPost is http.Post with the bearer token testHTTPToken
+func authorizedPost(url, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer "+testHTTPToken)
+	return http.DefaultClient.Do(req)
+}
+
+func TestHTTPTokenRequired(t *testing.T) {
+	p := testPluginState(t)
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	post := func(authorization string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/maintenance?enabled=true", nil)
+		require.NoError(t, err)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(""))
+	assert.Equal(t, http.StatusUnauthorized, post("Bearer wrong"))
+	assert.Equal(t, http.StatusUnauthorized, post(testHTTPToken))
+	assert.False(t, p.maintenance)
+	assert.Equal(t, http.StatusNoContent, post("Bearer "+testHTTPToken))
+	assert.True(t, p.maintenance)
+
+	// Reading needs no token
+	res, err := http.Get(srv.URL + "/leases")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Without a token, nothing can be modified
+	p.httpToken = ""
+	assert.Equal(t, http.StatusForbidden, post("Bearer "+testHTTPToken))
+	assert.Error(t, parseHTTPTokenOption(p, ""))
+}
+
+func TestServeMetrics(t *testing.T) {
+	p := testPluginState(t)
+	p.metrics.registerPoolGauges(p)
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	_, _ = p.Handler4(req, stub)
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	assert.Contains(t, string(body), "# TYPE consulrange_pool_size gauge\nconsulrange_pool_size 10\n")
+	assert.Contains(t, string(body), "# TYPE consulrange_pool_used gauge\nconsulrange_pool_used 1\n")
+	assert.Contains(t, string(body), "consulrange_malformed_requests_total 0\n")
+}
+
+// getLeases fetches the leases from the HTTP API with the given query
+func getLeases(t *testing.T, srv *httptest.Server, query string) ([]lease, *http.Response) {
+	res, err := http.Get(srv.URL + "/leases" + query)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var leases []lease
+	if res.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&leases))
+	}
+	return leases, res
+}
+
+func TestServeLeasesSortAndPaginate(t *testing.T) {
+	p := testPluginState(t)
+	alloc, err := bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 100))
+	require.NoError(t, err)
+	p.allocator = alloc
+	// Lexically, 10.0.0.10 would sort before 10.0.0.9
+	for i, last := range []byte{10, 9, 100, 2} {
+		rec := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, byte(4 - i)}, net.IPv4(10, 0, 0, last))
+		rec.Expires = expire + i
+	}
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	ips := func(leases []lease) []string {
+		var out []string
+		for _, l := range leases {
+			out = append(out, l.IP.String())
+		}
+		return out
+	}
+
+	leases, res := getLeases(t, srv, "")
+	assert.Equal(t, "4", res.Header.Get("X-Total-Count"))
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.9", "10.0.0.10", "10.0.0.100"}, ips(leases))
+
+	leases, _ = getLeases(t, srv, "?sort=mac")
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.100", "10.0.0.9", "10.0.0.10"}, ips(leases))
+
+	leases, _ = getLeases(t, srv, "?sort=expiry")
+	assert.Equal(t, []string{"10.0.0.10", "10.0.0.9", "10.0.0.100", "10.0.0.2"}, ips(leases))
+
+	leases, _ = getLeases(t, srv, "?limit=2")
+	assert.Equal(t, []string{"10.0.0.2", "10.0.0.9"}, ips(leases))
+	leases, _ = getLeases(t, srv, "?limit=2&offset=2")
+	assert.Equal(t, []string{"10.0.0.10", "10.0.0.100"}, ips(leases))
+	leases, _ = getLeases(t, srv, "?limit=2&offset=3")
+	assert.Equal(t, []string{"10.0.0.100"}, ips(leases))
+	leases, res = getLeases(t, srv, "?offset=4")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, leases)
+
+	for _, query := range []string{"?limit=-1", "?offset=x", "?sort=hostname"} {
+		_, res := getLeases(t, srv, query)
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode, query)
+	}
+}
+
+func TestServeLease(t *testing.T) {
+	p := testPluginState(t)
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 5))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/leases/10.0.0.5")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var l lease
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&l))
+	assert.Equal(t, "02:00:00:00:00:01", l.MAC)
+	assert.True(t, l.IP.Equal(net.IPv4(10, 0, 0, 5)))
+
+	for path, status := range map[string]int{
+		"/leases/10.0.0.6":    http.StatusNotFound,
+		"/leases/2001:db8::1": http.StatusBadRequest,
+	} {
+		res, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, status, res.StatusCode, path)
+	}
+}
+
+func TestServeLeasesSortByAge(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	// Allocated in this order, oldest first
+	for _, last := range []byte{7, 3, 9} {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, last})
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		clock.Advance(time.Hour)
+	}
+	// A record written before first_seen was recorded
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 10))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	leases, res := getLeases(t, srv, "?sort=age")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var macs []string
+	var ages []int64
+	for _, l := range leases {
+		macs = append(macs, l.MAC)
+		ages = append(ages, l.Age)
+	}
+	assert.Equal(t, []string{"02:00:00:00:00:07", "02:00:00:00:00:03", "02:00:00:00:00:09", "02:00:00:00:00:01"}, macs)
+	assert.Equal(t, []int64{3 * 3600, 2 * 3600, 3600, 0}, ages)
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, int(clock.Now().Add(-3*time.Hour).Unix()), stored["02:00:00:00:00:07"].FirstSeen, "first_seen must be persisted")
+}
@@ -0,0 +1,71 @@
+package consulrangeplugin
+
+import (
+	"math"
+	"time"
+)
+
+// infiniteLeaseTime is the lease time granted when the lease duration is
+// "infinite": RFC 2131 reserves 0xffffffff for leases that never expire
+const infiniteLeaseTime = math.MaxUint32 * time.Second
+
+// infiniteExpiry is the Expires of an infinite lease. No timestamp comes
+// after it, so such a lease is never considered expired.
+const infiniteExpiry = math.MaxInt
+
+// parseLeaseTime parses the lease duration argument, either a duration or "infinite"
+func parseLeaseTime(s string) (time.Duration, error) {
+	if s == "infinite" {
+		return infiniteLeaseTime, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// infinite reports whether the lease never expires
+func (r *Record) infinite() bool {
+	return r.Expires == infiniteExpiry
+}
+
+// expiresAt returns the Expires of a lease of the given time granted at now
+func expiresAt(now time.Time, leaseTime time.Duration) int {
+	if leaseTime == infiniteLeaseTime {
+		return infiniteExpiry
+	}
+	return int(now.Add(leaseTime).Unix())
+}
+
+// expiredAt reports whether the lease has expired by now. Pinned leases never expire.
+func (r *Record) expiredAt(now time.Time) bool {
+	return !r.infinite() && !r.Pinned && time.Unix(int64(r.Expires), 0).Before(now)
+}
+
+// needsExtension reports whether granting leaseTime at now must update the
+// lease: when it would expire before the lease granted, or when it switches
+// between finite and infinite because the lease duration was reconfigured.
+func (r *Record) needsExtension(now time.Time, leaseTime time.Duration) bool {
+	if r.infinite() || leaseTime == infiniteLeaseTime {
+		return r.infinite() != (leaseTime == infiniteLeaseTime)
+	}
+	return time.Unix(int64(r.Expires), 0).Before(now.Add(leaseTime))
+}
+
+// remaining returns the time left on the lease at now
+func (r *Record) remaining(now time.Time) time.Duration {
+	if r.infinite() {
+		return infiniteLeaseTime
+	}
+	return time.Unix(int64(r.Expires), 0).Sub(now)
+}
+
+// infiniteLeases returns how many leases never expire
+func (p *PluginState) infiniteLeases() int {
+	p.Lock()
+	defer p.Unlock()
+	n := 0
+	for _, rec := range p.Recordsv4 {
+		if rec.infinite() {
+			n++
+		}
+	}
+	return n
+}
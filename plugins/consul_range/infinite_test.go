@@ -0,0 +1,92 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4InfiniteLease(t *testing.T) {
+	p := testPluginState(t)
+	p.LeaseTime = infiniteLeaseTime
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac)
+	resp, stop := p.Handler4(req, stub)
+	require.False(t, stop)
+	require.NotNil(t, resp)
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff}, resp.Options.Get(dhcpv4.OptionIPAddressLeaseTime))
+
+	rec := p.Recordsv4[mac.String()]
+	require.NotNil(t, rec)
+	assert.Equal(t, infiniteExpiry, rec.Expires)
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, infiniteExpiry, stored[mac.String()].Expires)
+
+	assert.Equal(t, 0, p.sweep(context.Background()))
+	assert.Contains(t, p.Recordsv4, mac.String(), "sweep reclaimed an infinite lease")
+
+	// Renewing an infinite lease doesn't rewrite it
+	puts := p.kv.(*memKV).puts
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, puts, p.kv.(*memKV).puts)
+}
+
+func TestInfiniteLeaseRendering(t *testing.T) {
+	p := testPluginState(t)
+	rec := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	rec.Expires = infiniteExpiry
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 2))
+
+	var dump []map[string]interface{}
+	data, err := json.Marshal(p.dumpLeases())
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &dump))
+	require.Len(t, dump, 2)
+	assert.Equal(t, true, dump[0]["infinite"])
+	assert.NotContains(t, dump[1], "infinite")
+
+	var isc bytes.Buffer
+	require.NoError(t, writeISCLeases(&isc, p.leases(), p.LeaseTime))
+	first, _, _ := strings.Cut(isc.String(), "}")
+	assert.Equal(t, "lease 10.0.0.1 {\n  ends never;\n  hardware ethernet 02:00:00:00:00:01;\n", first)
+
+	p.metrics.registerPoolGauges(p)
+	var metrics bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&metrics))
+	assert.Contains(t, metrics.String(), "\nconsulrange_leases_infinite 1\n")
+}
+
+func TestRecordNeedsExtension(t *testing.T) {
+	now := time.Now()
+	finite := &Record{Expires: expiresAt(now, time.Hour)}
+	infinite := &Record{Expires: expiresAt(now, infiniteLeaseTime)}
+
+	assert.False(t, finite.needsExtension(now, time.Minute))
+	assert.True(t, finite.needsExtension(now, 2*time.Hour))
+	assert.True(t, finite.needsExtension(now, infiniteLeaseTime))
+	assert.False(t, infinite.needsExtension(now, infiniteLeaseTime))
+	assert.True(t, infinite.needsExtension(now, time.Hour), "lease stays infinite after the lease duration was made finite")
+	assert.False(t, infinite.expiredAt(now.Add(100*365*24*time.Hour)))
+}
+
+func TestParseLeaseTime(t *testing.T) {
+	d, err := parseLeaseTime("infinite")
+	require.NoError(t, err)
+	assert.Equal(t, infiniteLeaseTime, d)
+	d, err = parseLeaseTime("90s")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+	_, err = parseLeaseTime("forever")
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// defaultConsulQueueTimeout is how long an operation waits for a slot under
+// consul-max-inflight before failing
+const defaultConsulQueueTimeout = 100 * time.Millisecond
+
+// errConsulBusy is returned by operations that found no free slot in time
+var errConsulBusy = errors.New("too many consul operations in flight")
+
+func parseConsulMaxInFlightOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("consul-max-inflight must be positive: %d", n)
+	}
+	p.consulMaxInFlight = n
+	return nil
+}
+
+func parseConsulQueueTimeoutOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("consul-queue-timeout must be positive: %s", d)
+	}
+	p.consulQueueTimeout = d
+	return nil
+}
+
+// consulLimiter bounds the number of Consul operations in flight. An
+// operation over the limit queues for a slot up to a timeout, then fails with
+// errConsulBusy: the records failing to be written are kept in memory and
+// written back later, like any other failed write.
+type consulLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+	inFlight     atomic.Int64
+	busy         *counter
+}
+
+// newConsulLimiter returns a limiter of limit slots, the queue timeout
+// defaulting to defaultConsulQueueTimeout if zero
+func newConsulLimiter(limit int, queueTimeout time.Duration, busy *counter) *consulLimiter {
+	if queueTimeout == 0 {
+		queueTimeout = defaultConsulQueueTimeout
+	}
+	return &consulLimiter{slots: make(chan struct{}, limit), queueTimeout: queueTimeout, busy: busy}
+}
+
+// acquire takes a slot, waiting up to the queue timeout or until ctx is done,
+// and returns the function releasing it
+func (l *consulLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			l.busy.Inc()
+			return nil, errConsulBusy
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	l.inFlight.Add(1)
+	return func() {
+		l.inFlight.Add(-1)
+		<-l.slots
+	}, nil
+}
+
+// InFlight returns the number of operations in flight
+func (l *consulLimiter) InFlight() int64 {
+	return l.inFlight.Load()
+}
+
+// limitedKV is a kvStore taking a slot of a consulLimiter for each operation
+// on the one it wraps. Blocking queries wait for changes rather than load
+// Consul, and aren't limited.
+type limitedKV struct {
+	*consulLimiter
+	kv kvStore
+}
+
+// newLimitedKV wraps kv with the slots of l
+func newLimitedKV(kv kvStore, l *consulLimiter) *limitedKV {
+	return &limitedKV{consulLimiter: l, kv: kv}
+}
+
+func (l *limitedKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	if q != nil && q.WaitIndex > 0 {
+		return l.kv.Get(key, q)
+	}
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.kv.Get(key, q)
+}
+
+func (l *limitedKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	if q != nil && q.WaitIndex > 0 {
+		return l.kv.List(prefix, q)
+	}
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	return l.kv.List(prefix, q)
+}
+
+func (l *limitedKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.kv.Put(p, q)
+}
+
+func (l *limitedKV) Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error) {
+	release, err := l.acquire(w.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.kv.Delete(key, w)
+}
+
+func (l *limitedKV) Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return false, nil, err
+	}
+	defer release()
+	return l.kv.Acquire(p, q)
+}
+
+func (l *limitedKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return false, nil, err
+	}
+	defer release()
+	return l.kv.CAS(p, q)
+}
+
+// limitedSessions is a sessionStore sharing the slots of a consulLimiter with
+// the KV operations
+type limitedSessions struct {
+	*consulLimiter
+	sessions sessionStore
+}
+
+func (l *limitedSessions) Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error) {
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return "", nil, err
+	}
+	defer release()
+	return l.sessions.Create(se, q)
+}
+
+func (l *limitedSessions) Destroy(id string, q *api.WriteOptions) (*api.WriteMeta, error) {
+	release, err := l.acquire(q.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return l.sessions.Destroy(id, q)
+}
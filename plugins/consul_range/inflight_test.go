@@ -0,0 +1,146 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowKV is a memKV whose writes take a while, and which records how many
+// were in flight at most
+type slowKV struct {
+	*memKV
+	delay    time.Duration
+	inFlight atomic.Int64
+	peak     atomic.Int64
+	// hold, when set, blocks writes until it is closed
+	hold chan struct{}
+}
+
+func (s *slowKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	n := s.inFlight.Add(1)
+	defer s.inFlight.Add(-1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	if s.hold != nil {
+		<-s.hold
+	}
+	time.Sleep(s.delay)
+	return s.memKV.Put(p, q)
+}
+
+func TestLimitedKVRespectsCap(t *testing.T) {
+	slow := &slowKV{memKV: newMemKV(), delay: 5 * time.Millisecond}
+	busy := &counter{}
+	kv := newLimitedKV(slow, newConsulLimiter(3, 5*time.Second, busy))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 30)
+	for i := range 30 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := kv.Put(&api.KVPair{Key: fmt.Sprintf("leases/%d", i), Value: []byte("{}")}, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	assert.LessOrEqual(t, slow.peak.Load(), int64(3))
+	assert.Equal(t, 30, slow.puts)
+	assert.Zero(t, kv.InFlight())
+	assert.Zero(t, busy.Value())
+}
+
+func TestLimitedKVBusyKeepsLeaseInMemory(t *testing.T) {
+	p := testPluginState(t)
+	slow := &slowKV{memKV: p.kv.(*memKV), hold: make(chan struct{})}
+	kv := newLimitedKV(slow, newConsulLimiter(1, 10*time.Millisecond, p.metrics.consulBusy))
+	p.kv = kv
+
+	// Another operation holds the only slot
+	done := make(chan error)
+	go func() {
+		_, err := kv.Put(&api.KVPair{Key: "leases/_config/other", Value: []byte("x")}, nil)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return kv.InFlight() == 1 }, 5*time.Second, time.Millisecond)
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp, "the lease should be granted from memory")
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+	assert.Contains(t, p.dirty, mac.String(), "the write should be deferred")
+	assert.Equal(t, uint64(1), p.metrics.consulBusy.Value())
+
+	close(slow.hold)
+	require.NoError(t, <-done)
+	_, err := kv.Put(&api.KVPair{Key: "leases/" + mac.String(), Value: []byte("{}")}, nil)
+	assert.NoError(t, err, "the slot should be free again")
+}
+
+func TestLimitedKVCanceledWhileQueued(t *testing.T) {
+	slow := &slowKV{memKV: newMemKV(), hold: make(chan struct{})}
+	kv := newLimitedKV(slow, newConsulLimiter(1, time.Minute, &counter{}))
+	go func() { _, _ = kv.Put(&api.KVPair{Key: "a"}, nil) }()
+	require.Eventually(t, func() bool { return kv.InFlight() == 1 }, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := kv.Put(&api.KVPair{Key: "b"}, (&api.WriteOptions{}).WithContext(ctx))
+	assert.ErrorIs(t, err, context.Canceled)
+	close(slow.hold)
+}
+
+func TestLimitedSessionsShareSlots(t *testing.T) {
+	slow := &slowKV{memKV: newMemKV(), hold: make(chan struct{})}
+	limiter := newConsulLimiter(1, 10*time.Millisecond, &counter{})
+	kv := newLimitedKV(slow, limiter)
+	sessions := &limitedSessions{consulLimiter: limiter, sessions: &memSessions{kv: slow.memKV}}
+
+	// A write, e.g. from the flusher or reconciliation, holds the only slot
+	done := make(chan error)
+	go func() {
+		_, err := kv.Put(&api.KVPair{Key: "leases/02:00:00:00:00:01", Value: []byte("{}")}, nil)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return limiter.InFlight() == 1 }, 5*time.Second, time.Millisecond)
+	_, _, err := sessions.Create(&api.SessionEntry{}, nil)
+	assert.ErrorIs(t, err, errConsulBusy)
+	assert.Equal(t, uint64(1), limiter.busy.Value())
+
+	close(slow.hold)
+	require.NoError(t, <-done)
+	id, _, err := sessions.Create(&api.SessionEntry{}, nil)
+	require.NoError(t, err)
+	_, err = sessions.Destroy(id, nil)
+	require.NoError(t, err)
+	assert.Zero(t, limiter.InFlight())
+}
+
+func TestParseConsulMaxInFlightOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseConsulMaxInFlightOption(p, "8"))
+	assert.Equal(t, 8, p.consulMaxInFlight)
+	assert.Error(t, parseConsulMaxInFlightOption(p, "0"))
+	assert.Error(t, parseConsulMaxInFlightOption(p, "many"))
+	require.NoError(t, parseConsulQueueTimeoutOption(p, "250ms"))
+	assert.Equal(t, 250*time.Millisecond, p.consulQueueTimeout)
+	assert.Error(t, parseConsulQueueTimeoutOption(p, "0s"))
+}
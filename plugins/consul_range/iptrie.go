@@ -0,0 +1,230 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ipTrie maps IPv4 addresses to the MAC address leasing them, so that the
+// lease of an address can be found without scanning all records.
+// It is a radix trie with an 8 bit stride: the first three bytes of an address
+// select inner nodes, the last one a slot in a leaf. Addresses of a range share
+// nodes, which keeps storage compact, and walks visit addresses in order.
+type ipTrie struct {
+	root [256]*trieMid
+	n    int
+}
+
+type trieMid struct {
+	children [256]*trieLow
+	n        int
+}
+
+type trieLow struct {
+	leaves [256]*trieLeaf
+	n      int
+}
+
+type trieLeaf struct {
+	macs [256]string
+	n    int
+}
+
+// ipKey returns the trie key of an IPv4 address
+func ipKey(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip4), true
+}
+
+// Set records that ip is leased to mac, replacing any previous MAC
+func (t *ipTrie) Set(ip net.IP, mac string) {
+	k, ok := ipKey(ip)
+	if !ok || mac == "" {
+		return
+	}
+	mid := t.root[k>>24]
+	if mid == nil {
+		mid = &trieMid{}
+		t.root[k>>24] = mid
+	}
+	low := mid.children[k>>16&0xff]
+	if low == nil {
+		low = &trieLow{}
+		mid.children[k>>16&0xff] = low
+		mid.n++
+	}
+	leaf := low.leaves[k>>8&0xff]
+	if leaf == nil {
+		leaf = &trieLeaf{}
+		low.leaves[k>>8&0xff] = leaf
+		low.n++
+	}
+	if leaf.macs[k&0xff] == "" {
+		leaf.n++
+		t.n++
+	}
+	leaf.macs[k&0xff] = mac
+}
+
+// Lookup returns the MAC address ip is leased to
+func (t *ipTrie) Lookup(ip net.IP) (string, bool) {
+	k, ok := ipKey(ip)
+	if !ok {
+		return "", false
+	}
+	mid := t.root[k>>24]
+	if mid == nil {
+		return "", false
+	}
+	low := mid.children[k>>16&0xff]
+	if low == nil {
+		return "", false
+	}
+	leaf := low.leaves[k>>8&0xff]
+	if leaf == nil {
+		return "", false
+	}
+	mac := leaf.macs[k&0xff]
+	return mac, mac != ""
+}
+
+// Delete forgets the lease of ip, pruning the nodes left empty
+func (t *ipTrie) Delete(ip net.IP) {
+	k, ok := ipKey(ip)
+	if !ok {
+		return
+	}
+	mid := t.root[k>>24]
+	if mid == nil {
+		return
+	}
+	low := mid.children[k>>16&0xff]
+	if low == nil {
+		return
+	}
+	leaf := low.leaves[k>>8&0xff]
+	if leaf == nil || leaf.macs[k&0xff] == "" {
+		return
+	}
+	leaf.macs[k&0xff] = ""
+	leaf.n--
+	t.n--
+	if leaf.n > 0 {
+		return
+	}
+	low.leaves[k>>8&0xff] = nil
+	if low.n--; low.n > 0 {
+		return
+	}
+	mid.children[k>>16&0xff] = nil
+	if mid.n--; mid.n > 0 {
+		return
+	}
+	t.root[k>>24] = nil
+}
+
+// Len returns the number of addresses in the trie
+func (t *ipTrie) Len() int {
+	return t.n
+}
+
+// Walk calls fn with the leased addresses between lo and hi, inclusive, in
+// ascending order, until fn returns false
+func (t *ipTrie) Walk(lo, hi net.IP, fn func(ip net.IP, mac string) bool) {
+	from, ok := ipKey(lo)
+	if !ok {
+		return
+	}
+	to, ok := ipKey(hi)
+	if !ok {
+		return
+	}
+	for k := uint64(from); k <= uint64(to); {
+		mid := t.root[k>>24]
+		if mid == nil {
+			k = (k>>24 + 1) << 24
+			continue
+		}
+		low := mid.children[k>>16&0xff]
+		if low == nil {
+			k = (k>>16 + 1) << 16
+			continue
+		}
+		leaf := low.leaves[k>>8&0xff]
+		if leaf == nil {
+			k = (k>>8 + 1) << 8
+			continue
+		}
+		if mac := leaf.macs[k&0xff]; mac != "" {
+			if !fn(uint32ToIP(uint32(k)), mac) {
+				return
+			}
+		}
+		k++
+	}
+}
+
+// setRecord stores the record of mac, keeping the IP index up to date.
+// Must be called with the plugin lock held.
+func (p *PluginState) setRecord(mac string, rec *Record) {
+	if old, ok := p.Recordsv4[mac]; ok && !old.IP.Equal(rec.IP) {
+		p.unindex(old.IP, mac)
+	}
+	p.Recordsv4[mac] = rec
+	p.byIP.Set(rec.IP, mac)
+	p.noteChanged(mac)
+}
+
+// deleteRecord forgets the record of mac, keeping the IP index up to date.
+// Must be called with the plugin lock held.
+func (p *PluginState) deleteRecord(mac string) {
+	if old, ok := p.Recordsv4[mac]; ok {
+		p.unindex(old.IP, mac)
+	}
+	delete(p.Recordsv4, mac)
+	delete(p.merged, mac)
+	p.noteChanged(mac)
+}
+
+// setRecordIP moves the record of mac to ip, keeping the IP index up to date.
+// Must be called with the plugin lock held.
+func (p *PluginState) setRecordIP(mac string, rec *Record, ip net.IP) {
+	p.unindex(rec.IP, mac)
+	rec.IP = ip
+	p.byIP.Set(ip, mac)
+	p.noteChanged(mac)
+}
+
+// unindex removes ip from the IP index if mac is the one it points to
+func (p *PluginState) unindex(ip net.IP, mac string) {
+	if cur, ok := p.byIP.Lookup(ip); ok && cur == mac {
+		p.byIP.Delete(ip)
+	}
+}
+
+// reindex rebuilds the IP index from the records.
+// Must be called with the plugin lock held.
+func (p *PluginState) reindex() {
+	p.byIP = ipTrie{}
+	for mac, rec := range p.Recordsv4 {
+		p.byIP.Set(rec.IP, mac)
+	}
+}
+
+// leaseByIP returns the lease of ip, if any.
+// Must be called with the plugin lock held.
+func (p *PluginState) leaseByIP(ip net.IP) (lease, bool) {
+	mac, ok := p.byIP.Lookup(ip)
+	if !ok {
+		return lease{}, false
+	}
+	// Guard against the index going stale, Recordsv4 is exported
+	rec, ok := p.Recordsv4[mac]
+	if !ok || !rec.IP.Equal(ip) {
+		return lease{}, false
+	}
+	return lease{MAC: mac, Record: *rec}, true
+}
@@ -0,0 +1,181 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestIPTrieMatchesMap checks the trie against a plain map under random operations
+func TestIPTrieMatchesMap(t *testing.T) {
+	var trie ipTrie
+	want := make(map[uint32]string)
+	rng := rand.New(rand.NewSource(1))
+	// Span several leaves and inner nodes
+	base := binary.BigEndian.Uint32(net.IPv4(10, 0, 255, 0).To4())
+	for i := 0; i < 20000; i++ {
+		k := base + uint32(rng.Intn(2048))
+		ip := uint32ToIP(k)
+		if rng.Intn(3) == 0 {
+			trie.Delete(ip)
+			delete(want, k)
+		} else {
+			mac := fmt.Sprintf("mac-%d", rng.Intn(1000))
+			trie.Set(ip, mac)
+			want[k] = mac
+		}
+	}
+	require.Equal(t, len(want), trie.Len())
+	for k := base; k < base+2048; k++ {
+		mac, ok := trie.Lookup(uint32ToIP(k))
+		assert.Equal(t, want[k], mac)
+		_, wantOK := want[k]
+		assert.Equal(t, wantOK, ok)
+	}
+
+	var keys []uint32
+	lo, hi := base+100, base+1500
+	for k := range want {
+		if k >= lo && k <= hi {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	var walked []uint32
+	trie.Walk(uint32ToIP(lo), uint32ToIP(hi), func(ip net.IP, mac string) bool {
+		k, _ := ipKey(ip)
+		walked = append(walked, k)
+		assert.Equal(t, want[k], mac)
+		return true
+	})
+	assert.Equal(t, keys, walked)
+
+	for k := range want {
+		trie.Delete(uint32ToIP(k))
+	}
+	assert.Equal(t, 0, trie.Len())
+	assert.Equal(t, [256]*trieMid{}, trie.root, "empty nodes were not pruned")
+}
+
+func TestIPTrieWalkBounds(t *testing.T) {
+	var trie ipTrie
+	trie.Set(net.IPv4(255, 255, 255, 255), "last")
+	trie.Set(net.IPv4(0, 0, 0, 0), "first")
+	var got []string
+	trie.Walk(net.IPv4(0, 0, 0, 0), net.IPv4(255, 255, 255, 255), func(_ net.IP, mac string) bool {
+		got = append(got, mac)
+		return true
+	})
+	assert.Equal(t, []string{"first", "last"}, got)
+}
+
+func TestRecordIndex(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	l, ok := p.leaseByIP(resp.YourIPAddr)
+	require.True(t, ok)
+	assert.Equal(t, mac.String(), l.MAC)
+
+	old := resp.YourIPAddr
+	require.NoError(t, p.renumber(context.Background(), mac, p.Recordsv4[mac.String()], nil, p.LeaseTime))
+	_, ok = p.leaseByIP(old)
+	assert.False(t, ok, "renumbered lease still indexed under its old address")
+	_, ok = p.leaseByIP(p.Recordsv4[mac.String()].IP)
+	assert.True(t, ok)
+
+	p.deleteRecord(mac.String())
+	assert.Equal(t, 0, p.byIP.Len())
+}
+
+// benchmarkLeases generates n records in a /16 range, as in Recordsv4
+func benchmarkLeases(n int) map[string]*Record {
+	records := make(map[string]*Record, n)
+	base := binary.BigEndian.Uint32(net.IPv4(10, 0, 0, 0).To4())
+	for i := 0; i < n; i++ {
+		mac := net.HardwareAddr{2, 0, 0, byte(i >> 16), byte(i >> 8), byte(i)}
+		records[mac.String()] = &Record{IP: uint32ToIP(base + uint32(i))}
+	}
+	return records
+}
+
+// BenchmarkLookupByIP compares finding the lease of an address by scanning the
+// records, the only way with Recordsv4 alone, to looking it up in the trie
+func BenchmarkLookupByIP(b *testing.B) {
+	for _, n := range []int{256, 65536} {
+		records := benchmarkLeases(n)
+		var trie ipTrie
+		for mac, rec := range records {
+			trie.Set(rec.IP, mac)
+		}
+		target := uint32ToIP(binary.BigEndian.Uint32(net.IPv4(10, 0, 0, 0).To4()) + uint32(n/2))
+
+		b.Run(fmt.Sprintf("map-scan/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, rec := range records {
+					if rec.IP.Equal(target) {
+						break
+					}
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := trie.Lookup(target); !ok {
+					b.Fatal("missing lease")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkIndexMemory compares the heap used to index n leases by IP with a
+// map keyed by address and with the trie, reported as bytes/lease
+func BenchmarkIndexMemory(b *testing.B) {
+	const n = 65536
+	records := benchmarkLeases(n)
+	heap := func() uint64 {
+		runtime.GC()
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+
+	b.Run("map", func(b *testing.B) {
+		var keep []map[uint32]string
+		before := heap()
+		for i := 0; i < b.N; i++ {
+			m := make(map[uint32]string)
+			for mac, rec := range records {
+				k, _ := ipKey(rec.IP)
+				m[k] = mac
+			}
+			keep = append(keep, m)
+		}
+		b.ReportMetric(float64(heap()-before)/float64(b.N*n), "bytes/lease")
+		runtime.KeepAlive(keep)
+	})
+	b.Run("trie", func(b *testing.B) {
+		var keep []*ipTrie
+		before := heap()
+		for i := 0; i < b.N; i++ {
+			trie := &ipTrie{}
+			for mac, rec := range records {
+				trie.Set(rec.IP, mac)
+			}
+			keep = append(keep, trie)
+		}
+		b.ReportMetric(float64(heap()-before)/float64(b.N*n), "bytes/lease")
+		runtime.KeepAlive(keep)
+	})
+}
@@ -0,0 +1,55 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// iscTimeLayout is the date format used in dhcpd.leases, following the weekday number
+const iscTimeLayout = "2006/01/02 15:04:05"
+
+// iscTime formats t as an ISC dhcpd lease file timestamp, in UTC
+func iscTime(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%d %s", t.Weekday(), t.Format(iscTimeLayout))
+}
+
+// writeISCLeases renders leases in the ISC dhcpd.leases file syntax.
+// The start of each lease is derived from its expiry and the lease time,
+// since only the expiry is stored. Anonymized MAC addresses, which can't be
+// given as a hardware address, are rendered as the client uid instead.
+// Infinite leases end "never", and their start is unknown.
+func writeISCLeases(w io.Writer, leases []lease, leaseTime time.Duration) error {
+	for _, l := range leases {
+		if l.infinite() {
+			if _, err := fmt.Fprintf(w, "lease %s {\n  ends never;\n", l.IP); err != nil {
+				return err
+			}
+		} else {
+			ends := time.Unix(int64(l.Expires), 0)
+			if _, err := fmt.Fprintf(w, "lease %s {\n  starts %s;\n  ends %s;\n",
+				l.IP, iscTime(ends.Add(-leaseTime)), iscTime(ends)); err != nil {
+				return err
+			}
+		}
+		client := fmt.Sprintf("  hardware ethernet %s;\n", l.MAC)
+		if _, err := net.ParseMAC(l.MAC); err != nil {
+			client = fmt.Sprintf("  uid %s;\n", strconv.Quote(l.MAC))
+		}
+		if _, err := io.WriteString(w, client); err != nil {
+			return err
+		}
+		if l.Hostname != "" {
+			if _, err := fmt.Fprintf(w, "  client-hostname %s;\n", strconv.Quote(l.Hostname)); err != nil {
+				return err
+			}
+		}
+		if _, err := io.WriteString(w, "}\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package consulrangeplugin
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	iscLeaseRe    = regexp.MustCompile(`^lease (\S+) \{$`)
+	iscTimeRe     = regexp.MustCompile(`^  (starts|ends) (\d) (\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2});$`)
+	iscHardwareRe = regexp.MustCompile(`^  hardware ethernet (\S+);$`)
+	iscHostnameRe = regexp.MustCompile(`^  client-hostname (".*");$`)
+)
+
+// parseISCLeases is a minimal dhcpd.leases parser for the subset of the syntax we render
+func parseISCLeases(t *testing.T, data []byte) []lease {
+	var (
+		out []lease
+		cur *lease
+	)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case iscLeaseRe.MatchString(line):
+			cur = &lease{}
+			cur.IP = net.ParseIP(iscLeaseRe.FindStringSubmatch(line)[1]).To4()
+		case iscTimeRe.MatchString(line):
+			m := iscTimeRe.FindStringSubmatch(line)
+			ts, err := time.Parse(iscTimeLayout, m[3])
+			require.NoError(t, err)
+			assert.Equal(t, strconv.Itoa(int(ts.Weekday())), m[2], "wrong weekday in %q", line)
+			if m[1] == "ends" {
+				cur.Expires = int(ts.Unix())
+			}
+		case iscHardwareRe.MatchString(line):
+			cur.MAC = iscHardwareRe.FindStringSubmatch(line)[1]
+		case iscHostnameRe.MatchString(line):
+			h, err := strconv.Unquote(iscHostnameRe.FindStringSubmatch(line)[1])
+			require.NoError(t, err)
+			cur.Hostname = h
+		case line == "}":
+			out = append(out, *cur)
+			cur = nil
+		default:
+			t.Fatalf("unexpected line in ISC leases: %q", line)
+		}
+	}
+	require.Nil(t, cur, "unterminated lease")
+	return out
+}
+
+func TestWriteISCLeases(t *testing.T) {
+	p := testPluginState(t)
+	p.Recordsv4["02:00:00:00:00:02"] = &Record{IP: net.IPv4(10, 0, 0, 10).To4(), Expires: expire, Hostname: `tricky "name"`}
+	p.Recordsv4["02:00:00:00:00:01"] = &Record{IP: net.IPv4(10, 0, 0, 9).To4(), Expires: expire + 3600}
+
+	var buf bytes.Buffer
+	require.NoError(t, writeISCLeases(&buf, p.leases(), p.LeaseTime))
+	assert.True(t, strings.Contains(buf.String(), "  ends 6 2000/01/01 00:00:00;\n"), "expiry should be rendered in UTC")
+
+	parsed := parseISCLeases(t, buf.Bytes())
+	assert.Equal(t, p.leases(), parsed)
+}
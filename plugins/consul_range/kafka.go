@@ -0,0 +1,199 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// kafkaQueueSize bounds the number of events waiting to be published
+	kafkaQueueSize = 4096
+	// kafkaBatchSize is the number of events published at most per request
+	kafkaBatchSize = 256
+	// kafkaContentType is that of the JSON embedded format of the REST proxy v2 API
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+)
+
+// kafkaTopicName matches the names Kafka accepts for topics
+var kafkaTopicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+func parseKafkaOption(p *PluginState, value string) error {
+	var proxies []string
+	for _, s := range strings.Split(value, ",") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("Kafka REST proxy URL must be http or https: %s", s)
+		}
+		proxies = append(proxies, strings.TrimRight(s, "/"))
+	}
+	p.kafkaProxies = proxies
+	return nil
+}
+
+func parseKafkaTopicOption(p *PluginState, value string) error {
+	if !kafkaTopicName.MatchString(value) {
+		return fmt.Errorf("invalid Kafka topic %q", value)
+	}
+	p.kafkaTopic = value
+	return nil
+}
+
+// kafkaMessage is a message published to the lease events topic
+type kafkaMessage struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// kafkaProducer publishes messages to a Kafka topic
+type kafkaProducer interface {
+	Produce(msgs []kafkaMessage) error
+}
+
+// kafkaSink is a leaseHook publishing allocate, renew, release and expire
+// events to Kafka, keyed by MAC address so that the events of a client land in
+// the same partition, in order. Events are published in the background, those
+// that can't be queued or published are dropped and counted in dropped.
+type kafkaSink struct {
+	producer kafkaProducer
+	queue    chan kafkaMessage
+	dropped  *counter
+}
+
+func newKafkaSink(producer kafkaProducer, dropped *counter) *kafkaSink {
+	k := &kafkaSink{
+		producer: producer,
+		queue:    make(chan kafkaMessage, kafkaQueueSize),
+		dropped:  dropped,
+	}
+	go k.run()
+	return k
+}
+
+// LeaseEvent queues ev for publication
+func (k *kafkaSink) LeaseEvent(ev leaseEvent) {
+	switch ev.Type {
+	case eventAllocate, eventRenew, eventRelease, eventExpire:
+	default:
+		return
+	}
+	value, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("Could not marshal Kafka lease event: %v", err)
+		return
+	}
+	select {
+	case k.queue <- kafkaMessage{Key: ev.MAC, Value: value}:
+	default:
+		k.dropped.Inc()
+	}
+}
+
+// run publishes queued events, batching those queued while the previous
+// batch was being published
+func (k *kafkaSink) run() {
+	for msg := range k.queue {
+		batch := []kafkaMessage{msg}
+	drain:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case msg := <-k.queue:
+				batch = append(batch, msg)
+			default:
+				break drain
+			}
+		}
+		if err := k.producer.Produce(batch); err != nil {
+			log.Warningf("Could not publish %d lease events to Kafka: %v", len(batch), err)
+			k.dropped.Add(uint64(len(batch)))
+		}
+	}
+}
+
+// restProducer is a kafkaProducer publishing through a Kafka REST proxy v2 API,
+// trying each of its proxies in turn
+type restProducer struct {
+	proxies []string
+	topic   string
+	client  *http.Client
+}
+
+func newRESTProducer(proxies []string, topic string) *restProducer {
+	return &restProducer{
+		proxies: proxies,
+		topic:   topic,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type restRecord struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+type restProduceResponse struct {
+	Offsets []struct {
+		ErrorCode *int   `json:"error_code"`
+		Error     string `json:"error"`
+	} `json:"offsets"`
+}
+
+// Produce publishes msgs through the first proxy to accept them
+func (r *restProducer) Produce(msgs []kafkaMessage) error {
+	records := make([]restRecord, len(msgs))
+	for i, m := range msgs {
+		records[i] = restRecord{Key: m.Key, Value: m.Value}
+	}
+	body, err := json.Marshal(struct {
+		Records []restRecord `json:"records"`
+	}{records})
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, proxy := range r.proxies {
+		err := r.produce(proxy, body)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", proxy, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (r *restProducer) produce(proxy string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, proxy+"/topics/"+url.PathEscape(r.topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	// The proxy answers 200 even when some records could not be produced
+	var resp restProduceResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("could not decode response: %w", err)
+	}
+	for _, o := range resp.Offsets {
+		if o.ErrorCode != nil {
+			return fmt.Errorf("record not produced: %s (error code %d)", o.Error, *o.ErrorCode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockProducer is a kafkaProducer recording the messages published
+type mockProducer struct {
+	mu   sync.Mutex
+	msgs []kafkaMessage
+	err  error
+}
+
+func (m *mockProducer) Produce(msgs []kafkaMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.msgs = append(m.msgs, msgs...)
+	return nil
+}
+
+func (m *mockProducer) published() []kafkaMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]kafkaMessage(nil), m.msgs...)
+}
+
+func TestKafkaSinkPublishesLeaseEvents(t *testing.T) {
+	p := testPluginState(t)
+	producer := &mockProducer{}
+	p.addHook(newKafkaSink(producer, p.metrics.kafkaDropped))
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	req, stub = testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease), dhcpv4.WithClientIP(resp.YourIPAddr))
+	_, _ = p.Handler4(req, stub)
+
+	require.Eventually(t, func() bool { return len(producer.published()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	var got []eventType
+	for _, m := range producer.published() {
+		assert.Equal(t, mac.String(), m.Key)
+		var ev leaseEvent
+		require.NoError(t, json.Unmarshal(m.Value, &ev))
+		assert.Equal(t, mac.String(), ev.MAC)
+		assert.Equal(t, resp.YourIPAddr.String(), ev.IP.String())
+		got = append(got, ev.Type)
+	}
+	assert.Equal(t, []eventType{eventAllocate, eventRenew, eventRelease}, got)
+	assert.Zero(t, p.metrics.kafkaDropped.Value())
+}
+
+func TestKafkaSinkIgnoresOtherEvents(t *testing.T) {
+	dropped := newMetrics().kafkaDropped
+	k := &kafkaSink{queue: make(chan kafkaMessage, 1), dropped: dropped}
+	k.LeaseEvent(leaseEvent{Type: eventHostname})
+	assert.Empty(t, k.queue)
+}
+
+func TestKafkaSinkDropsWhenQueueFull(t *testing.T) {
+	dropped := newMetrics().kafkaDropped
+	// Not running, so that the queue fills up
+	k := &kafkaSink{queue: make(chan kafkaMessage, 1), dropped: dropped}
+	k.LeaseEvent(leaseEvent{Type: eventRenew})
+	k.LeaseEvent(leaseEvent{Type: eventRenew})
+	assert.Len(t, k.queue, 1)
+	assert.Equal(t, uint64(1), dropped.Value())
+}
+
+func TestKafkaSinkCountsFailedPublications(t *testing.T) {
+	dropped := newMetrics().kafkaDropped
+	k := newKafkaSink(&mockProducer{err: errors.New("broker down")}, dropped)
+	k.LeaseEvent(leaseEvent{Type: eventExpire})
+	require.Eventually(t, func() bool { return dropped.Value() == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRESTProducer(t *testing.T) {
+	var body struct {
+		Records []restRecord `json:"records"`
+	}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/dhcp.leases", r.URL.Path)
+		assert.Equal(t, kafkaContentType, r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":42,"error_code":null,"error":null}]}`))
+	}))
+	defer proxy.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	producer := newRESTProducer([]string{down.URL, proxy.URL}, "dhcp.leases")
+	require.NoError(t, producer.Produce([]kafkaMessage{{Key: "02:00:00:00:00:01", Value: json.RawMessage(`{"type":"renew"}`)}}))
+	require.Len(t, body.Records, 1)
+	assert.Equal(t, "02:00:00:00:00:01", body.Records[0].Key)
+	assert.JSONEq(t, `{"type":"renew"}`, string(body.Records[0].Value))
+}
+
+func TestRESTProducerRecordErrors(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"Kafka error"}]}`))
+	}))
+	defer proxy.Close()
+	err := newRESTProducer([]string{proxy.URL}, "leases").Produce([]kafkaMessage{{Key: "k", Value: json.RawMessage(`{}`)}})
+	assert.ErrorContains(t, err, "50003")
+}
+
+func TestParseKafkaOptions(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseKafkaOption(p, "http://proxy1:8082/,https://proxy2:8082"))
+	assert.Equal(t, []string{"http://proxy1:8082", "https://proxy2:8082"}, p.kafkaProxies)
+	assert.Error(t, parseKafkaOption(p, "kafka1:9092"))
+	require.NoError(t, parseKafkaTopicOption(p, "dhcp.leases"))
+	assert.Equal(t, "dhcp.leases", p.kafkaTopic)
+	assert.Error(t, parseKafkaTopicOption(p, ""))
+	assert.Error(t, parseKafkaTopicOption(p, "dhcp/leases"))
+}
@@ -0,0 +1,148 @@
+package consulrangeplugin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// keyCodec maps the MAC address of a JSON lease record to its Consul key,
+// relative to the KV prefix, and back. It lets the plugin adopt a store laid
+// out by another tool without migrating it.
+type keyCodec interface {
+	// Key returns the key holding the record of mac
+	Key(mac net.HardwareAddr) string
+	// MAC returns the MAC address whose record is held by key, or false if
+	// key doesn't hold a lease record
+	MAC(key string) (string, bool)
+}
+
+// macKeys is the default layout, with records held directly under the prefix
+// in keys named after the MAC address. Keys in sub-directories, such as those
+// of other instances, hold none.
+type macKeys struct{}
+
+func (macKeys) Key(mac net.HardwareAddr) string { return mac.String() }
+
+func (macKeys) MAC(key string) (string, bool) { return key, !strings.Contains(key, "/") }
+
+// macFormat is a way of spelling a MAC address in a key template
+type macFormat struct {
+	sep   string
+	upper bool
+}
+
+// keyTemplatePlaceholders maps the placeholders accepted in key templates to
+// the way they spell the MAC address
+var keyTemplatePlaceholders = map[string]macFormat{
+	"{mac}":       {sep: ":"},
+	"{MAC}":       {sep: ":", upper: true},
+	"{mac-dash}":  {sep: "-"},
+	"{MAC-DASH}":  {sep: "-", upper: true},
+	"{mac-plain}": {},
+	"{MAC-PLAIN}": {upper: true},
+}
+
+// templateKeys lays records out according to a key template such as
+// "hosts/{MAC-DASH}/lease": a fixed text around a single MAC placeholder
+type templateKeys struct {
+	before, after string
+	format        macFormat
+}
+
+func (t templateKeys) Key(mac net.HardwareAddr) string {
+	octets := make([]string, len(mac))
+	for i, b := range mac {
+		octets[i] = hex.EncodeToString([]byte{b})
+	}
+	s := strings.Join(octets, t.format.sep)
+	if t.format.upper {
+		s = strings.ToUpper(s)
+	}
+	return t.before + s + t.after
+}
+
+func (t templateKeys) MAC(key string) (string, bool) {
+	s, ok := strings.CutPrefix(key, t.before)
+	if !ok {
+		return "", false
+	}
+	if s, ok = strings.CutSuffix(s, t.after); !ok {
+		return "", false
+	}
+	if t.format.sep != "" {
+		s = strings.ReplaceAll(s, t.format.sep, "")
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 6 {
+		return "", false
+	}
+	mac := net.HardwareAddr(b)
+	// Only accept the exact spelling, so that each record has a single key
+	if t.Key(mac) != key {
+		return "", false
+	}
+	return mac.String(), true
+}
+
+func parseKeyTemplateOption(p *PluginState, value string) error {
+	var keys *templateKeys
+	for placeholder, format := range keyTemplatePlaceholders {
+		before, after, ok := strings.Cut(value, placeholder)
+		if !ok {
+			continue
+		}
+		if keys != nil || strings.Contains(after, placeholder) {
+			return fmt.Errorf("template %q must contain a single MAC address placeholder", value)
+		}
+		keys = &templateKeys{before: before, after: after, format: format}
+	}
+	if keys == nil {
+		return fmt.Errorf("template %q has no MAC address placeholder, such as {mac}", value)
+	}
+	if strings.HasPrefix(keys.before, "/") {
+		return fmt.Errorf("template %q must not begin with a '/'", value)
+	}
+	for _, dir := range []string{batchKeyDir, configKeyDir, offerKeyDir, v6KeyDir} {
+		if keys.before == dir || strings.HasPrefix(keys.before, dir+"/") {
+			return fmt.Errorf("template %q uses the reserved directory %s", value, dir)
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+// recordKeys returns the layout of JSON records under the KV prefix
+func (p *PluginState) recordKeys() keyCodec {
+	if p.keys == nil {
+		return macKeys{}
+	}
+	return p.keys
+}
+
+// parseInstanceOption sets the identifier of the instance, e.g. the interface
+// it serves, so that instances sharing a KV prefix keep separate leases
+func parseInstanceOption(p *PluginState, value string) error {
+	if value == "" {
+		return fmt.Errorf("instance identifier cannot be empty")
+	}
+	if strings.Contains(value, "/") {
+		return fmt.Errorf("instance identifier %q must not contain a '/'", value)
+	}
+	if strings.HasPrefix(value, "_") {
+		return fmt.Errorf("instance identifier %q must not begin with a '_', reserved for the plugin's directories", value)
+	}
+	p.instance = value
+	return nil
+}
+
+// instancePrefix returns the KV prefix of instance under prefix: all of its
+// keys, records as well as plugin state, live in a sub-directory named after
+// it. The prefix is used as is without an instance.
+func instancePrefix(prefix, instance string) string {
+	if instance == "" {
+		return prefix
+	}
+	return strings.TrimRight(prefix, "/") + "/" + instance
+}
@@ -0,0 +1,124 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestKeyTemplateAdoptsExistingStore loads and updates records held in an
+// existing schema, next to keys the plugin doesn't own
+func TestKeyTemplateAdoptsExistingStore(t *testing.T) {
+	kv := newMemKV()
+	for key, value := range map[string]string{
+		"dhcp/hosts/02-00-00-00-00-01/lease": `{"ip":"10.0.0.1","expires":1735689600,"hostname":"one"}`,
+		"dhcp/hosts/02-00-00-00-00-01/owner": `"alice"`,
+		"dhcp/hosts/02:00:00:00:00:02/lease": `{"ip":"10.0.0.2","expires":1735689600}`,
+		"dhcp/inventory":                     `[]`,
+	} {
+		_, err := kv.Put(&api.KVPair{Key: key, Value: []byte(value)}, nil)
+		require.NoError(t, err)
+	}
+	p := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "dhcp", metrics: newMetrics()}
+	require.NoError(t, parseKeyTemplateOption(p, "hosts/{MAC-DASH}/lease"))
+
+	stored, _, err := p.loadRecords()
+	require.NoError(t, err)
+	require.Len(t, stored, 1)
+	require.Contains(t, stored, "02:00:00:00:00:01")
+	assert.Equal(t, "one", stored["02:00:00:00:00:01"].Hostname)
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 0xab}
+	rec := &Record{IP: net.IPv4(10, 0, 0, 3), Expires: expire}
+	require.NoError(t, p.saveIPAddress(context.Background(), mac, rec))
+	assert.Contains(t, kv.data, "dhcp/hosts/02-00-00-00-00-AB/lease")
+	stored, _, err = p.loadRecords()
+	require.NoError(t, err)
+	assert.Equal(t, rec, stored[mac.String()])
+
+	require.NoError(t, p.deleteIPAddress(context.Background(), mac))
+	assert.NotContains(t, kv.data, "dhcp/hosts/02-00-00-00-00-AB/lease")
+}
+
+func TestTemplateKeys(t *testing.T) {
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0, 0, 1}
+	for template, key := range map[string]string{
+		"{mac}":             "aa:bb:cc:00:00:01",
+		"{MAC}.json":        "AA:BB:CC:00:00:01.json",
+		"hosts/{mac-plain}": "hosts/aabbcc000001",
+		"x/{MAC-PLAIN}/y":   "x/AABBCC000001/y",
+		"{mac-dash}":        "aa-bb-cc-00-00-01",
+	} {
+		p := &PluginState{}
+		require.NoError(t, parseKeyTemplateOption(p, template), template)
+		assert.Equal(t, key, p.keys.Key(mac), template)
+		got, ok := p.keys.MAC(key)
+		assert.True(t, ok, template)
+		assert.Equal(t, mac.String(), got, template)
+	}
+
+	p := &PluginState{}
+	require.NoError(t, parseKeyTemplateOption(p, "hosts/{mac-plain}"))
+	for _, key := range []string{"hosts/AABBCC000001", "hosts/aabbcc0000", "hosts/aabbcc000001/x", "other/aabbcc000001"} {
+		_, ok := p.keys.MAC(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestParseKeyTemplateOption(t *testing.T) {
+	for _, template := range []string{
+		"hosts/lease",
+		"{mac}/{mac}",
+		"{mac}/{MAC}",
+		"/hosts/{mac}",
+		"_config/{mac}",
+		"_batch",
+	} {
+		assert.Error(t, parseKeyTemplateOption(&PluginState{}, template), template)
+	}
+}
+
+// TestInstancesShareAPrefix keeps the leases of instances sharing a prefix
+// apart, and out of the records of an instance without an identifier
+func TestInstancesShareAPrefix(t *testing.T) {
+	kv := newMemKV()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	instance := func(id string) *PluginState {
+		p := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, metrics: newMetrics()}
+		if id != "" {
+			require.NoError(t, parseInstanceOption(p, id))
+		}
+		p.consulKVPrefix = instancePrefix("leases", p.instance)
+		return p
+	}
+	eth1, eth10 := instance("eth1"), instance("eth10")
+	require.NoError(t, eth1.saveIPAddress(context.Background(), mac, &Record{IP: net.IPv4(10, 0, 0, 1), Expires: expire}))
+	require.NoError(t, eth10.saveIPAddress(context.Background(), mac, &Record{IP: net.IPv4(10, 1, 0, 1), Expires: expire}))
+	assert.Contains(t, kv.data, "leases/eth1/"+mac.String())
+	assert.Contains(t, kv.data, "leases/eth10/"+mac.String())
+
+	for p, ip := range map[*PluginState]net.IP{eth1: net.IPv4(10, 0, 0, 1), eth10: net.IPv4(10, 1, 0, 1)} {
+		stored, _, err := p.loadRecords()
+		require.NoError(t, err)
+		require.Len(t, stored, 1, p.instance)
+		assert.True(t, stored[mac.String()].IP.Equal(ip), p.instance)
+	}
+
+	stored, _, err := instance("").loadRecords()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+}
+
+func TestParseInstanceOption(t *testing.T) {
+	for _, value := range []string{"", "eth0/1", "_config"} {
+		assert.Error(t, parseInstanceOption(&PluginState{}, value), value)
+	}
+	p := &PluginState{}
+	require.NoError(t, parseInstanceOption(p, "eth0"))
+	assert.Equal(t, "leases/eth0", instancePrefix("leases/", p.instance))
+	assert.Equal(t, "leases/", instancePrefix("leases/", ""))
+}
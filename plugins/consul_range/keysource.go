@@ -0,0 +1,77 @@
+package consulrangeplugin
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// unstableKeyOptions are options whose value differs between the messages of
+// a client, which can't key its lease
+var unstableKeyOptions = map[uint8]bool{
+	dhcpv4.OptionRequestedIPAddress.Code(): true,
+	dhcpv4.OptionIPAddressLeaseTime.Code(): true,
+	dhcpv4.OptionDHCPMessageType.Code():    true,
+	dhcpv4.OptionServerIdentifier.Code():   true,
+}
+
+// parseKeySourceOption sets what identifies the client of a lease: "mac",
+// "client-id" (option 61) or the code of another option
+func parseKeySourceOption(p *PluginState, value string) error {
+	switch value {
+	case "mac":
+		p.keySource = nil
+		return nil
+	case "client-id":
+		p.keySource = dhcpv4.OptionClientIdentifier
+		return nil
+	}
+	code, err := strconv.ParseUint(value, 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid key source %q, want mac, client-id or an option code", value)
+	}
+	if code == 0 || code == 255 {
+		return fmt.Errorf("option %d carries no data", code)
+	}
+	if unstableKeyOptions[uint8(code)] {
+		return fmt.Errorf("option %d changes between the messages of a client", code)
+	}
+	p.keySource = dhcpv4.GenericOptionCode(code)
+	return nil
+}
+
+// clientKey returns the key of the lease of the client of req: its hardware
+// address, or the value of the key-source option, spelled like a MAC address.
+// It returns an error if req doesn't carry it.
+func (p *PluginState) clientKey(req *dhcpv4.DHCPv4) (net.HardwareAddr, error) {
+	if p.keySource == nil {
+		return req.ClientHWAddr, nil
+	}
+	value := req.Options.Get(p.keySource)
+	if len(value) == 0 {
+		return nil, fmt.Errorf("missing key source %s from MAC %s", p.keySource, p.logMAC(req.ClientHWAddr.String()))
+	}
+	return net.HardwareAddr(value), nil
+}
+
+// parseClientKey parses a lease key: a MAC address in any format accepted by
+// net.ParseMAC, or colon separated hex octets of any length
+func parseClientKey(s string) (net.HardwareAddr, error) {
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac, nil
+	}
+	octets := strings.Split(s, ":")
+	key := make(net.HardwareAddr, len(octets))
+	for i, o := range octets {
+		b, err := hex.DecodeString(o)
+		if err != nil || len(b) != 1 {
+			return nil, fmt.Errorf("invalid lease key %q", s)
+		}
+		key[i] = b[0]
+	}
+	return key, nil
+}
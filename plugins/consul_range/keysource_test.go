@@ -0,0 +1,84 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4KeySource(t *testing.T) {
+	clientID := dhcpv4.OptClientIdentifier([]byte{1, 2, 0, 0, 0, 0, 9})
+	custom := dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(224), []byte("asset-42"))
+	for _, tc := range []struct {
+		source string
+		option dhcpv4.Option
+		key    string
+	}{
+		{"mac", dhcpv4.OptHostName("laptop"), "02:00:00:00:00:01"},
+		{"client-id", clientID, "01:02:00:00:00:00:09"},
+		{"224", custom, "61:73:73:65:74:2d:34:32"},
+	} {
+		t.Run(tc.source, func(t *testing.T) {
+			p := testPluginState(t)
+			require.NoError(t, parseKeySourceOption(p, tc.source))
+			lease := func(mac net.HardwareAddr) string {
+				req, stub := testRequest(t, mac, dhcpv4.WithOption(tc.option))
+				resp, _ := p.Handler4(req, stub)
+				require.NotNil(t, resp)
+				return resp.YourIPAddr.String()
+			}
+
+			ip := lease(net.HardwareAddr{2, 0, 0, 0, 0, 1})
+			assert.Equal(t, ip, lease(net.HardwareAddr{2, 0, 0, 0, 0, 1}), "the lease must be stable")
+			require.Contains(t, p.Recordsv4, tc.key)
+			stored, err := loadRecords(p.kv, p.consulKVPrefix)
+			require.NoError(t, err)
+			assert.Equal(t, ip, stored[tc.key].IP.String(), "the lease must be stored under its key")
+
+			other := lease(net.HardwareAddr{2, 0, 0, 0, 0, 2})
+			if tc.source == "mac" {
+				assert.NotEqual(t, ip, other)
+			} else {
+				assert.Equal(t, ip, other, "a new NIC with the same key keeps the lease")
+				assert.Len(t, p.Recordsv4, 1)
+
+				// Requests without the key are dropped
+				req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3})
+				resp, _ := p.Handler4(req, stub)
+				assert.Nil(t, resp)
+				assert.Equal(t, uint64(1), p.metrics.malformedRequests.Value())
+			}
+		})
+	}
+}
+
+func TestParseKeySourceOption(t *testing.T) {
+	for _, value := range []string{"duid", "0", "255", "256", "50", "53", "54"} {
+		assert.Error(t, parseKeySourceOption(&PluginState{}, value), value)
+	}
+	p := &PluginState{}
+	require.NoError(t, parseKeySourceOption(p, "82"))
+	assert.Equal(t, uint8(82), p.keySource.Code())
+	require.NoError(t, parseKeySourceOption(p, "mac"))
+	assert.Nil(t, p.keySource)
+}
+
+func TestParseClientKey(t *testing.T) {
+	for s, want := range map[string]string{
+		"02:00:00:00:00:01":    "02:00:00:00:00:01",
+		"02-00-00-00-00-01":    "02:00:00:00:00:01",
+		"01:02:00:00:00:00:09": "01:02:00:00:00:00:09",
+		"ff":                   "ff",
+	} {
+		key, err := parseClientKey(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, key.String())
+	}
+	for _, s := range []string{"", "01:2", "01::02", "0g:00"} {
+		_, err := parseClientKey(s)
+		assert.Error(t, err, s)
+	}
+}
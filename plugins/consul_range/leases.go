@@ -0,0 +1,86 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// lease is a point-in-time copy of a record, along with the MAC address it belongs to
+type lease struct {
+	MAC string `json:"mac"`
+	Record
+	// Infinite is set for leases that never expire, whose expiry is meaningless
+	Infinite bool `json:"infinite,omitempty"`
+	// Age is the number of seconds the client has held a lease for, unset if
+	// the record predates first_seen
+	Age int64 `json:"age,omitempty"`
+}
+
+// leases returns a copy of all records, ordered by IP address
+func (p *PluginState) leases() []lease {
+	p.Lock()
+	out := make([]lease, 0, len(p.Recordsv4))
+	for mac, rec := range p.Recordsv4 {
+		out = append(out, lease{MAC: mac, Record: *rec, Infinite: rec.infinite()})
+	}
+	p.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		return compareIP(out[i].IP, out[j].IP) < 0
+	})
+	return out
+}
+
+// dumpLeases returns the leases as exposed by the HTTP API, with MAC
+// addresses anonymized if configured
+func (p *PluginState) dumpLeases() []lease {
+	leases := p.leases()
+	now := p.now().Unix()
+	for i := range leases {
+		leases[i].MAC = p.logMAC(leases[i].MAC)
+		if leases[i].FirstSeen > 0 {
+			leases[i].Age = now - int64(leases[i].FirstSeen)
+		}
+	}
+	return leases
+}
+
+// sortLeases orders leases, already ordered by IP address, by the given key:
+// "ip" (or "") or "mac", "expiry" with ties ordered by IP address, or "age"
+// from the oldest allocation to the newest, leases of unknown age last
+func sortLeases(leases []lease, key string) error {
+	switch key {
+	case "", "ip":
+	case "mac":
+		sort.SliceStable(leases, func(i, j int) bool { return leases[i].MAC < leases[j].MAC })
+	case "expiry":
+		sort.SliceStable(leases, func(i, j int) bool { return leases[i].Expires < leases[j].Expires })
+	case "age":
+		sort.SliceStable(leases, func(i, j int) bool {
+			a, b := leases[i].FirstSeen, leases[j].FirstSeen
+			return a > 0 && (b == 0 || a < b)
+		})
+	default:
+		return fmt.Errorf("unknown sort key %q, want ip, mac, expiry or age", key)
+	}
+	return nil
+}
+
+// paginate returns the page of up to limit leases starting at offset. A zero
+// limit returns all leases from offset.
+func paginate(leases []lease, offset, limit int) []lease {
+	if offset >= len(leases) {
+		return []lease{}
+	}
+	leases = leases[offset:]
+	if limit > 0 && limit < len(leases) {
+		leases = leases[:limit]
+	}
+	return leases
+}
+
+// compareIP orders IPv4 addresses numerically
+func compareIP(a, b net.IP) int {
+	return bytes.Compare(a.To4(), b.To4())
+}
@@ -0,0 +1,90 @@
+package consulrangeplugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errLeaseTimeFloor is returned when applying a lease time below the floor
+var errLeaseTimeFloor = errors.New("lease time is below the floor")
+
+func parseLeaseTimeFloorOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("floor must be positive, got %s", d)
+	}
+	p.leaseTimeFloor = d
+	return nil
+}
+
+// checkLeaseTimeFloor returns an error if d is below the lease time floor, if set
+func (p *PluginState) checkLeaseTimeFloor(d time.Duration) error {
+	if p.leaseTimeFloor > 0 && d < p.leaseTimeFloor {
+		return fmt.Errorf("%w: %s is shorter than %s", errLeaseTimeFloor, d, p.leaseTimeFloor)
+	}
+	return nil
+}
+
+// setLeaseTime changes the lease time granted from now on, refusing values
+// below the floor, so that a mistake can't make clients renew far more often
+// and overload Consul. Existing leases are updated as clients renew.
+func (p *PluginState) setLeaseTime(d time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+	if err := p.checkLeaseTimeFloor(d); err != nil {
+		p.metrics.leaseTimeBelowFloor.Inc()
+		log.Warningf("Refusing to change the lease time from %s: %v", p.LeaseTime, err)
+		return err
+	}
+	if d == infiniteLeaseTime && p.backpressureFree > 0 {
+		return errors.New("backpressure cannot shorten infinite leases")
+	}
+	log.Printf("Changing the lease time from %s to %s", p.LeaseTime, d)
+	p.LeaseTime = d
+	return nil
+}
+
+// noteGrantedLeaseTime warns when the lease time granted, e.g. shortened by
+// backpressure, falls below the floor, and counts such grants.
+// Must be called with the plugin lock held.
+func (p *PluginState) noteGrantedLeaseTime(d time.Duration) {
+	if p.leaseTimeFloor == 0 {
+		return
+	}
+	below := d < p.leaseTimeFloor
+	if below {
+		p.metrics.leaseTimeBelowFloor.Inc()
+	}
+	if below != p.belowLeaseTimeFloor {
+		p.belowLeaseTimeFloor = below
+		if below {
+			log.Warningf("Granting a lease time of %s, below the floor of %s", d, p.leaseTimeFloor)
+		} else {
+			log.Printf("Granted lease time is back above the floor of %s", p.leaseTimeFloor)
+		}
+	}
+}
+
+// serveLeaseTime changes the lease time to the "duration" query parameter,
+// see setLeaseTime. The change lasts until restart.
+func (p *PluginState) serveLeaseTime(w http.ResponseWriter, r *http.Request) {
+	d, err := parseLeaseTime(r.URL.Query().Get("duration"))
+	if err != nil || d <= 0 {
+		http.Error(w, "missing or invalid duration", http.StatusBadRequest)
+		return
+	}
+	if err := p.setLeaseTime(d); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errLeaseTimeFloor) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseTimeChangeBelowFloorRejected(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseLeaseTimeFloorOption(p, "30m"))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	res, err := authorizedPost(srv.URL+"/lease-time?duration=1m", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.Equal(t, time.Hour, p.LeaseTime, "the lease time must not change")
+
+	var metrics bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&metrics))
+	assert.Contains(t, metrics.String(), "\nconsulrange_lease_time_below_floor_total 1\n")
+
+	res, err = authorizedPost(srv.URL+"/lease-time?duration=45m", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, 45*time.Minute, resp.IPAddressLeaseTime(0))
+
+	res, err = authorizedPost(srv.URL+"/lease-time?duration=soon", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestInfiniteLeaseTimeRefusedWithBackpressure(t *testing.T) {
+	p := testPluginState(t)
+	p.backpressureFree = 10
+	p.backpressureFactor = 0.5
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	res, err := authorizedPost(srv.URL+"/lease-time?duration=infinite", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, time.Hour, p.LeaseTime, "the lease time must not change")
+	assert.Error(t, p.setLeaseTime(infiniteLeaseTime))
+
+	// Leaving infinite leases is allowed
+	p.LeaseTime = infiniteLeaseTime
+	assert.NoError(t, p.setLeaseTime(time.Hour))
+}
+
+func TestGrantedLeaseTimeBelowFloorCounted(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseLeaseTimeFloorOption(p, "30m"))
+	p.Lock()
+	p.noteGrantedLeaseTime(10 * time.Minute)
+	p.noteGrantedLeaseTime(10 * time.Minute)
+	assert.True(t, p.belowLeaseTimeFloor)
+	p.noteGrantedLeaseTime(time.Hour)
+	assert.False(t, p.belowLeaseTimeFloor)
+	p.Unlock()
+
+	var metrics bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&metrics))
+	assert.Contains(t, metrics.String(), "\nconsulrange_lease_time_below_floor_total 2\n")
+}
+
+func TestZeroRequestedLeaseTimeGetsDefault(t *testing.T) {
+	p := testPluginState(t)
+	for i, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)},
+			dhcpv4.WithMessageType(mt), dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(0)))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		assert.Equal(t, time.Hour, resp.IPAddressLeaseTime(0), mt.String())
+	}
+
+	// Backpressure never shortens a lease to nothing
+	p.LeaseTime = time.Second
+	p.backpressureFree = 99
+	p.backpressureFactor = 0.1
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3}, dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(0)))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, time.Second, resp.IPAddressLeaseTime(0))
+}
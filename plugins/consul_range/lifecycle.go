@@ -0,0 +1,114 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func parseSweepOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("sweep interval must be positive: %s", d)
+	}
+	p.sweepInterval = d
+	return nil
+}
+
+// removeLease frees the address leased to mac and deletes its record from
+// memory and Consul. Must be called with the plugin lock held.
+func (p *PluginState) removeLease(ctx context.Context, mac string, rec *Record) error {
+	hw, err := parseClientKey(mac)
+	if err != nil {
+		return fmt.Errorf("invalid MAC address %q: %w", mac, err)
+	}
+	if err := p.deleteIPAddress(ctx, hw); err != nil {
+		return err
+	}
+	p.deleteRecord(mac)
+	p.releaseAddress(rec.IP, mac)
+	p.cancelMove(mac)
+	if rec.Next != nil {
+		if err := p.free(rec.Next); err != nil {
+			log.Warningf("Could not free %s set aside for MAC %s: %v", rec.Next, p.logMAC(mac), err)
+		}
+	}
+	return nil
+}
+
+// releaseAddress frees ip, no longer leased to mac.
+// Must be called with the plugin lock held.
+func (p *PluginState) releaseAddress(ip net.IP, mac string) {
+	// Reserved addresses stay allocated for their client, abandoned ones for nobody
+	if p.inRange(ip) && !p.isReserved(ip) && !p.abandoned(ip) || p.migrated(ip) {
+		if err := p.free(ip); err != nil {
+			log.Warningf("Could not free %s for MAC %s: %v", ip, p.logMAC(mac), err)
+		}
+	}
+}
+
+// handleRelease ends the lease of mac a client gives up with a DHCPRELEASE.
+// Must be called with the plugin lock held.
+func (p *PluginState) handleRelease(ctx context.Context, req *dhcpv4.DHCPv4, mac string) {
+	rec, ok := p.Recordsv4[mac]
+	if !ok || !rec.IP.Equal(req.ClientIPAddr) {
+		log.Printf("Ignoring release of unknown lease %s for MAC %s", req.ClientIPAddr, p.logMAC(mac))
+		return
+	}
+	if rec.Pinned {
+		log.Printf("Keeping pinned lease %s released by MAC %s", rec.IP, p.logMAC(mac))
+		return
+	}
+	if err := p.removeLease(ctx, mac, rec); err != nil {
+		log.Errorf("Could not release lease %s for MAC %s: %v", rec.IP, p.logMAC(mac), err)
+		return
+	}
+	p.affinity.remember(mac, rec.IP, p.now())
+	log.Printf("Released lease %s for MAC %s", rec.IP, p.logMAC(mac))
+	p.emit(eventRelease, mac, rec)
+}
+
+// startSweeper periodically reclaims expired leases.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) startSweeper() {
+	go func() {
+		ticker := time.NewTicker(p.sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), p.sweepInterval)
+			if n := p.sweep(ctx); n > 0 {
+				log.Printf("Reclaimed %d expired leases", n)
+			}
+			cancel()
+		}
+	}()
+}
+
+// sweep reclaims all expired leases and offers, and returns how many leases were reclaimed
+func (p *PluginState) sweep(ctx context.Context) int {
+	p.Lock()
+	defer p.Unlock()
+	now := p.now()
+	n := 0
+	p.expireOffers(ctx)
+	for mac, rec := range p.Recordsv4 {
+		if !rec.expiredAt(now) {
+			continue
+		}
+		if err := p.removeLease(ctx, mac, rec); err != nil {
+			log.Warningf("Could not reclaim expired lease %s for MAC %s: %v", rec.IP, p.logMAC(mac), err)
+			continue
+		}
+		p.affinity.remember(mac, rec.IP, now)
+		p.emit(eventExpire, mac, rec)
+		n++
+	}
+	p.shedRecords(ctx)
+	return n
+}
@@ -0,0 +1,82 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingHook is a leaseHook remembering all events it was notified of
+type recordingHook struct {
+	sync.Mutex
+	events []leaseEvent
+}
+
+func (h *recordingHook) LeaseEvent(ev leaseEvent) {
+	h.Lock()
+	defer h.Unlock()
+	h.events = append(h.events, ev)
+}
+
+func (h *recordingHook) types() []eventType {
+	h.Lock()
+	defer h.Unlock()
+	var out []eventType
+	for _, ev := range h.events {
+		out = append(out, ev.Type)
+	}
+	return out
+}
+
+func TestSweepReclaimsExpired(t *testing.T) {
+	p := testPluginState(t)
+	hook := &recordingHook{}
+	p.addHook(hook)
+	ctx := context.Background()
+
+	expired := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	expired.Expires = int(time.Now().Add(-time.Minute).Unix())
+	require.NoError(t, p.saveIPAddress(ctx, net.HardwareAddr{2, 0, 0, 0, 0, 1}, expired))
+	live := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 2))
+	require.NoError(t, p.saveIPAddress(ctx, net.HardwareAddr{2, 0, 0, 0, 0, 2}, live))
+
+	assert.Equal(t, 1, p.sweep(ctx))
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:01")
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:02")
+	assert.Equal(t, []eventType{eventExpire}, hook.types())
+
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "02:00:00:00:00:01", "expired lease was not deleted from Consul")
+
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 1))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated, "expired lease address was not freed")
+}
+
+func TestHandler4Release(t *testing.T) {
+	p := testPluginState(t)
+	hook := &recordingHook{}
+	p.addHook(hook)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	ip := resp.YourIPAddr
+
+	req, stub = testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease), dhcpv4.WithClientIP(ip))
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp, "no response is sent to a release")
+	assert.True(t, stop)
+	assert.NotContains(t, p.Recordsv4, mac.String())
+	assert.Equal(t, []eventType{eventAllocate, eventRelease}, hook.types())
+}
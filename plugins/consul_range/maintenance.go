@@ -0,0 +1,51 @@
+package consulrangeplugin
+
+import (
+	"net/http"
+	"strconv"
+)
+
+func parseMaintenanceOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.maintenance = enabled
+	return nil
+}
+
+// setMaintenance toggles maintenance mode: existing leases keep being renewed
+// so that clients keep their configuration, while new clients are deferred
+// until it ends
+func (p *PluginState) setMaintenance(enabled bool) {
+	p.Lock()
+	defer p.Unlock()
+	if p.maintenance == enabled {
+		return
+	}
+	p.maintenance = enabled
+	if enabled {
+		log.Printf("Entering maintenance, only renewing existing leases")
+	} else {
+		log.Printf("Leaving maintenance, allocating again")
+	}
+}
+
+// inMaintenance reports whether maintenance mode is on
+func (p *PluginState) inMaintenance() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.maintenance
+}
+
+// serveMaintenance toggles maintenance mode according to the enabled query
+// parameter, see setMaintenance
+func (p *PluginState) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "missing or invalid enabled", http.StatusBadRequest)
+		return
+	}
+	p.setMaintenance(enabled)
+	w.WriteHeader(http.StatusNoContent)
+}
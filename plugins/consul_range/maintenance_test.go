@@ -0,0 +1,70 @@
+package consulrangeplugin
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceOnlyRenews(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	post := func(query string) int {
+		res, err := authorizedPost(srv.URL+"/maintenance"+query, "", nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	healthz := func() string {
+		res, err := http.Get(srv.URL + "/healthz")
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	existing := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, existing)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "ok\n", healthz())
+
+	assert.Equal(t, http.StatusBadRequest, post(""))
+	require.Equal(t, http.StatusNoContent, post("?enabled=true"))
+	assert.Equal(t, "maintenance\n", healthz())
+
+	// New clients are deferred
+	newcomer := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	req, stub = testRequest(t, newcomer, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.NotContains(t, p.Recordsv4, newcomer.String())
+
+	// Existing leases are extended
+	clock.Advance(p.LeaseTime / 2)
+	before := p.Recordsv4[existing.String()].Expires
+	req, stub = testRequest(t, existing, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+	assert.Greater(t, p.Recordsv4[existing.String()].Expires, before)
+
+	require.Equal(t, http.StatusNoContent, post("?enabled=false"))
+	assert.Equal(t, "ok\n", healthz())
+	req, stub = testRequest(t, newcomer, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.2", resp.YourIPAddr.String())
+}
@@ -0,0 +1,133 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+const (
+	// recordOverhead estimates the memory used by a record besides its
+	// contents: its map entry, pointer and MAC address key
+	recordOverhead = int(unsafe.Sizeof(Record{})) + 64
+	// tagOverhead estimates the memory used by a tag besides its key and value
+	tagOverhead = 48
+	// userClassOverhead estimates the memory used by a user class besides its value
+	userClassOverhead = int(unsafe.Sizeof(""))
+	// memoryShedAt and memoryShedTo are the fractions of the memory cap at
+	// which leases start being shed, and down to which they are shed
+	memoryShedAt = 0.9
+	memoryShedTo = 0.8
+)
+
+// parseByteSize parses a size in bytes, with an optional KiB, MiB or GiB suffix
+func parseByteSize(value string) (int, error) {
+	multiplier := 1
+	for suffix, m := range map[string]int{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if n, ok := strings.CutSuffix(value, suffix); ok {
+			value, multiplier = n, m
+			break
+		}
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive, got %d", n)
+	}
+	return n * multiplier, nil
+}
+
+func parseRecordsMemoryCapOption(p *PluginState, value string) error {
+	n, err := parseByteSize(value)
+	if err != nil {
+		return err
+	}
+	p.recordsMemoryCap = n
+	return nil
+}
+
+// size estimates the memory used by the record of mac
+func (r *Record) size(mac string) int {
+	n := recordOverhead + len(mac) + len(r.IP) + len(r.Next) + len(r.Hostname)
+	for k, v := range r.Tags {
+		n += tagOverhead + len(k) + len(v)
+	}
+	for _, class := range r.UserClass {
+		n += userClassOverhead + len(class)
+	}
+	return n
+}
+
+// recordsMemory estimates the memory used by the records.
+// Must be called with the plugin lock held.
+func (p *PluginState) recordsMemory() int {
+	n := 0
+	for mac, rec := range p.Recordsv4 {
+		n += rec.size(mac)
+	}
+	return n
+}
+
+// shedRecords expires the leases that were renewed the longest ago once the
+// records get close to the memory cap, until they are well below it. Pinned
+// and infinite leases, and those of reserved addresses, are never shed. It
+// returns the number of leases shed.
+// Must be called with the plugin lock held.
+func (p *PluginState) shedRecords(ctx context.Context) int {
+	if p.recordsMemoryCap == 0 {
+		return 0
+	}
+	used := p.recordsMemory()
+	if used < int(float64(p.recordsMemoryCap)*memoryShedAt) {
+		return 0
+	}
+	log.Errorf("Lease records use about %d bytes, close to records-memory-cap %d, expiring the oldest idle leases", used, p.recordsMemoryCap)
+
+	type candidate struct {
+		mac string
+		rec *Record
+	}
+	var candidates []candidate
+	for mac, rec := range p.Recordsv4 {
+		if rec.Pinned || rec.infinite() || p.isReserved(rec.IP) {
+			continue
+		}
+		candidates = append(candidates, candidate{mac, rec})
+	}
+	// Leases expiring first were renewed the longest ago
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].rec.Expires < candidates[j].rec.Expires
+	})
+	target := int(float64(p.recordsMemoryCap) * memoryShedTo)
+	n := 0
+	for _, c := range candidates {
+		if used <= target {
+			break
+		}
+		size := c.rec.size(c.mac)
+		if err := p.removeLease(ctx, c.mac, c.rec); err != nil {
+			log.Warningf("Could not shed lease %s for MAC %s: %v", c.rec.IP, p.logMAC(c.mac), err)
+			continue
+		}
+		p.emit(eventExpire, c.mac, c.rec)
+		used -= size
+		n++
+	}
+	p.metrics.recordsShed.Add(uint64(n))
+	log.Errorf("Shed %d leases, lease records now use about %d bytes", n, used)
+	return n
+}
+
+// registerMemoryGauge exports the estimated memory used by the records of p
+func (m *metrics) registerMemoryGauge(p *PluginState) {
+	m.newGauge("consulrange_records_memory_bytes", "Estimated memory used by the lease records", func() float64 {
+		p.Lock()
+		defer p.Unlock()
+		return float64(p.recordsMemory())
+	})
+}
@@ -0,0 +1,66 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShedRecordsTrimsOldestLeases(t *testing.T) {
+	p := testPluginState(t)
+	p.metrics.registerMemoryGauge(p)
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		rec := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}, net.IPv4(10, 0, 0, byte(i)))
+		rec.Expires = int(now.Add(time.Duration(i) * time.Minute).Unix())
+	}
+	p.Recordsv4["02:00:00:00:00:01"].Pinned = true
+	size := p.Recordsv4["02:00:00:00:00:02"].size("02:00:00:00:00:02")
+	p.Lock()
+	used := p.recordsMemory()
+	p.Unlock()
+	assert.Equal(t, 10*size, used)
+
+	// Below the threshold nothing is shed
+	p.recordsMemoryCap = 12 * size
+	assert.Zero(t, p.sweep(context.Background()))
+	assert.Len(t, p.Recordsv4, 10)
+
+	// Above it, leases are shed down to 80% of the cap, oldest first
+	p.recordsMemoryCap = 10 * size
+	p.sweep(context.Background())
+	assert.Len(t, p.Recordsv4, 8)
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:01", "pinned leases are never shed")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:02")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:03")
+	assert.Equal(t, uint64(2), p.metrics.recordsShed.Value())
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "02:00:00:00:00:02")
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 2))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated, "the address of a shed lease must be freed")
+
+	var metrics bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&metrics))
+	assert.Contains(t, metrics.String(), "consulrange_records_memory_bytes ")
+}
+
+func TestParseByteSize(t *testing.T) {
+	for value, want := range map[string]int{"100": 100, "4KiB": 4096, "64MiB": 64 << 20, "1GiB": 1 << 30} {
+		got, err := parseByteSize(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, want, got, value)
+	}
+	for _, value := range []string{"", "0", "-1KiB", "1KB", "MiB"} {
+		_, err := parseByteSize(value)
+		assert.Error(t, err, value)
+	}
+}
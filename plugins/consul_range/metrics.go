@@ -0,0 +1,202 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// counter is a monotonically increasing metric, safe for concurrent use
+type counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n
+func (c *counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current value of the counter
+func (c *counter) Value() uint64 {
+	return c.value.Load()
+}
+
+// gauge is a metric whose value is computed when it is collected
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// labeledGauge is a family of gauges told apart by their labels, whose samples
+// are computed when collected
+type labeledGauge struct {
+	name    string
+	help    string
+	samples func() []gaugeSample
+}
+
+// gaugeSample is the value of a labeled gauge for a set of labels, rendered as
+// in the exposition format, e.g. class="staff"
+type gaugeSample struct {
+	labels string
+	value  float64
+}
+
+// metrics holds the metrics exported by an instance of the consulrange plugin
+type metrics struct {
+	counters      []*counter
+	gauges        []*gauge
+	labeledGauges []*labeledGauge
+
+	// malformedRequests counts requests dropped because they could not be keyed or handled
+	malformedRequests *counter
+	// reconcileRepairs counts drift between the allocator and the records fixed by reconciliation
+	reconcileRepairs *counter
+	// poolExhausted, peerHeld and allocationErrors count allocation failures by reason
+	poolExhausted    *counter
+	peerHeld         *counter
+	allocationErrors *counter
+	// encodingFailures counts lease records that could not be serialized for Consul
+	encodingFailures *counter
+	// leaseTimeBelowFloor counts lease times below the floor granted or refused
+	leaseTimeBelowFloor *counter
+	// invalidRecords counts values under the prefix skipped because they aren't lease records
+	invalidRecords *counter
+	// writesDeduplicated counts record writes skipped because nothing changed
+	writesDeduplicated *counter
+	// hostnameCapped counts new leases refused because too many leases share the client's hostname
+	hostnameCapped *counter
+	// declines counts the DHCPDECLINEs of leased addresses
+	declines *counter
+	// foreignServerID counts requests dropped because they were meant for another server
+	foreignServerID *counter
+	// snapshotFailures counts lease table snapshots that could not be uploaded
+	snapshotFailures *counter
+	// recordsShed counts leases expired early because the records neared their memory cap
+	recordsShed *counter
+	// eventsDropped counts lease events not streamed to a subscriber too slow to keep up
+	eventsDropped *counter
+	// denyCacheHits counts requests dropped because their client was recently denied a lease
+	denyCacheHits *counter
+	// untrustedRelays counts requests dropped because they came through an untrusted relay agent
+	untrustedRelays *counter
+	// consulWriteRetries counts lease record writes retried in the background after failing
+	consulWriteRetries *counter
+	// relayThrottled counts requests dropped because their relay agent exceeded relay-rate-limit
+	relayThrottled *counter
+	// warmupDropped counts requests dropped while warming up after startup
+	warmupDropped *counter
+	// consulBusy counts Consul operations failed because consul-max-inflight were in flight
+	consulBusy *counter
+	// kafkaDropped counts lease events not published to Kafka
+	kafkaDropped *counter
+	// naks counts the DHCPNAKs sent, nakLoops the clients sent nak-loop-threshold of them within nak-loop-window
+	naks     *counter
+	nakLoops *counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{}
+	m.malformedRequests = m.newCounter("consulrange_malformed_requests_total", "Requests dropped because they were malformed")
+	m.reconcileRepairs = m.newCounter("consulrange_reconcile_repairs_total", "Discrepancies between the allocator and the lease records repaired")
+	m.poolExhausted = m.newCounter("consulrange_allocation_exhausted_total", "Allocations failed because the pool was exhausted")
+	m.peerHeld = m.newCounter("consulrange_allocation_peer_held_total", "Allocations failed because all free addresses were offered by peers")
+	m.allocationErrors = m.newCounter("consulrange_allocation_errors_total", "Allocations failed because the allocator or Consul failed")
+	m.leaseTimeBelowFloor = m.newCounter("consulrange_lease_time_below_floor_total", "Lease times below the floor granted, or refused when changing the lease time")
+	m.encodingFailures = m.newCounter("consulrange_record_encoding_failures_total", "Lease records that could not be serialized for Consul")
+	m.invalidRecords = m.newCounter("consulrange_invalid_records_total", "Values under the prefix skipped when loading lease records because they were not valid records")
+	m.writesDeduplicated = m.newCounter("consulrange_writes_deduplicated_total", "Lease record writes skipped because the record was unchanged")
+	m.hostnameCapped = m.newCounter("consulrange_hostname_cap_refusals_total", "New leases refused because max-leases-per-hostname leases already used the client's hostname")
+	m.declines = m.newCounter("consulrange_declines_total", "Leased addresses declined by their client because they were in use")
+	m.foreignServerID = m.newCounter("consulrange_foreign_server_id_total", "Requests dropped because their server identifier was that of another server")
+	m.snapshotFailures = m.newCounter("consulrange_snapshot_failures_total", "Snapshots of the lease table that could not be uploaded")
+	m.recordsShed = m.newCounter("consulrange_records_shed_total", "Leases expired early because the lease records neared records-memory-cap")
+	m.eventsDropped = m.newCounter("consulrange_event_stream_dropped_total", "Lease events dropped because an event socket subscriber was too slow")
+	m.denyCacheHits = m.newCounter("consulrange_deny_cache_hits_total", "Requests dropped because their client was denied a new lease within deny-cache-ttl")
+	m.untrustedRelays = m.newCounter("consulrange_untrusted_relay_total", "Requests dropped because their relay agent was not a trusted-relay")
+	m.consulWriteRetries = m.newCounter("consulrange_consul_write_retries_total", "Lease record writes to Consul retried in the background after failing, e.g. during a leader election")
+	m.relayThrottled = m.newCounter("consulrange_relay_throttled_total", "Requests dropped because their relay agent forwarded more than relay-rate-limit requests a second")
+	m.warmupDropped = m.newCounter("consulrange_warmup_dropped_total", "Requests dropped while warming up after startup")
+	m.consulBusy = m.newCounter("consulrange_consul_busy_total", "Consul KV operations failed because consul-max-inflight operations were in flight for consul-queue-timeout")
+	m.kafkaDropped = m.newCounter("consulrange_kafka_dropped_total", "Lease events dropped because the Kafka queue was full or they could not be published")
+	m.naks = m.newCounter("consulrange_naks_total", "DHCPNAKs sent to clients")
+	m.nakLoops = m.newCounter("consulrange_nak_loops_total", "Clients sent nak-loop-threshold DHCPNAKs within nak-loop-window, e.g. stuck in a boot loop")
+	return m
+}
+
+// newCounter creates a counter and registers it with the metrics set
+func (m *metrics) newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	m.counters = append(m.counters, c)
+	return c
+}
+
+// newGauge creates a gauge reading its value from fn and registers it with the metrics set
+func (m *metrics) newGauge(name, help string, fn func() float64) *gauge {
+	g := &gauge{name: name, help: help, value: fn}
+	m.gauges = append(m.gauges, g)
+	return g
+}
+
+// newLabeledGauge creates a labeled gauge reading its samples from fn and
+// registers it with the metrics set
+func (m *metrics) newLabeledGauge(name, help string, fn func() []gaugeSample) *labeledGauge {
+	g := &labeledGauge{name: name, help: help, samples: fn}
+	m.labeledGauges = append(m.labeledGauges, g)
+	return g
+}
+
+// registerPoolGauges exports the utilization of the pool served by p
+func (m *metrics) registerPoolGauges(p *PluginState) {
+	m.newGauge("consulrange_pool_size", "Number of addresses in the range", func() float64 {
+		// The range can be resized at runtime
+		p.Lock()
+		defer p.Unlock()
+		return float64(p.poolSize())
+	})
+	m.newGauge("consulrange_pool_used", "Number of addresses currently allocated", func() float64 {
+		return float64(p.poolUsed())
+	})
+	m.newGauge("consulrange_leases_infinite", "Number of leases that never expire", func() float64 {
+		return float64(p.infiniteLeases())
+	})
+	m.newLabeledGauge("consulrange_subrange_size", "Number of addresses in each sub-range of the range", func() []gaugeSample {
+		return p.subRangeSamples(func(u subRangeUsage) uint32 { return u.size })
+	})
+	m.newLabeledGauge("consulrange_subrange_used", "Number of addresses currently allocated in each sub-range of the range", func() []gaugeSample {
+		return p.subRangeSamples(func(u subRangeUsage) uint32 { return u.used })
+	})
+}
+
+// writeText renders all metrics in the Prometheus text exposition format
+func (m *metrics) writeText(w io.Writer) error {
+	for _, c := range m.counters {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value()); err != nil {
+			return err
+		}
+	}
+	for _, g := range m.gauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value()); err != nil {
+			return err
+		}
+	}
+	for _, g := range m.labeledGauges {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name); err != nil {
+			return err
+		}
+		for _, s := range g.samples() {
+			if _, err := fmt.Fprintf(w, "%s{%s} %g\n", g.name, s.labels, s.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
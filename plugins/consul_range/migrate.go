@@ -0,0 +1,188 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultMigrationLease is the lease time granted on the old address of a
+// client being migrated, so that it soon comes back to be moved
+const defaultMigrationLease = time.Minute
+
+// migration is a range all clients are moved to over their renewals, draining
+// the configured range
+type migration struct {
+	start, end net.IP
+	allocator  allocators.Allocator
+}
+
+// contains reports whether ip is within the migration target
+func (m *migration) contains(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	n := binary.BigEndian.Uint32(ip4)
+	return n >= binary.BigEndian.Uint32(m.start) && n <= binary.BigEndian.Uint32(m.end)
+}
+
+// parseMigrateToOption sets the range to migrate clients to, given as
+// "<start IP>-<end IP>". It may not overlap the configured range.
+func parseMigrateToOption(p *PluginState, value string) error {
+	first, last, ok := strings.Cut(value, "-")
+	if !ok {
+		return fmt.Errorf("invalid migration target %q, want <start IP>-<end IP>", value)
+	}
+	start, err := parseIPv4(first)
+	if err != nil {
+		return err
+	}
+	end, err := parseIPv4(last)
+	if err != nil {
+		return err
+	}
+	if compareIP(start, end) > 0 {
+		return fmt.Errorf("start of migration target %s is higher than its end %s", start, end)
+	}
+	if compareIP(start, p.rangeEnd) <= 0 && compareIP(p.rangeStart, end) <= 0 {
+		return fmt.Errorf("migration target %s overlaps the range", value)
+	}
+	alloc, err := p.newAllocator(start, end)
+	if err != nil {
+		return err
+	}
+	p.migration = &migration{start: start, end: end, allocator: alloc}
+	return nil
+}
+
+func parseMigrateLeaseOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < time.Second {
+		return fmt.Errorf("lease time must be at least 1s, got %s", d)
+	}
+	p.migrationLease = d
+	return nil
+}
+
+// migrated reports whether ip is within the migration target, if any
+func (p *PluginState) migrated(ip net.IP) bool {
+	return p.migration != nil && p.migration.contains(ip)
+}
+
+// free returns ip to the allocator it was allocated from
+func (p *PluginState) free(ip net.IP) error {
+	alloc := p.allocator
+	if p.migrated(ip) {
+		alloc = p.migration.allocator
+	}
+	return alloc.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+}
+
+// claimMigration allocates the addresses of rec within the migration target,
+// when loading records
+func (p *PluginState) claimMigration(rec *Record) error {
+	for _, ip := range []net.IP{rec.IP, rec.Next} {
+		if !p.migrated(ip) {
+			continue
+		}
+		got, err := p.migration.allocator.Allocate(net.IPNet{IP: ip})
+		if err != nil {
+			return err
+		}
+		if !got.IP.Equal(ip) {
+			_ = p.migration.allocator.Free(got)
+			return fmt.Errorf("%s is already allocated", ip)
+		}
+	}
+	return nil
+}
+
+// migrationStep is what migrateLease did to a lease still within the range
+type migrationStep int
+
+const (
+	// migrationMoved means the lease was moved to the migration target
+	migrationMoved migrationStep = iota
+	// migrationDrain means the old address was granted a short lease, with
+	// the client's address in the target set aside
+	migrationDrain
+	// migrationNak means the client must restart its configuration to be moved
+	migrationNak
+)
+
+// migrateLease moves the lease of mac, of the client of req, towards the migration
+// target. A client renewing its old address is granted a short lease on it,
+// with its new address set aside in the record. When it comes back, it is
+// NAKed so that it restarts with a DISCOVER, which moves the lease.
+// Must be called with the plugin lock held.
+func (p *PluginState) migrateLease(ctx context.Context, req *dhcpv4.DHCPv4, mac net.HardwareAddr, record *Record, leaseTime time.Duration) (migrationStep, error) {
+	drained := record.Next != nil
+	if !drained {
+		ip, err := p.migration.allocator.Allocate(net.IPNet{})
+		if err != nil {
+			return 0, newAllocationError(err)
+		}
+		record.Next = ip.IP.To4()
+	}
+
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		old := record.IP
+		p.setRecordIP(mac.String(), record, record.Next)
+		record.Next = nil
+		record.Expires = expiresAt(p.now(), leaseTime)
+		if err := p.persist(ctx, mac, record); err != nil {
+			log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+		}
+		if err := p.free(old); err != nil {
+			log.Warningf("Could not free %s for MAC %s: %v", old, p.logMAC(mac.String()), err)
+		}
+		log.Printf("Migrated MAC %s from %s to %s", p.logMAC(mac.String()), old, record.IP)
+		return migrationMoved, nil
+	}
+	if drained {
+		return migrationNak, nil
+	}
+	record.Expires = expiresAt(p.now(), p.migrationLease)
+	if err := p.persist(ctx, mac, record); err != nil {
+		log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+	}
+	log.Printf("Moving MAC %s from %s to %s on its next renewal", p.logMAC(mac.String()), record.IP, record.Next)
+	return migrationDrain, nil
+}
+
+// migrationProgress returns how many leases are left in the range, and how
+// many were moved to the migration target
+func (p *PluginState) migrationProgress() (remaining, moved int) {
+	p.Lock()
+	defer p.Unlock()
+	for _, rec := range p.Recordsv4 {
+		if p.migrated(rec.IP) {
+			moved++
+		} else if p.inRange(rec.IP) {
+			remaining++
+		}
+	}
+	return remaining, moved
+}
+
+// registerMigrationGauges exports the progress of the migration of p
+func (m *metrics) registerMigrationGauges(p *PluginState) {
+	m.newGauge("consulrange_migration_remaining", "Number of leases left to migrate out of the range", func() float64 {
+		remaining, _ := p.migrationProgress()
+		return float64(remaining)
+	})
+	m.newGauge("consulrange_migration_moved", "Number of leases migrated to the target range", func() float64 {
+		_, moved := p.migrationProgress()
+		return float64(moved)
+	})
+}
@@ -0,0 +1,115 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrationMovesClientsAcrossRenewals(t *testing.T) {
+	p := testPluginState(t)
+	p.migrationLease = defaultMigrationLease
+	require.NoError(t, parseMigrateToOption(p, "10.0.1.1-10.0.1.10"))
+	p.metrics.registerMigrationGauges(p)
+	clients := []net.HardwareAddr{{2, 0, 0, 0, 0, 1}, {2, 0, 0, 0, 0, 2}}
+	for i, mac := range clients {
+		testLease(t, p, mac, net.IPv4(10, 0, 0, byte(i+1)))
+	}
+	renew := func(mac net.HardwareAddr) *dhcpv4.DHCPv4 {
+		req, stub := testRequest(t, mac, dhcpv4.WithClientIP(p.Recordsv4[mac.String()].IP))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		return resp
+	}
+
+	// First renewal: the old address is kept with a short lease
+	resp := renew(clients[0])
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+	assert.Equal(t, defaultMigrationLease, resp.IPAddressLeaseTime(0))
+	rec := p.Recordsv4[clients[0].String()]
+	assert.Equal(t, "10.0.1.1", rec.Next.String())
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.1", stored[clients[0].String()].Next.String(), "the new address was not persisted")
+
+	// Next renewal: the client is told to restart, and moved on its DISCOVER
+	resp = renew(clients[0])
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	req, stub := testRequest(t, clients[0], dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.1.1", resp.YourIPAddr.String())
+	assert.Equal(t, time.Hour, resp.IPAddressLeaseTime(0))
+	req, stub = testRequest(t, clients[0], dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(10, 0, 1, 1))))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.1.1", resp.YourIPAddr.String())
+	assert.Nil(t, p.Recordsv4[clients[0].String()].Next)
+
+	remaining, moved := p.migrationProgress()
+	assert.Equal(t, 1, remaining)
+	assert.Equal(t, 1, moved)
+
+	// The old address was freed, new clients only get addresses in the target
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 1))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated)
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3})
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.1.2", resp.YourIPAddr.String())
+
+	// The second client moves the same way
+	renew(clients[1])
+	assert.Equal(t, dhcpv4.MessageTypeNak, renew(clients[1]).MessageType())
+	req, stub = testRequest(t, clients[1], dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.1.3", resp.YourIPAddr.String())
+
+	remaining, moved = p.migrationProgress()
+	assert.Equal(t, 0, remaining)
+	assert.Equal(t, 3, moved)
+	var metrics bytes.Buffer
+	require.NoError(t, p.metrics.writeText(&metrics))
+	assert.Contains(t, metrics.String(), "\nconsulrange_migration_remaining 0\n")
+	assert.Contains(t, metrics.String(), "\nconsulrange_migration_moved 3\n")
+}
+
+func TestMigrationSweepFreesTarget(t *testing.T) {
+	p := testPluginState(t)
+	p.migrationLease = defaultMigrationLease
+	require.NoError(t, parseMigrateToOption(p, "10.0.1.1-10.0.1.10"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+
+	req, stub := testRequest(t, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)))
+	_, _ = p.Handler4(req, stub)
+	p.Recordsv4[mac.String()].Expires = int(time.Now().Add(-time.Minute).Unix())
+	assert.Equal(t, 1, p.sweep(context.Background()))
+
+	// Both the old address and the one set aside are free again
+	got, err := p.migration.allocator.Allocate(net.IPNet{})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.1.1", got.IP.String())
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 1))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated)
+}
+
+func TestParseMigrateToOption(t *testing.T) {
+	for _, value := range []string{"10.0.0.5-10.0.1.5", "10.0.1.5-10.0.1.1", "10.0.1.1", "10.0.1.1-::1"} {
+		p := testPluginState(t)
+		assert.Error(t, parseMigrateToOption(p, value), value)
+	}
+}
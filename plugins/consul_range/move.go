@@ -0,0 +1,109 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// errInvalidMove is returned when staging a move to an address outside the range
+	errInvalidMove = errors.New("invalid move")
+	// errMoveConflict is returned when staging a move to an address in use
+	errMoveConflict = errors.New("address in use")
+)
+
+// stageMove sets ip aside for the client holding the lease of mac, which is
+// moved to it at its next contact, see applyMove. ip must be free and within
+// the range. Staged moves are held in memory only.
+func (p *PluginState) stageMove(mac net.HardwareAddr, ip net.IP) error {
+	p.Lock()
+	defer p.Unlock()
+	rec, ok := p.Recordsv4[mac.String()]
+	if !ok {
+		return fmt.Errorf("%w for MAC %s", errNoLease, p.logMAC(mac.String()))
+	}
+	if !p.inRange(ip) {
+		return fmt.Errorf("%w: %s is not within range %s-%s", errInvalidMove, ip, p.rangeStart, p.rangeEnd)
+	}
+	if rec.IP.Equal(ip) {
+		return fmt.Errorf("%w: MAC %s already holds %s", errInvalidMove, p.logMAC(mac.String()), ip)
+	}
+	if p.isReserved(ip) {
+		return fmt.Errorf("%w: %s is reserved", errMoveConflict, ip)
+	}
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errMoveConflict, ip, err)
+	}
+	if !got.IP.Equal(ip) {
+		_ = p.allocator.Free(got)
+		return fmt.Errorf("%w: %s", errMoveConflict, ip)
+	}
+	p.cancelMove(mac.String())
+	if p.moves == nil {
+		p.moves = make(map[string]net.IP)
+	}
+	p.moves[mac.String()] = ip
+	log.Printf("Moving MAC %s from %s to %s at its next contact", p.logMAC(mac.String()), rec.IP, ip)
+	return nil
+}
+
+// cancelMove drops the move staged for mac, if any, freeing its address.
+// Must be called with the plugin lock held.
+func (p *PluginState) cancelMove(mac string) {
+	ip, ok := p.moves[mac]
+	if !ok {
+		return
+	}
+	delete(p.moves, mac)
+	if err := p.free(ip); err != nil {
+		log.Warningf("Could not free %s staged for MAC %s: %v", ip, p.logMAC(mac), err)
+	}
+}
+
+// applyMove moves the lease of mac to the address staged for it, granted
+// for leaseTime, and frees its old address.
+// Must be called with the plugin lock held.
+func (p *PluginState) applyMove(ctx context.Context, mac net.HardwareAddr, record *Record, leaseTime time.Duration) {
+	ip := p.moves[mac.String()]
+	delete(p.moves, mac.String())
+	old := record.IP
+	p.setRecordIP(mac.String(), record, ip)
+	record.Expires = expiresAt(p.now(), leaseTime)
+	if err := p.persist(ctx, mac, record); err != nil {
+		log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+	}
+	p.releaseAddress(old, mac.String())
+	log.Printf("Moved MAC %s from %s to %s", p.logMAC(mac.String()), old, ip)
+}
+
+// serveMove stages a move of the lease of the MAC address in the path to the
+// "ip" query parameter, see stageMove
+func (p *PluginState) serveMove(w http.ResponseWriter, r *http.Request) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	ip, err := parseIPv4(r.URL.Query().Get("ip"))
+	if err != nil {
+		http.Error(w, "missing or invalid ip", http.StatusBadRequest)
+		return
+	}
+	err = p.stageMove(mac, ip)
+	switch {
+	case errors.Is(err, errNoLease):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errInvalidMove):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errMoveConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,68 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postMove POSTs a move of mac to ip and returns the status
+func postMove(t *testing.T, srv *httptest.Server, mac, ip string) int {
+	t.Helper()
+	res, err := authorizedPost(srv.URL+"/leases/"+mac+"/move?ip="+ip, "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestMoveStagedAndConsumed(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 2))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusConflict, postMove(t, srv, mac.String(), "10.0.0.2"))
+	assert.Equal(t, http.StatusBadRequest, postMove(t, srv, mac.String(), "10.0.1.1"))
+	assert.Equal(t, http.StatusNotFound, postMove(t, srv, "02:00:00:00:00:03", "10.0.0.5"))
+	require.Equal(t, http.StatusAccepted, postMove(t, srv, mac.String(), "10.0.0.5"))
+
+	// The staged address is held until the client comes back
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3}, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.NotEqual(t, "10.0.0.5", resp.YourIPAddr.String())
+
+	// Renewing the old address restarts the client onto the new one
+	req, stub = testRequest(t, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 1)))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.Equal(t, "10.0.0.5", p.Recordsv4[mac.String()].IP.String())
+	assert.Empty(t, p.moves)
+	l, ok := p.leaseByIP(net.IPv4(10, 0, 0, 5))
+	require.True(t, ok, "the moved lease is not indexed under its new address")
+	assert.Equal(t, mac.String(), l.MAC)
+	_, ok = p.leaseByIP(net.IPv4(10, 0, 0, 1))
+	assert.False(t, ok, "the moved lease is still indexed under its old address")
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", stored[mac.String()].IP.String(), "the move was not persisted")
+
+	req, stub = testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.5", resp.YourIPAddr.String())
+
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 1))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated, "the old address was not freed")
+}
@@ -0,0 +1,78 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultNakLoopThreshold is the number of NAKs within the window past
+	// which a client is reported, unless set otherwise
+	defaultNakLoopThreshold = 5
+	// defaultNakLoopWindow is the window NAKs are counted in, unless set otherwise
+	defaultNakLoopWindow = 5 * time.Minute
+	// maxTrackedNaks bounds the number of clients whose NAKs are counted
+	maxTrackedNaks = 1024
+)
+
+// nakTracker counts the NAKs sent to each client, to report those NAKed
+// threshold times within window, typically stuck requesting an address they
+// can't have. It is protected by the plugin lock.
+type nakTracker struct {
+	threshold int
+	// clients holds the clients NAKed within the window, counting the NAKs
+	// since the first as hits
+	clients ttlSet[string]
+}
+
+func parseNakLoopThresholdOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 1 {
+		return fmt.Errorf("NAK loop threshold must be at least 2, got %d", n)
+	}
+	p.naks.threshold = n
+	return nil
+}
+
+func parseNakLoopWindowOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("NAK loop window must be positive: %s", d)
+	}
+	p.naks.clients.ttl = d
+	return nil
+}
+
+// limit returns the number of NAKs within the window a client is reported at
+func (t *nakTracker) limit() int {
+	if t.threshold == 0 {
+		return defaultNakLoopThreshold
+	}
+	return t.threshold
+}
+
+// period returns the window NAKs are counted in
+func (t *nakTracker) period() time.Duration {
+	return t.clients.ttl
+}
+
+// nak records that mac was NAKed at now, and reports whether that makes the
+// threshold within its window, once per window. If the tracker is full once
+// expired windows are pruned, the NAK is not counted.
+func (t *nakTracker) nak(mac string, now time.Time) bool {
+	c, ok := t.clients.get(mac, now)
+	if !ok {
+		if c = t.clients.add(mac, now); c == nil {
+			return false
+		}
+	}
+	c.hits++
+	return c.hits == t.limit()
+}
@@ -0,0 +1,90 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nakLoopWarnings returns the number of NAK loop warnings logged by hook
+func nakLoopWarnings(hook *test.Hook) int {
+	n := 0
+	for _, e := range hook.AllEntries() {
+		if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "boot loop") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRepeatedNaksDetected(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	require.NoError(t, parseNakLoopThresholdOption(p, "3"))
+	require.NoError(t, parseNakLoopWindowOption(p, "1m"))
+	p.naks.clients.size = maxTrackedNaks
+	hook := test.NewLocal(log.Logger)
+	defer hook.Reset()
+
+	// A client stuck requesting an address outside the range
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	shrunkLease(p, mac)
+	request := func() {
+		t.Helper()
+		req, stub := testRequest(t, mac)
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		require.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+		clock.Advance(10 * time.Second)
+	}
+
+	request()
+	request()
+	assert.Zero(t, p.metrics.nakLoops.Value())
+	request()
+	assert.Equal(t, uint64(1), p.metrics.nakLoops.Value())
+	assert.Equal(t, 1, nakLoopWarnings(hook))
+	// Reported once per window
+	request()
+	assert.Equal(t, uint64(1), p.metrics.nakLoops.Value())
+	assert.Equal(t, uint64(4), p.metrics.naks.Value())
+
+	// NAKs spread wider than the window aren't a loop
+	clock.Advance(time.Minute)
+	for range 3 {
+		request()
+		clock.Advance(time.Minute)
+	}
+	assert.Equal(t, uint64(1), p.metrics.nakLoops.Value())
+	assert.Equal(t, 1, nakLoopWarnings(hook))
+}
+
+func TestNakTrackerBounded(t *testing.T) {
+	tracker := nakTracker{clients: ttlSet[string]{ttl: defaultNakLoopWindow, size: maxTrackedNaks}}
+	now := time.Now()
+	for i := range maxTrackedNaks {
+		tracker.nak(net.HardwareAddr{2, 0, 0, 0, byte(i >> 8), byte(i)}.String(), now)
+	}
+	assert.False(t, tracker.nak("02:00:00:00:ff:ff", now))
+	assert.Equal(t, maxTrackedNaks, tracker.clients.len())
+
+	// Expired windows make room
+	tracker.nak("02:00:00:00:ff:ff", now.Add(defaultNakLoopWindow))
+	assert.Equal(t, 1, tracker.clients.len())
+}
+
+func TestParseNakLoopOptions(t *testing.T) {
+	p := &PluginState{}
+	assert.Error(t, parseNakLoopThresholdOption(p, "1"))
+	assert.Error(t, parseNakLoopThresholdOption(p, "many"))
+	assert.Error(t, parseNakLoopWindowOption(p, "0s"))
+	assert.Error(t, parseNakLoopWindowOption(p, "-1m"))
+}
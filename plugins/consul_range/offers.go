@@ -0,0 +1,187 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// offerKeyDir is the sub-directory of the KV prefix holding the addresses
+// reserved by outstanding offers, one key per address
+const offerKeyDir = "_offer"
+
+// Consul rejects session TTLs outside of these bounds
+const (
+	minOfferTTL = 10 * time.Second
+	maxOfferTTL = 24 * time.Hour
+)
+
+// sessionStore is the subset of the Consul session API used to reserve offers
+type sessionStore interface {
+	Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error)
+	Destroy(id string, q *api.WriteOptions) (*api.WriteMeta, error)
+}
+
+// offer is an address offered to a client that has not requested it yet.
+// The address is reserved in Consul by a key locked by a TTL session, so peers
+// sharing the KV prefix won't offer it too until the session expires.
+type offer struct {
+	ip      net.IP
+	session string
+	expires time.Time
+}
+
+func parseOfferTTLOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < minOfferTTL || d > maxOfferTTL {
+		return fmt.Errorf("offer TTL must be between %s and %s, got %s", minOfferTTL, maxOfferTTL, d)
+	}
+	p.offerTTL = d
+	return nil
+}
+
+// offerKey returns the key reserving ip while it is offered
+func (p *PluginState) offerKey(ip net.IP) string {
+	return strings.TrimRight(p.consulKVPrefix, "/") + "/" + offerKeyDir + "/" + ip.String()
+}
+
+// pendingOffer returns the outstanding offer made to mac, reserving a new
+// address from pool if there is none.
+// Must be called with the plugin lock held.
+func (p *PluginState) pendingOffer(ctx context.Context, mac string, pool *classPool) (*offer, error) {
+	p.expireOffers(ctx)
+	if o, ok := p.offers[mac]; ok {
+		return o, nil
+	}
+	if p.offers == nil {
+		p.offers = make(map[string]*offer)
+	}
+	// Addresses a peer holds the reservation of stay allocated while looking
+	// for another one, so that they aren't handed out again, then are freed
+	var skipped []net.IP
+	defer func() {
+		for _, ip := range skipped {
+			if err := p.free(ip); err != nil {
+				log.Warningf("Could not free %s: %v", ip, err)
+			}
+		}
+	}()
+	for {
+		ip, err := p.allocateFor(mac, pool)
+		if err != nil {
+			if len(skipped) > 0 && allocationFailure(err) == allocExhausted {
+				return nil, &allocationError{reason: allocPeerHeld, err: errPeerHeld}
+			}
+			return nil, err
+		}
+		session, err := p.reserve(ctx, mac, ip.IP)
+		if err != nil {
+			if ferr := p.free(ip.IP); ferr != nil {
+				log.Warningf("Could not free %s: %v", ip.IP, ferr)
+			}
+			return nil, &allocationError{reason: allocError, err: err}
+		}
+		if session == "" {
+			log.Debugf("Address %s is reserved by a peer, trying the next one", ip.IP)
+			skipped = append(skipped, ip.IP)
+			continue
+		}
+		o := &offer{ip: ip.IP.To4(), session: session, expires: p.now().Add(p.offerTTL)}
+		p.offers[mac] = o
+		return o, nil
+	}
+}
+
+// reserve locks the offer key of ip with a new TTL session. It returns the ID of
+// the session, or an empty string if a peer holds the reservation.
+func (p *PluginState) reserve(ctx context.Context, mac string, ip net.IP) (string, error) {
+	wo := (&api.WriteOptions{}).WithContext(ctx)
+	session, _, err := p.sessions.Create(&api.SessionEntry{
+		Name:     "consulrange offer " + ip.String(),
+		TTL:      p.offerTTL.String(),
+		Behavior: api.SessionBehaviorDelete,
+		// The default lock delay would block re-offering the address for 15s
+		LockDelay: time.Millisecond,
+	}, wo)
+	if err != nil {
+		return "", fmt.Errorf("failed to create offer session: %w", err)
+	}
+	acquired, _, err := p.kv.Acquire(&api.KVPair{Key: p.offerKey(ip), Value: []byte(mac), Session: session}, wo)
+	if err != nil || !acquired {
+		if _, derr := p.sessions.Destroy(session, wo); derr != nil {
+			log.Warningf("Could not destroy offer session %s: %v", session, derr)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to reserve offer in consul: %w", err)
+	}
+	if !acquired {
+		return "", nil
+	}
+	return session, nil
+}
+
+// promoteOffer drops the reservation of the offer made to mac once it has been
+// turned into a lease, if there is one.
+// Must be called with the plugin lock held.
+func (p *PluginState) promoteOffer(ctx context.Context, mac string) {
+	o, ok := p.offers[mac]
+	if !ok {
+		return
+	}
+	delete(p.offers, mac)
+	// The session deletes the reservation key when destroyed
+	if _, err := p.sessions.Destroy(o.session, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		log.Warningf("Could not release reservation of %s for MAC %s: %v", o.ip, p.logMAC(mac), err)
+	}
+}
+
+// expireOffers returns the addresses of lapsed offers to the pool.
+// Must be called with the plugin lock held.
+func (p *PluginState) expireOffers(ctx context.Context) {
+	now := p.now()
+	for mac, o := range p.offers {
+		if now.Before(o.expires) {
+			continue
+		}
+		delete(p.offers, mac)
+		// Consul may take up to twice the TTL to invalidate the session itself
+		if _, err := p.sessions.Destroy(o.session, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			log.Warningf("Could not release reservation of %s for MAC %s: %v", o.ip, p.logMAC(mac), err)
+		}
+		if err := p.free(o.ip); err != nil {
+			log.Warningf("Could not free offered address %s: %v", o.ip, err)
+		}
+	}
+}
+
+// allocateLease picks the address of a new lease for mac from pool. With offer
+// reservations enabled, that is the address offered to mac, or a freshly
+// reserved one for clients requesting an address without a prior offer.
+// Clients with a static reservation get the reserved address.
+// Must be called with the plugin lock held.
+func (p *PluginState) allocateLease(ctx context.Context, mac string, pool *classPool) (net.IP, error) {
+	if ip, ok := p.reservedFor(mac); ok {
+		// Already allocated when the reservation was applied
+		return ip, nil
+	}
+	if p.offerTTL == 0 {
+		ip, err := p.allocateFor(mac, pool)
+		if err != nil {
+			return nil, err
+		}
+		return ip.IP.To4(), nil
+	}
+	o, err := p.pendingOffer(ctx, mac, pool)
+	if err != nil {
+		return nil, err
+	}
+	return o.ip, nil
+}
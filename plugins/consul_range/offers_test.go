@@ -0,0 +1,140 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memSessions is an in-memory sessionStore releasing the locks of a memKV,
+// with the delete behavior, when a session is destroyed
+type memSessions struct {
+	sync.Mutex
+	kv   *memKV
+	next int
+}
+
+func (s *memSessions) Create(_ *api.SessionEntry, _ *api.WriteOptions) (string, *api.WriteMeta, error) {
+	s.Lock()
+	defer s.Unlock()
+	s.next++
+	return fmt.Sprintf("session-%d", s.next), &api.WriteMeta{}, nil
+}
+
+func (s *memSessions) Destroy(id string, _ *api.WriteOptions) (*api.WriteMeta, error) {
+	s.kv.Lock()
+	defer s.kv.Unlock()
+	for key, holder := range s.kv.locks {
+		if holder == id {
+			delete(s.kv.locks, key)
+			delete(s.kv.data, key)
+		}
+	}
+	return &api.WriteMeta{}, nil
+}
+
+// testOfferPluginState is a testPluginState with offer reservations stored in kv
+func testOfferPluginState(t *testing.T, kv *memKV, sessions *memSessions) *PluginState {
+	p := testPluginState(t)
+	p.kv = kv
+	p.sessions = sessions
+	p.offerTTL = time.Minute
+	return p
+}
+
+func TestOffersDoNotCollideAcrossInstances(t *testing.T) {
+	kv := newMemKV()
+	sessions := &memSessions{kv: kv}
+	instances := []*PluginState{
+		testOfferPluginState(t, kv, sessions),
+		testOfferPluginState(t, kv, sessions),
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		offered = make(map[string]string)
+	)
+	for i, p := range instances {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(p *PluginState, mac net.HardwareAddr) {
+				defer wg.Done()
+				req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+				resp, _ := p.Handler4(req, stub)
+				if !assert.NotNil(t, resp) {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if other, ok := offered[resp.YourIPAddr.String()]; ok {
+					t.Errorf("%s offered to both %s and %s", resp.YourIPAddr, other, mac)
+				}
+				offered[resp.YourIPAddr.String()] = mac.String()
+			}(p, net.HardwareAddr{2, 0, 0, 0, byte(i), byte(j)})
+		}
+	}
+	wg.Wait()
+	assert.Len(t, offered, 8)
+
+	// Offers are not leases until requested
+	stored, err := loadRecords(kv, "leases")
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// Requesting promotes the reservation to a lease
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 0}
+	req, stub := testRequest(t, mac)
+	resp, _ := instances[0].Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, mac.String(), offered[resp.YourIPAddr.String()], "the offered address was not leased")
+	assert.NotContains(t, instances[0].offers, mac.String())
+	stored, err = loadRecords(kv, "leases")
+	require.NoError(t, err)
+	assert.Contains(t, stored, mac.String())
+	pair, _, err := kv.Get(instances[0].offerKey(resp.YourIPAddr), nil)
+	require.NoError(t, err)
+	assert.Nil(t, pair, "reservation was not released")
+}
+
+func TestOfferExpires(t *testing.T) {
+	kv := newMemKV()
+	p := testOfferPluginState(t, kv, &memSessions{kv: kv})
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	ip := resp.YourIPAddr
+
+	p.Lock()
+	p.offers[mac.String()].expires = time.Now().Add(-time.Second)
+	p.Unlock()
+	p.sweep(context.Background())
+
+	p.Lock()
+	defer p.Unlock()
+	assert.Empty(t, p.offers)
+	allocated, err := p.isAllocated(ip)
+	require.NoError(t, err)
+	assert.False(t, allocated, "lapsed offer was not freed")
+	pair, _, err := kv.Get(p.offerKey(ip), nil)
+	require.NoError(t, err)
+	assert.Nil(t, pair, "reservation was not released")
+}
+
+func TestParseOfferTTLOption(t *testing.T) {
+	var p PluginState
+	require.NoError(t, parseOfferTTLOption(&p, "30s"))
+	assert.Equal(t, 30*time.Second, p.offerTTL)
+	assert.Error(t, parseOfferTTLOption(&p, "1s"), "below the Consul session TTL minimum")
+	assert.Error(t, parseOfferTTLOption(&p, "48h"), "above the Consul session TTL maximum")
+}
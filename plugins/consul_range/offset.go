@@ -0,0 +1,40 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+func parseOffsetOption(p *PluginState, value string) error {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid offset %q: %w", value, err)
+	}
+	p.offset = uint32(n)
+	return nil
+}
+
+// dynamicStart returns the first address of the range handed out dynamically,
+// the addresses before it being kept for static use.
+// Must be called with the plugin lock held, the range can be resized.
+func (p *PluginState) dynamicStart() net.IP {
+	return uint32ToIP(binary.BigEndian.Uint32(p.rangeStart) + p.offset)
+}
+
+// applyOffset checks that dynamic allocation can start offset addresses into
+// the range. The skipped addresses remain part of the range, so they can still
+// be reserved and leases on them renewed.
+func (p *PluginState) applyOffset() error {
+	if p.offset == 0 {
+		return nil
+	}
+	if uint64(binary.BigEndian.Uint32(p.rangeStart))+uint64(p.offset) > uint64(binary.BigEndian.Uint32(p.rangeEnd)) {
+		return fmt.Errorf("offset %d is beyond the end of range %s-%s", p.offset, p.rangeStart, p.rangeEnd)
+	}
+	if _, ok := p.allocator.(withinAllocator); !ok {
+		return fmt.Errorf("allocator %T does not support an offset", p.allocator)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetSkipsStartOfRange(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseOffsetOption(p, "3"))
+	require.NoError(t, p.applyOffset())
+
+	var got []string
+	for i := 0; i < 7; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)})
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		got = append(got, resp.YourIPAddr.String())
+	}
+	assert.Equal(t, []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.9", "10.0.0.10"}, got)
+
+	p.Lock()
+	_, err := p.allocate(nil)
+	p.Unlock()
+	assert.ErrorIs(t, err, allocators.ErrNoAddrAvail, "the first addresses must never be allocated")
+
+	// They remain part of the range
+	assert.True(t, p.inRange(net.IPv4(10, 0, 0, 1)))
+}
+
+func TestOffsetWithClassPool(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseClassOption(p, "lab:10.0.0.1-10.0.0.5"))
+	require.NoError(t, parseOffsetOption(p, "3"))
+	require.NoError(t, p.applyClasses())
+	require.NoError(t, p.applyOffset())
+
+	p.Lock()
+	defer p.Unlock()
+	assert.Equal(t, [][2]net.IP{{net.IPv4(10, 0, 0, 6).To4(), net.IPv4(10, 0, 0, 10).To4()}}, p.defaultPool())
+}
+
+func TestApplyOffsetBeyondRange(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseOffsetOption(p, "10"))
+	assert.Error(t, p.applyOffset())
+	require.NoError(t, parseOffsetOption(p, "9"))
+	assert.NoError(t, p.applyOffset())
+	assert.Error(t, parseOffsetOption(p, "-1"))
+}
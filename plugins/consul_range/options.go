@@ -0,0 +1,113 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// optionParser applies the value of an optional argument to the plugin state
+type optionParser func(p *PluginState, value string) error
+
+// optionParsers maps the name of each optional "key=value" argument, accepted
+// after the positional ones, to its parser
+var optionParsers = map[string]optionParser{
+	"storage":                 parseStorageOption,
+	"out-of-range":            parseOutOfRangeOption,
+	"http":                    parseHTTPOption,
+	"http-token":              parseHTTPTokenOption,
+	"renew-mismatch":          parseRenewMismatchOption,
+	"mac-hash-key":            parseMACHashKeyOption,
+	"consul-timeout":          parseConsulTimeoutOption,
+	"reconcile":               parseReconcileOption,
+	"subnet":                  parseSubnetOption,
+	"sweep":                   parseSweepOption,
+	"webhook":                 parseWebhookOption,
+	"webhook-secret":          parseWebhookSecretOption,
+	"offer-ttl":               parseOfferTTLOption,
+	"ignore":                  parseIgnoreOption,
+	"class":                   parseClassOption,
+	"startup-check":           parseStartupCheckOption,
+	"await-handoff":           parseAwaitHandoffOption,
+	"discover-debounce":       parseDiscoverDebounceOption,
+	"rapid-commit":            parseRapidCommitOption,
+	"backpressure":            parseBackpressureOption,
+	"backpressure-lease":      parseBackpressureLeaseOption,
+	"reservations":            parseReservationsOption,
+	"key-template":            parseKeyTemplateOption,
+	"serve-subnet":            parseServeSubnetOption,
+	"hostname":                parseHostnameOption,
+	"server-id":               parseServerIDOption,
+	"server-id-mismatch":      parseServerIDMismatchOption,
+	"nak-server-id":           parseNakServerIDOption,
+	"invalid-hostname":        parseInvalidHostnameOption,
+	"migrate-to":              parseMigrateToOption,
+	"migrate-lease":           parseMigrateLeaseOption,
+	"lease-time-floor":        parseLeaseTimeFloorOption,
+	"offset":                  parseOffsetOption,
+	"dedupe-writes":           parseDedupeWritesOption,
+	"max-leases-per-hostname": parseMaxPerHostnameOption,
+	"pool-config":             parsePoolConfigOption,
+	"allocator":               parseAllocatorOption,
+	"decline-limit":           parseDeclineLimitOption,
+	"subnet-lease":            parseSubnetLeaseOption,
+	"snapshot-url":            parseSnapshotURLOption,
+	"snapshot-interval":       parseSnapshotIntervalOption,
+	"snapshot-import":         parseSnapshotImportOption,
+	"snapshot-region":         parseSnapshotRegionOption,
+	"snapshot-access-key":     parseSnapshotAccessKeyOption,
+	"snapshot-secret-key":     parseSnapshotSecretKeyOption,
+	"records-memory-cap":      parseRecordsMemoryCapOption,
+	"key-source":              parseKeySourceOption,
+	"event-socket":            parseEventSocketOption,
+	"read-prefix":             parseReadPrefixOption,
+	"deny-cache-ttl":          parseDenyCacheTTLOption,
+	"deny-cache-size":         parseDenyCacheSizeOption,
+	"trusted-relay":           parseTrustedRelayOption,
+	"expired-renewal":         parseExpiredRenewalOption,
+	"pretty-json":             parsePrettyJSONOption,
+	"domain":                  parseDomainOption,
+	"search-domains":          parseSearchDomainsOption,
+	"relay-rate-limit":        parseRelayRateLimitOption,
+	"relay-backoff":           parseRelayBackoffOption,
+	"exclude-own-addresses":   parseExcludeOwnAddressesOption,
+	"warmup":                  parseWarmupOption,
+	"consul-max-inflight":     parseConsulMaxInFlightOption,
+	"consul-queue-timeout":    parseConsulQueueTimeoutOption,
+	"maintenance":             parseMaintenanceOption,
+	"hash-allocation":         parseHashAllocationOption,
+	"overflow":                parseOverflowOption,
+	"otlp-endpoint":           parseOTLPEndpointOption,
+	"instance":                parseInstanceOption,
+	"dirty-flush-interval":    parseDirtyFlushIntervalOption,
+	"dirty-flush-timeout":     parseDirtyFlushTimeoutOption,
+	"special-space":           parseSpecialSpaceOption,
+	"encryption-key":          parseEncryptionKeyOption,
+	"range-conflicts":         parseRangeConflictsOption,
+	"registration-id":         parseRegistrationIDOption,
+	"hostname-policy":         parseHostnamePolicyOption,
+	"lease-affinity":          parseLeaseAffinityOption,
+	"kafka":                   parseKafkaOption,
+	"kafka-topic":             parseKafkaTopicOption,
+	"strip-options":           parseStripOptionsOption,
+	"nak-loop-threshold":      parseNakLoopThresholdOption,
+	"nak-loop-window":         parseNakLoopWindowOption,
+	"request-history":         parseRequestHistoryOption,
+}
+
+// parseOptions applies the optional "key=value" arguments to the plugin state
+func (p *PluginState) parseOptions(args []string) error {
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("%w %q, want key=value", ErrInvalidOption, arg)
+		}
+		parse, ok := optionParsers[key]
+		if !ok {
+			return fmt.Errorf("%w: unknown option %q", ErrInvalidOption, key)
+		}
+		if err := parse(p, value); err != nil {
+			return fmt.Errorf("%w: invalid value for option %s: %w", ErrInvalidOption, key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package consulrangeplugin
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+)
+
+// overflowPolicy selects what happens when the leases loaded at startup don't
+// fit in the range, e.g. leases of the same address written by peers that
+// disagreed about the range
+type overflowPolicy int
+
+const (
+	// overflowFail fails the setup, naming how many leases don't fit
+	overflowFail overflowPolicy = iota
+	// overflowKeepRecent keeps the most recently active leases that fit, and
+	// deletes the others
+	overflowKeepRecent
+)
+
+func parseOverflowOption(p *PluginState, value string) error {
+	switch value {
+	case "fail":
+		p.overflow = overflowFail
+	case "keep-recent":
+		p.overflow = overflowKeepRecent
+	default:
+		return fmt.Errorf("unknown overflow policy %q, want fail or keep-recent", value)
+	}
+	return nil
+}
+
+// fitRecords checks, before their addresses are allocated, that the loaded
+// leases within the range fit in it: there can be no more of them than
+// addresses, and no two on the same address. Otherwise it fails, or keeps the
+// most recently active leases according to the overflow policy. Leases that
+// are pinned or never expire are kept first, then those expiring last, which
+// were renewed last.
+// Must be called before the records are indexed.
+func (p *PluginState) fitRecords() error {
+	var macs []string
+	for mac, rec := range p.Recordsv4 {
+		if p.inRange(rec.IP) && !p.migrated(rec.IP) {
+			macs = append(macs, mac)
+		}
+	}
+	capacity := int(p.poolSize()) - len(p.excluded)
+	seen := make(map[string]struct{}, len(macs))
+	conflicts := 0
+	for _, mac := range macs {
+		ip := p.Recordsv4[mac].IP.String()
+		if _, ok := seen[ip]; ok {
+			conflicts++
+		}
+		seen[ip] = struct{}{}
+	}
+	if len(macs) <= capacity && conflicts == 0 {
+		return nil
+	}
+	if p.overflow == overflowFail {
+		return fmt.Errorf("%d leases are within range %s-%s, which holds %d addresses, %d of them on an address already leased",
+			len(macs), p.rangeStart, p.rangeEnd, capacity, conflicts)
+	}
+
+	slices.SortFunc(macs, func(a, b string) int {
+		ra, rb := p.Recordsv4[a], p.Recordsv4[b]
+		if ka, kb := ra.Pinned || ra.infinite(), rb.Pinned || rb.infinite(); ka != kb {
+			if ka {
+				return -1
+			}
+			return 1
+		}
+		if ra.Expires != rb.Expires {
+			return cmp.Compare(rb.Expires, ra.Expires)
+		}
+		return compareIP(ra.IP, rb.IP)
+	})
+	kept := make(map[string]struct{}, capacity)
+	var dropped []string
+	for _, mac := range macs {
+		ip := p.Recordsv4[mac].IP.String()
+		if _, taken := kept[ip]; taken || len(kept) >= capacity {
+			dropped = append(dropped, mac)
+			continue
+		}
+		kept[ip] = struct{}{}
+	}
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	for _, mac := range dropped {
+		log.Warningf("Dropping lease %s for MAC %s, it doesn't fit in range %s-%s", p.Recordsv4[mac].IP, p.logMAC(mac), p.rangeStart, p.rangeEnd)
+		p.deleteRecord(mac)
+		hw, err := parseClientKey(mac)
+		if err != nil {
+			continue
+		}
+		if err := p.deleteIPAddress(ctx, hw); err != nil {
+			log.Errorf("Could not delete lease of MAC %s: %v", p.logMAC(mac), err)
+		}
+	}
+	log.Warningf("Dropped %d leases that didn't fit in range %s-%s", len(dropped), p.rangeStart, p.rangeEnd)
+	return nil
+}
@@ -0,0 +1,85 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// overflowingState returns a plugin state holding a lease on each address of
+// its range, plus older and newer duplicates of the lease on 10.0.0.1
+func overflowingState(t *testing.T) *PluginState {
+	p := testPluginState(t)
+	for i := 1; i <= 10; i++ {
+		mac := net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}
+		rec := &Record{IP: net.IPv4(10, 0, 0, byte(i)), Expires: 1700000000}
+		require.NoError(t, p.saveIPAddress(context.Background(), mac, rec))
+		p.Recordsv4[mac.String()] = rec
+	}
+	for mac, expires := range map[string]int{"02:00:00:00:01:01": 1600000000, "02:00:00:00:01:02": 1800000000} {
+		hw, err := net.ParseMAC(mac)
+		require.NoError(t, err)
+		rec := &Record{IP: net.IPv4(10, 0, 0, 1), Expires: expires}
+		require.NoError(t, p.saveIPAddress(context.Background(), hw, rec))
+		p.Recordsv4[mac] = rec
+	}
+	// Out of range leases are handled as the client renews, they don't count
+	p.Recordsv4["02:00:00:00:02:01"] = &Record{IP: net.IPv4(10, 0, 1, 1), Expires: 1700000000}
+	return p
+}
+
+func TestOverflowFails(t *testing.T) {
+	p := overflowingState(t)
+	err := p.fitRecords()
+	require.Error(t, err)
+	assert.Equal(t, "12 leases are within range 10.0.0.1-10.0.0.10, which holds 10 addresses, 2 of them on an address already leased", err.Error())
+	assert.Len(t, p.Recordsv4, 13)
+}
+
+func TestOverflowKeepsRecent(t *testing.T) {
+	p := overflowingState(t)
+	require.NoError(t, parseOverflowOption(p, "keep-recent"))
+	require.NoError(t, p.fitRecords())
+
+	assert.Len(t, p.Recordsv4, 11)
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:01:02", "the most recent lease of 10.0.0.1 should be kept")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:01:01")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:01")
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:02:01")
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Len(t, stored, 10, "the dropped leases should be deleted from Consul")
+
+	// The remaining leases can all be allocated
+	p.reindex()
+	for mac, rec := range p.Recordsv4 {
+		if !p.inRange(rec.IP) {
+			continue
+		}
+		got, err := p.allocator.Allocate(net.IPNet{IP: rec.IP})
+		require.NoError(t, err)
+		assert.Equal(t, rec.IP.String(), got.IP.String(), fmt.Sprintf("lease of MAC %s", mac))
+	}
+}
+
+func TestOverflowKeepsPinnedFirst(t *testing.T) {
+	p := overflowingState(t)
+	require.NoError(t, parseOverflowOption(p, "keep-recent"))
+	p.Recordsv4["02:00:00:00:01:01"].Pinned = true
+	require.NoError(t, p.fitRecords())
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:01:01")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:01:02")
+}
+
+func TestParseOverflowOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseOverflowOption(p, "keep-recent"))
+	assert.Equal(t, overflowKeepRecent, p.overflow)
+	require.NoError(t, parseOverflowOption(p, "fail"))
+	assert.Equal(t, overflowFail, p.overflow)
+	assert.Error(t, parseOverflowOption(p, "keep-oldest"))
+}
@@ -0,0 +1,61 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+func parseExcludeOwnAddressesOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.excludeOwnAddresses = enabled
+	return nil
+}
+
+// ownAddresses returns the IPv4 addresses of the host's interfaces
+func (p *PluginState) ownAddresses() ([]net.IP, error) {
+	list := p.interfaceAddrs
+	if list == nil {
+		list = net.InterfaceAddrs
+	}
+	addrs, err := list()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		var ip net.IP
+		switch a := addr.(type) {
+		case *net.IPNet:
+			ip = a.IP
+		case *net.IPAddr:
+			ip = a.IP
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ips = append(ips, ip4)
+		}
+	}
+	return ips, nil
+}
+
+// applyOwnAddresses excludes the addresses of the host's interfaces from
+// allocation if exclude-own-addresses is set, so that a range overlapping
+// the server's own address never hands it to a client.
+func (p *PluginState) applyOwnAddresses() error {
+	if !p.excludeOwnAddresses {
+		return nil
+	}
+	ips, err := p.ownAddresses()
+	if err != nil {
+		return fmt.Errorf("could not list the addresses of the host: %w", err)
+	}
+	for _, ip := range ips {
+		if err := p.exclude(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hostAddrs returns interface addresses holding the given CIDRs
+func hostAddrs(t *testing.T, cidrs ...string) func() ([]net.Addr, error) {
+	t.Helper()
+	var addrs []net.Addr
+	for _, c := range cidrs {
+		ip, subnet, err := net.ParseCIDR(c)
+		require.NoError(t, err)
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+	return func() ([]net.Addr, error) { return addrs, nil }
+}
+
+func TestOwnAddressesExcluded(t *testing.T) {
+	p := testPluginState(t)
+	p.interfaceAddrs = hostAddrs(t, "127.0.0.1/8", "10.0.0.3/24", "fe80::1/64", "10.0.0.15/24")
+	require.NoError(t, parseExcludeOwnAddressesOption(p, "true"))
+	require.NoError(t, p.applyOwnAddresses())
+
+	for i := 1; i <= 9; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i)})
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp, "allocation %d failed", i)
+		assert.False(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 3)), "the server's address was allocated")
+	}
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 10})
+	resp, _ := p.Handler4(req, stub)
+	assert.Nil(t, resp, "the pool should be exhausted")
+	assert.False(t, p.inRange(net.IPv4(10, 0, 0, 3)))
+
+	// Growing the range over another address of the host excludes it too
+	require.NoError(t, p.resize(context.Background(), net.IPv4(10, 0, 0, 15).To4()))
+	assert.False(t, p.inRange(net.IPv4(10, 0, 0, 15)))
+	assert.True(t, p.inRange(net.IPv4(10, 0, 0, 14)))
+}
+
+func TestOwnAddressesKeptUnlessEnabled(t *testing.T) {
+	p := testPluginState(t)
+	p.interfaceAddrs = func() ([]net.Addr, error) { return nil, errors.New("not listed") }
+	require.NoError(t, p.applyOwnAddresses())
+	assert.True(t, p.inRange(net.IPv4(10, 0, 0, 3)))
+
+	require.NoError(t, parseExcludeOwnAddressesOption(p, "1"))
+	assert.Error(t, p.applyOwnAddresses())
+	assert.Error(t, parseExcludeOwnAddressesOption(p, "sometimes"))
+}
@@ -0,0 +1,68 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// errNoLease is returned when operating on the lease of a client that holds none
+var errNoLease = errors.New("no lease")
+
+// pin marks the lease of mac as pinned, or not: a pinned lease never expires
+// and keeps its address, even when the client releases it, turning a dynamic
+// lease into a reservation. The flag is persisted with the record.
+func (p *PluginState) pin(ctx context.Context, mac net.HardwareAddr, pinned bool) (lease, error) {
+	p.Lock()
+	defer p.Unlock()
+	rec, ok := p.Recordsv4[mac.String()]
+	if !ok {
+		return lease{}, fmt.Errorf("%w for MAC %s", errNoLease, p.logMAC(mac.String()))
+	}
+	if rec.Pinned != pinned {
+		rec.Pinned = pinned
+		if err := p.saveIPAddress(ctx, mac, rec); err != nil {
+			rec.Pinned = !pinned
+			return lease{}, err
+		}
+		if pinned {
+			log.Printf("Pinned lease %s for MAC %s", rec.IP, p.logMAC(mac.String()))
+		} else {
+			log.Printf("Unpinned lease %s for MAC %s", rec.IP, p.logMAC(mac.String()))
+		}
+	}
+	return lease{MAC: p.logMAC(mac.String()), Record: *rec, Infinite: rec.infinite()}, nil
+}
+
+// servePin pins the lease of the MAC address in the path, see pin
+func (p *PluginState) servePin(w http.ResponseWriter, r *http.Request) {
+	p.servePinned(w, r, true)
+}
+
+// serveUnpin unpins the lease of the MAC address in the path, see pin
+func (p *PluginState) serveUnpin(w http.ResponseWriter, r *http.Request) {
+	p.servePinned(w, r, false)
+}
+
+func (p *PluginState) servePinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	l, err := p.pin(r.Context(), mac, pinned)
+	if errors.Is(err, errNoLease) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Warningf("Failed to write lease: %v", err)
+	}
+}
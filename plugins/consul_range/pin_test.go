@@ -0,0 +1,82 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// postPin POSTs to the pin or unpin endpoint of mac and returns the status and lease
+func postPin(t *testing.T, srv *httptest.Server, mac, action string) (int, lease) {
+	t.Helper()
+	res, err := authorizedPost(srv.URL+"/leases/"+mac+"/"+action, "", nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var l lease
+	if res.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&l))
+	}
+	return res.StatusCode, l
+}
+
+func TestPinnedLeaseSurvivesSweep(t *testing.T) {
+	p := testPluginState(t)
+	ctx := context.Background()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 5))
+	rec.Expires = int(time.Now().Add(-time.Minute).Unix())
+	require.NoError(t, p.saveIPAddress(ctx, mac, rec))
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	status, l := postPin(t, srv, mac.String(), "pin")
+	require.Equal(t, http.StatusOK, status)
+	assert.True(t, l.Pinned)
+	assert.True(t, l.IP.Equal(net.IPv4(10, 0, 0, 5)))
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.True(t, stored[mac.String()].Pinned, "pin was not persisted")
+
+	assert.Equal(t, 0, p.sweep(ctx), "sweep reclaimed a pinned lease")
+	assert.Contains(t, p.Recordsv4, mac.String())
+
+	// Releasing keeps the address for the client
+	req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeRelease))
+	req.ClientIPAddr = net.IPv4(10, 0, 0, 5)
+	_, _ = p.Handler4(req, stub)
+	assert.Contains(t, p.Recordsv4, mac.String())
+
+	// Reconciliation keeps it, and restores the pin if Consul lost it
+	stored[mac.String()].Pinned = false
+	require.NoError(t, p.saveIPAddress(ctx, mac, stored[mac.String()]))
+	repairs, err := p.reconcile(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, repairs)
+	stored, err = loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.True(t, stored[mac.String()].Pinned)
+
+	status, l = postPin(t, srv, mac.String(), "unpin")
+	require.Equal(t, http.StatusOK, status)
+	assert.False(t, l.Pinned)
+	assert.Equal(t, 1, p.sweep(ctx), "an unpinned expired lease must be reclaimed")
+}
+
+func TestPinErrors(t *testing.T) {
+	p := testPluginState(t)
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	status, _ := postPin(t, srv, "02:00:00:00:00:01", "pin")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = postPin(t, srv, "not-a-mac", "pin")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
@@ -1,10 +1,13 @@
 package consulrangeplugin
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,9 +15,8 @@ import (
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/coredhcp/coredhcp/plugins/allocators"
-	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
-	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/hashicorp/consul/api"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 )
 
 var log = logger.GetLogger("plugins/consulrange")
@@ -22,6 +24,7 @@ var log = logger.GetLogger("plugins/consulrange")
 // Plugin wraps plugin registration information
 var Plugin = plugins.Plugin{
 	Name:   "consulrange",
+	Setup6: setupConsulRange6,
 	Setup4: setupConsulRange,
 }
 
@@ -30,6 +33,20 @@ type Record struct {
 	IP       net.IP `json:"ip"`
 	Expires  int    `json:"expires"`  // for example, a Unix timestamp
 	Hostname string `json:"hostname"` // the client hostname
+	// Pinned leases never expire and keep their address, see pin
+	Pinned bool `json:"pinned,omitempty"`
+	// Next is the address set aside for the client in the migration target
+	Next net.IP `json:"next,omitempty"`
+	// Tags are free-form operator annotations, see setTags
+	Tags map[string]string `json:"tags,omitempty"`
+	// UserClass holds the user classes last sent by the client in option 77
+	UserClass []string `json:"user_class,omitempty"`
+	// StickyFloor is the lease time in seconds below which backpressure may
+	// not shorten the client's leases, see setStickyFloor
+	StickyFloor int `json:"sticky_floor,omitempty"`
+	// FirstSeen is the Unix timestamp the client was first leased an address
+	// at, kept for as long as it holds a lease, even across moves
+	FirstSeen int `json:"first_seen,omitempty"`
 }
 
 // PluginState is the data held by an instance of the consul plugin
@@ -40,54 +57,709 @@ type PluginState struct {
 	Recordsv4      map[string]*Record
 	LeaseTime      time.Duration
 	allocator      allocators.Allocator
+	rangeStart     net.IP
+	rangeEnd       net.IP
+	outOfRange     outOfRangePolicy
+	renewMismatch  renewMismatchPolicy
+	expiredRenewal expiredRenewalPolicy
 	consulURL      string
 	consulKVPrefix string
 	consulClient   *api.Client
+	kv             kvStore
+	storageFormat  storageFormat
+	prettyJSON     bool
+	metrics        *metrics
+	httpAddr       string
+	consulTimeout  time.Duration
+	// httpToken authorizes the HTTP requests modifying leases or the pool, see authorize
+	httpToken string
+	// keys lays JSON records out under the KV prefix, nil for the default layout
+	keys keyCodec
+	// sealer encrypts the lease records in Consul, nil to store them in plaintext
+	sealer *recordSealer
+	// instance namespaces the keys of the instance under the KV prefix, see instancePrefix
+	instance string
+	// readPrefixes are read-only prefixes whose records are merged in at startup
+	readPrefixes []string
+	// merged holds the clients whose lease was merged in from a read-only
+	// prefix and hasn't been written under the KV prefix since
+	merged map[string]struct{}
+	// listing counts the reconciliations listing the records in Consul, and
+	// changedWhileListing holds the clients whose record changed in memory
+	// meanwhile, see noteChanged
+	listing             int
+	changedWhileListing map[string]struct{}
+	// keySource is the option identifying the client of a lease, or nil for
+	// its hardware address
+	keySource dhcpv4.OptionCode
+	// reconcileInterval enables periodic reconciliation when non-zero
+	reconcileInterval time.Duration
+	macHashKey        []byte
+	subnet            *net.IPNet
+	// serverIDs and defaultServerID select the server identifier answered by
+	// ingress subnet, if set
+	serverIDs       []serverID
+	defaultServerID net.IP
+	// serverIDMismatch selects what to do with requests for another server
+	serverIDMismatch serverIDMismatchPolicy
+	// nakServerID selects the server identifier of NAKs when none is configured
+	nakServerID     nakServerIDPolicy
+	invalidHostname invalidHostname
+	// affinity remembers the former addresses of clients, see lease-affinity
+	affinity leaseHistory
+	// hostnamePolicy selects how renewals update the recorded hostname
+	hostnamePolicy hostnamePolicy
+	// hostnameTemplate generates the hostname of clients sending none, if set
+	hostnameTemplate string
+	// domain and searchDomains are the domain name and search list sent to
+	// clients, if set
+	domain        string
+	searchDomains []string
+	// serveSubnet restricts the requests answered to those from a subnet, if set
+	serveSubnet *net.IPNet
+	// trustedRelays are the relay agents allowed to relay requests, any if empty
+	trustedRelays []*net.IPNet
+	relayThrottle relayThrottle
+	// excluded holds the addresses within the range that are never allocated
+	excluded      map[string]struct{}
+	hooks         []leaseHook
+	sweepInterval time.Duration
+	webhookURL    string
+	webhookSecret []byte
+	// kafkaProxies are the Kafka REST proxies lease events are published
+	// through to kafkaTopic, if set
+	kafkaProxies []string
+	kafkaTopic   string
+	// eventSocket is the path of the Unix socket streaming lease events, if set
+	eventSocket string
+	// snapshot uploads snapshots of the lease table, if its URL is set
+	snapshot snapshotter
+	// recordsMemoryCap is the estimated memory the records may use before
+	// leases are shed, if set
+	recordsMemoryCap int
+	// offerTTL enables offer reservations in Consul when non-zero
+	offerTTL time.Duration
+	sessions sessionStore
+	// offers holds the outstanding offers by MAC address
+	offers map[string]*offer
+	// ignored holds the message types passed through without being handled
+	ignored map[dhcpv4.MessageType]bool
+	// optionFilters remove options from responses, see strip-options
+	optionFilters []optionFilter
+	// classes holds the user class sub-pools, ordered by address
+	classes          []*classPool
+	skipStartupCheck bool
+	// dirty holds the MAC addresses of the records that failed to be persisted
+	dirty map[string]struct{}
+	// dirtyFlushInterval enables retrying writes of the dirty records when non-zero
+	dirtyFlushInterval time.Duration
+	// dirtyFlushTimeout is how long to retry flushing the dirty records on Close
+	dirtyFlushTimeout time.Duration
+	// retryKick wakes the dirty flusher up to retry writes that failed transiently
+	retryKick chan struct{}
+	// flushMu serializes the flushes of the dirty records
+	flushMu sync.Mutex
+	// rangeConflicts selects what to do about instances sharing the prefix
+	// with overlapping ranges, registrationID identifies us among them
+	rangeConflicts rangeConflictPolicy
+	registrationID string
+	// specialSpace selects whether a range overlapping special-purpose space is refused
+	specialSpace specialSpacePolicy
+	// draining is set once the leases have been handed over to a peer
+	draining bool
+	// awaitHandoff enables waiting for a peer's handoff at startup when non-zero
+	awaitHandoff    time.Duration
+	awaitingHandoff bool
+	debounce        debouncer
+	denials         denyCache
+	naks            nakTracker
+	history         requestHistory
+	// byIP indexes the records by IP address
+	byIP        ipTrie
+	rapidCommit bool
+	// backpressureFree is the percentage of free addresses below which lease
+	// times are shortened to backpressureFactor of LeaseTime, 0 to disable it
+	backpressureFree   float64
+	backpressureFactor float64
+	backpressureActive bool
+	reservationsFile   string
+	// reservations holds the static MAC -> IP reservations
+	reservations map[string]net.IP
+	// reservations6 holds the static DUID+IAID -> IP reservations of a DHCPv6 instance
+	reservations6 map[reservation6]net.IP
+	// claimable holds the addresses reserved for the next new clients, see reserveByIP
+	claimable []net.IP
+	// migration moves clients to another range over their renewals, if set
+	migration      *migration
+	migrationLease time.Duration
+	// moves are the addresses staged for clients to move to, by MAC address
+	moves map[string]net.IP
+	// subnetLeases are the lease times of subnets, most specific first
+	subnetLeases []subnetLease
+	// declineLimit is the number of declines after which an address is
+	// abandoned, 0 not to track declines
+	declineLimit int
+	declines     map[string]*declines
+	// allocatorName selects the allocator factory, the default one if empty
+	allocatorName string
+	// poolConfigKey is the Consul key holding the pool definition, if any, and
+	// configExcluded the addresses it excludes
+	poolConfigKey  string
+	configExcluded map[string]net.IP
+	// maxPerHostname caps the leases sharing a client hostname, 0 for no cap
+	maxPerHostname int
+	// dedupeWrites skips writing records identical to the last one written,
+	// whose digests are held in written
+	dedupeWrites bool
+	written      map[string]uint64
+	// offset is the number of addresses at the start of the range not
+	// allocated dynamically
+	offset uint32
+	// leaseTimeFloor is the lowest lease time that may be configured, 0 for none
+	leaseTimeFloor      time.Duration
+	belowLeaseTimeFloor bool
+	// clock returns the current time, nil for time.Now. Tests inject their own.
+	clock func() time.Time
+	// excludeOwnAddresses takes the host's addresses out of the pool, see applyOwnAddresses
+	excludeOwnAddresses bool
+	// consulMaxInFlight bounds the Consul KV operations in flight when non-zero, see limitedKV
+	consulMaxInFlight  int
+	consulQueueTimeout time.Duration
+	// warmup is how long to drop requests for after startup, see startWarmup
+	warmup    time.Duration
+	warmingUp bool
+	// overflow selects what happens to loaded leases that don't fit in the range
+	overflow overflowPolicy
+	// otlpEndpoint is where traces are exported to, see tracer
+	otlpEndpoint string
+	tracer       *tracer
+	// hashAllocation prefers addresses hashed from the lease key, see allocateFor
+	hashAllocation bool
+	// maintenance defers new clients while leases keep being renewed, see setMaintenance
+	maintenance bool
+	// interfaceAddrs lists the host's addresses, nil for net.InterfaceAddrs.
+	// Tests inject their own.
+	interfaceAddrs func() ([]net.Addr, error)
+}
+
+// now returns the current time according to the plugin's clock
+func (p *PluginState) now() time.Time {
+	if p.clock == nil {
+		return time.Now()
+	}
+	return p.clock()
+}
+
+// validateRequest checks that a request can be safely keyed and is a message
+// type that a client may send to a server
+func validateRequest(req *dhcpv4.DHCPv4) error {
+	if len(req.ClientHWAddr) == 0 {
+		return errors.New("missing client hardware address")
+	}
+	zero := true
+	for _, b := range req.ClientHWAddr {
+		if b != 0 {
+			zero = false
+			break
+		}
+	}
+	if zero {
+		return fmt.Errorf("zero client hardware address %s", req.ClientHWAddr)
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeDecline,
+		dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeInform:
+		return nil
+	default:
+		return fmt.Errorf("unexpected message type %s", req.MessageType())
+	}
 }
 
 // Handler4 handles DHCPv4 packets for the range plugin
 func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if p.tracer == nil {
+		resp, stop := p.handle4(context.Background(), req, resp)
+		p.stripOptions(req, resp)
+		return resp, stop
+	}
+	return p.traceRequest(req, func(ctx context.Context) (*dhcpv4.DHCPv4, bool) {
+		resp, stop := p.handle4(ctx, req, resp)
+		p.stripOptions(req, resp)
+		return resp, stop
+	})
+}
+
+// handle4 is Handler4, the Consul operations it makes being traced as children
+// of the span carried by trace, if any
+func (p *PluginState) handle4(trace context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if p.ignored[req.MessageType()] || !p.servesSubnet(req) {
+		return resp, false
+	}
+	if err := validateRequest(req); err != nil {
+		p.metrics.malformedRequests.Inc()
+		log.Debugf("Dropping malformed request: %v", err)
+		return nil, true
+	}
+	mac, err := p.clientKey(req)
+	if err != nil {
+		p.metrics.malformedRequests.Inc()
+		log.Debugf("Dropping request without a lease key: %v", err)
+		return nil, true
+	}
+	if p.untrustedRelay(req) {
+		p.metrics.untrustedRelays.Inc()
+		log.Warningf("Dropping %s from MAC %s relayed by untrusted agent %s", req.MessageType(), p.logMAC(mac.String()), req.GatewayIPAddr)
+		return nil, true
+	}
+	if p.throttledRelay(req) {
+		return nil, true
+	}
+	setReplyFlags(req, resp)
+	if id := p.serverIDFor(req); id != nil {
+		// In anycast setups, the identifier of the server the client reached
+		resp.UpdateOption(dhcpv4.OptServerIdentifier(id))
+	}
+	if p.foreignServerID(req, resp) {
+		p.metrics.foreignServerID.Inc()
+		log.Debugf("Dropping %s from MAC %s for server %s", req.MessageType(), p.logMAC(mac.String()), req.ServerIdentifier())
+		return nil, true
+	}
+	// The handler signature carries no context, bound the Consul I/O done for this request
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	ctx = withSpan(ctx, spanFrom(trace))
 	p.Lock()
 	defer p.Unlock()
-	record, ok := p.Recordsv4[req.ClientHWAddr.String()]
-	hostname := req.HostName()
-	if !ok {
-		// Allocating new address since there isn't one allocated
-		log.Printf("MAC address %s is new, leasing new IPv4 address", req.ClientHWAddr.String())
-		ip, err := p.allocator.Allocate(net.IPNet{})
+	p.history.record(mac.String(), req, p.historyOptions(req), p.now())
+	if p.draining {
+		log.Debugf("Dropping request from MAC %s, leases were handed over", p.logMAC(mac.String()))
+		return nil, true
+	}
+	if p.warmingUp {
+		p.metrics.warmupDropped.Inc()
+		log.Debugf("Dropping %s from MAC %s, still warming up", req.MessageType(), p.logMAC(mac.String()))
+		return nil, true
+	}
+	if req.MessageType() == dhcpv4.MessageTypeRelease {
+		p.handleRelease(ctx, req, mac.String())
+		return nil, true
+	}
+	if req.MessageType() == dhcpv4.MessageTypeDecline {
+		if p.declineLimit > 0 {
+			p.handleDecline(ctx, req, mac.String())
+		}
+		return nil, true
+	}
+	if req.MessageType() == dhcpv4.MessageTypeInform {
+		// The client has its address already and wants no lease (RFC 2131 §3.4)
+		log.Debugf("Dropping INFORM from MAC %s", p.logMAC(mac.String()))
+		return nil, true
+	}
+	record, ok := p.Recordsv4[mac.String()]
+	if isRenewing(req) && (!ok || !record.IP.Equal(req.ClientIPAddr)) {
+		if p.renewMismatch == renewMismatchDrop {
+			log.Printf("Ignoring renewal of unknown lease %s for MAC %s", req.ClientIPAddr, p.logMAC(mac.String()))
+			return nil, true
+		}
+		log.Printf("Renewal of unknown lease %s for MAC %s, sending NAK", req.ClientIPAddr, p.logMAC(mac.String()))
+		return p.nak(req, resp, mac.String()), true
+	}
+	if !ok && p.awaitingHandoff {
+		log.Printf("Not allocating for MAC %s until a peer hands its leases over", p.logMAC(mac.String()))
+		p.logDecision(mac.String(), denied("awaiting handoff"), nil)
+		return nil, true
+	}
+	if !ok && p.maintenance {
+		log.Printf("Deferring %s from new MAC %s until maintenance ends", req.MessageType(), p.logMAC(mac.String()))
+		p.logDecision(mac.String(), denied("maintenance"), nil)
+		return nil, true
+	}
+	rapid := p.isRapidCommit(req)
+	var floor time.Duration
+	if ok {
+		floor = record.stickyFloor()
+	}
+	leaseTime := p.grantedLeaseTime(req, floor)
+	p.noteGrantedLeaseTime(leaseTime)
+	_, reserved := p.reservedFor(mac.String())
+	if !ok && !reserved && p.denials.hit(mac.String(), p.now()) {
+		p.metrics.denyCacheHits.Inc()
+		log.Debugf("Dropping %s from MAC %s, it was recently denied a lease", req.MessageType(), p.logMAC(mac.String()))
+		p.logDecision(mac.String(), denied("recently denied"), nil)
+		return nil, true
+	}
+	if !ok && !reserved && p.hostnameCapped(mac.String(), p.clientHostname(req)) {
+		p.denials.deny(mac.String(), p.now())
+		p.logDecision(mac.String(), denied("hostname cap"), nil)
+		return nil, true
+	}
+	// Addresses reserved by IP are claimed by leasing them right away
+	claiming := !ok && !reserved && len(p.claimable) > 0
+	if !ok && p.offerTTL > 0 && req.MessageType() == dhcpv4.MessageTypeDiscover && !rapid && !reserved && !claiming {
+		// Only reserve the address until the client requests it
+		o, err := p.pendingOffer(ctx, mac.String(), p.classPoolFor(req))
 		if err != nil {
-			log.Errorf("Could not allocate IP for MAC %s: %v", req.ClientHWAddr.String(), err)
+			p.allocationFailed(mac.String(), err)
+			p.logDecision(mac.String(), decisionFailed, nil)
 			return nil, true
 		}
+		resp.YourIPAddr = o.ip
+		resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leaseTime.Round(time.Second)))
+		if name := p.hostnameFor(req, o.ip); name != "" && name != req.HostName() {
+			resp.Options.Update(dhcpv4.OptHostName(name))
+		}
+		p.setDomainOptions(resp)
+		p.logDecision(mac.String(), decisionFresh, o.ip)
+		log.Printf("offering IP address %s to MAC %s", o.ip, p.logMAC(mac.String()))
+		return resp, false
+	}
+	var why decision
+	if !ok {
+		p.shedRecords(ctx)
+		// Allocating new address since there isn't one allocated
+		log.Printf("MAC address %s is new, leasing new IPv4 address", p.logMAC(mac.String()))
+		ip, claimed := net.IP(nil), false
+		if claiming {
+			ip, claimed = p.claimByIP()
+		}
+		if !claimed {
+			var err error
+			ip, err = p.allocateLease(ctx, mac.String(), p.classPoolFor(req))
+			if err != nil {
+				p.allocationFailed(mac.String(), err)
+				p.logDecision(mac.String(), decisionFailed, nil)
+				return nil, true
+			}
+		}
+		switch {
+		case claimed:
+			why = decisionClaimed
+		case reserved:
+			why = decisionReservation
+		default:
+			why = decisionFresh
+		}
 		rec := Record{
-			IP:       ip.IP.To4(),
-			Expires:  int(time.Now().Add(p.LeaseTime).Unix()),
-			Hostname: hostname,
+			IP:        ip,
+			Expires:   expiresAt(p.now(), leaseTime),
+			Hostname:  p.hostnameFor(req, ip),
+			UserClass: req.UserClass(),
+			Pinned:    claimed,
+			FirstSeen: int(p.now().Unix()),
 		}
-		err = p.saveIPAddress(req.ClientHWAddr, &rec)
+		if claimed {
+			log.Printf("MAC address %s claimed %s, pinning its lease", p.logMAC(mac.String()), ip)
+		}
+		if len(rec.UserClass) > 0 {
+			log.Printf("MAC address %s sent user class %q", p.logMAC(mac.String()), rec.UserClass)
+		}
+		err = p.persist(ctx, mac, &rec)
 		if err != nil {
-			log.Errorf("SaveIPAddress for MAC %s failed: %v", req.ClientHWAddr.String(), err)
+			log.Errorf("SaveIPAddress for MAC %s failed: %v", p.logMAC(mac.String()), err)
+		}
+		p.setRecord(mac.String(), &rec)
+		p.promoteOffer(ctx, mac.String())
+		if req.MessageType() == dhcpv4.MessageTypeDiscover {
+			p.debounce.mark(mac.String(), p.now())
 		}
-		p.Recordsv4[req.ClientHWAddr.String()] = &rec
 		record = &rec
+		p.emit(eventAllocate, mac.String(), record)
+	} else if p.reassigned(mac.String(), record) {
+		old := record.IP
+		if err := p.reallocateExpired(ctx, mac, record, p.classPoolFor(req), leaseTime); err != nil {
+			p.allocationFailed(mac.String(), err)
+			p.logDecision(mac.String(), decisionFailed, nil)
+			return nil, true
+		}
+		why = decisionReallocated
+		if !record.IP.Equal(old) && req.MessageType() == dhcpv4.MessageTypeRequest {
+			p.logDecision(mac.String(), why, record.IP)
+			// The client asks for the address it lost, have it restart to get the new one
+			return p.nak(req, resp, mac.String()), true
+		}
+	} else if _, staged := p.moves[mac.String()]; staged {
+		p.applyMove(ctx, mac, record, leaseTime)
+		why = decisionMoved
+		if req.MessageType() == dhcpv4.MessageTypeRequest {
+			p.logDecision(mac.String(), why, record.IP)
+			// The client asks for its old address, have it restart to get the new one
+			return p.nak(req, resp, mac.String()), true
+		}
+	} else if p.migration != nil && p.inRange(record.IP) && !reserved {
+		step, err := p.migrateLease(ctx, req, mac, record, leaseTime)
+		if err != nil {
+			p.allocationFailed(mac.String(), err)
+			p.logDecision(mac.String(), decisionFailed, nil)
+			return nil, true
+		}
+		why = decisionMigrated
+		switch step {
+		case migrationNak:
+			p.logDecision(mac.String(), why, record.Next)
+			log.Printf("Sending NAK so that MAC %s moves to %s", p.logMAC(mac.String()), record.Next)
+			return p.nak(req, resp, mac.String()), true
+		case migrationDrain:
+			leaseTime = min(leaseTime, p.migrationLease)
+		}
+	} else if !p.inRange(record.IP) && !p.migrated(record.IP) {
+		// The range shrank since this lease was handed out
+		if p.outOfRange == outOfRangeNak && req.MessageType() == dhcpv4.MessageTypeRequest {
+			log.Warningf("Lease %s for MAC %s is outside the range, sending NAK", record.IP, p.logMAC(mac.String()))
+			p.logDecision(mac.String(), denied("out of range"), nil)
+			return p.nak(req, resp, mac.String()), true
+		}
+		if err := p.renumber(ctx, mac, record, p.classPoolFor(req), leaseTime); err != nil {
+			log.Errorf("Could not renumber out of range lease %s for MAC %s: %v", record.IP, p.logMAC(mac.String()), err)
+			p.logDecision(mac.String(), decisionFailed, nil)
+			return nil, true
+		}
+		why = decisionRenumbered
+	} else if req.MessageType() == dhcpv4.MessageTypeDiscover && p.debounce.recent(mac.String(), p.now()) {
+		// A retransmission, the lease was just written
+		log.Debugf("Reusing lease %s just offered to MAC %s", record.IP, p.logMAC(mac.String()))
+		leaseTime = record.remaining(p.now())
+		why = decisionReused
 	} else {
-		// Ensure we extend the existing lease at least past when the one we're giving expires
-		expiry := time.Unix(int64(record.Expires), 0)
-		if expiry.Before(time.Now().Add(p.LeaseTime)) {
-			record.Expires = int(time.Now().Add(p.LeaseTime).Round(time.Second).Unix())
-			record.Hostname = hostname
-			err := p.saveIPAddress(req.ClientHWAddr, record)
+		why = decisionRenewed
+		// Ensure we extend the existing lease at least past when the one we're
+		// giving expires. A lease that already runs longer, e.g. granted before
+		// backpressure shortened leases, is kept and its remaining time echoed.
+		if !record.needsExtension(p.now(), leaseTime) {
+			leaseTime = record.remaining(p.now())
+		} else {
+			record.Expires = expiresAt(p.now(), leaseTime)
+			p.renewHostname(mac.String(), record, p.hostnameFor(req, record.IP))
+			record.UserClass = req.UserClass()
+			err := p.persist(ctx, mac, record)
 			if err != nil {
-				log.Errorf("Could not persist lease for MAC %s: %v", req.ClientHWAddr.String(), err)
+				log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+			}
+			p.emit(eventRenew, mac.String(), record)
+			if req.MessageType() == dhcpv4.MessageTypeDiscover {
+				p.debounce.mark(mac.String(), p.now())
 			}
 		}
 	}
 	resp.YourIPAddr = record.IP
-	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.LeaseTime.Round(time.Second)))
-	log.Printf("found IP address %s for MAC %s", record.IP, req.ClientHWAddr.String())
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leaseTime.Round(time.Second)))
+	if name := p.hostnameFor(req, record.IP); name != "" && name != req.HostName() {
+		// Tell the client the name it was given
+		resp.Options.Update(dhcpv4.OptHostName(name))
+	}
+	p.setDomainOptions(resp)
+	if rapid {
+		// RFC 4039: the lease is committed, acknowledge it straight away
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRapidCommit, nil))
+	}
+	p.logDecision(mac.String(), why, record.IP)
+	log.Printf("found IP address %s for MAC %s", record.IP, p.logMAC(mac.String()))
 	return resp, false
 }
 
+// outOfRangePolicy selects what happens when a client renews a lease outside the range
+type outOfRangePolicy int
+
+const (
+	// outOfRangeNak NAKs the renewal, so the client restarts from DISCOVER
+	outOfRangeNak outOfRangePolicy = iota
+	// outOfRangeRenumber moves the client to a new in-range address
+	outOfRangeRenumber
+)
+
+func parseOutOfRangeOption(p *PluginState, value string) error {
+	switch value {
+	case "nak":
+		p.outOfRange = outOfRangeNak
+	case "renumber":
+		p.outOfRange = outOfRangeRenumber
+	default:
+		return fmt.Errorf("unknown out-of-range policy %q, want nak or renumber", value)
+	}
+	return nil
+}
+
+// renewMismatchPolicy selects the response to a renewal of a lease the client doesn't hold
+type renewMismatchPolicy int
+
+const (
+	// renewMismatchNak NAKs the renewal, so the client restarts from INIT-REBOOT
+	renewMismatchNak renewMismatchPolicy = iota
+	// renewMismatchDrop ignores the renewal, leaving it to whichever server holds the lease
+	renewMismatchDrop
+)
+
+func parseRenewMismatchOption(p *PluginState, value string) error {
+	switch value {
+	case "nak":
+		p.renewMismatch = renewMismatchNak
+	case "drop":
+		p.renewMismatch = renewMismatchDrop
+	default:
+		return fmt.Errorf("unknown renew-mismatch policy %q, want nak or drop", value)
+	}
+	return nil
+}
+
+// parseIgnoreOption parses a comma separated list of message types to pass
+// through untouched, e.g. "inform,decline"
+func parseIgnoreOption(p *PluginState, value string) error {
+	p.ignored = make(map[dhcpv4.MessageType]bool)
+	for _, name := range strings.Split(value, ",") {
+		mt, err := parseMessageType(name)
+		if err != nil {
+			return err
+		}
+		p.ignored[mt] = true
+	}
+	return nil
+}
+
+// parseMessageType looks up a DHCPv4 message type by its case insensitive name
+func parseMessageType(name string) (dhcpv4.MessageType, error) {
+	for mt := dhcpv4.MessageTypeDiscover; mt <= dhcpv4.MessageTypeInform; mt++ {
+		if strings.EqualFold(mt.String(), name) {
+			return mt, nil
+		}
+	}
+	return dhcpv4.MessageTypeNone, fmt.Errorf("unknown message type %q", name)
+}
+
+func parseRapidCommitOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.rapidCommit = enabled
+	return nil
+}
+
+// isRapidCommit reports whether req is a DISCOVER asking for a one-shot
+// allocation with the Rapid Commit option, and that is enabled
+func (p *PluginState) isRapidCommit(req *dhcpv4.DHCPv4) bool {
+	return p.rapidCommit && req.MessageType() == dhcpv4.MessageTypeDiscover && req.Options.Has(dhcpv4.OptionRapidCommit)
+}
+
+// isRenewing reports whether req is a REQUEST from a client in the RENEWING or
+// REBINDING state, which sets ciaddr to its current address and carries no
+// requested IP address option (RFC 2131, section 4.3.2)
+func isRenewing(req *dhcpv4.DHCPv4) bool {
+	return req.MessageType() == dhcpv4.MessageTypeRequest &&
+		req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified() &&
+		req.RequestedIPAddress() == nil
+}
+
+// inRange reports whether ip is within the range served by the plugin, and
+// not excluded from it
+func (p *PluginState) inRange(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if _, ok := p.excluded[ip4.String()]; ok {
+		return false
+	}
+	n := binary.BigEndian.Uint32(ip4)
+	return n >= binary.BigEndian.Uint32(p.rangeStart.To4()) && n <= binary.BigEndian.Uint32(p.rangeEnd.To4())
+}
+
+// renumber moves an existing lease to a freshly allocated in-range address,
+// granted for leaseTime, and persists it.
+// Must be called with the plugin lock held.
+func (p *PluginState) renumber(ctx context.Context, mac net.HardwareAddr, record *Record, pool *classPool, leaseTime time.Duration) error {
+	ip, err := p.allocate(pool)
+	if err != nil {
+		return err
+	}
+	log.Printf("Renumbering MAC %s from %s to %s", p.logMAC(mac.String()), record.IP, ip.IP)
+	p.setRecordIP(mac.String(), record, ip.IP.To4())
+	record.Expires = expiresAt(p.now(), leaseTime)
+	if err := p.persist(ctx, mac, record); err != nil {
+		log.Errorf("Could not persist lease for MAC %s: %v", p.logMAC(mac.String()), err)
+	}
+	return nil
+}
+
+// poolSize returns the number of addresses in the range served by the plugin
+func (p *PluginState) poolSize() uint32 {
+	return binary.BigEndian.Uint32(p.rangeEnd.To4()) - binary.BigEndian.Uint32(p.rangeStart.To4()) + 1
+}
+
+// usageReporter is implemented by allocators that can report their utilization without locking
+type usageReporter interface {
+	Used() uint32
+}
+
+// poolUsed returns the number of allocated addresses in the range. It doesn't
+// take the plugin lock when the allocator can report its usage lock-free.
+func (p *PluginState) poolUsed() uint32 {
+	if u, ok := p.allocator.(usageReporter); ok {
+		return u.Used()
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.usedLocked()
+}
+
+// usedLocked is poolUsed for callers holding the plugin lock
+func (p *PluginState) usedLocked() uint32 {
+	if u, ok := p.allocator.(usageReporter); ok {
+		return u.Used()
+	}
+	var used uint32
+	for _, rec := range p.Recordsv4 {
+		if p.inRange(rec.IP) {
+			used++
+		}
+	}
+	return used
+}
+
+// nak turns resp into a DHCPNAK for mac, telling the client to restart its
+// configuration
+func (p *PluginState) nak(req, resp *dhcpv4.DHCPv4, mac string) *dhcpv4.DHCPv4 {
+	p.metrics.naks.Inc()
+	if p.naks.nak(mac, p.now()) {
+		p.metrics.nakLoops.Inc()
+		log.Warningf("MAC %s was sent %d NAKs within %s, it may be stuck in a boot loop", p.logMAC(mac), p.naks.limit(), p.naks.period())
+	}
+	if relayed(resp) {
+		// The client may have moved, the relay must broadcast it (RFC 2131, section 4.3.2)
+		resp.SetBroadcast()
+	}
+	resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	resp.Options.Del(dhcpv4.OptionIPAddressLeaseTime)
+	resp.YourIPAddr = net.IPv4zero
+	p.setNakServerID(req, resp)
+	return resp
+}
+
+// parseIPv4 parses an IPv4 address into its 4-byte form. IPv4-mapped IPv6
+// addresses (::ffff:a.b.c.d) are accepted as the IPv4 address they map, any
+// other IPv6 address is rejected.
+func parseIPv4(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%q is an IPv6 address, want IPv4", s)
+	}
+	return ip4, nil
+}
+
+// Errors returned by the plugin setup when validating its arguments, so that
+// callers can tell failures apart with errors.Is
+var (
+	ErrInvalidArguments = errors.New("invalid number of arguments")
+	ErrEmptyURL         = errors.New("Consul URL cannot be empty")
+	ErrEmptyPrefix      = errors.New("Consul KV prefix cannot be empty")
+	ErrInvalidRange     = errors.New("invalid IP range")
+	ErrBadLeaseDuration = errors.New("invalid lease duration")
+	ErrInvalidOption    = errors.New("invalid option")
+)
+
 func setupConsulRange(args ...string) (handler.Handler4, error) {
 	var (
 		err error
@@ -95,42 +767,85 @@ func setupConsulRange(args ...string) (handler.Handler4, error) {
 	)
 
 	if len(args) < 5 {
-		return nil, fmt.Errorf("invalid number of arguments, want: 4 (Consul base URL, KV prefix, start IP, end IP, lease time), got: %d", len(args))
+		return nil, fmt.Errorf("%w, want at least: 5 (Consul base URL, KV prefix, start IP, end IP, lease time), got: %d", ErrInvalidArguments, len(args))
+	}
+	args, err = expandArgs(args)
+	if err != nil {
+		return nil, err
 	}
 	consulURL := args[0]
 	if consulURL == "" {
-		return nil, errors.New("Consul URL cannot be empty")
+		return nil, ErrEmptyURL
 	}
 
 	consulKVPrefix := args[1]
 	if consulKVPrefix == "" {
-		return nil, errors.New("Consul KV prefix cannot be empty")
+		return nil, ErrEmptyPrefix
 	}
 
-	ipRangeStart := net.ParseIP(args[2])
-	if ipRangeStart.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[2])
+	ipRangeStart, err := parseIPv4(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid start: %w", ErrInvalidRange, err)
 	}
-	ipRangeEnd := net.ParseIP(args[3])
-	if ipRangeEnd.To4() == nil {
-		return nil, fmt.Errorf("invalid IPv4 address: %v", args[3])
+	ipRangeEnd, err := parseIPv4(args[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid end: %w", ErrInvalidRange, err)
 	}
-	if binary.BigEndian.Uint32(ipRangeStart.To4()) >= binary.BigEndian.Uint32(ipRangeEnd.To4()) {
-		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	if binary.BigEndian.Uint32(ipRangeStart) >= binary.BigEndian.Uint32(ipRangeEnd) {
+		return nil, fmt.Errorf("%w: start %s has to be lower than end %s", ErrInvalidRange, ipRangeStart, ipRangeEnd)
 	}
 
-	p.allocator, err = bitmap.NewIPv4Allocator(ipRangeStart, ipRangeEnd)
-	if err != nil {
-		return nil, fmt.Errorf("could not create an allocator: %w", err)
+	p.rangeStart = ipRangeStart
+	p.rangeEnd = ipRangeEnd
+
+	p.LeaseTime, err = parseLeaseTime(args[4])
+	if err != nil || p.LeaseTime <= 0 {
+		return nil, fmt.Errorf("%w: %v", ErrBadLeaseDuration, args[4])
 	}
 
-	p.LeaseTime, err = time.ParseDuration(args[4])
-	if err != nil {
-		return nil, fmt.Errorf("invalid lease duration: %v", args[4])
+	p.consulTimeout = defaultConsulTimeout
+	p.debounce.seen.ttl, p.debounce.seen.size = defaultDiscoverDebounce, maxDebounced
+	p.denials.denied.size = defaultDenyCacheSize
+	p.naks.clients.ttl, p.naks.clients.size = defaultNakLoopWindow, maxTrackedNaks
+	p.backpressureFactor = defaultBackpressureFactor
+	p.migrationLease = defaultMigrationLease
+	p.snapshot.interval = defaultSnapshotInterval
+	p.snapshot.region = defaultSnapshotRegion
+	if err := p.parseOptions(args[5:]); err != nil {
+		return nil, err
+	}
+	if p.LeaseTime == infiniteLeaseTime && p.backpressureFree > 0 {
+		return nil, fmt.Errorf("%w: backpressure cannot shorten infinite leases", ErrBadLeaseDuration)
+	}
+	if err := p.checkSpecialSpace(p.rangeStart, p.rangeEnd); err != nil {
+		return nil, err
+	}
+	if err := p.checkLeaseTimeFloor(p.LeaseTime); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadLeaseDuration, err)
+	}
+	if err := p.checkSubnetLeases(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadLeaseDuration, err)
+	}
+	if p.keySource != nil && p.keys != nil {
+		return nil, fmt.Errorf("%w: key-template spells MAC addresses, it requires key-source=mac", ErrInvalidOption)
+	}
+	if err := p.snapshot.check(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOption, err)
 	}
 
+	p.metrics = newMetrics()
+	p.retryKick = make(chan struct{}, 1)
+	p.metrics.registerPoolGauges(&p)
+	p.metrics.registerMemoryGauge(&p)
+	p.metrics.registerDirtyGauge(&p)
+	if p.migration != nil {
+		p.metrics.registerMigrationGauges(&p)
+	}
 	p.consulURL = consulURL
-	p.consulKVPrefix = consulKVPrefix
+	p.consulKVPrefix = instancePrefix(consulKVPrefix, p.instance)
+	if err := p.checkReadPrefixes(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOption, err)
+	}
 
 	// Create a new Consul API client.
 	config := api.DefaultConfig()
@@ -141,15 +856,143 @@ func setupConsulRange(args ...string) (handler.Handler4, error) {
 	}
 
 	p.consulClient = client
+	p.kv = client.KV()
+	p.sessions = client.Session()
+	if p.consulMaxInFlight > 0 {
+		limiter := newConsulLimiter(p.consulMaxInFlight, p.consulQueueTimeout, p.metrics.consulBusy)
+		p.metrics.newGauge("consulrange_consul_inflight", "Number of Consul operations in flight", func() float64 {
+			return float64(limiter.InFlight())
+		})
+		p.kv = newLimitedKV(p.kv, limiter)
+		p.sessions = &limitedSessions{consulLimiter: limiter, sessions: p.sessions}
+	}
+	if p.otlpEndpoint != "" {
+		p.tracer = newTracer(p.otlpEndpoint, traceFlushInterval)
+		p.kv = &tracedKV{kv: p.kv, tracer: p.tracer}
+	}
+
+	if !p.skipStartupCheck {
+		ctx, cancel := p.requestContext()
+		err := p.checkConsul(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("consul startup check failed: %w", err)
+		}
+	}
+
+	// A range resized at runtime survives restarts
+	persisted, err := loadRange(p.kv, p.configKey(rangeConfigKey))
+	if err != nil {
+		return nil, fmt.Errorf("could not load persisted range: %w", err)
+	}
+	if persisted != nil && (!persisted.Start.Equal(p.rangeStart) || !persisted.End.Equal(p.rangeEnd)) {
+		log.Warningf("Using range %s-%s persisted in Consul instead of configured %s-%s",
+			persisted.Start, persisted.End, p.rangeStart, p.rangeEnd)
+		p.rangeStart = persisted.Start.To4()
+		p.rangeEnd = persisted.End.To4()
+	}
+
+	// A pool defined in Consul takes precedence over the arguments
+	var (
+		pool      *poolConfig
+		poolIndex uint64
+	)
+	if p.poolConfigKey != "" {
+		var meta *api.QueryMeta
+		pool, meta, err = p.loadPoolConfig()
+		if err != nil {
+			return nil, err
+		}
+		poolIndex = meta.LastIndex
+		if pool == nil {
+			log.Warningf("No pool definition in %s yet, using range %s-%s", p.poolConfigKey, p.rangeStart, p.rangeEnd)
+		} else if err := p.usePoolConfig(pool); err != nil {
+			return nil, fmt.Errorf("invalid pool definition in %s: %w", p.poolConfigKey, err)
+		}
+	}
+
+	if p.rangeConflicts != rangeConflictIgnore {
+		if p.registrationID == "" {
+			p.registrationID = defaultRegistrationID()
+		}
+		ctx, cancel := p.requestContext()
+		err := p.checkRangeConflicts(ctx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	p.Recordsv4, err = loadRecords(p.consulClient, p.consulKVPrefix)
+	p.allocator, err = p.newAllocator(p.rangeStart, p.rangeEnd)
+	if err != nil {
+		return nil, fmt.Errorf("could not create an allocator: %w", err)
+	}
+	if p.migration != nil {
+		// The allocator option may come after migrate-to
+		p.migration.allocator, err = p.newAllocator(p.migration.start, p.migration.end)
+		if err != nil {
+			return nil, fmt.Errorf("could not create an allocator for the migration target: %w", err)
+		}
+	}
+	if err := p.applySubnet(); err != nil {
+		return nil, err
+	}
+	if err := p.applyOwnAddresses(); err != nil {
+		return nil, err
+	}
+	if err := p.applyClasses(); err != nil {
+		return nil, err
+	}
+	if err := p.applyOffset(); err != nil {
+		return nil, err
+	}
+	if pool != nil {
+		p.setConfigExclusions(pool.Exclude)
+	}
+
+	var handoff handoffWatch
+	if p.awaitHandoff > 0 {
+		if handoff, err = p.readHandoffMarker(); err != nil {
+			return nil, err
+		}
+	}
+
+	var skipped int
+	p.Recordsv4, skipped, err = p.loadMergedRecords()
 	if err != nil {
 		return nil, fmt.Errorf("could not load records from file: %v", err)
 	}
 
 	log.Printf("Loaded %d DHCPv4 leases from %s", len(p.Recordsv4), consulURL)
+	if skipped > 0 {
+		log.Warningf("Skipped %d values under %s that aren't valid lease records", skipped, p.consulKVPrefix)
+	}
+	if len(p.Recordsv4) == 0 && skipped == 0 && p.snapshot.importAge > 0 {
+		// A fresh Consul, e.g. after a disaster
+		ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+		_, err := p.importSnapshot(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("could not import lease snapshot: %w", err)
+		}
+	}
+	if err := p.fitRecords(); err != nil {
+		return nil, err
+	}
+	p.reindex()
 
-	for _, v := range p.Recordsv4 {
+	for mac, v := range p.Recordsv4 {
+		if err := p.claimMigration(v); err != nil {
+			return nil, fmt.Errorf("failed to re-allocate migrated lease of MAC %s: %w", p.logMAC(mac), err)
+		}
+		if p.migrated(v.IP) {
+			continue
+		}
+		if !p.inRange(v.IP) {
+			// Handled when the client next renews, according to the out-of-range option
+			log.Warningf("Lease %s for MAC %s is outside the range, not re-allocating it", v.IP, p.logMAC(mac))
+			continue
+		}
 		ip, err := p.allocator.Allocate(net.IPNet{IP: v.IP})
 		if err != nil {
 			return nil, fmt.Errorf("failed to re-allocate leased ip %v: %v", v.IP.String(), err)
@@ -159,5 +1002,77 @@ func setupConsulRange(args ...string) (handler.Handler4, error) {
 		}
 	}
 
+	if p.declineLimit > 0 {
+		p.declines, err = p.loadDeclines()
+		if err != nil {
+			return nil, fmt.Errorf("could not load declines: %w", err)
+		}
+		p.holdAbandoned()
+		p.metrics.newGauge("consulrange_addresses_abandoned", "Number of addresses abandoned after too many declines", func() float64 {
+			return float64(p.abandonedAddresses())
+		})
+	}
+
+	if p.reservationsFile != "" {
+		n, err := p.reloadReservations()
+		if err != nil {
+			return nil, fmt.Errorf("could not load reservations: %w", err)
+		}
+		if err := p.watchReservations(p.reloadReservations); err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded %d reservations from %s", n, p.reservationsFile)
+	}
+
+	if p.webhookURL != "" {
+		if len(p.webhookSecret) == 0 {
+			return nil, errors.New("webhook requires a webhook-secret to sign payloads")
+		}
+		p.addHook(newWebhook(p.webhookURL, p.webhookSecret))
+	}
+	if p.eventSocket != "" {
+		stream, err := newEventStream(p.eventSocket, p.metrics.eventsDropped)
+		if err != nil {
+			return nil, fmt.Errorf("could not listen on event socket: %w", err)
+		}
+		p.addHook(stream)
+	}
+	if len(p.kafkaProxies) > 0 {
+		if p.kafkaTopic == "" {
+			return nil, errors.New("kafka requires a kafka-topic to publish lease events to")
+		}
+		p.addHook(newKafkaSink(newRESTProducer(p.kafkaProxies, p.kafkaTopic), p.metrics.kafkaDropped))
+	}
+
+	if p.awaitHandoff > 0 {
+		p.startHandoffWatch(handoff)
+	}
+	if p.poolConfigKey != "" {
+		// We never stop it, but that's ok because plugins are never stopped/unregistered.
+		go p.watchPoolConfig(context.Background(), poolIndex)
+	}
+	if p.reconcileInterval > 0 {
+		p.startReconciler()
+	}
+	if p.sweepInterval > 0 {
+		p.startSweeper()
+	}
+	p.startDirtyFlusher()
+	if p.rangeConflicts != rangeConflictIgnore {
+		p.startRegistrationRefresh()
+	}
+	if p.snapshot.url != nil {
+		p.startSnapshots()
+	}
+	if p.warmup > 0 {
+		p.startWarmup()
+	}
+
+	if p.httpAddr != "" {
+		if err := p.startHTTP(p.httpAddr); err != nil {
+			return nil, err
+		}
+	}
+
 	return p.Handler4, nil
 }
@@ -0,0 +1,348 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPluginState creates a PluginState serving 10.0.0.1-10.0.0.10 without a Consul backend
+func testPluginState(t *testing.T) *PluginState {
+	alloc, err := bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 10))
+	require.NoError(t, err)
+	return &PluginState{
+		Recordsv4:      make(map[string]*Record),
+		LeaseTime:      time.Hour,
+		allocator:      alloc,
+		rangeStart:     net.IPv4(10, 0, 0, 1).To4(),
+		rangeEnd:       net.IPv4(10, 0, 0, 10).To4(),
+		kv:             newMemKV(),
+		consulKVPrefix: "leases",
+		metrics:        newMetrics(),
+		httpToken:      testHTTPToken,
+	}
+}
+
+// testLease records and allocates a lease of ip to mac, expiring in an hour
+func testLease(t *testing.T, p *PluginState, mac net.HardwareAddr, ip net.IP) *Record {
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	require.NoError(t, err)
+	require.True(t, got.IP.Equal(ip), "could not allocate %s", ip)
+	rec := &Record{IP: ip.To4(), Expires: int(time.Now().Add(time.Hour).Unix())}
+	p.setRecord(mac.String(), rec)
+	return rec
+}
+
+// testRequest builds a DHCPREQUEST from mac and an empty reply to it
+func testRequest(t *testing.T, mac net.HardwareAddr, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	modifiers = append([]dhcpv4.Modifier{dhcpv4.WithMessageType(dhcpv4.MessageTypeRequest)}, modifiers...)
+	req, err := dhcpv4.NewDiscovery(mac, modifiers...)
+	require.NoError(t, err)
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	return req, resp
+}
+
+func TestHandler4DropsZeroMAC(t *testing.T) {
+	p := testPluginState(t)
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	stub, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp, "malformed request should not get a response")
+	assert.True(t, stop, "malformed request should stop processing")
+	assert.Empty(t, p.Recordsv4)
+	assert.Equal(t, uint64(1), p.metrics.malformedRequests.Value())
+
+	// The allocator must not have been touched: the first address is still free
+	ip, err := p.allocator.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 1)})
+	require.NoError(t, err)
+	assert.True(t, ip.IP.Equal(net.IPv4(10, 0, 0, 1)))
+}
+
+func TestHandler4DropsUnexpectedMessageType(t *testing.T) {
+	p := testPluginState(t)
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	require.NoError(t, err)
+	req.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	stub, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.Empty(t, p.Recordsv4)
+	assert.Equal(t, uint64(1), p.metrics.malformedRequests.Value())
+}
+
+func TestHandler4DropsDeclineWithoutLimit(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	record := p.Recordsv4[mac.String()]
+	require.NotNil(t, record)
+
+	decline, stub := testRequest(t, mac,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDecline),
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(record.IP)))
+	resp, stop := p.Handler4(decline, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	// The lease is left alone: without decline-limit, declines aren't acted on
+	assert.Same(t, record, p.Recordsv4[mac.String()])
+	assert.Len(t, p.Recordsv4, 1)
+}
+
+func TestHandler4DropsInform(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeInform),
+		dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 5)))
+
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.Empty(t, p.Recordsv4)
+	assert.Zero(t, p.metrics.malformedRequests.Value())
+}
+
+// shrunkLease records a lease for mac that lies outside the configured range
+func shrunkLease(p *PluginState, mac net.HardwareAddr) *Record {
+	rec := &Record{IP: net.IPv4(10, 0, 0, 50).To4(), Expires: int(time.Now().Add(time.Minute).Unix())}
+	p.Recordsv4[mac.String()] = rec
+	return rec
+}
+
+func TestHandler4OutOfRangeNak(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	shrunkLease(p, mac)
+
+	req, stub := testRequest(t, mac)
+	resp, stop := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.True(t, resp.YourIPAddr.IsUnspecified())
+
+	// After the NAK the client starts over and gets an in-range address
+	req, stub = testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, stop = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, p.inRange(resp.YourIPAddr), "expected an in-range address, got %s", resp.YourIPAddr)
+}
+
+func TestHandler4OutOfRangeRenumber(t *testing.T) {
+	p := testPluginState(t)
+	p.outOfRange = outOfRangeRenumber
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := shrunkLease(p, mac)
+
+	req, stub := testRequest(t, mac)
+	resp, stop := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.True(t, p.inRange(resp.YourIPAddr), "expected an in-range address, got %s", resp.YourIPAddr)
+	assert.True(t, rec.IP.Equal(resp.YourIPAddr), "record was not renumbered")
+
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	require.Contains(t, stored, mac.String())
+	assert.True(t, stored[mac.String()].IP.Equal(resp.YourIPAddr), "renumbered lease was not persisted")
+}
+
+func TestHandler4RenewingMatchingCiaddr(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	expires := int(time.Now().Add(time.Minute).Unix())
+	p.Recordsv4[mac.String()] = &Record{IP: net.IPv4(10, 0, 0, 5).To4(), Expires: expires}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 5)))
+	resp, stop := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.NotEqual(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 5)))
+	assert.Greater(t, p.Recordsv4[mac.String()].Expires, expires, "lease was not renewed")
+}
+
+func TestHandler4RenewingMismatchedCiaddr(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	p.Recordsv4[mac.String()] = &Record{IP: net.IPv4(10, 0, 0, 5).To4(), Expires: int(time.Now().Unix())}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 6)))
+	resp, stop := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+
+	// A client without any record is NAKed too
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2}, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 6)))
+	resp, stop = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.True(t, stop)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:02", "no lease should be allocated on a mismatched renewal")
+
+	p.renewMismatch = renewMismatchDrop
+	req, stub = testRequest(t, mac, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 6)))
+	resp, stop = p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+}
+
+func TestSetupRejectsIPv6Bounds(t *testing.T) {
+	for _, args := range [][]string{
+		{"127.0.0.1:8500", "leases", "2001:db8::1", "10.0.0.10", "1h"},
+		{"127.0.0.1:8500", "leases", "10.0.0.1", "2001:db8::10", "1h"},
+		{"127.0.0.1:8500", "leases", "not-an-ip", "10.0.0.10", "1h"},
+	} {
+		var err error
+		assert.NotPanics(t, func() { _, err = setupConsulRange(args...) }, args)
+		assert.ErrorContains(t, err, "range", args)
+	}
+}
+
+func TestSetupErrors(t *testing.T) {
+	base := []string{"127.0.0.1:8500", "leases", "10.0.0.1", "10.0.0.10", "1h"}
+	with := func(i int, v string, options ...string) []string {
+		args := append([]string{}, base...)
+		args[i] = v
+		return append(args, options...)
+	}
+	for _, tc := range []struct {
+		args []string
+		want error
+	}{
+		{base[:4], ErrInvalidArguments},
+		{with(0, ""), ErrEmptyURL},
+		{with(1, ""), ErrEmptyPrefix},
+		{with(2, "not-an-ip"), ErrInvalidRange},
+		{with(3, "10.0.0.300"), ErrInvalidRange},
+		{with(3, "10.0.0.1"), ErrInvalidRange},
+		{with(4, "an hour"), ErrBadLeaseDuration},
+		{with(4, "0s"), ErrBadLeaseDuration},
+		{with(4, "1m", "lease-time-floor=5m"), ErrBadLeaseDuration},
+		{with(4, "infinite", "backpressure=10"), ErrBadLeaseDuration},
+		{append(base, "lease-time-floor"), ErrInvalidOption},
+		{append(base, "no-such-option=1"), ErrInvalidOption},
+		{append(base, "offset=-1"), ErrInvalidOption},
+	} {
+		_, err := setupConsulRange(tc.args...)
+		assert.ErrorIs(t, err, tc.want, tc.args)
+	}
+}
+
+func TestParseIPv4(t *testing.T) {
+	ip, err := parseIPv4("::ffff:10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, ip, "IPv4-mapped addresses are converted to their 4-byte form")
+
+	ip, err = parseIPv4("10.0.0.1")
+	require.NoError(t, err)
+	assert.Len(t, ip, net.IPv4len)
+
+	_, err = parseIPv4("2001:db8::1")
+	assert.ErrorContains(t, err, "IPv6")
+}
+
+func TestHandler4IgnoredTypePassesThrough(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseIgnoreOption(p, "inform,DECLINE"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac, dhcpv4.WithMessageType(dhcpv4.MessageTypeInform))
+	want := stub.ToBytes()
+	resp, stop := p.Handler4(req, stub)
+	assert.False(t, stop, "ignored messages must be passed to the next plugin")
+	require.NotNil(t, resp)
+	assert.Equal(t, want, resp.ToBytes(), "ignored messages must not be modified")
+	assert.Empty(t, p.Recordsv4)
+	assert.Equal(t, uint32(0), p.poolUsed())
+}
+
+func TestParseIgnoreOption(t *testing.T) {
+	var p PluginState
+	require.NoError(t, parseIgnoreOption(&p, "release"))
+	assert.True(t, p.ignored[dhcpv4.MessageTypeRelease])
+	assert.False(t, p.ignored[dhcpv4.MessageTypeRequest])
+	assert.Error(t, parseIgnoreOption(&p, "inform,bogus"))
+	assert.Error(t, parseIgnoreOption(&p, ""))
+}
+
+func TestHandler4RapidCommit(t *testing.T) {
+	p := testPluginState(t)
+	p.rapidCommit = true
+	kv := newMemKV()
+	p.kv = kv
+	p.sessions = &memSessions{kv: kv}
+	// Rapid commit skips the offer reservation
+	p.offerTTL = time.Minute
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	req, stub := testRequest(t, mac,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRapidCommit, nil)))
+	stub.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeAck, resp.MessageType())
+	assert.True(t, resp.Options.Has(dhcpv4.OptionRapidCommit))
+	assert.Empty(t, p.offers)
+
+	stored, err := loadRecords(kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	require.Contains(t, stored, mac.String(), "the committed lease was not persisted")
+	assert.True(t, stored[mac.String()].IP.Equal(resp.YourIPAddr))
+}
+
+func TestHandler4RapidCommitDisabled(t *testing.T) {
+	p := testPluginState(t)
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionRapidCommit, nil)))
+	stub.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeOffer, resp.MessageType())
+	assert.False(t, resp.Options.Has(dhcpv4.OptionRapidCommit))
+}
+
+func TestHandler4RecordsUserClass(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	kv := p.kv.(*memKV)
+
+	// RFC 3004 encodes each class prefixed with its length
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac, dhcpv4.WithGeneric(dhcpv4.OptionUserClassInformation, []byte("\x04ipxe\x03lab")))
+	_, _ = p.Handler4(req, stub)
+	require.Contains(t, p.Recordsv4, mac.String())
+	assert.Equal(t, []string{"ipxe", "lab"}, p.Recordsv4[mac.String()].UserClass)
+	assert.Contains(t, string(kv.data["leases/"+mac.String()]), `"user_class":["ipxe","lab"]`)
+	assert.Equal(t, []string{"ipxe", "lab"}, p.dumpLeases()[0].UserClass)
+
+	// Windows clients send a single class without a length
+	other := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	req, stub = testRequest(t, other, dhcpv4.WithGeneric(dhcpv4.OptionUserClassInformation, []byte("RRAS.Microsoft")))
+	_, _ = p.Handler4(req, stub)
+	assert.Equal(t, []string{"RRAS.Microsoft"}, p.Recordsv4[other.String()].UserClass)
+
+	// Renewals update the classes
+	clock.Advance(time.Minute)
+	req, stub = testRequest(t, mac)
+	_, _ = p.Handler4(req, stub)
+	assert.Empty(t, p.Recordsv4[mac.String()].UserClass)
+}
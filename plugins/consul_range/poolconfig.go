@@ -0,0 +1,187 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// poolConfig is the definition of the pool read from the Consul key given by
+// the pool-config option, e.g.
+//
+//	{"start": "10.0.0.1", "end": "10.0.0.200", "lease": "1h", "exclude": ["10.0.0.10"]}
+type poolConfig struct {
+	Start   net.IP   `json:"start"`
+	End     net.IP   `json:"end"`
+	Lease   string   `json:"lease"`
+	Exclude []net.IP `json:"exclude,omitempty"`
+
+	leaseTime time.Duration
+}
+
+func parsePoolConfigOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("key cannot be empty")
+	}
+	p.poolConfigKey = value
+	return nil
+}
+
+// decodePoolConfig parses and validates a pool definition
+func decodePoolConfig(data []byte) (*poolConfig, error) {
+	var c poolConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	c.Start, c.End = c.Start.To4(), c.End.To4()
+	if c.Start == nil || c.End == nil {
+		return nil, errors.New("start and end must be IPv4 addresses")
+	}
+	if compareIP(c.Start, c.End) >= 0 {
+		return nil, errors.New("start of IP range has to be lower than the end of an IP range")
+	}
+	leaseTime, err := parseLeaseTime(c.Lease)
+	if err != nil || leaseTime <= 0 {
+		return nil, fmt.Errorf("invalid lease duration %q", c.Lease)
+	}
+	c.leaseTime = leaseTime
+	for i, ip := range c.Exclude {
+		if c.Exclude[i] = ip.To4(); c.Exclude[i] == nil {
+			return nil, fmt.Errorf("excluded address %s is not an IPv4 address", ip)
+		}
+	}
+	return &c, nil
+}
+
+// loadPoolConfig reads the pool definition, which is nil if the key doesn't exist
+func (p *PluginState) loadPoolConfig() (*poolConfig, *api.QueryMeta, error) {
+	pair, meta, err := p.kv.Get(p.poolConfigKey, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get key %q: %w", p.poolConfigKey, err)
+	}
+	if pair == nil {
+		return nil, meta, nil
+	}
+	c, err := decodePoolConfig(pair.Value)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid pool definition in key %q: %w", p.poolConfigKey, err)
+	}
+	return c, meta, nil
+}
+
+// usePoolConfig replaces the configured range and lease time by those of c,
+// before the allocator is created
+func (p *PluginState) usePoolConfig(c *poolConfig) error {
+	p.rangeStart, p.rangeEnd = c.Start, c.End
+	p.LeaseTime = c.leaseTime
+	if p.LeaseTime == infiniteLeaseTime && p.backpressureFree > 0 {
+		return errors.New("backpressure cannot shorten infinite leases")
+	}
+	return p.checkLeaseTimeFloor(p.LeaseTime)
+}
+
+// setConfigExclusions excludes exactly ips from allocation, on top of the
+// addresses excluded otherwise, e.g. by the subnet option. An address that is
+// leased can't be excluded, it is skipped with a warning.
+// Must be called with the plugin lock held.
+func (p *PluginState) setConfigExclusions(ips []net.IP) {
+	want := make(map[string]net.IP, len(ips))
+	for _, ip := range ips {
+		want[ip.String()] = ip
+	}
+	for key, ip := range p.configExcluded {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		delete(p.configExcluded, key)
+		delete(p.excluded, key)
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+			log.Warningf("Could not free %s no longer excluded: %v", ip, err)
+			continue
+		}
+		log.Printf("Returned %s to allocation", ip)
+	}
+	for key, ip := range want {
+		if _, ok := p.excluded[key]; ok {
+			continue
+		}
+		if err := p.exclude(ip); err != nil {
+			log.Warningf("Not excluding %s: %v", ip, err)
+			continue
+		}
+		if _, ok := p.excluded[key]; !ok {
+			// Not within the range
+			continue
+		}
+		if p.configExcluded == nil {
+			p.configExcluded = make(map[string]net.IP)
+		}
+		p.configExcluded[key] = ip
+	}
+}
+
+// applyPoolConfig applies a changed pool definition: the range is resized and
+// the lease time changed as by the HTTP API, and the exclusions updated. The
+// start of the range can only be moved by a restart.
+func (p *PluginState) applyPoolConfig(ctx context.Context, c *poolConfig) error {
+	p.Lock()
+	start, end, leaseTime := p.rangeStart, p.rangeEnd, p.LeaseTime
+	p.Unlock()
+
+	var errs []error
+	if !c.Start.Equal(start) {
+		errs = append(errs, fmt.Errorf("the start of the range can only be moved from %s to %s by a restart", start, c.Start))
+	}
+	if !c.End.Equal(end) {
+		if err := p.resize(ctx, c.End); err != nil {
+			errs = append(errs, fmt.Errorf("could not resize the range: %w", err))
+		}
+	}
+	if c.leaseTime != leaseTime {
+		if err := p.setLeaseTime(c.leaseTime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.Lock()
+	p.setConfigExclusions(c.Exclude)
+	p.Unlock()
+	return errors.Join(errs...)
+}
+
+// watchPoolConfig applies the changes made to the pool definition after index
+// until ctx is done
+func (p *PluginState) watchPoolConfig(ctx context.Context, index uint64) {
+	applied := index
+	for {
+		pair, meta, err := p.kv.Get(p.poolConfigKey, (&api.QueryOptions{WaitIndex: index}).WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warningf("Could not watch pool definition %s: %v", p.poolConfigKey, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		// Blocking queries need a positive index
+		index = max(meta.LastIndex, 1)
+		if pair == nil || pair.ModifyIndex <= applied {
+			continue
+		}
+		applied = pair.ModifyIndex
+		c, err := decodePoolConfig(pair.Value)
+		if err != nil {
+			log.Warningf("Ignoring invalid pool definition in %s: %v", p.poolConfigKey, err)
+			continue
+		}
+		if err := p.applyPoolConfig(ctx, c); err != nil {
+			log.Warningf("Applied pool definition from %s partially: %v", p.poolConfigKey, err)
+			continue
+		}
+		log.Printf("Applied pool definition from %s", p.poolConfigKey)
+	}
+}
@@ -0,0 +1,69 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolConfigFromConsul(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parsePoolConfigOption(p, "dhcp/pool"))
+	put := func(value string) {
+		_, err := p.kv.Put(&api.KVPair{Key: "dhcp/pool", Value: []byte(value)}, nil)
+		require.NoError(t, err)
+	}
+	put(`{"start":"10.0.0.1","end":"10.0.0.10","lease":"1h","exclude":["10.0.0.2"]}`)
+
+	c, meta, err := p.loadPoolConfig()
+	require.NoError(t, err)
+	require.NoError(t, p.usePoolConfig(c))
+	p.Lock()
+	p.setConfigExclusions(c.Exclude)
+	p.Unlock()
+	assert.False(t, p.inRange(net.IPv4(10, 0, 0, 2)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.watchPoolConfig(ctx, meta.LastIndex)
+
+	put(`{"start":"10.0.0.1","end":"10.0.0.20","lease":"30m","exclude":["10.0.0.3"]}`)
+	require.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		return p.LeaseTime == 30*time.Minute
+	}, time.Second, time.Millisecond)
+	p.Lock()
+	defer p.Unlock()
+	assert.Equal(t, "10.0.0.20", p.rangeEnd.String())
+	assert.True(t, p.inRange(net.IPv4(10, 0, 0, 2)), "addresses no longer excluded must be allocatable again")
+	assert.False(t, p.inRange(net.IPv4(10, 0, 0, 3)))
+	assert.True(t, p.inRange(net.IPv4(10, 0, 0, 15)))
+}
+
+func TestApplyPoolConfigRejectsStartChange(t *testing.T) {
+	p := testPluginState(t)
+	c, err := decodePoolConfig([]byte(`{"start":"10.0.0.2","end":"10.0.0.12","lease":"1h"}`))
+	require.NoError(t, err)
+	assert.Error(t, p.applyPoolConfig(context.Background(), c))
+	assert.Equal(t, "10.0.0.1", p.rangeStart.String())
+	assert.Equal(t, "10.0.0.12", p.rangeEnd.String(), "the rest of the definition is applied")
+}
+
+func TestDecodePoolConfig(t *testing.T) {
+	for _, value := range []string{
+		`{"start":"10.0.0.10","end":"10.0.0.1","lease":"1h"}`,
+		`{"start":"10.0.0.1","end":"10.0.0.10"}`,
+		`{"start":"::1","end":"10.0.0.10","lease":"1h"}`,
+		`{"start":"10.0.0.1","end":"10.0.0.10","lease":"1h","exclude":["::1"]}`,
+		`[]`,
+	} {
+		_, err := decodePoolConfig([]byte(value))
+		assert.Error(t, err, value)
+	}
+}
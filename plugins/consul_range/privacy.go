@@ -0,0 +1,84 @@
+package consulrangeplugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// macHashLen is the number of bytes of the HMAC kept when anonymizing a MAC address
+const macHashLen = 12
+
+func parseMACHashKeyOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("MAC hashing key cannot be empty")
+	}
+	p.macHashKey = []byte(value)
+	return nil
+}
+
+// logMAC returns the representation of a MAC address to use in logs and dumps.
+// When a MAC hashing key is configured this is a truncated HMAC-SHA256 of the
+// address, which is stable for a given key so that entries can be correlated
+// without revealing the address. Otherwise the address is returned as is.
+func (p *PluginState) logMAC(mac string) string {
+	if len(p.macHashKey) == 0 {
+		return mac
+	}
+	return hex.EncodeToString(p.keyedHash([]byte(mac)))
+}
+
+// keyedHash returns the truncated HMAC-SHA256 of data keyed with the MAC
+// hashing key, which must be configured
+func (p *PluginState) keyedHash(data []byte) []byte {
+	h := hmac.New(sha256.New, p.macHashKey)
+	h.Write(data)
+	return h.Sum(nil)[:macHashLen]
+}
+
+// pathClient returns the client named by the mac path value of an HTTP API
+// request: a lease key, or when MAC addresses are anonymized, its hash as
+// found in logs and dumps. If there is none, it answers the request and
+// returns false.
+func (p *PluginState) pathClient(w http.ResponseWriter, r *http.Request) (net.HardwareAddr, bool) {
+	s := r.PathValue("mac")
+	if len(p.macHashKey) > 0 && len(s) == 2*macHashLen {
+		if _, err := hex.DecodeString(s); err == nil {
+			mac, ok := p.clientByHash(strings.ToLower(s))
+			if !ok {
+				http.Error(w, "no client with MAC address hash "+s, http.StatusNotFound)
+			}
+			return mac, ok
+		}
+	}
+	mac, err := parseClientKey(s)
+	if err != nil {
+		http.Error(w, "invalid MAC address", http.StatusBadRequest)
+		return nil, false
+	}
+	return mac, true
+}
+
+// clientByHash returns the client holding a lease or a request history whose
+// MAC address hashes to hash
+func (p *PluginState) clientByHash(hash string) (net.HardwareAddr, bool) {
+	p.Lock()
+	defer p.Unlock()
+	for mac := range p.Recordsv4 {
+		if p.logMAC(mac) == hash {
+			key, err := parseClientKey(mac)
+			return key, err == nil
+		}
+	}
+	for mac := range p.history.clients {
+		if p.logMAC(mac) == hash {
+			key, err := parseClientKey(mac)
+			return key, err == nil
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,79 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogMACHashed(t *testing.T) {
+	p := testPluginState(t)
+	p.macHashKey = []byte("secret")
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	hashed := p.logMAC(mac.String())
+	assert.NotEqual(t, mac.String(), hashed)
+	assert.Equal(t, hashed, p.logMAC(mac.String()), "hash should be stable")
+
+	hook := test.NewLocal(log.Logger)
+	defer hook.Reset()
+	log.Logger.SetLevel(logrus.DebugLevel)
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+
+	require.NotEmpty(t, hook.AllEntries())
+	for _, e := range hook.AllEntries() {
+		line, err := e.String()
+		require.NoError(t, err)
+		assert.NotContains(t, line, mac.String(), "raw MAC address leaked into logs")
+	}
+	assert.Contains(t, hook.LastEntry().Message, hashed)
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/leases")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var dump []lease
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&dump))
+	require.Len(t, dump, 1)
+	assert.Equal(t, hashed, dump[0].MAC)
+}
+
+func TestLogMACPlain(t *testing.T) {
+	p := testPluginState(t)
+	assert.Equal(t, "02:00:00:00:00:01", p.logMAC("02:00:00:00:00:01"))
+}
+
+func TestHTTPAcceptsHashedMAC(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseMACHashKeyOption(p, "secret"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 5))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	hashed := p.logMAC(mac.String())
+
+	status, l := postPin(t, srv, hashed, "pin")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, hashed, l.MAC)
+	assert.True(t, p.Recordsv4[mac.String()].Pinned)
+	assert.Equal(t, http.StatusAccepted, postMove(t, srv, hashed, "10.0.0.6"))
+
+	// Raw MAC addresses are still accepted
+	status, _ = postPin(t, srv, mac.String(), "unpin")
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, p.Recordsv4[mac.String()].Pinned)
+
+	// A hash matching no client is not found
+	status, _ = postPin(t, srv, p.logMAC("02:00:00:00:00:02"), "pin")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:02")
+}
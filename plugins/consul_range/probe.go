@@ -0,0 +1,80 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Errors returned by the startup check, to tell misconfigurations apart
+var (
+	errConsulUnreachable = errors.New("consul is unreachable")
+	errConsulDenied      = errors.New("consul denied access to the KV prefix")
+	errConsulPrefix      = errors.New("consul KV prefix is unusable")
+)
+
+func parseStartupCheckOption(p *PluginState, value string) error {
+	check, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.skipStartupCheck = !check
+	return nil
+}
+
+// checkConsul confirms the plugin can write and read back keys under its
+// prefix by round-tripping a sentinel key, which is then deleted
+func (p *PluginState) checkConsul(ctx context.Context) error {
+	if strings.HasPrefix(p.consulKVPrefix, "/") {
+		return fmt.Errorf("%w: %q must not begin with a '/'", errConsulPrefix, p.consulKVPrefix)
+	}
+	token := make([]byte, 8)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	// Random, so that peers starting at the same time don't clobber each other's sentinel
+	key := p.configKey("check-" + hex.EncodeToString(token))
+	value := []byte(hex.EncodeToString(token))
+
+	if _, err := p.kv.Put(&api.KVPair{Key: key, Value: value}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return consulCheckError("write", key, err)
+	}
+	defer func() {
+		if _, err := p.kv.Delete(key, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			log.Warningf("Could not delete startup check key %s: %v", key, err)
+		}
+	}()
+	pair, _, err := p.kv.Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return consulCheckError("read", key, err)
+	}
+	if pair == nil || !bytes.Equal(pair.Value, value) {
+		return fmt.Errorf("%w: key %s written under %q could not be read back", errConsulPrefix, key, p.consulKVPrefix)
+	}
+	return nil
+}
+
+// consulCheckError classifies an error returned by Consul during the startup check
+func consulCheckError(op, key string, err error) error {
+	var status api.StatusError
+	if errors.As(err, &status) {
+		if status.Code == http.StatusForbidden {
+			return fmt.Errorf("%w: %s of %s: %s, check the ACL token", errConsulDenied, op, key, status.Body)
+		}
+		return fmt.Errorf("%s of %s failed with status %d: %s", op, key, status.Code, status.Body)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %s of %s: %v", errConsulUnreachable, op, key, err)
+	}
+	return fmt.Errorf("%s of %s failed: %w", op, key, err)
+}
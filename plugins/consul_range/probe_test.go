@@ -0,0 +1,72 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// denyingKV is a memKV rejecting writes like Consul does without a suitable ACL token
+type denyingKV struct {
+	*memKV
+}
+
+func (d denyingKV) Put(*api.KVPair, *api.WriteOptions) (*api.WriteMeta, error) {
+	return nil, api.StatusError{Code: http.StatusForbidden, Body: "Permission denied"}
+}
+
+// discardingKV is a memKV silently dropping writes
+type discardingKV struct {
+	*memKV
+}
+
+func (d discardingKV) Put(*api.KVPair, *api.WriteOptions) (*api.WriteMeta, error) {
+	return &api.WriteMeta{}, nil
+}
+
+func TestCheckConsul(t *testing.T) {
+	p := testPluginState(t)
+	kv := p.kv.(*memKV)
+	require.NoError(t, p.checkConsul(context.Background()))
+	assert.Empty(t, kv.data, "the sentinel key was not cleaned up")
+	assert.Equal(t, 1, kv.puts)
+}
+
+func TestCheckConsulDenied(t *testing.T) {
+	p := testPluginState(t)
+	p.kv = denyingKV{newMemKV()}
+	err := p.checkConsul(context.Background())
+	assert.ErrorIs(t, err, errConsulDenied)
+	assert.ErrorContains(t, err, "leases/_config/check-")
+}
+
+func TestCheckConsulPrefix(t *testing.T) {
+	p := testPluginState(t)
+	p.kv = discardingKV{newMemKV()}
+	assert.ErrorIs(t, p.checkConsul(context.Background()), errConsulPrefix)
+
+	p = testPluginState(t)
+	p.consulKVPrefix = "/leases"
+	assert.ErrorIs(t, p.checkConsul(context.Background()), errConsulPrefix)
+}
+
+func TestCheckConsulUnreachable(t *testing.T) {
+	// Grab a free port and close it, so that nothing listens on it
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	config := api.DefaultConfig()
+	config.Address = addr
+	client, err := api.NewClient(config)
+	require.NoError(t, err)
+	p := testPluginState(t)
+	p.kv = client.KV()
+	assert.ErrorIs(t, p.checkConsul(context.Background()), errConsulUnreachable)
+}
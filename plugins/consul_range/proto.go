@@ -0,0 +1,200 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// protoMagic starts the values of protobuf records, which can't be confused
+// with JSON records
+const protoMagic = 0x00
+
+// Field numbers of the Record message of record.proto
+const (
+	protoFieldIP          = 1
+	protoFieldExpires     = 2
+	protoFieldHostname    = 3
+	protoFieldPinned      = 4
+	protoFieldNext        = 5
+	protoFieldTags        = 6
+	protoFieldUserClass   = 7
+	protoFieldStickyFloor = 8
+	protoFieldFirstSeen   = 9
+)
+
+// Protobuf wire types
+const (
+	wireVarint = 0
+	wireI64    = 1
+	wireLen    = 2
+	wireI32    = 5
+)
+
+var errProtoTruncated = errors.New("truncated protobuf record")
+
+// isProtoRecord reports whether a stored value is a protobuf record
+func isProtoRecord(data []byte) bool {
+	return len(data) > 0 && data[0] == protoMagic
+}
+
+// appendProtoTag appends the key of field num of wire type typ
+func appendProtoTag(b []byte, num, typ int) []byte {
+	return binary.AppendUvarint(b, uint64(num)<<3|uint64(typ))
+}
+
+// appendProtoBytes appends field num holding v, omitted if empty like proto3 does
+func appendProtoBytes(b []byte, num int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = appendProtoTag(b, num, wireLen)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendProtoVarint appends field num holding v, omitted if zero
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, num, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// encodeProtoRecord serializes rec as a protobuf Record, see record.proto
+func encodeProtoRecord(rec *Record) []byte {
+	b := []byte{protoMagic}
+	b = appendProtoBytes(b, protoFieldIP, rec.IP)
+	b = appendProtoVarint(b, protoFieldExpires, uint64(int64(rec.Expires)))
+	b = appendProtoBytes(b, protoFieldHostname, []byte(rec.Hostname))
+	if rec.Pinned {
+		b = appendProtoVarint(b, protoFieldPinned, 1)
+	}
+	b = appendProtoBytes(b, protoFieldNext, rec.Next)
+	for k, v := range rec.Tags {
+		var entry []byte
+		entry = appendProtoBytes(entry, 1, []byte(k))
+		entry = appendProtoBytes(entry, 2, []byte(v))
+		// Entries are always written, even if empty, so that an empty tag survives
+		b = appendProtoTag(b, protoFieldTags, wireLen)
+		b = binary.AppendUvarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	for _, class := range rec.UserClass {
+		b = appendProtoTag(b, protoFieldUserClass, wireLen)
+		b = binary.AppendUvarint(b, uint64(len(class)))
+		b = append(b, class...)
+	}
+	b = appendProtoVarint(b, protoFieldStickyFloor, uint64(int64(rec.StickyFloor)))
+	return appendProtoVarint(b, protoFieldFirstSeen, uint64(int64(rec.FirstSeen)))
+}
+
+// protoField is a field read from a protobuf message
+type protoField struct {
+	num    int
+	typ    int
+	varint uint64
+	data   []byte
+}
+
+// readProtoField reads the field at the start of b, returning the rest of b
+func readProtoField(b []byte) (protoField, []byte, error) {
+	key, n := binary.Uvarint(b)
+	if n <= 0 {
+		return protoField{}, nil, errProtoTruncated
+	}
+	b = b[n:]
+	f := protoField{num: int(key >> 3), typ: int(key & 7)}
+	switch f.typ {
+	case wireVarint:
+		f.varint, n = binary.Uvarint(b)
+		if n <= 0 {
+			return f, nil, errProtoTruncated
+		}
+		return f, b[n:], nil
+	case wireLen:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return f, nil, errProtoTruncated
+		}
+		f.data = b[n : n+int(l)]
+		return f, b[n+int(l):], nil
+	case wireI64, wireI32:
+		size := 8
+		if f.typ == wireI32 {
+			size = 4
+		}
+		if len(b) < size {
+			return f, nil, errProtoTruncated
+		}
+		return f, b[size:], nil
+	}
+	return f, nil, fmt.Errorf("unsupported protobuf wire type %d", f.typ)
+}
+
+// decodeProtoRecord parses a value written by encodeProtoRecord. Unknown
+// fields are skipped, so that fields can be added to the schema.
+func decodeProtoRecord(data []byte) (*Record, error) {
+	if !isProtoRecord(data) {
+		return nil, errors.New("not a protobuf record")
+	}
+	rec := &Record{}
+	for b := data[1:]; len(b) > 0; {
+		f, rest, err := readProtoField(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+		switch {
+		case f.num == protoFieldIP && f.typ == wireLen:
+			rec.IP = net.IP(append([]byte(nil), f.data...))
+		case f.num == protoFieldExpires && f.typ == wireVarint:
+			rec.Expires = int(int64(f.varint))
+		case f.num == protoFieldHostname && f.typ == wireLen:
+			rec.Hostname = string(f.data)
+		case f.num == protoFieldPinned && f.typ == wireVarint:
+			rec.Pinned = f.varint != 0
+		case f.num == protoFieldNext && f.typ == wireLen:
+			rec.Next = net.IP(append([]byte(nil), f.data...))
+		case f.num == protoFieldTags && f.typ == wireLen:
+			k, v, err := decodeProtoTag(f.data)
+			if err != nil {
+				return nil, err
+			}
+			if rec.Tags == nil {
+				rec.Tags = make(map[string]string)
+			}
+			rec.Tags[k] = v
+		case f.num == protoFieldUserClass && f.typ == wireLen:
+			rec.UserClass = append(rec.UserClass, string(f.data))
+		case f.num == protoFieldStickyFloor && f.typ == wireVarint:
+			rec.StickyFloor = int(int64(f.varint))
+		case f.num == protoFieldFirstSeen && f.typ == wireVarint:
+			rec.FirstSeen = int(int64(f.varint))
+		}
+	}
+	return rec, nil
+}
+
+// decodeProtoTag parses a map entry of the tags field
+func decodeProtoTag(b []byte) (k, v string, err error) {
+	for len(b) > 0 {
+		f, rest, err := readProtoField(b)
+		if err != nil {
+			return "", "", err
+		}
+		b = rest
+		if f.typ != wireLen {
+			continue
+		}
+		switch f.num {
+		case 1:
+			k = string(f.data)
+		case 2:
+			v = string(f.data)
+		}
+	}
+	return k, v, nil
+}
@@ -0,0 +1,93 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtoRecordRoundTrip(t *testing.T) {
+	for name, rec := range map[string]*Record{
+		"minimal": {IP: net.IPv4(10, 0, 0, 1).To4()},
+		"full": {
+			IP:          net.IPv4(10, 0, 0, 2).To4(),
+			Expires:     1700000000,
+			Hostname:    "printer",
+			Pinned:      true,
+			Next:        net.IPv4(10, 1, 0, 2).To4(),
+			Tags:        map[string]string{"owner": "lab", "empty": ""},
+			UserClass:   []string{"ipxe", "lab"},
+			StickyFloor: 600,
+			FirstSeen:   1700000000,
+		},
+		"infinite":  {IP: net.IPv4(10, 0, 0, 3).To4(), Expires: infiniteExpiry},
+		"negative":  {IP: net.IPv4(10, 0, 0, 4).To4(), Expires: -1},
+		"ipv6 form": {IP: net.IPv4(10, 0, 0, 5)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := encodeProtoRecord(rec)
+			require.True(t, isProtoRecord(data))
+			decoded, err := decodeProtoRecord(data)
+			require.NoError(t, err)
+			assert.Equal(t, rec, decoded)
+		})
+	}
+}
+
+func TestProtoRecordSkipsUnknownFields(t *testing.T) {
+	data := encodeProtoRecord(&Record{IP: net.IPv4(10, 0, 0, 1).To4(), Hostname: "printer"})
+	data = appendProtoVarint(data, 99, 42)
+	data = appendProtoBytes(data, 100, []byte("future"))
+	decoded, err := decodeProtoRecord(data)
+	require.NoError(t, err)
+	assert.Equal(t, &Record{IP: net.IPv4(10, 0, 0, 1).To4(), Hostname: "printer"}, decoded)
+}
+
+func TestProtoRecordTruncated(t *testing.T) {
+	data := encodeProtoRecord(&Record{IP: net.IPv4(10, 0, 0, 1).To4(), Hostname: "printer"})
+	// Cutting between the fields leaves a valid record, only cut inside them
+	ipEnd := 1 + 2 + 4
+	for i := 2; i < len(data); i++ {
+		if i == ipEnd {
+			continue
+		}
+		_, err := decodeProtoRecord(data[:i])
+		assert.Error(t, err, "truncated at %d", i)
+	}
+}
+
+func TestProtobufStorageMixedStore(t *testing.T) {
+	p := testPluginState(t)
+	kv := p.kv.(*memKV)
+	jsonMAC := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	jsonRec := &Record{IP: net.IPv4(10, 0, 0, 1), Expires: 1700000000, Hostname: "old"}
+	require.NoError(t, p.saveIPAddress(context.Background(), jsonMAC, jsonRec))
+
+	require.NoError(t, parseStorageOption(p, "protobuf"))
+	protoMAC := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	protoRec := &Record{IP: net.IPv4(10, 0, 0, 2), Expires: 1700000000, Hostname: "new", Tags: map[string]string{"rack": "a1"}}
+	require.NoError(t, p.saveIPAddress(context.Background(), protoMAC, protoRec))
+	assert.True(t, isProtoRecord(kv.data["leases/"+protoMAC.String()]))
+	assert.False(t, isProtoRecord(kv.data["leases/"+jsonMAC.String()]))
+
+	// A corrupt protobuf value is skipped like an invalid JSON one
+	kv.data["leases/02:00:00:00:00:03"] = []byte{protoMagic, 0x0a, 0x04, 10}
+
+	loaded, skipped, err := loadRecordsWith(kv, "leases", macKeys{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, skipped)
+	assert.Equal(t, map[string]*Record{
+		jsonMAC.String():  jsonRec,
+		protoMAC.String(): protoRec,
+	}, loaded)
+}
+
+func TestParseStorageOptionProtobuf(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseStorageOption(p, "protobuf"))
+	assert.Equal(t, storageProtobuf, p.storageFormat)
+	assert.ErrorContains(t, parseStorageOption(p, "msgpack"), "protobuf")
+}
@@ -0,0 +1,189 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators"
+)
+
+func parseReconcileOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("reconciliation interval must be positive: %s", d)
+	}
+	p.reconcileInterval = d
+	return nil
+}
+
+// startReconciler periodically reconciles the allocator with the lease records.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) startReconciler() {
+	go func() {
+		ticker := time.NewTicker(p.reconcileInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), p.reconcileInterval)
+			if _, err := p.reconcile(ctx); err != nil {
+				log.Warningf("Reconciliation failed: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// reconcile cross-checks the allocator against the records in memory and in
+// Consul, and repairs drift caused e.g. by a crash in the middle of a write:
+//   - a record in Consul whose address isn't allocated gets it allocated
+//   - a record only in memory, or pinned only in memory, is written back to Consul
+//   - an allocated address with no record anywhere is freed
+//
+// It returns the number of repairs made.
+func (p *PluginState) reconcile(ctx context.Context) (int, error) {
+	p.Lock()
+	if p.listing == 0 {
+		p.changedWhileListing = make(map[string]struct{})
+	}
+	p.listing++
+	p.Unlock()
+
+	stored, _, err := p.loadRecords()
+
+	p.Lock()
+	defer p.Unlock()
+	// The listing may predate the records changed meanwhile, e.g. leases
+	// released since: they are left to the next pass
+	changed := p.changedWhileListing
+	p.listing--
+	if p.listing == 0 {
+		p.changedWhileListing = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	repairs := 0
+	repaired := func(format string, args ...interface{}) {
+		repairs++
+		p.metrics.reconcileRepairs.Inc()
+		log.Warningf("Reconciliation: "+format, args...)
+	}
+
+	for mac, rec := range stored {
+		if _, ok := changed[mac]; ok {
+			continue
+		}
+		if _, ok := p.Recordsv4[mac]; !ok {
+			p.setRecord(mac, rec)
+			repaired("loaded lease %s for MAC %s missing from memory", rec.IP, p.logMAC(mac))
+		}
+	}
+	for mac, rec := range p.Recordsv4 {
+		_, modified := changed[mac]
+		if _, ok := p.merged[mac]; ok || modified {
+			// Read-only records are only copied as their clients renew
+			continue
+		}
+		if s, ok := stored[mac]; !ok || !s.IP.Equal(rec.IP) || s.Pinned != rec.Pinned {
+			hw, err := parseClientKey(mac)
+			if err != nil {
+				log.Warningf("Reconciliation: cannot persist lease with invalid MAC %q: %v", p.logMAC(mac), err)
+				continue
+			}
+			// Consul no longer holds what was last written
+			p.noteWritten(mac, nil)
+			if err := p.persist(ctx, hw, rec); err != nil {
+				return repairs, fmt.Errorf("could not persist lease for MAC %s: %w", p.logMAC(mac), err)
+			}
+			repaired("persisted lease %s for MAC %s missing from Consul", rec.IP, p.logMAC(mac))
+		}
+	}
+
+	leased := make(map[uint32]bool, len(p.Recordsv4))
+	for _, rec := range p.Recordsv4 {
+		if !p.inRange(rec.IP) {
+			continue
+		}
+		leased[binary.BigEndian.Uint32(rec.IP.To4())] = true
+		allocated, err := p.isAllocated(rec.IP)
+		if err != nil {
+			return repairs, err
+		}
+		if !allocated {
+			if _, err := p.allocator.Allocate(net.IPNet{IP: rec.IP}); err != nil {
+				return repairs, fmt.Errorf("could not allocate leased ip %s: %w", rec.IP, err)
+			}
+			repaired("allocated leased address %s", rec.IP)
+		}
+	}
+
+	// Outstanding offers, reservations, staged moves, addresses set aside for
+	// the next new clients and abandoned addresses hold their address without
+	// a lease
+	for _, o := range p.offers {
+		leased[binary.BigEndian.Uint32(o.ip)] = true
+	}
+	for _, ip := range p.reservations {
+		leased[binary.BigEndian.Uint32(ip)] = true
+	}
+	for _, ip := range p.moves {
+		leased[binary.BigEndian.Uint32(ip)] = true
+	}
+	for _, ip := range p.claimable {
+		leased[binary.BigEndian.Uint32(ip.To4())] = true
+	}
+	for key, d := range p.declines {
+		if ip := net.ParseIP(key).To4(); ip != nil && d.Abandoned {
+			leased[binary.BigEndian.Uint32(ip)] = true
+		}
+	}
+
+	for _, n := range p.allocator.Allocated() {
+		ip := n.IP.To4()
+		if ip == nil || leased[binary.BigEndian.Uint32(ip)] {
+			continue
+		}
+		if _, ok := p.excluded[ip.String()]; ok {
+			continue
+		}
+		if err := p.allocator.Free(n); err != nil {
+			return repairs, fmt.Errorf("could not free unleased ip %s: %w", ip, err)
+		}
+		repaired("freed allocated address %s without a lease", ip)
+	}
+	return repairs, nil
+}
+
+// noteChanged records that the record of mac changed in memory, for the
+// reconciliations listing the records in Consul.
+// Must be called with the plugin lock held.
+func (p *PluginState) noteChanged(mac string) {
+	if p.changedWhileListing != nil {
+		p.changedWhileListing[mac] = struct{}{}
+	}
+}
+
+// isAllocated probes whether ip is allocated, leaving the allocator unchanged.
+// The Allocator interface offers no way to query an address, so this tries to
+// allocate it and frees whatever was handed out.
+// Must be called with the plugin lock held.
+func (p *PluginState) isAllocated(ip net.IP) (bool, error) {
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if errors.Is(err, allocators.ErrNoAddrAvail) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := p.allocator.Free(got); err != nil {
+		return false, err
+	}
+	return !got.IP.Equal(ip), nil
+}
@@ -0,0 +1,123 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconcileRepairsDrift(t *testing.T) {
+	p := testPluginState(t)
+	kv := p.kv.(*memKV)
+
+	// A consistent lease, which must be left alone
+	ok := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	require.NoError(t, p.saveIPAddress(context.Background(), net.HardwareAddr{2, 0, 0, 0, 0, 1}, ok))
+
+	// Allocated, but no record anywhere
+	_, err := p.allocator.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 2)})
+	require.NoError(t, err)
+
+	// Recorded in Consul only, and not allocated
+	data, err := json.Marshal(&Record{IP: net.IPv4(10, 0, 0, 3), Expires: int(time.Now().Add(time.Hour).Unix())})
+	require.NoError(t, err)
+	_, err = kv.Put(&api.KVPair{Key: "leases/02:00:00:00:00:03", Value: data}, nil)
+	require.NoError(t, err)
+
+	// Recorded and allocated in memory only, as after a failed write
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 4}, net.IPv4(10, 0, 0, 4))
+
+	repairs, err := p.reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, repairs)
+	assert.Equal(t, uint64(4), p.metrics.reconcileRepairs.Value())
+
+	p.Lock()
+	for ip, want := range map[byte]bool{1: true, 2: false, 3: true, 4: true, 5: false} {
+		allocated, err := p.isAllocated(net.IPv4(10, 0, 0, ip))
+		require.NoError(t, err)
+		assert.Equal(t, want, allocated, "wrong allocation state for 10.0.0.%d", ip)
+	}
+	p.Unlock()
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:03")
+	stored, err := loadRecords(kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Contains(t, stored, "02:00:00:00:00:04")
+
+	// Once repaired, there is nothing left to do
+	repairs, err = p.reconcile(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, repairs)
+}
+
+// listHookKV is a memKV calling hook once, while listing
+type listHookKV struct {
+	*memKV
+	hook func()
+}
+
+func (l *listHookKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	pairs, meta, err := l.memKV.List(prefix, q)
+	if l.hook != nil {
+		l.hook()
+		l.hook = nil
+	}
+	return pairs, meta, err
+}
+
+func TestReconcileKeepsLeasesReleasedWhileListing(t *testing.T) {
+	p := testPluginState(t)
+	ctx := context.Background()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+	require.NoError(t, p.saveIPAddress(ctx, mac, rec))
+	kv := &listHookKV{memKV: p.kv.(*memKV)}
+	p.kv = kv
+
+	// The lease is released once Consul was listed, before the lock is taken
+	kv.hook = func() {
+		p.Lock()
+		defer p.Unlock()
+		require.NoError(t, p.removeLease(ctx, mac.String(), rec))
+	}
+	_, err := p.reconcile(ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, p.Recordsv4, mac.String(), "the released lease was loaded back")
+	stored, err := loadRecords(kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, mac.String(), "the released lease was persisted again")
+	assert.Nil(t, p.changedWhileListing)
+}
+
+func TestReconcileLeavesReadOnlyLeases(t *testing.T) {
+	p := testPluginState(t)
+	ctx := context.Background()
+	data, err := json.Marshal(&Record{IP: net.IPv4(10, 0, 0, 5), Expires: int(time.Now().Add(time.Hour).Unix())})
+	require.NoError(t, err)
+	_, err = p.kv.Put(&api.KVPair{Key: "old/02:00:00:00:00:05", Value: data}, nil)
+	require.NoError(t, err)
+	p.readPrefixes = []string{"old"}
+	p.Recordsv4, _, err = p.loadMergedRecords()
+	require.NoError(t, err)
+	p.reindex()
+
+	_, err = p.reconcile(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, p.Recordsv4, "02:00:00:00:00:05")
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, stored, "a read-only lease was copied under the KV prefix")
+
+	// Renewing copies it
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 5}
+	p.Lock()
+	require.NoError(t, p.persist(ctx, mac, p.Recordsv4[mac.String()]))
+	p.Unlock()
+	assert.NotContains(t, p.merged, mac.String())
+}
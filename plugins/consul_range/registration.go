@@ -0,0 +1,162 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// registrationDir is the plugin state directory instances register their range in
+const registrationDir = "instances"
+
+// registrationRefresh is how often an instance refreshes its registration, and
+// registrationStale how long after its last refresh a registration is ignored
+const (
+	registrationRefresh = time.Minute
+	registrationStale   = 5 * registrationRefresh
+)
+
+// registration is written by each instance serving the KV prefix
+type registration struct {
+	ID    string    `json:"id"`
+	Start net.IP    `json:"start"`
+	End   net.IP    `json:"end"`
+	Seen  time.Time `json:"seen"`
+}
+
+// rangeConflictPolicy selects the response to instances sharing the KV
+// prefix with overlapping ranges
+type rangeConflictPolicy int
+
+const (
+	// rangeConflictWarn logs a warning and serves the range anyway
+	rangeConflictWarn rangeConflictPolicy = iota
+	// rangeConflictRefuse fails the setup
+	rangeConflictRefuse
+	// rangeConflictIgnore neither registers the instance nor checks for conflicts
+	rangeConflictIgnore
+)
+
+func parseRangeConflictsOption(p *PluginState, value string) error {
+	switch value {
+	case "warn":
+		p.rangeConflicts = rangeConflictWarn
+	case "refuse":
+		p.rangeConflicts = rangeConflictRefuse
+	case "ignore":
+		p.rangeConflicts = rangeConflictIgnore
+	default:
+		return fmt.Errorf("unknown range-conflicts policy %q, want warn, refuse or ignore", value)
+	}
+	return nil
+}
+
+func parseRegistrationIDOption(p *PluginState, value string) error {
+	if value == "" || strings.Contains(value, "/") {
+		return fmt.Errorf("invalid registration id %q, want a non-empty name without '/'", value)
+	}
+	p.registrationID = value
+	return nil
+}
+
+// defaultRegistrationID identifies the process among the instances sharing the prefix
+func defaultRegistrationID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// register writes or refreshes the registration of the instance and its range
+func (p *PluginState) register(ctx context.Context) error {
+	p.Lock()
+	reg := registration{ID: p.registrationID, Start: p.rangeStart, End: p.rangeEnd, Seen: p.now().UTC()}
+	p.Unlock()
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	key := p.configKey(registrationDir + "/" + reg.ID)
+	if _, err := p.kv.Put(&api.KVPair{Key: key, Value: data}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to store registration in consul: %w", err)
+	}
+	return nil
+}
+
+// conflictingRegistrations returns the live registrations of other instances
+// whose range overlaps ours. Instances serving the exact same range are peers
+// sharing it, not conflicts.
+func (p *PluginState) conflictingRegistrations(ctx context.Context) ([]registration, error) {
+	pairs, _, err := p.kv.List(p.configKey(registrationDir)+"/", (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list registrations: %w", err)
+	}
+	var conflicts []registration
+	for _, pair := range pairs {
+		var reg registration
+		if err := json.Unmarshal(pair.Value, &reg); err != nil {
+			log.Warningf("Ignoring invalid registration %s: %v", pair.Key, err)
+			continue
+		}
+		start, end := reg.Start.To4(), reg.End.To4()
+		switch {
+		case reg.ID == p.registrationID || start == nil || end == nil:
+		case p.now().Sub(reg.Seen) > registrationStale:
+		case start.Equal(p.rangeStart) && end.Equal(p.rangeEnd):
+		case compareIP(start, p.rangeEnd) <= 0 && compareIP(p.rangeStart, end) <= 0:
+			conflicts = append(conflicts, reg)
+		}
+	}
+	return conflicts, nil
+}
+
+// checkRangeConflicts registers the instance, then warns about or, with
+// range-conflicts=refuse, fails on instances sharing the prefix whose range
+// overlaps ours without being the same, which would hand out the same
+// addresses without coordinating.
+func (p *PluginState) checkRangeConflicts(ctx context.Context) error {
+	if err := p.register(ctx); err != nil {
+		return err
+	}
+	conflicts, err := p.conflictingRegistrations(ctx)
+	if err != nil || len(conflicts) == 0 {
+		return err
+	}
+	descs := make([]string, 0, len(conflicts))
+	for _, reg := range conflicts {
+		descs = append(descs, fmt.Sprintf("%s serving %s-%s", reg.ID, reg.Start, reg.End))
+	}
+	msg := fmt.Sprintf("range %s-%s overlaps the ranges of other instances sharing prefix %s: %s",
+		p.rangeStart, p.rangeEnd, p.consulKVPrefix, strings.Join(descs, ", "))
+	if p.rangeConflicts == rangeConflictRefuse {
+		if _, err := p.kv.Delete(p.configKey(registrationDir+"/"+p.registrationID), (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+			log.Warningf("Could not remove registration: %v", err)
+		}
+		return fmt.Errorf("%w: %s", ErrInvalidRange, msg)
+	}
+	log.Errorf("Misconfiguration: the %s, their leases will collide", msg)
+	return nil
+}
+
+// startRegistrationRefresh keeps the registration of the instance from going stale.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) startRegistrationRefresh() {
+	go func() {
+		ticker := time.NewTicker(registrationRefresh)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := p.requestContext()
+			if err := p.register(ctx); err != nil {
+				log.Warningf("Could not refresh registration: %v", err)
+			}
+			cancel()
+		}
+	}()
+}
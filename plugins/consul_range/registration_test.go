@@ -0,0 +1,85 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registeredInstance is an instance serving start-end under the prefix held by kv
+func registeredInstance(kv *memKV, clock *fakeClock, id, start, end string) *PluginState {
+	return &PluginState{
+		kv:             kv,
+		consulKVPrefix: "leases",
+		registrationID: id,
+		rangeStart:     net.ParseIP(start).To4(),
+		rangeEnd:       net.ParseIP(end).To4(),
+		clock:          clock.Now,
+	}
+}
+
+func TestOverlappingRegistrations(t *testing.T) {
+	kv := newMemKV()
+	clock := newFakeClock()
+	ctx := context.Background()
+	first := registeredInstance(kv, clock, "first", "10.0.0.1", "10.0.0.100")
+	require.NoError(t, first.checkRangeConflicts(ctx))
+	assert.Contains(t, kv.data, "leases/_config/instances/first")
+
+	hook := test.NewLocal(log.Logger)
+	defer hook.Reset()
+	second := registeredInstance(kv, clock, "second", "10.0.0.50", "10.0.0.150")
+	require.NoError(t, second.checkRangeConflicts(ctx))
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "first serving 10.0.0.1-10.0.0.100")
+
+	refused := registeredInstance(kv, clock, "refused", "10.0.0.90", "10.0.0.110")
+	require.NoError(t, parseRangeConflictsOption(refused, "refuse"))
+	err := refused.checkRangeConflicts(ctx)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	assert.ErrorContains(t, err, "first serving 10.0.0.1-10.0.0.100")
+	assert.ErrorContains(t, err, "second serving 10.0.0.50-10.0.0.150")
+	assert.NotContains(t, kv.data, "leases/_config/instances/refused", "a refused instance must not stay registered")
+}
+
+func TestCompatibleRegistrations(t *testing.T) {
+	kv := newMemKV()
+	clock := newFakeClock()
+	ctx := context.Background()
+	require.NoError(t, registeredInstance(kv, clock, "first", "10.0.0.1", "10.0.0.100").checkRangeConflicts(ctx))
+
+	for _, p := range []*PluginState{
+		// A peer sharing the range
+		registeredInstance(kv, clock, "peer", "10.0.0.1", "10.0.0.100"),
+		registeredInstance(kv, clock, "disjoint", "10.0.0.101", "10.0.0.200"),
+		// A restart refreshes its registration
+		registeredInstance(kv, clock, "first", "10.0.0.1", "10.0.0.50"),
+	} {
+		require.NoError(t, parseRangeConflictsOption(p, "refuse"))
+		conflicts, err := p.conflictingRegistrations(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, conflicts, p.registrationID)
+	}
+
+	// Registrations not refreshed are ignored
+	clock.Advance(registrationStale + time.Minute)
+	late := registeredInstance(kv, clock, "late", "10.0.0.50", "10.0.0.150")
+	require.NoError(t, parseRangeConflictsOption(late, "refuse"))
+	assert.NoError(t, late.checkRangeConflicts(ctx))
+}
+
+func TestParseRegistrationOptions(t *testing.T) {
+	p := &PluginState{}
+	assert.Error(t, parseRangeConflictsOption(p, "fight"))
+	assert.Error(t, parseRegistrationIDOption(p, ""))
+	assert.Error(t, parseRegistrationIDOption(p, "a/b"))
+	require.NoError(t, parseRegistrationIDOption(p, "dhcp-1"))
+	assert.Equal(t, "dhcp-1", p.registrationID)
+}
@@ -0,0 +1,164 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// parseTrustedRelayOption adds a relay agent address, or a subnet of them,
+// to those allowed to relay requests
+func parseTrustedRelayOption(p *PluginState, value string) error {
+	if !strings.Contains(value, "/") {
+		value += "/32"
+	}
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("not an IPv4 relay address: %s", value)
+	}
+	p.trustedRelays = append(p.trustedRelays, subnet)
+	return nil
+}
+
+// untrustedRelay reports whether req was relayed by an agent missing from the
+// trusted relays, if any are configured. Local requests are always trusted.
+func (p *PluginState) untrustedRelay(req *dhcpv4.DHCPv4) bool {
+	if len(p.trustedRelays) == 0 || !relayed(req) {
+		return false
+	}
+	for _, subnet := range p.trustedRelays {
+		if subnet.Contains(req.GatewayIPAddr) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	// defaultRelayBackoff is how long a relay exceeding relay-rate-limit is
+	// throttled for, unless configured
+	defaultRelayBackoff = 30 * time.Second
+	// maxTrackedRelays bounds the number of relays whose request rate is tracked
+	maxTrackedRelays = 4096
+)
+
+// relayThrottle drops the requests of relay agents forwarding more than limit
+// requests a second, e.g. looping broadcasts, for backoff. It has its own lock
+// so that throttled requests are dropped without waiting for the plugin lock.
+type relayThrottle struct {
+	limit   int
+	backoff time.Duration
+
+	mu     sync.Mutex
+	relays map[string]*relayRate
+}
+
+// relayRate is the request rate of a relay agent
+type relayRate struct {
+	// window is when the current one second window started, count the
+	// number of requests within it
+	window time.Time
+	count  int
+	// until is when a throttled relay is let through again
+	until time.Time
+}
+
+func parseRelayRateLimitOption(p *PluginState, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("relay rate limit must be positive, got %d", n)
+	}
+	p.relayThrottle.limit = n
+	return nil
+}
+
+func parseRelayBackoffOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("relay backoff must be positive, got %s", d)
+	}
+	p.relayThrottle.backoff = d
+	return nil
+}
+
+// allow reports whether a request relayed by giaddr at now may be served, and
+// whether it is the one getting the relay throttled
+func (t *relayThrottle) allow(giaddr net.IP, now time.Time) (allowed, throttled bool) {
+	if t.limit == 0 {
+		return true, false
+	}
+	key := giaddr.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.relays[key]
+	if !ok {
+		if t.relays == nil {
+			t.relays = make(map[string]*relayRate)
+		}
+		if len(t.relays) >= maxTrackedRelays {
+			t.prune(now)
+			if len(t.relays) >= maxTrackedRelays {
+				// Fail open rather than throttle relays we can't track
+				return true, false
+			}
+		}
+		r = &relayRate{window: now}
+		t.relays[key] = r
+	}
+	if now.Before(r.until) {
+		return false, false
+	}
+	if now.Sub(r.window) >= time.Second {
+		r.window, r.count = now, 0
+	}
+	r.count++
+	if r.count <= t.limit {
+		return true, false
+	}
+	backoff := t.backoff
+	if backoff == 0 {
+		backoff = defaultRelayBackoff
+	}
+	r.until = now.Add(backoff)
+	return false, true
+}
+
+// prune forgets the relays neither throttled nor seen within the last second.
+// Must be called with the throttle lock held.
+func (t *relayThrottle) prune(now time.Time) {
+	for key, r := range t.relays {
+		if now.Sub(r.window) >= time.Second && !now.Before(r.until) {
+			delete(t.relays, key)
+		}
+	}
+}
+
+// throttledRelay reports whether req must be dropped because its relay agent
+// is flooding the server, logging when a relay gets throttled
+func (p *PluginState) throttledRelay(req *dhcpv4.DHCPv4) bool {
+	if !relayed(req) {
+		return false
+	}
+	allowed, throttled := p.relayThrottle.allow(req.GatewayIPAddr, p.now())
+	if throttled {
+		log.Warningf("Relay agent %s forwards more than %d requests a second, dropping its requests for a while", req.GatewayIPAddr, p.relayThrottle.limit)
+	}
+	if !allowed {
+		p.metrics.relayThrottled.Inc()
+	}
+	return !allowed
+}
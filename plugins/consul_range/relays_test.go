@@ -0,0 +1,93 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4UntrustedRelay(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseTrustedRelayOption(p, "192.0.2.1"))
+	require.NoError(t, parseTrustedRelayOption(p, "198.51.100.0/24"))
+
+	for i, tc := range []struct {
+		giaddr  net.IP
+		trusted bool
+	}{
+		{nil, true},
+		{net.IPv4(192, 0, 2, 1), true},
+		{net.IPv4(198, 51, 100, 7), true},
+		{net.IPv4(192, 0, 2, 2), false},
+	} {
+		mac := net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)}
+		req, stub := testRequest(t, mac)
+		req.GatewayIPAddr = tc.giaddr
+		resp, stop := p.Handler4(req, stub)
+		if tc.trusted {
+			assert.NotNil(t, resp, "giaddr %s", tc.giaddr)
+			assert.Contains(t, p.Recordsv4, mac.String())
+			continue
+		}
+		assert.Nil(t, resp, "giaddr %s", tc.giaddr)
+		assert.True(t, stop)
+		assert.NotContains(t, p.Recordsv4, mac.String())
+	}
+	assert.Equal(t, uint64(1), p.metrics.untrustedRelays.Value())
+}
+
+func TestParseTrustedRelayOption(t *testing.T) {
+	for _, value := range []string{"", "relay", "2001:db8::1", "192.0.2.0/33"} {
+		assert.Error(t, parseTrustedRelayOption(&PluginState{}, value), value)
+	}
+}
+
+func TestHandler4ThrottlesFloodingRelay(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	require.NoError(t, parseRelayRateLimitOption(p, "5"))
+	require.NoError(t, parseRelayBackoffOption(p, "10s"))
+	relay := func(giaddr net.IP) *dhcpv4.DHCPv4 {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+		req.GatewayIPAddr = giaddr
+		resp, _ := p.Handler4(req, stub)
+		return resp
+	}
+	flooding, steady := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+
+	served := 0
+	for range 20 {
+		if relay(flooding) != nil {
+			served++
+		}
+	}
+	assert.Equal(t, 5, served)
+	assert.Equal(t, uint64(15), p.metrics.relayThrottled.Value())
+	assert.NotNil(t, relay(steady), "other relays are not throttled")
+	// Local requests are never throttled
+	assert.NotNil(t, relay(nil))
+
+	// The relay stays throttled for the backoff, even once it calms down
+	clock.Advance(5 * time.Second)
+	assert.Nil(t, relay(flooding))
+	clock.Advance(5 * time.Second)
+	assert.NotNil(t, relay(flooding))
+}
+
+func TestRelayThrottleIsBounded(t *testing.T) {
+	tr := relayThrottle{limit: 1}
+	now := time.Now()
+	for i := range maxTrackedRelays + 10 {
+		allowed, _ := tr.allow(uint32ToIP(uint32(i)), now)
+		assert.True(t, allowed)
+	}
+	assert.Len(t, tr.relays, maxTrackedRelays)
+	// Relays not seen for a second make room again
+	tr.allow(net.IPv4(192, 0, 2, 1), now.Add(time.Second))
+	assert.Len(t, tr.relays, 1)
+}
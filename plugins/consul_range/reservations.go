@@ -0,0 +1,175 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+func parseReservationsOption(p *PluginState, value string) error {
+	if value == "" {
+		return fmt.Errorf("reservations file name cannot be empty")
+	}
+	p.reservationsFile = value
+	return nil
+}
+
+// loadReservations reads static MAC -> IP reservations from a YAML file, a
+// mapping of MAC addresses to IPv4 addresses. JSON being a subset of YAML, a
+// JSON object works too.
+func loadReservations(filename string) (map[string]net.IP, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	reservations := make(map[string]net.IP, len(raw))
+	for m, i := range raw {
+		mac, err := parseClientKey(m)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC address %q in %s: %w", m, filename, err)
+		}
+		ip, err := parseIPv4(i)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reservation for MAC %s in %s: %w", mac, filename, err)
+		}
+		reservations[mac.String()] = ip
+	}
+	return reservations, nil
+}
+
+// applyReservations replaces the static reservations. Newly reserved addresses
+// are allocated right away so no other client gets them, unless they are
+// leased to another client, in which case they are taken over once that lease
+// ends. Addresses no longer reserved are freed unless they are leased.
+// Must be called with the plugin lock held.
+func (p *PluginState) applyReservations(reservations map[string]net.IP) error {
+	owners := make(map[string]string, len(reservations))
+	for mac, ip := range reservations {
+		if !p.inRange(ip) {
+			return fmt.Errorf("address %s reserved for MAC %s is not within range %s-%s", ip, p.logMAC(mac), p.rangeStart, p.rangeEnd)
+		}
+		if other, ok := owners[ip.String()]; ok {
+			return fmt.Errorf("address %s is reserved for both MAC %s and MAC %s", ip, p.logMAC(other), p.logMAC(mac))
+		}
+		owners[ip.String()] = mac
+	}
+
+	for mac, ip := range p.reservations {
+		if _, ok := owners[ip.String()]; ok {
+			continue
+		}
+		if _, leased := p.byIP.Lookup(ip); leased {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+			log.Warningf("Could not free %s no longer reserved for MAC %s: %v", ip, p.logMAC(mac), err)
+		}
+	}
+	for mac, ip := range reservations {
+		if p.isReserved(ip) {
+			continue
+		}
+		if holder, leased := p.byIP.Lookup(ip); leased {
+			if holder != mac {
+				log.Warningf("Address %s reserved for MAC %s is leased to MAC %s, reserving it once the lease ends", ip, p.logMAC(mac), p.logMAC(holder))
+			}
+			continue
+		}
+		got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+		if err != nil {
+			return fmt.Errorf("could not allocate %s reserved for MAC %s: %w", ip, p.logMAC(mac), err)
+		}
+		if !got.IP.Equal(ip) {
+			_ = p.allocator.Free(got)
+			log.Warningf("Address %s reserved for MAC %s is in use, reserving it once it is freed", ip, p.logMAC(mac))
+		}
+	}
+	p.reservations = reservations
+	return nil
+}
+
+// isReserved reports whether ip is statically reserved.
+// Must be called with the plugin lock held.
+func (p *PluginState) isReserved(ip net.IP) bool {
+	for _, r := range p.reservations {
+		if r.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedFor returns the address reserved for mac, unless another client
+// still holds a lease on it.
+// Must be called with the plugin lock held.
+func (p *PluginState) reservedFor(mac string) (net.IP, bool) {
+	ip, ok := p.reservations[mac]
+	if !ok {
+		return nil, false
+	}
+	if holder, leased := p.byIP.Lookup(ip); leased && holder != mac {
+		return nil, false
+	}
+	return ip, true
+}
+
+// reloadReservations loads and applies the reservations file, and returns the
+// number of reservations
+func (p *PluginState) reloadReservations() (int, error) {
+	reservations, err := loadReservations(p.reservationsFile)
+	if err != nil {
+		return 0, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return len(reservations), p.applyReservations(reservations)
+}
+
+// watchReservations calls reload whenever the reservations file changes. The
+// directory is watched rather than the file, so that files replaced by a
+// rename, as config management tools do, keep being watched.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) watchReservations(reload func() (int, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(p.reservationsFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %w", p.reservationsFile, err)
+	}
+	name := filepath.Clean(p.reservationsFile)
+	go func() {
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != name || !ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				n, err := reload()
+				if err != nil {
+					log.Warningf("Failed to reload reservations from %s: %v", p.reservationsFile, err)
+					continue
+				}
+				log.Printf("Reloaded %d reservations from %s", n, p.reservationsFile)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Warningf("Watching %s failed: %v", p.reservationsFile, err)
+			}
+		}
+	}()
+	return nil
+}
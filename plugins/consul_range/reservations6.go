@@ -0,0 +1,297 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/hashicorp/consul/api"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"gopkg.in/yaml.v3"
+)
+
+// v6KeyDir is the sub-directory of the KV prefix holding the DHCPv6 bindings
+// of reserved clients, one key per DUID and IAID
+const v6KeyDir = "_v6"
+
+// options6 are the options accepted by a DHCPv6 instance, which only serves
+// reservations
+var options6 = map[string]bool{
+	"reservations":   true,
+	"consul-timeout": true,
+	"startup-check":  true,
+	"instance":       true,
+	"mac-hash-key":   true,
+}
+
+// reservation6 identifies the IA_NA of a client a DHCPv6 reservation is for
+type reservation6 struct {
+	// duid is the hex encoded DUID of the client
+	duid string
+	iaid uint32
+}
+
+// parseDUID parses a DUID spelled as hex, its octets optionally separated by
+// colons, into its canonical lowercase hex form
+func parseDUID(s string) (string, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return "", err
+	}
+	// A 2 octet type and up to 128 octets of identifier (RFC 8415 §11.1)
+	if len(b) < 3 || len(b) > 130 {
+		return "", fmt.Errorf("DUID of %d octets, want 3 to 130", len(b))
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseIPv6 parses an IPv6 address, rejecting IPv4 and IPv4-mapped ones
+func parseIPv6(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", s)
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%q is an IPv4 address, want IPv6", s)
+	}
+	return ip, nil
+}
+
+// loadReservations6 reads static DUID+IAID -> IP reservations from a YAML
+// file, a mapping of DUIDs to mappings of IAIDs to IPv6 addresses. JSON being
+// a subset of YAML, a JSON object works too.
+func loadReservations6(filename string) (map[reservation6]net.IP, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]map[string]string
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	reservations := make(map[reservation6]net.IP)
+	for d, ias := range raw {
+		duid, err := parseDUID(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DUID %q in %s: %w", d, filename, err)
+		}
+		for i, a := range ias {
+			iaid, err := strconv.ParseUint(i, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IAID %q of DUID %s in %s: %w", i, duid, filename, err)
+			}
+			ip, err := parseIPv6(a)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reservation for DUID %s IAID %d in %s: %w", duid, iaid, filename, err)
+			}
+			reservations[reservation6{duid: duid, iaid: uint32(iaid)}] = ip
+		}
+	}
+	return reservations, nil
+}
+
+// inRange6 reports whether ip is within the DHCPv6 range
+func (p *PluginState) inRange6(ip net.IP) bool {
+	ip = ip.To16()
+	return ip.To4() == nil && bytes.Compare(ip, p.rangeStart) >= 0 && bytes.Compare(ip, p.rangeEnd) <= 0
+}
+
+// applyReservations6 replaces the DHCPv6 reservations, after checking their
+// addresses are within the range and reserved once.
+// Must be called with the plugin lock held.
+func (p *PluginState) applyReservations6(reservations map[reservation6]net.IP) error {
+	owners := make(map[string]reservation6, len(reservations))
+	for r, ip := range reservations {
+		if !p.inRange6(ip) {
+			return fmt.Errorf("address %s reserved for DUID %s IAID %d is not within range %s-%s", ip, p.logMAC(r.duid), r.iaid, p.rangeStart, p.rangeEnd)
+		}
+		if other, ok := owners[ip.String()]; ok {
+			return fmt.Errorf("address %s is reserved for both DUID %s IAID %d and DUID %s IAID %d", ip, p.logMAC(other.duid), other.iaid, p.logMAC(r.duid), r.iaid)
+		}
+		owners[ip.String()] = r
+	}
+	p.reservations6 = reservations
+	return nil
+}
+
+// reloadReservations6 loads and applies the DHCPv6 reservations file, and
+// returns the number of reservations
+func (p *PluginState) reloadReservations6() (int, error) {
+	reservations, err := loadReservations6(p.reservationsFile)
+	if err != nil {
+		return 0, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return len(reservations), p.applyReservations6(reservations)
+}
+
+// bindingKey6 returns the key of the DHCPv6 binding of r
+func (p *PluginState) bindingKey6(r reservation6) string {
+	return strings.TrimRight(p.consulKVPrefix, "/") + "/" + v6KeyDir + "/" + r.duid + "/" + strconv.FormatUint(uint64(r.iaid), 10)
+}
+
+// saveBinding6 persists the binding of ip to r, granted now
+func (p *PluginState) saveBinding6(ctx context.Context, r reservation6, ip net.IP) error {
+	data, err := json.Marshal(&Record{IP: ip, Expires: expiresAt(p.now(), p.LeaseTime)})
+	if err != nil {
+		return err
+	}
+	if _, err := p.kv.Put(&api.KVPair{Key: p.bindingKey6(r), Value: data}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to store binding in consul: %w", err)
+	}
+	return nil
+}
+
+// deleteBinding6 removes the persisted binding of r
+func (p *PluginState) deleteBinding6(ctx context.Context, r reservation6) error {
+	if _, err := p.kv.Delete(p.bindingKey6(r), (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to delete binding from consul: %w", err)
+	}
+	return nil
+}
+
+// Handler6 answers the IA_NAs of clients holding a reservation with their
+// reserved address, persisting the binding once requested. Other clients and
+// IA_NAs are left to the next plugins.
+func (p *PluginState) Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	m, err := req.GetInnerMessage()
+	if err != nil {
+		log.Errorf("BUG: could not decapsulate: %v", err)
+		return nil, true
+	}
+	duid := m.Options.ClientID()
+	if duid == nil {
+		log.Debug("No client identifier, passing")
+		return resp, false
+	}
+	id := hex.EncodeToString(duid.ToBytes())
+
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	p.Lock()
+	defer p.Unlock()
+	for _, iana := range m.Options.IANA() {
+		r := reservation6{duid: id, iaid: binary.BigEndian.Uint32(iana.IaId[:])}
+		ip, ok := p.reservations6[r]
+		if !ok {
+			log.Debugf("No reservation for DUID %s IAID %d, passing", p.logMAC(id), r.iaid)
+			continue
+		}
+		switch m.MessageType {
+		case dhcpv6.MessageTypeSolicit:
+		case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+			if err := p.saveBinding6(ctx, r, ip); err != nil {
+				log.Errorf("Could not persist binding for DUID %s IAID %d: %v", p.logMAC(id), r.iaid, err)
+			}
+		case dhcpv6.MessageTypeRelease:
+			if err := p.deleteBinding6(ctx, r); err != nil {
+				log.Errorf("Could not delete binding for DUID %s IAID %d: %v", p.logMAC(id), r.iaid, err)
+			}
+			continue
+		default:
+			continue
+		}
+		resp.AddOption(&dhcpv6.OptIANA{
+			IaId: iana.IaId,
+			Options: dhcpv6.IdentityOptions{Options: []dhcpv6.Option{
+				&dhcpv6.OptIAAddress{
+					IPv6Addr:          ip,
+					PreferredLifetime: p.LeaseTime,
+					ValidLifetime:     p.LeaseTime,
+				},
+			}},
+		})
+	}
+	return resp, false
+}
+
+func setupConsulRange6(args ...string) (handler.Handler6, error) {
+	var (
+		err error
+		p   PluginState
+	)
+
+	if len(args) < 5 {
+		return nil, fmt.Errorf("%w, want at least: 5 (Consul base URL, KV prefix, start IP, end IP, lease time), got: %d", ErrInvalidArguments, len(args))
+	}
+	args, err = expandArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	consulURL := args[0]
+	if consulURL == "" {
+		return nil, ErrEmptyURL
+	}
+	consulKVPrefix := args[1]
+	if consulKVPrefix == "" {
+		return nil, ErrEmptyPrefix
+	}
+
+	p.rangeStart, err = parseIPv6(args[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid start: %w", ErrInvalidRange, err)
+	}
+	p.rangeEnd, err = parseIPv6(args[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid end: %w", ErrInvalidRange, err)
+	}
+	if bytes.Compare(p.rangeStart, p.rangeEnd) >= 0 {
+		return nil, fmt.Errorf("%w: start %s has to be lower than end %s", ErrInvalidRange, p.rangeStart, p.rangeEnd)
+	}
+
+	p.LeaseTime, err = parseLeaseTime(args[4])
+	if err != nil || p.LeaseTime <= 0 {
+		return nil, fmt.Errorf("%w: %v", ErrBadLeaseDuration, args[4])
+	}
+
+	p.consulTimeout = defaultConsulTimeout
+	for _, arg := range args[5:] {
+		if key, _, _ := strings.Cut(arg, "="); !options6[key] {
+			return nil, fmt.Errorf("%w: option %q is not supported for DHCPv6", ErrInvalidOption, key)
+		}
+	}
+	if err := p.parseOptions(args[5:]); err != nil {
+		return nil, err
+	}
+	if p.reservationsFile == "" {
+		return nil, fmt.Errorf("%w: DHCPv6 only serves reservations, it requires a reservations file", ErrInvalidOption)
+	}
+	p.consulKVPrefix = instancePrefix(consulKVPrefix, p.instance)
+
+	config := api.DefaultConfig()
+	config.Address = consulURL
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consul client: %w", err)
+	}
+	p.kv = client.KV()
+
+	if !p.skipStartupCheck {
+		ctx, cancel := p.requestContext()
+		err := p.checkConsul(ctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("consul startup check failed: %w", err)
+		}
+	}
+
+	n, err := p.reloadReservations6()
+	if err != nil {
+		return nil, fmt.Errorf("could not load reservations: %w", err)
+	}
+	if err := p.watchReservations(p.reloadReservations6); err != nil {
+		return nil, err
+	}
+	log.Printf("Loaded %d DHCPv6 reservations from %s", n, p.reservationsFile)
+
+	return p.Handler6, nil
+}
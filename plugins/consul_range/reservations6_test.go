@@ -0,0 +1,142 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPluginState6 returns a DHCPv6 instance serving 2001:db8::1-2001:db8::100
+// with the reservations of the given file contents
+func testPluginState6(t *testing.T, reservations string) *PluginState {
+	p := &PluginState{
+		LeaseTime:        time.Hour,
+		rangeStart:       net.ParseIP("2001:db8::1"),
+		rangeEnd:         net.ParseIP("2001:db8::100"),
+		kv:               newMemKV(),
+		consulKVPrefix:   "leases",
+		reservationsFile: filepath.Join(t.TempDir(), "reservations6.yaml"),
+	}
+	require.NoError(t, os.WriteFile(p.reservationsFile, []byte(reservations), 0o644))
+	_, err := p.reloadReservations6()
+	require.NoError(t, err)
+	return p
+}
+
+// request6 sends a message of type typ from the client with duid for an IA_NA
+// of iaid, and returns the address answered for it, if any
+func request6(t *testing.T, p *PluginState, typ dhcpv6.MessageType, duid dhcpv6.DUID, iaid uint32) net.IP {
+	t.Helper()
+	id := [4]byte{byte(iaid >> 24), byte(iaid >> 16), byte(iaid >> 8), byte(iaid)}
+	req, err := dhcpv6.NewMessage(dhcpv6.WithClientID(duid), dhcpv6.WithIAID(id))
+	require.NoError(t, err)
+	req.MessageType = typ
+	var resp *dhcpv6.Message
+	if typ == dhcpv6.MessageTypeSolicit {
+		resp, err = dhcpv6.NewAdvertiseFromSolicit(req)
+	} else {
+		resp, err = dhcpv6.NewReplyFromMessage(req)
+	}
+	require.NoError(t, err)
+	out, stop := p.Handler6(req, resp)
+	require.False(t, stop)
+	m, err := out.GetInnerMessage()
+	require.NoError(t, err)
+	ia := m.Options.OneIANA()
+	if ia == nil {
+		return nil
+	}
+	addr := ia.Options.OneAddress()
+	require.NotNil(t, addr)
+	assert.Equal(t, id, ia.IaId)
+	assert.Equal(t, p.LeaseTime, addr.ValidLifetime)
+	return addr.IPv6Addr
+}
+
+func TestReservedDUIDGetsItsAddress(t *testing.T) {
+	p := testPluginState6(t, "00:03:00:01:02:00:00:00:00:01:\n  1: 2001:db8::10\n  2: 2001:db8::11\n")
+	duid := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}}
+	other := &dhcpv6.DUIDLL{HWType: iana.HWTypeEthernet, LinkLayerAddr: net.HardwareAddr{2, 0, 0, 0, 0, 2}}
+
+	for range 3 {
+		for _, typ := range []dhcpv6.MessageType{dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind} {
+			assert.Equal(t, "2001:db8::10", request6(t, p, typ, duid, 1).String(), typ.String())
+			assert.Equal(t, "2001:db8::11", request6(t, p, typ, duid, 2).String(), typ.String())
+			// Other clients and IA_NAs are left to the next plugins
+			assert.Nil(t, request6(t, p, typ, other, 1))
+			assert.Nil(t, request6(t, p, typ, duid, 3))
+		}
+	}
+
+	pair, _, err := p.kv.Get("leases/_v6/00030001020000000001/1", nil)
+	require.NoError(t, err)
+	require.NotNil(t, pair, "the binding was not persisted")
+	var rec Record
+	require.NoError(t, json.Unmarshal(pair.Value, &rec))
+	assert.Equal(t, "2001:db8::10", rec.IP.String())
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Empty(t, stored, "bindings were read back as DHCPv4 leases")
+
+	assert.Nil(t, request6(t, p, dhcpv6.MessageTypeRelease, duid, 1))
+	pair, _, err = p.kv.Get("leases/_v6/00030001020000000001/1", nil)
+	require.NoError(t, err)
+	assert.Nil(t, pair, "the released binding was not deleted")
+	assert.Equal(t, "2001:db8::10", request6(t, p, dhcpv6.MessageTypeSolicit, duid, 1).String())
+}
+
+func TestLoadReservations6Validation(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		err  string
+	}{
+		"json":         {file: `{"00:03:00:01:02:00:00:00:00:01": {"0x10": "2001:db8::10"}}`},
+		"out of range": {file: "00030001020000000001:\n  1: 2001:db8::1:0\n", err: "not within range"},
+		"ipv4":         {file: "00:03:00:01:02:00:00:00:00:01:\n  1: 10.0.0.1\n", err: "want IPv6"},
+		"duplicate":    {file: "00:03:00:01:02:00:00:00:00:01:\n  1: 2001:db8::10\n00:03:00:01:02:00:00:00:00:02:\n  1: 2001:db8::10\n", err: "reserved for both"},
+		"bad duid":     {file: "00:03:\n  1: 2001:db8::10\n", err: "invalid DUID"},
+		"bad iaid":     {file: "00:03:00:01:02:00:00:00:00:01:\n  x: 2001:db8::10\n", err: "invalid IAID"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := &PluginState{
+				rangeStart:       net.ParseIP("2001:db8::1"),
+				rangeEnd:         net.ParseIP("2001:db8::100"),
+				reservationsFile: filepath.Join(t.TempDir(), "reservations6.yaml"),
+			}
+			require.NoError(t, os.WriteFile(p.reservationsFile, []byte(tc.file), 0o644))
+			n, err := p.reloadReservations6()
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+			assert.Equal(t, "2001:db8::10", p.reservations6[reservation6{duid: "00030001020000000001", iaid: 16}].String())
+		})
+	}
+}
+
+func TestSetupConsulRange6(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "reservations6.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("00:03:00:01:02:00:00:00:00:01:\n  1: 2001:db8::10\n"), 0o644))
+	args := []string{"127.0.0.1:8500", "leases", "2001:db8::1", "2001:db8::100", "1h", "startup-check=false"}
+
+	h, err := setupConsulRange6(append(args, "reservations="+file)...)
+	require.NoError(t, err)
+	assert.NotNil(t, h)
+
+	_, err = setupConsulRange6(args...)
+	assert.ErrorIs(t, err, ErrInvalidOption)
+	_, err = setupConsulRange6(append(args, "reservations="+file, "sweep=1m")...)
+	assert.ErrorIs(t, err, ErrInvalidOption)
+	_, err = setupConsulRange6("127.0.0.1:8500", "leases", "10.0.0.1", "10.0.0.10", "1h", "reservations="+file)
+	assert.ErrorIs(t, err, ErrInvalidRange)
+}
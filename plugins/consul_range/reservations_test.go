@@ -0,0 +1,114 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// leasedIP requests a lease for mac and returns the leased address
+func leasedIP(t *testing.T, p *PluginState, mac net.HardwareAddr) net.IP {
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	return resp.YourIPAddr
+}
+
+func TestReservationsHotReload(t *testing.T) {
+	p := testPluginState(t)
+	p.reservationsFile = filepath.Join(t.TempDir(), "reservations.yaml")
+	require.NoError(t, os.WriteFile(p.reservationsFile, []byte("02:00:00:00:00:01: 10.0.0.5\n02:00:00:00:00:09: 10.0.0.9\n"), 0o644))
+	n, err := p.reloadReservations()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	require.NoError(t, p.watchReservations(p.reloadReservations))
+
+	assert.True(t, leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}).Equal(net.IPv4(10, 0, 0, 5)))
+	// Reserved addresses are never handed to other clients
+	for i := byte(2); i <= 8; i++ {
+		ip := leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i})
+		assert.False(t, ip.Equal(net.IPv4(10, 0, 0, 9)), "reserved address handed out")
+	}
+
+	// Replace the file, as config management tools do: add a reservation for a
+	// new client and drop the unused one
+	tmp := p.reservationsFile + ".tmp"
+	require.NoError(t, os.WriteFile(tmp, []byte(`{"02:00:00:00:00:01": "10.0.0.5", "02:00:00:00:00:02": "10.0.0.10"}`), 0o644))
+	require.NoError(t, os.Rename(tmp, p.reservationsFile))
+	require.Eventually(t, func() bool {
+		p.Lock()
+		defer p.Unlock()
+		_, ok := p.reservations["02:00:00:00:00:02"]
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.True(t, leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}).Equal(net.IPv4(10, 0, 0, 10)))
+	p.Lock()
+	allocated, err := p.isAllocated(net.IPv4(10, 0, 0, 9))
+	p.Unlock()
+	require.NoError(t, err)
+	assert.False(t, allocated, "address no longer reserved was not freed")
+}
+
+func TestReservationsAllocatedBeforeFirstRequest(t *testing.T) {
+	p := testPluginState(t)
+	p.reservationsFile = filepath.Join(t.TempDir(), "reservations.yaml")
+	require.NoError(t, os.WriteFile(p.reservationsFile, []byte("02:00:00:00:00:01: 10.0.0.1\n02:00:00:00:00:02: 10.0.0.2\n"), 0o644))
+	_, err := p.reloadReservations()
+	require.NoError(t, err)
+
+	// As done in setup, before the handler serves anything
+	p.Lock()
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)} {
+		allocated, err := p.isAllocated(ip)
+		require.NoError(t, err)
+		assert.True(t, allocated, "reserved address %s is not allocated", ip)
+	}
+	p.Unlock()
+	assert.True(t, leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 1, 1}).Equal(net.IPv4(10, 0, 0, 3)))
+	assert.True(t, leasedIP(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}).Equal(net.IPv4(10, 0, 0, 2)))
+}
+
+func TestApplyReservationsValidation(t *testing.T) {
+	p := testPluginState(t)
+	p.Lock()
+	defer p.Unlock()
+	assert.Error(t, p.applyReservations(map[string]net.IP{"02:00:00:00:00:01": net.IPv4(10, 0, 1, 1).To4()}), "out of range")
+	assert.Error(t, p.applyReservations(map[string]net.IP{
+		"02:00:00:00:00:01": net.IPv4(10, 0, 0, 1).To4(),
+		"02:00:00:00:00:02": net.IPv4(10, 0, 0, 1).To4(),
+	}), "duplicate address")
+
+	// An address leased to another client is taken over once the lease ends
+	rec := testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 3}, net.IPv4(10, 0, 0, 2))
+	require.NoError(t, p.applyReservations(map[string]net.IP{"02:00:00:00:00:01": net.IPv4(10, 0, 0, 2).To4()}))
+	_, ok := p.reservedFor("02:00:00:00:00:01")
+	assert.False(t, ok)
+	require.NoError(t, p.removeLease(context.Background(), "02:00:00:00:00:03", rec))
+	ip, ok := p.reservedFor("02:00:00:00:00:01")
+	assert.True(t, ok)
+	assert.True(t, ip.Equal(net.IPv4(10, 0, 0, 2)))
+	allocated, err := p.isAllocated(ip)
+	require.NoError(t, err)
+	assert.True(t, allocated, "reserved address was freed with the lease")
+}
+
+func TestLoadReservationsErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"mac":  "not-a-mac: 10.0.0.1\n",
+		"ip":   "02:00:00:00:00:01: 2001:db8::1\n",
+		"yaml": "[unterminated\n",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err := loadReservations(path)
+		assert.Error(t, err, name)
+	}
+}
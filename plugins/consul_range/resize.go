@@ -0,0 +1,162 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// rangeConfigKey is the name of the plugin state entry holding the range, once resized
+const rangeConfigKey = "range"
+
+// errResizeStrands is returned when shrinking the range would strand live leases
+var errResizeStrands = errors.New("resizing would strand live leases")
+
+// endSetter is implemented by allocators whose range can be moved at runtime
+type endSetter interface {
+	SetEnd(end net.IP) error
+}
+
+// persistedRange is the range as stored in Consul
+type persistedRange struct {
+	Start net.IP `json:"start"`
+	End   net.IP `json:"end"`
+}
+
+// resize moves the end of the range to end, keeping existing allocations,
+// and persists the new range to Consul so that it survives a restart.
+func (p *PluginState) resize(ctx context.Context, end net.IP) error {
+	end = end.To4()
+	if end == nil {
+		return fmt.Errorf("invalid IPv4 address: %v", end)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if binary.BigEndian.Uint32(end) <= binary.BigEndian.Uint32(p.rangeStart) {
+		return errors.New("end of IP range has to be higher than its start")
+	}
+	if p.subnet != nil && !p.subnet.Contains(end) {
+		return fmt.Errorf("end of IP range %s is not within subnet %s", end, p.subnet)
+	}
+	if err := p.checkSpecialSpace(p.rangeStart, end); err != nil {
+		return err
+	}
+	setter, ok := p.allocator.(endSetter)
+	if !ok {
+		return fmt.Errorf("allocator %T cannot be resized", p.allocator)
+	}
+	for _, rec := range p.Recordsv4 {
+		if p.inRange(rec.IP) && compareIP(rec.IP, end) > 0 {
+			return fmt.Errorf("%w: %s is leased", errResizeStrands, rec.IP)
+		}
+	}
+	if compareIP(p.dynamicStart(), end) > 0 {
+		return fmt.Errorf("end of IP range %s is below the offset of %d addresses", end, p.offset)
+	}
+	for _, pool := range p.classes {
+		if compareIP(pool.end, end) > 0 {
+			return fmt.Errorf("pool %s-%s of class %s would extend beyond the range", pool.start, pool.end, pool.class)
+		}
+	}
+	oldEnd := p.rangeEnd
+	// Excluded addresses beyond the new end, such as the broadcast address,
+	// are held in the allocator, which can only shrink once they are freed
+	released := p.releaseExcluded(end)
+	if err := setter.SetEnd(end); err != nil {
+		p.restoreExcluded(released)
+		return fmt.Errorf("could not resize the allocator: %w", err)
+	}
+	p.rangeEnd = end
+	if p.subnet != nil {
+		// The range may have grown to cover the broadcast address
+		if _, broadcast := subnetBoundaries(p.subnet); broadcast.Equal(end) {
+			if err := p.exclude(broadcast); err != nil {
+				log.Errorf("Could not exclude broadcast address after resize: %v", err)
+			}
+		}
+	}
+	// The range may have grown to cover an address of the host
+	if err := p.applyOwnAddresses(); err != nil {
+		log.Errorf("Could not exclude the host's addresses after resize: %v", err)
+	}
+	if err := p.saveRange(ctx); err != nil {
+		// Keep memory and Consul consistent: roll back if we failed to persist
+		if rerr := setter.SetEnd(oldEnd); rerr != nil {
+			log.Errorf("Could not roll back range end to %s: %v", oldEnd, rerr)
+		} else {
+			p.rangeEnd = oldEnd
+			p.restoreExcluded(released)
+		}
+		return err
+	}
+	log.Printf("Resized range to %s-%s", p.rangeStart, p.rangeEnd)
+	return nil
+}
+
+// releaseExcluded frees the excluded addresses beyond end, returning them.
+// Must be called with the plugin lock held.
+func (p *PluginState) releaseExcluded(end net.IP) []net.IP {
+	var released []net.IP
+	for key := range p.excluded {
+		ip := net.ParseIP(key).To4()
+		if compareIP(ip, end) <= 0 {
+			continue
+		}
+		if err := p.allocator.Free(net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}); err != nil {
+			log.Warningf("Could not free excluded address %s: %v", ip, err)
+			continue
+		}
+		delete(p.excluded, key)
+		released = append(released, ip)
+	}
+	return released
+}
+
+// restoreExcluded excludes the addresses released by releaseExcluded again,
+// once the range is back to covering them.
+// Must be called with the plugin lock held.
+func (p *PluginState) restoreExcluded(released []net.IP) {
+	for _, ip := range released {
+		if err := p.exclude(ip); err != nil {
+			log.Errorf("Could not exclude %s again: %v", ip, err)
+		}
+	}
+}
+
+// saveRange persists the current range to Consul
+func (p *PluginState) saveRange(ctx context.Context) error {
+	data, err := json.Marshal(persistedRange{Start: p.rangeStart, End: p.rangeEnd})
+	if err != nil {
+		return fmt.Errorf("failed to marshal range: %w", err)
+	}
+	if _, err := p.kv.Put(&api.KVPair{Key: p.configKey(rangeConfigKey), Value: data}, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to store range in consul: %w", err)
+	}
+	return nil
+}
+
+// loadRange returns the range persisted in Consul, or nil if the range has
+// never been resized
+func loadRange(kv kvStore, key string) (*persistedRange, error) {
+	pair, _, err := kv.Get(key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key %q: %w", key, err)
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	var r persistedRange
+	if err := json.Unmarshal(pair.Value, &r); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal range from key %q: %w", key, err)
+	}
+	if r.Start.To4() == nil || r.End.To4() == nil {
+		return nil, fmt.Errorf("invalid range in key %q: %s-%s", key, r.Start, r.End)
+	}
+	return &r, nil
+}
@@ -0,0 +1,100 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResizeGrow(t *testing.T) {
+	p := testPluginState(t)
+	for i := 1; i <= 10; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i)})
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+	}
+	// The pool is exhausted
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 11})
+	resp, _ := p.Handler4(req, stub)
+	require.Nil(t, resp)
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	res, err := authorizedPost(srv.URL+"/resize?end=10.0.0.20", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 11})
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.True(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 11)), "expected an address from the grown range, got %s", resp.YourIPAddr)
+	assert.Equal(t, uint32(20), p.poolSize())
+
+	persisted, err := loadRange(p.kv, p.configKey(rangeConfigKey))
+	require.NoError(t, err)
+	require.NotNil(t, persisted)
+	assert.True(t, persisted.End.Equal(net.IPv4(10, 0, 0, 20)))
+
+	// The persisted range must not be mistaken for a lease
+	records, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Len(t, records, 11)
+}
+
+func TestResizeRejectsStrandingShrink(t *testing.T) {
+	p := testPluginState(t)
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 8))
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	res, err := authorizedPost(srv.URL+"/resize?end=10.0.0.5", "", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode)
+	assert.True(t, p.rangeEnd.Equal(net.IPv4(10, 0, 0, 10)), "range must be unchanged after a rejected shrink")
+}
+
+func TestResizeShrinkPastExcluded(t *testing.T) {
+	p := testPluginState(t)
+	alloc, err := bitmap.NewIPv4Allocator(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 15))
+	require.NoError(t, err)
+	p.allocator, p.rangeEnd = alloc, net.IPv4(10, 0, 0, 15).To4()
+	require.NoError(t, parseSubnetOption(p, "10.0.0.0/28"))
+	require.NoError(t, p.applySubnet())
+	broadcast := net.IPv4(10, 0, 0, 15).To4()
+	require.Contains(t, p.excluded, broadcast.String())
+
+	// An address beyond the new end held otherwise fails the shrink, the
+	// broadcast address is excluded again
+	held, err := p.allocator.Allocate(net.IPNet{IP: net.IPv4(10, 0, 0, 12)})
+	require.NoError(t, err)
+	assert.Error(t, p.resize(context.Background(), net.IPv4(10, 0, 0, 10)))
+	assert.Contains(t, p.excluded, broadcast.String())
+	allocated, err := p.isAllocated(broadcast)
+	require.NoError(t, err)
+	assert.True(t, allocated)
+	require.NoError(t, p.allocator.Free(held))
+
+	// Failing to persist the range rolls the exclusion back too
+	kv := p.kv
+	p.kv = denyingKV{newMemKV()}
+	assert.Error(t, p.resize(context.Background(), net.IPv4(10, 0, 0, 10)))
+	assert.True(t, p.rangeEnd.Equal(broadcast))
+	assert.Contains(t, p.excluded, broadcast.String())
+	p.kv = kv
+
+	require.NoError(t, p.resize(context.Background(), net.IPv4(10, 0, 0, 10)))
+	assert.True(t, p.rangeEnd.Equal(net.IPv4(10, 0, 0, 10)))
+	assert.NotContains(t, p.excluded, broadcast.String())
+
+	// Growing back excludes the broadcast address again
+	require.NoError(t, p.resize(context.Background(), broadcast))
+	assert.Contains(t, p.excluded, broadcast.String())
+}
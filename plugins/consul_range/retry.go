@@ -0,0 +1,74 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// consulWriteAttempts bounds the attempts of a lease record write failing
+	// transiently, the first made by the request and the others in the background
+	consulWriteAttempts = 4
+	// consulRetryBackoff is the wait before the first retry, doubled after each
+	consulRetryBackoff = 50 * time.Millisecond
+)
+
+// retryableConsulError reports whether a KV write failing with err may succeed
+// if retried: Consul answers 500 while it elects a leader, and 429 or 503 when
+// overloaded. Other statuses, such as a permission denied, are permanent.
+func retryableConsulError(err error) bool {
+	if errors.Is(err, errBatchConflict) {
+		return true
+	}
+	var status api.StatusError
+	if errors.As(err, &status) {
+		return status.Code >= http.StatusInternalServerError || status.Code == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled)
+}
+
+// markDirty records that the last write of the record of mac failed with err,
+// so that it is written again. Writes failing transiently, e.g. during a
+// Consul leader election, are retried shortly by the dirty flusher.
+// Must be called with the plugin lock held.
+func (p *PluginState) markDirty(mac string, err error) {
+	if p.dirty == nil {
+		p.dirty = make(map[string]struct{})
+	}
+	p.dirty[mac] = struct{}{}
+	if retryableConsulError(err) {
+		select {
+		case p.retryKick <- struct{}{}:
+		default:
+			// A retry is already due
+		}
+	}
+}
+
+// retryDirty flushes the dirty records with a backoff while the writes fail
+// transiently, giving up after consulWriteAttempts writes. It sleeps without
+// holding the plugin lock, so that requests are served meanwhile.
+func (p *PluginState) retryDirty() {
+	backoff := consulRetryBackoff
+	for attempt := 2; attempt <= consulWriteAttempts; attempt++ {
+		time.Sleep(backoff)
+		ctx, cancel := p.requestContext()
+		err := p.flushDirty(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		if !retryableConsulError(err) || attempt == consulWriteAttempts {
+			log.Warningf("Could not retry the Consul writes that failed: %v", err)
+			return
+		}
+		log.Debugf("Consul write failed transiently, retrying in %s: %v", 2*backoff, err)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,130 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingKV is a memKV failing its first writes with err
+type failingKV struct {
+	*memKV
+	failures int
+	err      error
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func (f *failingKV) Put(pair *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	f.mu.Lock()
+	f.attempts++
+	failed := f.attempts <= f.failures
+	f.mu.Unlock()
+	if failed {
+		return nil, f.err
+	}
+	return f.memKV.Put(pair, q)
+}
+
+func (f *failingKV) CAS(pair *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	f.mu.Lock()
+	f.attempts++
+	failed := f.attempts <= f.failures
+	f.mu.Unlock()
+	if failed {
+		return false, nil, f.err
+	}
+	return f.memKV.CAS(pair, q)
+}
+
+// putAttempts returns the number of writes attempted
+func (f *failingKV) putAttempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attempts
+}
+
+// stored reports whether key is held by f
+func (f *failingKV) stored(key string) bool {
+	f.memKV.Lock()
+	defer f.memKV.Unlock()
+	_, ok := f.data[key]
+	return ok
+}
+
+// startRetries starts the dirty flusher of p retrying the writes that failed
+func startRetries(p *PluginState) {
+	p.retryKick = make(chan struct{}, 1)
+	p.startDirtyFlusher()
+}
+
+func TestWriteRetriedDuringLeaderElection(t *testing.T) {
+	p := testPluginState(t)
+	kv := &failingKV{memKV: newMemKV(), failures: 2, err: api.StatusError{Code: http.StatusInternalServerError, Body: "No cluster leader"}}
+	p.kv = kv
+	startRetries(p)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	// The request isn't held up by the retries
+	start := time.Now()
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Less(t, time.Since(start), consulRetryBackoff)
+	assert.Equal(t, 1, kv.putAttempts())
+
+	assert.Eventually(t, func() bool { return p.dirtyCount() == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, kv.putAttempts())
+	assert.True(t, kv.stored("leases/"+mac.String()))
+	assert.Equal(t, uint64(2), p.metrics.consulWriteRetries.Value())
+}
+
+func TestWriteNotRetriedWhenDenied(t *testing.T) {
+	p := testPluginState(t)
+	kv := &failingKV{memKV: newMemKV(), failures: 1, err: api.StatusError{Code: http.StatusForbidden, Body: "Permission denied"}}
+	p.kv = kv
+	startRetries(p)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	p.Lock()
+	assert.Error(t, p.persist(context.Background(), mac, &Record{IP: net.IPv4(10, 0, 0, 1)}))
+	p.Unlock()
+	time.Sleep(4 * consulRetryBackoff)
+	assert.Equal(t, 1, kv.putAttempts())
+	assert.Zero(t, p.metrics.consulWriteRetries.Value())
+	assert.Equal(t, 1, p.dirtyCount())
+}
+
+func TestWriteRetriesAreBounded(t *testing.T) {
+	p := testPluginState(t)
+	kv := &failingKV{memKV: newMemKV(), failures: 100, err: api.StatusError{Code: http.StatusInternalServerError, Body: "leadership lost while committing log"}}
+	p.kv = kv
+	startRetries(p)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, mac, net.IPv4(10, 0, 0, 1))
+
+	p.Lock()
+	assert.Error(t, p.persist(context.Background(), mac, p.Recordsv4[mac.String()]))
+	p.Unlock()
+	assert.Eventually(t, func() bool { return kv.putAttempts() == consulWriteAttempts }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(16 * consulRetryBackoff)
+	assert.Equal(t, consulWriteAttempts, kv.putAttempts())
+	assert.Equal(t, 1, p.dirtyCount(), "the record stays dirty for the next flush")
+}
+
+func TestRetryableConsulError(t *testing.T) {
+	assert.True(t, retryableConsulError(api.StatusError{Code: http.StatusInternalServerError, Body: "No cluster leader"}))
+	assert.True(t, retryableConsulError(api.StatusError{Code: http.StatusTooManyRequests}))
+	assert.False(t, retryableConsulError(api.StatusError{Code: http.StatusForbidden}))
+	assert.False(t, retryableConsulError(errors.New("invalid record")))
+	assert.True(t, retryableConsulError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+}
@@ -0,0 +1,146 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// serverID is the server identifier answered to the clients of a subnet
+type serverID struct {
+	subnet *net.IPNet
+	id     net.IP
+}
+
+// parseServerIDOption adds the server identifier answered to the clients of a
+// subnet, given as "<CIDR>:<IP>", or to all other clients, given as "<IP>"
+func parseServerIDOption(p *PluginState, value string) error {
+	cidr, addr, ok := strings.Cut(value, ":")
+	if !ok {
+		cidr, addr = "", value
+	}
+	id, err := parseIPv4(addr)
+	if err != nil {
+		return err
+	}
+	if cidr == "" {
+		if p.defaultServerID != nil {
+			return fmt.Errorf("duplicate default server identifier %s", id)
+		}
+		p.defaultServerID = id
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("not an IPv4 subnet: %s", cidr)
+	}
+	for _, other := range p.serverIDs {
+		if other.subnet.String() == subnet.String() {
+			return fmt.Errorf("duplicate server identifier for %s", subnet)
+		}
+	}
+	p.serverIDs = append(p.serverIDs, serverID{subnet: subnet, id: id})
+	// Most specific subnets first
+	slices.SortStableFunc(p.serverIDs, func(a, b serverID) int {
+		la, _ := a.subnet.Mask.Size()
+		lb, _ := b.subnet.Mask.Size()
+		return lb - la
+	})
+	return nil
+}
+
+// serverIDFor returns the server identifier to answer req with: the one of the
+// most specific subnet containing the address it came in on, or the default.
+// It returns nil if none is configured.
+func (p *PluginState) serverIDFor(req *dhcpv4.DHCPv4) net.IP {
+	from := p.ingressAddr(req)
+	for _, s := range p.serverIDs {
+		if s.subnet.Contains(from) {
+			return s.id
+		}
+	}
+	return p.defaultServerID
+}
+
+// serverIDMismatchPolicy selects the handling of requests whose server
+// identifier isn't the one answered by this server
+type serverIDMismatchPolicy int
+
+const (
+	// serverIDMismatchProcess handles the request as if it were for this server
+	serverIDMismatchProcess serverIDMismatchPolicy = iota
+	// serverIDMismatchDrop ignores the request, which the client sent to the
+	// server it selected, as RFC 2131 section 4.3.2 requires
+	serverIDMismatchDrop
+)
+
+func parseServerIDMismatchOption(p *PluginState, value string) error {
+	switch value {
+	case "process":
+		p.serverIDMismatch = serverIDMismatchProcess
+	case "drop":
+		p.serverIDMismatch = serverIDMismatchDrop
+	default:
+		return fmt.Errorf("unknown server-id-mismatch policy %q, want process or drop", value)
+	}
+	return nil
+}
+
+// foreignServerID reports whether req is to be dropped because it carries a
+// server identifier other than the one of resp, per the server-id-mismatch
+// policy. Requests are never dropped when no identifier is answered.
+func (p *PluginState) foreignServerID(req, resp *dhcpv4.DHCPv4) bool {
+	if p.serverIDMismatch != serverIDMismatchDrop {
+		return false
+	}
+	theirs, ours := req.ServerIdentifier(), resp.ServerIdentifier()
+	return theirs != nil && ours != nil && !theirs.Equal(ours)
+}
+
+// nakServerIDPolicy selects the server identifier of NAKs sent while none is
+// configured for the subnet of the client, nor set by other plugins
+type nakServerIDPolicy int
+
+const (
+	// nakServerIDConfigured sends NAKs with no server identifier, which some
+	// clients ignore
+	nakServerIDConfigured nakServerIDPolicy = iota
+	// nakServerIDEcho echoes the server identifier sent by the client
+	nakServerIDEcho
+)
+
+func parseNakServerIDOption(p *PluginState, value string) error {
+	switch value {
+	case "configured":
+		p.nakServerID = nakServerIDConfigured
+	case "echo":
+		p.nakServerID = nakServerIDEcho
+	default:
+		return fmt.Errorf("unknown nak-server-id policy %q, want configured or echo", value)
+	}
+	return nil
+}
+
+// setNakServerID sets the server identifier of resp, a NAK to req, that the
+// client needs to accept it: the one configured for the subnet of req, or set
+// by other plugins, or the one of req per the nak-server-id policy
+func (p *PluginState) setNakServerID(req, resp *dhcpv4.DHCPv4) {
+	if id := p.serverIDFor(req); id != nil {
+		resp.UpdateOption(dhcpv4.OptServerIdentifier(id))
+		return
+	}
+	if resp.ServerIdentifier() != nil {
+		return
+	}
+	if id := req.ServerIdentifier(); id != nil && p.nakServerID == nakServerIDEcho {
+		resp.UpdateOption(dhcpv4.OptServerIdentifier(id))
+		return
+	}
+	log.Debugf("Sending NAK to MAC %s without a server identifier, the client may ignore it", p.logMAC(req.ClientHWAddr.String()))
+}
@@ -0,0 +1,104 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler4ServerIDBySubnet(t *testing.T) {
+	p := testPluginState(t)
+	for _, v := range []string{"10.0.0.0/24:10.0.0.254", "192.168.0.0/16:192.168.0.1", "192.168.1.0/24:192.168.1.1", "172.16.0.1"} {
+		require.NoError(t, parseServerIDOption(p, v))
+	}
+
+	for i, tc := range []struct {
+		giaddr net.IP
+		want   string
+	}{
+		{nil, "10.0.0.254"},
+		{net.IPv4(192, 168, 1, 254), "192.168.1.1"},
+		{net.IPv4(192, 168, 2, 254), "192.168.0.1"},
+		{net.IPv4(172, 31, 0, 1), "172.16.0.1"},
+	} {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i)})
+		stub.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(203, 0, 113, 1)))
+		if tc.giaddr != nil {
+			req.GatewayIPAddr = tc.giaddr
+		}
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		assert.Equal(t, tc.want, resp.ServerIdentifier().String(), "giaddr %s", tc.giaddr)
+	}
+}
+
+func TestHandler4ServerIDUnset(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseServerIDOption(p, "192.168.1.0/24:192.168.1.1"))
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	stub.UpdateOption(dhcpv4.OptServerIdentifier(net.IPv4(203, 0, 113, 1)))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "203.0.113.1", resp.ServerIdentifier().String(), "without a match, the configured identifier is kept")
+}
+
+func TestParseServerIDOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseServerIDOption(p, "10.0.0.1"))
+	assert.Error(t, parseServerIDOption(p, "10.0.0.2"), "duplicate default")
+	require.NoError(t, parseServerIDOption(p, "10.0.0.0/8:10.0.0.1"))
+	assert.Error(t, parseServerIDOption(p, "10.1.2.3/8:10.0.0.2"), "duplicate subnet")
+	assert.Error(t, parseServerIDOption(p, "10.0.0.0/8"))
+	assert.Error(t, parseServerIDOption(p, "2001:db8::/32:10.0.0.1"))
+}
+
+func TestHandler4ServerIDMismatch(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseServerIDOption(p, "10.0.0.254"))
+	send := func(mac net.HardwareAddr, id net.IP) *dhcpv4.DHCPv4 {
+		req, stub := testRequest(t, mac, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(id)))
+		resp, _ := p.Handler4(req, stub)
+		return resp
+	}
+
+	// By default requests are processed whichever server they are for
+	assert.NotNil(t, send(net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 253)))
+
+	require.NoError(t, parseServerIDMismatchOption(p, "drop"))
+	assert.Nil(t, send(net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 253)))
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:02", "a request for another server must not allocate")
+	assert.Equal(t, uint64(1), p.metrics.foreignServerID.Value())
+	resp := send(net.HardwareAddr{2, 0, 0, 0, 0, 3}, net.IPv4(10, 0, 0, 254))
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.254", resp.ServerIdentifier().String())
+
+	assert.Error(t, parseServerIDMismatchOption(p, "nak"))
+}
+
+func TestHandler4NakServerID(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseServerIDOption(p, "192.168.1.0/24:192.168.1.1"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	renew := func(giaddr net.IP, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+		modifiers = append(modifiers, dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 6)))
+		req, stub := testRequest(t, mac, modifiers...)
+		req.GatewayIPAddr = giaddr
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		require.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+		return resp
+	}
+
+	assert.Equal(t, "192.168.1.1", renew(net.IPv4(192, 168, 1, 254)).ServerIdentifier().String())
+	assert.Nil(t, renew(nil).ServerIdentifier(), "without a configured identifier, the NAK has none by default")
+
+	require.NoError(t, parseNakServerIDOption(p, "echo"))
+	assert.Equal(t, "10.0.0.254", renew(nil, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 254)))).ServerIdentifier().String())
+	assert.Equal(t, "192.168.1.1", renew(net.IPv4(192, 168, 1, 254), dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(10, 0, 0, 254)))).ServerIdentifier().String(),
+		"a configured identifier wins over the client's")
+	assert.Error(t, parseNakServerIDOption(p, "always"))
+}
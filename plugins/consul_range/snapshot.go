@@ -0,0 +1,357 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSnapshotInterval is the interval between snapshots of the lease table
+	defaultSnapshotInterval = time.Hour
+	// defaultSnapshotRegion is the region snapshot uploads are signed for
+	defaultSnapshotRegion = "us-east-1"
+	// snapshotTimeout bounds the upload of a snapshot
+	snapshotTimeout = time.Minute
+	// snapshotTimeFormat timestamps snapshot object names, so that they sort by time
+	snapshotTimeFormat = "20060102T150405Z"
+	// snapshotPrefix and snapshotSuffix surround the timestamp in snapshot object names
+	snapshotPrefix = "leases-"
+	snapshotSuffix = ".ndjson"
+)
+
+func parseSnapshotURLOption(p *PluginState, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("snapshot URL must be an http or https URL: %s", value)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("snapshot URL cannot have a query or fragment: %s", value)
+	}
+	p.snapshot.url = u
+	return nil
+}
+
+func parseSnapshotIntervalOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < time.Minute {
+		return fmt.Errorf("snapshot interval must be at least 1m, got %s", d)
+	}
+	p.snapshot.interval = d
+	return nil
+}
+
+func parseSnapshotImportOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("maximum snapshot age must be positive, got %s", d)
+	}
+	p.snapshot.importAge = d
+	return nil
+}
+
+func parseSnapshotRegionOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("snapshot region cannot be empty")
+	}
+	p.snapshot.region = value
+	return nil
+}
+
+func parseSnapshotAccessKeyOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("snapshot access key cannot be empty")
+	}
+	p.snapshot.accessKey = value
+	return nil
+}
+
+func parseSnapshotSecretKeyOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("snapshot secret key cannot be empty")
+	}
+	p.snapshot.secretKey = value
+	return nil
+}
+
+// snapshotter uploads snapshots of the lease table to S3 compatible object
+// storage, as objects under a path-style bucket URL. Uploads are signed with
+// AWS Signature Version 4 when credentials are set.
+type snapshotter struct {
+	url       *url.URL
+	interval  time.Duration
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+	// importAge is the maximum age of a snapshot imported into an empty
+	// store at startup, if set
+	importAge time.Duration
+}
+
+// check returns an error if the snapshot options are inconsistent
+func (s *snapshotter) check() error {
+	if s.url == nil {
+		if s.accessKey != "" || s.secretKey != "" || s.importAge > 0 {
+			return errors.New("snapshot credentials and snapshot-import require a snapshot-url")
+		}
+		return nil
+	}
+	if (s.accessKey == "") != (s.secretKey == "") {
+		return errors.New("snapshot-access-key and snapshot-secret-key must be set together")
+	}
+	return nil
+}
+
+// startSnapshots periodically uploads a snapshot of the lease table. A failed
+// upload is logged and retried at the next interval.
+// We never stop it, but that's ok because plugins are never stopped/unregistered.
+func (p *PluginState) startSnapshots() {
+	go func() {
+		ticker := time.NewTicker(p.snapshot.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), p.snapshot.interval)
+			if name, err := p.exportSnapshot(ctx); err != nil {
+				p.metrics.snapshotFailures.Inc()
+				log.Warningf("Could not upload lease snapshot: %v", err)
+			} else {
+				log.Debugf("Uploaded lease snapshot %s", name)
+			}
+			cancel()
+		}
+	}()
+}
+
+// encodeSnapshot serializes leases as NDJSON, one lease per line
+func encodeSnapshot(leases []lease) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, l := range leases {
+		if err := enc.Encode(l); err != nil {
+			return nil, fmt.Errorf("%w for MAC %s: %v", errRecordEncoding, l.MAC, err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// exportSnapshot uploads a snapshot of all leases, named after the current
+// time, and returns the name of the object
+func (p *PluginState) exportSnapshot(ctx context.Context) (string, error) {
+	body, err := encodeSnapshot(p.leases())
+	if err != nil {
+		return "", err
+	}
+	now := p.now().UTC()
+	name := snapshotPrefix + now.Format(snapshotTimeFormat) + snapshotSuffix
+	u := *p.snapshot.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	res, err := p.snapshot.do(ctx, http.MethodPut, &u, body, now)
+	if err != nil {
+		return "", fmt.Errorf("uploading %s: %w", name, err)
+	}
+	res.Body.Close()
+	return name, nil
+}
+
+// do sends a request for u with body, signed at now if credentials are set.
+// Responses other than 2xx are returned as errors.
+func (s *snapshotter) do(ctx context.Context, method string, u *url.URL, body []byte, now time.Time) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if s.accessKey != "" {
+		s.sign(req, body, now)
+	}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: snapshotTimeout}
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res, nil
+}
+
+// latestSnapshot returns the name of the most recent snapshot under the
+// snapshot URL, or "" if there is none. The first segment of the URL path is
+// the bucket, listed with ListObjectsV2.
+func (s *snapshotter) latestSnapshot(ctx context.Context, now time.Time) (string, error) {
+	bucket, dir, _ := strings.Cut(strings.TrimPrefix(s.url.Path, "/"), "/")
+	if dir = strings.TrimSuffix(dir, "/"); dir != "" {
+		dir += "/"
+	}
+	u := *s.url
+	u.Path, u.RawPath = "/"+bucket, ""
+	latest, token := "", ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {dir + snapshotPrefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = canonicalQuery(q)
+		res, err := s.do(ctx, http.MethodGet, &u, nil, now)
+		if err != nil {
+			return "", fmt.Errorf("listing snapshots: %w", err)
+		}
+		var list struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return "", fmt.Errorf("listing snapshots: %w", err)
+		}
+		for _, c := range list.Contents {
+			// Timestamps sort in time order
+			if name := strings.TrimPrefix(c.Key, dir); strings.HasSuffix(name, snapshotSuffix) && name > latest {
+				latest = name
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return latest, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+// importSnapshot bootstraps an empty store from the most recent snapshot, if
+// it is no older than the snapshot-import age: its unexpired leases are
+// written to Consul and added to the records, to be allocated as if they had
+// been loaded. It returns the number of leases imported.
+// Must be called before serving, with no records loaded.
+func (p *PluginState) importSnapshot(ctx context.Context) (int, error) {
+	now := p.now().UTC()
+	name, err := p.snapshot.latestSnapshot(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	if name == "" {
+		log.Warningf("No lease snapshot to import under %s", p.snapshot.url.Redacted())
+		return 0, nil
+	}
+	taken, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+	if err != nil {
+		return 0, fmt.Errorf("invalid snapshot name %s: %w", name, err)
+	}
+	if age := now.Sub(taken); age > p.snapshot.importAge {
+		log.Warningf("Not importing lease snapshot %s, taken %s ago, older than %s", name, age.Round(time.Second), p.snapshot.importAge)
+		return 0, nil
+	}
+
+	u := *p.snapshot.url
+	u.Path, u.RawPath = strings.TrimSuffix(u.Path, "/")+"/"+name, ""
+	res, err := p.snapshot.do(ctx, http.MethodGet, &u, nil, now)
+	if err != nil {
+		return 0, fmt.Errorf("downloading %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	var leases []lease
+	dec := json.NewDecoder(res.Body)
+	for dec.More() {
+		var l lease
+		if err := dec.Decode(&l); err != nil {
+			return 0, fmt.Errorf("invalid snapshot %s: %w", name, err)
+		}
+		leases = append(leases, l)
+	}
+
+	n := 0
+	for _, l := range leases {
+		mac, err := parseClientKey(l.MAC)
+		if err != nil || l.IP.To4() == nil {
+			log.Warningf("Skipping invalid lease of MAC %q in snapshot %s", p.logMAC(l.MAC), name)
+			continue
+		}
+		rec := l.Record
+		rec.IP = rec.IP.To4()
+		if rec.expiredAt(now) {
+			continue
+		}
+		p.setRecord(mac.String(), &rec)
+		if err := p.saveIPAddress(ctx, mac, &rec); err != nil {
+			return n, fmt.Errorf("could not write imported lease of MAC %s: %w", p.logMAC(mac.String()), err)
+		}
+		n++
+	}
+	log.Printf("Imported %d leases from snapshot %s, taken at %s", n, name, taken)
+	return n, nil
+}
+
+// canonicalQuery encodes q the way Signature Version 4 expects, sorted by
+// key, with spaces as %20
+func canonicalQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// sign adds the AWS Signature Version 4 headers of an S3 request made at now
+func (s *snapshotter) sign(req *http.Request, body []byte, now time.Time) {
+	date := now.Format(snapshotTimeFormat)
+	day := now.Format("20060102")
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + date,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{day, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
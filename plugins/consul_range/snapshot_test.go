@@ -0,0 +1,186 @@
+package consulrangeplugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportSnapshotUploads(t *testing.T) {
+	type upload struct {
+		path string
+		body []byte
+		hdr  http.Header
+	}
+	uploads := make(chan upload, 1)
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		uploads <- upload{path: r.URL.Path, body: body, hdr: r.Header}
+	}))
+	defer s3.Close()
+
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 2}, net.IPv4(10, 0, 0, 2))
+	require.NoError(t, parseSnapshotURLOption(p, s3.URL+"/backups/coredhcp/"))
+	require.NoError(t, parseSnapshotAccessKeyOption(p, "AKIDEXAMPLE"))
+	require.NoError(t, parseSnapshotSecretKeyOption(p, "secret"))
+	p.snapshot.region = defaultSnapshotRegion
+	p.snapshot.client = s3.Client()
+
+	name, err := p.exportSnapshot(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "leases-20250101T000000Z.ndjson", name)
+	got := <-uploads
+	assert.Equal(t, "/backups/coredhcp/leases-20250101T000000Z.ndjson", got.path)
+
+	var macs []string
+	scanner := bufio.NewScanner(bytes.NewReader(got.body))
+	for scanner.Scan() {
+		var l lease
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &l))
+		macs = append(macs, l.MAC)
+	}
+	assert.Equal(t, []string{"02:00:00:00:00:01", "02:00:00:00:00:02"}, macs)
+
+	sum := sha256.Sum256(got.body)
+	assert.Equal(t, hex.EncodeToString(sum[:]), got.hdr.Get("X-Amz-Content-Sha256"))
+	assert.Equal(t, "20250101T000000Z", got.hdr.Get("X-Amz-Date"))
+	assert.Regexp(t, `^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20250101/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`, got.hdr.Get("Authorization"))
+}
+
+func TestExportSnapshotFailure(t *testing.T) {
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "SlowDown", http.StatusServiceUnavailable)
+	}))
+	defer s3.Close()
+	p := testPluginState(t)
+	require.NoError(t, parseSnapshotURLOption(p, s3.URL+"/backups"))
+	p.snapshot.client = s3.Client()
+
+	_, err := p.exportSnapshot(context.Background())
+	assert.ErrorContains(t, err, "503")
+}
+
+// fakeS3 serves ListObjectsV2 and GetObject for the given objects of a
+// bucket, listing one object per page
+func fakeS3(t *testing.T, bucket string, objects map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+bucket {
+			body, ok := objects[strings.TrimPrefix(r.URL.Path, "/"+bucket+"/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			_, _ = w.Write(body)
+			return
+		}
+		assert.Equal(t, "2", r.URL.Query().Get("list-type"))
+		var keys []string
+		for key := range objects {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		i := 0
+		if token := r.URL.Query().Get("continuation-token"); token != "" {
+			i, _ = strconv.Atoi(token)
+		}
+		var list struct {
+			XMLName               xml.Name `xml:"ListBucketResult"`
+			Key                   []string `xml:"Contents>Key"`
+			IsTruncated           bool
+			NextContinuationToken string `xml:",omitempty"`
+		}
+		if i < len(keys) {
+			list.Key = keys[i : i+1]
+		}
+		if i+1 < len(keys) {
+			list.IsTruncated = true
+			list.NextContinuationToken = strconv.Itoa(i + 1)
+		}
+		_ = xml.NewEncoder(w).Encode(list)
+	}))
+}
+
+func TestImportSnapshotIntoEmptyStore(t *testing.T) {
+	clock := newFakeClock()
+	snapshot, err := encodeSnapshot([]lease{
+		{MAC: "02:00:00:00:00:01", Record: Record{IP: net.IPv4(10, 0, 0, 1), Expires: int(clock.Now().Add(time.Hour).Unix()), Hostname: "a"}},
+		{MAC: "02:00:00:00:00:02", Record: Record{IP: net.IPv4(10, 0, 0, 2), Expires: int(clock.Now().Add(-time.Hour).Unix())}},
+		{MAC: "02:00:00:00:00:03", Record: Record{IP: net.IPv4(10, 0, 0, 3), Expires: infiniteExpiry}, Infinite: true},
+	})
+	require.NoError(t, err)
+	s3 := fakeS3(t, "backups", map[string][]byte{
+		"coredhcp/leases-20241231T000000Z.ndjson": []byte("not a snapshot"),
+		"coredhcp/leases-20241231T230000Z.ndjson": snapshot,
+		"other/leases-20250101T000000Z.ndjson":    []byte("not ours"),
+	})
+	defer s3.Close()
+
+	p := testPluginState(t)
+	p.clock = clock.Now
+	require.NoError(t, parseSnapshotURLOption(p, s3.URL+"/backups/coredhcp"))
+	require.NoError(t, parseSnapshotImportOption(p, "2h"))
+	p.snapshot.client = s3.Client()
+
+	n, err := p.importSnapshot(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "the expired lease must be skipped")
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, "10.0.0.1", stored["02:00:00:00:00:01"].IP.String())
+	assert.Equal(t, "a", stored["02:00:00:00:00:01"].Hostname)
+	assert.True(t, stored["02:00:00:00:00:03"].infinite())
+	assert.Len(t, p.Recordsv4, 2)
+
+	// A stale snapshot is not imported
+	p = testPluginState(t)
+	clock.Advance(2 * time.Hour)
+	p.clock = clock.Now
+	require.NoError(t, parseSnapshotURLOption(p, s3.URL+"/backups/coredhcp/"))
+	require.NoError(t, parseSnapshotImportOption(p, "2h"))
+	p.snapshot.client = s3.Client()
+	n, err = p.importSnapshot(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	assert.Empty(t, p.kv.(*memKV).data)
+}
+
+func TestSnapshotOptions(t *testing.T) {
+	p := testPluginState(t)
+	assert.Error(t, parseSnapshotURLOption(p, "s3://bucket"))
+	assert.Error(t, parseSnapshotURLOption(p, "https://s3.example.com/bucket?versionId=1"))
+	assert.Error(t, parseSnapshotIntervalOption(p, "1s"))
+	require.NoError(t, parseSnapshotAccessKeyOption(p, "AKIDEXAMPLE"))
+	assert.Error(t, p.snapshot.check(), "credentials without a URL")
+	p.snapshot.url = &url.URL{Scheme: "https", Host: "s3.example.com", Path: "/bucket"}
+	assert.Error(t, p.snapshot.check(), "access key without a secret key")
+	require.NoError(t, parseSnapshotSecretKeyOption(p, "secret"))
+	assert.NoError(t, p.snapshot.check())
+}
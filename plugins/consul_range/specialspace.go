@@ -0,0 +1,82 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// specialBlocks are the IPv4 blocks that can't be leased to hosts, from the
+// IANA special-purpose address registry
+var specialBlocks = []struct {
+	name  string
+	block *net.IPNet
+}{
+	{"this network", mustParseCIDR("0.0.0.0/8")},
+	{"loopback", mustParseCIDR("127.0.0.0/8")},
+	{"link-local", mustParseCIDR("169.254.0.0/16")},
+	{"multicast", mustParseCIDR("224.0.0.0/4")},
+	{"reserved", mustParseCIDR("240.0.0.0/4")},
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, block, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// specialSpacePolicy selects the response to a range overlapping special-purpose space
+type specialSpacePolicy int
+
+const (
+	// specialSpaceWarn logs a warning and serves the range anyway
+	specialSpaceWarn specialSpacePolicy = iota
+	// specialSpaceError refuses the range
+	specialSpaceError
+)
+
+func parseSpecialSpaceOption(p *PluginState, value string) error {
+	switch value {
+	case "warn":
+		p.specialSpace = specialSpaceWarn
+	case "error":
+		p.specialSpace = specialSpaceError
+	default:
+		return fmt.Errorf("unknown special-space policy %q, want warn or error", value)
+	}
+	return nil
+}
+
+// overlapsSpecialSpace describes the blocks of special-purpose space
+// overlapping the range start-end
+func overlapsSpecialSpace(start, end net.IP) []string {
+	var overlaps []string
+	for _, b := range specialBlocks {
+		first := b.block.IP.To4()
+		last := make(net.IP, net.IPv4len)
+		for i := range last {
+			last[i] = first[i] | ^b.block.Mask[i]
+		}
+		if compareIP(start, last) <= 0 && compareIP(first, end) <= 0 {
+			overlaps = append(overlaps, fmt.Sprintf("%s %s", b.name, b.block))
+		}
+	}
+	return overlaps
+}
+
+// checkSpecialSpace warns about, or with special-space=error refuses, a range
+// start-end overlapping special-purpose space, which no host can be leased
+func (p *PluginState) checkSpecialSpace(start, end net.IP) error {
+	overlaps := overlapsSpecialSpace(start, end)
+	if len(overlaps) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("range %s-%s overlaps special-purpose space (%s)", start, end, strings.Join(overlaps, ", "))
+	if p.specialSpace == specialSpaceError {
+		return fmt.Errorf("%w: %s", ErrInvalidRange, msg)
+	}
+	log.Warningf("The %s and is likely misconfigured", msg)
+	return nil
+}
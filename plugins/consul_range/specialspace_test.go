@@ -0,0 +1,53 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlapsSpecialSpace(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		want       []string
+	}{
+		{"10.0.0.1", "10.0.0.10", nil},
+		{"169.254.0.10", "169.254.0.20", []string{"link-local 169.254.0.0/16"}},
+		{"169.253.255.200", "169.254.0.1", []string{"link-local 169.254.0.0/16"}},
+		{"223.255.255.200", "224.0.0.10", []string{"multicast 224.0.0.0/4"}},
+		{"239.255.255.200", "240.0.0.10", []string{"multicast 224.0.0.0/4", "reserved 240.0.0.0/4"}},
+		{"126.255.255.1", "127.0.0.1", []string{"loopback 127.0.0.0/8"}},
+		{"0.0.0.1", "0.0.0.10", []string{"this network 0.0.0.0/8"}},
+		{"169.255.0.1", "223.255.255.254", nil},
+	} {
+		got := overlapsSpecialSpace(net.ParseIP(tc.start).To4(), net.ParseIP(tc.end).To4())
+		assert.Equal(t, tc.want, got, "%s-%s", tc.start, tc.end)
+	}
+}
+
+func TestSpecialSpaceWarns(t *testing.T) {
+	hook := test.NewLocal(log.Logger)
+	defer hook.Reset()
+	p := &PluginState{}
+	require.NoError(t, p.checkSpecialSpace(net.IPv4(169, 254, 0, 1).To4(), net.IPv4(169, 254, 0, 10).To4()))
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "link-local 169.254.0.0/16")
+
+	hook.Reset()
+	require.NoError(t, p.checkSpecialSpace(net.IPv4(10, 0, 0, 1).To4(), net.IPv4(10, 0, 0, 10).To4()))
+	assert.Empty(t, hook.AllEntries())
+}
+
+func TestSpecialSpaceError(t *testing.T) {
+	_, err := setupConsulRange("127.0.0.1:8500", "leases", "224.0.0.1", "224.0.0.10", "1h", "special-space=error")
+	assert.ErrorIs(t, err, ErrInvalidRange)
+	assert.ErrorContains(t, err, "multicast 224.0.0.0/4")
+
+	_, err = setupConsulRange("127.0.0.1:8500", "leases", "224.0.0.1", "224.0.0.10", "1h", "special-space=refuse")
+	assert.ErrorIs(t, err, ErrInvalidOption)
+}
@@ -0,0 +1,63 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// stickyFloor returns the lease time below which backpressure may not shorten
+// the leases of the record, zero if unset
+func (r *Record) stickyFloor() time.Duration {
+	return time.Duration(r.StickyFloor) * time.Second
+}
+
+// setStickyFloor sets the sticky floor of the lease of mac, clearing it if d is
+// zero, and persists it.
+func (p *PluginState) setStickyFloor(ctx context.Context, mac net.HardwareAddr, d time.Duration) (lease, error) {
+	p.Lock()
+	defer p.Unlock()
+	rec, ok := p.Recordsv4[mac.String()]
+	if !ok {
+		return lease{}, fmt.Errorf("%w for MAC %s", errNoLease, p.logMAC(mac.String()))
+	}
+	old := rec.StickyFloor
+	rec.StickyFloor = int(d / time.Second)
+	if err := p.saveIPAddress(ctx, mac, rec); err != nil {
+		rec.StickyFloor = old
+		return lease{}, err
+	}
+	log.Printf("Set the sticky lease time floor of MAC %s to %s", p.logMAC(mac.String()), d)
+	return lease{MAC: p.logMAC(mac.String()), Record: *rec, Infinite: rec.infinite()}, nil
+}
+
+// serveStickyFloor sets the sticky floor of the lease of the MAC address in the
+// path to the "duration" query parameter, 0 to clear it
+func (p *PluginState) serveStickyFloor(w http.ResponseWriter, r *http.Request) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || d < 0 || d%time.Second != 0 {
+		http.Error(w, "missing or invalid duration, want whole seconds", http.StatusBadRequest)
+		return
+	}
+	l, err := p.setStickyFloor(r.Context(), mac, d)
+	if errors.Is(err, errNoLease) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Warningf("Failed to write lease: %v", err)
+	}
+}
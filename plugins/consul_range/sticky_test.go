@@ -0,0 +1,70 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putStickyFloor PUTs duration to the sticky floor endpoint of mac and returns the status
+func putStickyFloor(t *testing.T, srv *httptest.Server, mac, duration string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/leases/"+mac+"/sticky-floor?duration="+duration, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testHTTPToken)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestStickyFloorResistsBackpressure(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseBackpressureOption(p, "30"))
+	p.backpressureFactor = 0.25
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	critical := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	testLease(t, p, critical, net.IPv4(10, 0, 0, 1))
+	require.Equal(t, http.StatusOK, putStickyFloor(t, srv, critical.String(), "45m"))
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, 45*time.Minute, stored[critical.String()].stickyFloor(), "the floor must be persisted")
+	capped := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	testLease(t, p, capped, net.IPv4(10, 0, 0, 2))
+	require.Equal(t, http.StatusOK, putStickyFloor(t, srv, capped.String(), "2h"))
+	for i := byte(3); i <= 8; i++ {
+		testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 1, i}, net.IPv4(10, 0, 0, i))
+	}
+
+	assert.Equal(t, 15*time.Minute, grantedLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 3}), "20% free")
+	require.True(t, p.backpressureActive)
+	p.Recordsv4[critical.String()].Expires = 0
+	assert.Equal(t, 45*time.Minute, grantedLease(t, p, critical))
+	// The floor never lengthens leases past the lease time
+	p.Recordsv4[capped.String()].Expires = 0
+	assert.Equal(t, time.Hour, grantedLease(t, p, capped))
+
+	// Once cleared, the lease is shortened like the others
+	require.Equal(t, http.StatusOK, putStickyFloor(t, srv, critical.String(), "0s"))
+	p.Recordsv4[critical.String()].Expires = 0
+	assert.Equal(t, 15*time.Minute, grantedLease(t, p, critical))
+}
+
+func TestStickyFloorErrors(t *testing.T) {
+	p := testPluginState(t)
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	assert.Equal(t, http.StatusNotFound, putStickyFloor(t, srv, "02:00:00:00:00:01", "1h"))
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	for _, duration := range []string{"", "-1h", "1.5s", "forever"} {
+		assert.Equal(t, http.StatusBadRequest, putStickyFloor(t, srv, "02:00:00:00:00:01", duration), duration)
+	}
+	assert.Equal(t, http.StatusBadRequest, putStickyFloor(t, srv, "nope", "1h"))
+}
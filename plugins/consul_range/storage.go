@@ -1,62 +1,506 @@
 package consulrangeplugin
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/consul/api"
 )
 
+// storageFormat selects how lease records are laid out in the Consul KV store
+type storageFormat int
+
+const (
+	// storageJSON stores one JSON-encoded record per MAC address key
+	storageJSON storageFormat = iota
+	// storageBatched stores gzip-compressed gob batches of records, sharded by MAC address
+	storageBatched
+	// storageProtobuf stores one protobuf-encoded record per MAC address key, see record.proto
+	storageProtobuf
+)
+
+// batchKeyDir is the sub-directory of the KV prefix holding batched records.
+// It can never collide with a MAC address key.
+const batchKeyDir = "_batch"
+
+// configKeyDir is the sub-directory of the KV prefix holding plugin state
+// other than lease records, such as the persisted range
+const configKeyDir = "_config"
+
+// batchShards is the number of batch keys records are spread across in the batched format
+const batchShards = 16
+
+// consulMaxValueSize is the largest value Consul stores under a key
+const consulMaxValueSize = 512 * 1024
+
+// batchWriteAttempts bounds the times a batch modified concurrently is merged
+// into again before its write fails with errBatchConflict
+const batchWriteAttempts = 5
+
+// errBatchConflict is returned when a batch keeps being modified by other
+// instances sharing the prefix while it is written
+var errBatchConflict = errors.New("record batch modified concurrently")
+
+// errRecordEncoding is returned when a record can't be serialized, as opposed
+// to failing to be written to Consul. Retrying won't help.
+var errRecordEncoding = errors.New("could not encode lease record")
+
+// defaultConsulTimeout bounds the Consul I/O done while handling a single request
+const defaultConsulTimeout = 2 * time.Second
+
+// kvStore is the subset of the Consul KV API used to persist leases
+type kvStore interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error)
+	Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error)
+	Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error)
+	Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+}
+
+func parseConsulTimeoutOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("timeout cannot be negative: %s", d)
+	}
+	p.consulTimeout = d
+	return nil
+}
+
+// requestContext returns a context bounding the Consul operations done on
+// behalf of a single request. A zero timeout disables the bound.
+func (p *PluginState) requestContext() (context.Context, context.CancelFunc) {
+	if p.consulTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), p.consulTimeout)
+}
+
+func parsePrettyJSONOption(p *PluginState, value string) error {
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	p.prettyJSON = enabled
+	return nil
+}
+
+func parseStorageOption(p *PluginState, value string) error {
+	switch value {
+	case "json":
+		p.storageFormat = storageJSON
+	case "batched":
+		p.storageFormat = storageBatched
+	case "protobuf":
+		p.storageFormat = storageProtobuf
+	default:
+		return fmt.Errorf("unknown storage format %q, want json, batched or protobuf", value)
+	}
+	return nil
+}
+
 // loadRecords retrieves all lease records stored in Consul under the given key prefix.
-// It uses a single GET (KV.List) call to fetch all keys and unmarshals each value from JSON.
-func loadRecords(client *api.Client, consulKVPrefix string) (map[string]*Record, error) {
+// It uses a single GET (KV.List) call to fetch all keys and decodes each value,
+// transparently handling per-key JSON and protobuf records and compressed
+// batches, so a store can hold a mix of them while it's migrated.
+// When a MAC address is present in both formats, the batched record wins.
+// Values that aren't valid records, e.g. stored by another application sharing
+// the prefix, are skipped with a warning.
+func loadRecords(kv kvStore, consulKVPrefix string) (map[string]*Record, error) {
+	records, _, err := loadRecordsWith(kv, consulKVPrefix, macKeys{}, nil)
+	return records, err
+}
+
+// loadRecordsWith is loadRecords with JSON records laid out by keys, and
+// encrypted values decrypted by sealer. Keys under the prefix that hold no
+// record according to keys are ignored. It also returns the number of values
+// skipped because they aren't valid records.
+func loadRecordsWith(kv kvStore, consulKVPrefix string, keys keyCodec, sealer *recordSealer) (map[string]*Record, int, error) {
 	// Use the KV API to list all keys under the specified prefix.
-	kv := client.KV()
-	pairs, _, err := kv.List(consulKVPrefix, nil)
+	// The trailing slash keeps out keys of prefixes it is a prefix of
+	pairs, _, err := kv.List(strings.TrimRight(consulKVPrefix, "/")+"/", nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list keys with prefix %q: %w", consulKVPrefix, err)
+		return nil, 0, fmt.Errorf("failed to list keys with prefix %q: %w", consulKVPrefix, err)
 	}
 
+	skipped := 0
 	records := make(map[string]*Record)
+	batched := make(map[string]*Record)
 	for _, pair := range pairs {
-		var rec Record
-		// Unmarshal the JSON value into a Record.
-		if err := json.Unmarshal(pair.Value, &rec); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal record for key %q: %w", pair.Key, err)
-		}
 		// Extract the MAC address from the key.
 		// If the key is "leases/aa:bb:cc:dd:ee:ff", remove the prefix.
-		macStr := strings.TrimPrefix(pair.Key, consulKVPrefix)
-		macStr = strings.TrimLeft(macStr, "/")
-		records[macStr] = &rec
+		key := strings.TrimPrefix(pair.Key, consulKVPrefix)
+		key = strings.TrimLeft(key, "/")
+		if strings.HasPrefix(key, configKeyDir+"/") || strings.HasPrefix(key, offerKeyDir+"/") || strings.HasPrefix(key, v6KeyDir+"/") {
+			continue
+		}
+		if strings.HasPrefix(key, batchKeyDir+"/") {
+			data, err := sealer.open(key, pair.Value)
+			if err != nil {
+				log.Warningf("Skipping key %q, not a readable record batch: %v", pair.Key, err)
+				skipped++
+				continue
+			}
+			batch, err := decodeBatch(data)
+			if err != nil {
+				log.Warningf("Skipping key %q, not a valid record batch: %v", pair.Key, err)
+				skipped++
+				continue
+			}
+			for mac, rec := range batch {
+				batched[mac] = rec
+			}
+			continue
+		}
+		macStr, ok := keys.MAC(key)
+		if !ok {
+			continue
+		}
+		// Unmarshal the value into a Record. Any JSON object unmarshals,
+		// a record without an address isn't one.
+		data, err := sealer.open(key, pair.Value)
+		if err != nil {
+			log.Warningf("Skipping key %q, not a readable record: %v", pair.Key, err)
+			skipped++
+			continue
+		}
+		rec, err := unmarshalRecord(data)
+		if err == nil && rec.IP.To4() == nil {
+			err = errors.New("no IPv4 address")
+		}
+		if err != nil {
+			log.Warningf("Skipping key %q, not a valid record: %v", pair.Key, err)
+			skipped++
+			continue
+		}
+		records[macStr] = rec
 	}
-	return records, nil
+	for mac, rec := range batched {
+		records[mac] = rec
+	}
+	return records, skipped, nil
 }
 
 // saveIPAddress stores (or updates) a lease record in Consul.
-// It marshals the Record into JSON and writes it under a key built from the key prefix and the MAC address.
-func (p *PluginState) saveIPAddress(mac net.HardwareAddr, record *Record) error {
+// In the default format it marshals the Record into JSON and writes it under a
+// key built from the key prefix and the MAC address. In the batched format it
+// rewrites the whole batch the MAC address belongs to.
+func (p *PluginState) saveIPAddress(ctx context.Context, mac net.HardwareAddr, record *Record) error {
+	err := p.writeRecord(ctx, mac, record)
+	if err != nil {
+		p.noteWritten(mac.String(), nil)
+		return err
+	}
+	p.noteWritten(mac.String(), record)
+	return nil
+}
+
+// writeRecord is saveIPAddress, without keeping track of what was written
+func (p *PluginState) writeRecord(ctx context.Context, mac net.HardwareAddr, record *Record) error {
+	w, err := p.prepareWrite(mac, record)
+	if err != nil {
+		return err
+	}
+	if err := p.applyWrite(ctx, w); err != nil {
+		if p.storageFormat == storageBatched {
+			return fmt.Errorf("failed to store record batch in consul: %w", err)
+		}
+		return fmt.Errorf("failed to store record in consul: %w", err)
+	}
+	return nil
+}
+
+// recordWrite is a write to Consul persisting the lease record of a MAC
+// address: the put of its record, the deletion of its record, or the change
+// to its batch
+type recordWrite struct {
+	pair   *api.KVPair
+	delete bool
+	batch  *batchChange
+}
+
+// batchChange is the change a write makes to the batch under a key: the
+// record of mac replaced by a copy of the one written, or removed if there is
+// none
+type batchChange struct {
+	name   string
+	mac    net.HardwareAddr
+	record *Record
+}
+
+// prepareWrite serializes the write persisting record for mac, or removing it
+// if record is nil, so that it can be applied without holding the plugin lock.
+// Must be called with the plugin lock held.
+func (p *PluginState) prepareWrite(mac net.HardwareAddr, record *Record) (recordWrite, error) {
+	if p.storageFormat == storageBatched {
+		return p.prepareBatch(mac, record)
+	}
+
 	// Build the key. For example, if consulKVPrefix is "leases", the key becomes "leases/aa:bb:cc:dd:ee:ff".
-	key := strings.TrimRight(p.consulKVPrefix, "/") + "/" + mac.String()
+	key := p.recordKey(mac)
+	if record == nil {
+		return recordWrite{pair: &api.KVPair{Key: key}, delete: true}, nil
+	}
 
-	// Marshal the record into JSON.
-	data, err := json.Marshal(record)
+	// Marshal the record into JSON, indented if asked for debugging, or protobuf.
+	data, err := p.marshalRecord(record)
+	if err == nil {
+		data, err = p.sealer.seal(p.recordKeys().Key(mac), data)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to marshal record: %w", err)
+		return recordWrite{}, p.encodingFailed(mac, err)
+	}
+	return recordWrite{pair: &api.KVPair{Key: key, Value: data}}, nil
+}
+
+// applyWrite stores (or updates, or deletes) the record of w in Consul
+func (p *PluginState) applyWrite(ctx context.Context, w recordWrite) error {
+	if w.batch != nil {
+		return p.applyBatch(ctx, w.pair.Key, w.batch)
+	}
+	var err error
+	if w.delete {
+		_, err = p.kv.Delete(w.pair.Key, (&api.WriteOptions{}).WithContext(ctx))
+	} else {
+		_, err = p.kv.Put(w.pair, (&api.WriteOptions{}).WithContext(ctx))
+	}
+	return err
+}
+
+// marshalRecord serializes a record in the storage format, JSON being compact
+// unless pretty-json is set
+func (p *PluginState) marshalRecord(record *Record) ([]byte, error) {
+	if p.storageFormat == storageProtobuf {
+		return encodeProtoRecord(record), nil
+	}
+	if p.prettyJSON {
+		return json.MarshalIndent(record, "", "  ")
 	}
+	return json.Marshal(record)
+}
 
-	// Create the KV pair.
-	kvPair := &api.KVPair{
-		Key:   key,
-		Value: data,
+// unmarshalRecord parses a per-key record, telling protobuf records from JSON
+// ones by their leading magic byte
+func unmarshalRecord(data []byte) (*Record, error) {
+	if isProtoRecord(data) {
+		return decodeProtoRecord(data)
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
 	}
+	return &rec, nil
+}
 
-	// Store (or update) the record in Consul.
-	_, err = p.consulClient.KV().Put(kvPair, nil)
+// deleteIPAddress removes the lease record of a MAC address from Consul. If
+// that fails, the MAC address is marked dirty for the deletion to be retried.
+func (p *PluginState) deleteIPAddress(ctx context.Context, mac net.HardwareAddr) error {
+	p.noteWritten(mac.String(), nil)
+	w, err := p.prepareWrite(mac, nil)
 	if err != nil {
-		return fmt.Errorf("failed to store record in consul: %w", err)
+		return err
+	}
+	if err := p.applyWrite(ctx, w); err != nil {
+		p.markDirty(mac.String(), err)
+		if p.storageFormat == storageBatched {
+			return fmt.Errorf("failed to store record batch in consul: %w", err)
+		}
+		return fmt.Errorf("failed to delete record from consul: %w", err)
+	}
+	delete(p.dirty, mac.String())
+	return nil
+}
+
+// encodingFailed logs and counts the failure to serialize the record of mac,
+// or the batch it belongs to, and returns the error to report
+func (p *PluginState) encodingFailed(mac net.HardwareAddr, err error) error {
+	p.metrics.encodingFailures.Inc()
+	log.Errorf("Could not serialize the lease record of MAC %s, it is only held in memory: %v", p.logMAC(mac.String()), err)
+	return fmt.Errorf("%w: %v", errRecordEncoding, err)
+}
+
+// recordKey returns the key of the JSON record of a MAC address
+func (p *PluginState) recordKey(mac net.HardwareAddr) string {
+	return strings.TrimRight(p.consulKVPrefix, "/") + "/" + p.recordKeys().Key(mac)
+}
+
+// loadRecords retrieves all lease records stored under the plugin's KV prefix,
+// and the number of values skipped because they aren't valid records
+func (p *PluginState) loadRecords() (map[string]*Record, int, error) {
+	records, skipped, err := loadRecordsWith(p.kv, p.consulKVPrefix, p.recordKeys(), p.sealer)
+	p.metrics.invalidRecords.Add(uint64(skipped))
+	return records, skipped, err
+}
+
+// loadMergedRecords is loadRecords, with the records of the read-only
+// secondary prefixes merged in. The primary prefix wins over the secondary
+// ones, which win over those listed after them.
+func (p *PluginState) loadMergedRecords() (map[string]*Record, int, error) {
+	records, skipped, err := p.loadRecords()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, prefix := range p.readPrefixes {
+		secondary, n, err := loadRecordsWith(p.kv, prefix, p.recordKeys(), p.sealer)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.metrics.invalidRecords.Add(uint64(n))
+		skipped += n
+		merged := 0
+		for mac, rec := range secondary {
+			if _, ok := records[mac]; !ok {
+				records[mac] = rec
+				if p.merged == nil {
+					p.merged = make(map[string]struct{})
+				}
+				p.merged[mac] = struct{}{}
+				merged++
+			}
+		}
+		log.Printf("Merged %d of %d lease records from read-only prefix %s", merged, len(secondary), prefix)
+	}
+	return records, skipped, nil
+}
+
+func parseReadPrefixOption(p *PluginState, value string) error {
+	prefix := strings.Trim(value, "/")
+	if prefix == "" {
+		return errors.New("read-only prefix cannot be empty")
+	}
+	for _, other := range p.readPrefixes {
+		if other == prefix {
+			return fmt.Errorf("duplicate read-only prefix %s", prefix)
+		}
+	}
+	p.readPrefixes = append(p.readPrefixes, prefix)
+	return nil
+}
+
+// checkReadPrefixes returns an error if a read-only prefix overlaps the
+// primary one, so that it can't list the other's records
+func (p *PluginState) checkReadPrefixes() error {
+	primary := strings.Trim(p.consulKVPrefix, "/")
+	for _, prefix := range p.readPrefixes {
+		if prefix == primary || strings.HasPrefix(prefix, primary+"/") || strings.HasPrefix(primary, prefix+"/") {
+			return fmt.Errorf("read-only prefix %s overlaps the KV prefix %s", prefix, p.consulKVPrefix)
+		}
 	}
 	return nil
 }
+
+// configKey returns the full key of a plugin state entry under the prefix
+func (p *PluginState) configKey(name string) string {
+	return strings.TrimRight(p.consulKVPrefix, "/") + "/" + configKeyDir + "/" + name
+}
+
+// batchShard returns the index of the batch a MAC address is stored in
+func batchShard(mac string) int {
+	h := fnv.New32a()
+	h.Write([]byte(mac))
+	return int(h.Sum32() % batchShards)
+}
+
+// prepareBatch serializes the change to the batch holding the given MAC
+// address, record replacing whatever is held for that MAC, or the MAC removed
+// from the batch if record is nil. Must be called with the plugin lock held.
+func (p *PluginState) prepareBatch(mac net.HardwareAddr, record *Record) (recordWrite, error) {
+	change := &batchChange{name: fmt.Sprintf("%s/%02d", batchKeyDir, batchShard(mac.String())), mac: mac}
+	if record != nil {
+		// Tags and user classes are replaced rather than modified, sharing them is safe
+		r := *record
+		change.record = &r
+	}
+	key := strings.TrimRight(p.consulKVPrefix, "/") + "/" + change.name
+	return recordWrite{pair: &api.KVPair{Key: key}, batch: change}, nil
+}
+
+// applyBatch merges change into the batch stored under key. Instances sharing
+// the prefix write the same batches: the batch is written back with a
+// check-and-set on the index it was read at, and merged into again if another
+// instance modified it meanwhile.
+func (p *PluginState) applyBatch(ctx context.Context, key string, change *batchChange) error {
+	for range batchWriteAttempts {
+		pair, _, err := p.kv.Get(key, (&api.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		batch := make(map[string]*Record)
+		var index uint64
+		if pair != nil {
+			index = pair.ModifyIndex
+			data, err := p.sealer.open(change.name, pair.Value)
+			if err == nil {
+				batch, err = decodeBatch(data)
+			}
+			if err != nil {
+				return fmt.Errorf("could not merge into record batch %q: %w", key, err)
+			}
+		}
+		if change.record != nil {
+			batch[change.mac.String()] = change.record
+		} else {
+			delete(batch, change.mac.String())
+		}
+
+		data, err := encodeBatch(batch)
+		if err == nil {
+			data, err = p.sealer.seal(change.name, data)
+		}
+		if err == nil && len(data) > consulMaxValueSize {
+			err = fmt.Errorf("batch %q of %d records is %d bytes, over the %d bytes Consul stores under a key", change.name, len(batch), len(data), consulMaxValueSize)
+		}
+		if err != nil {
+			return p.encodingFailed(change.mac, err)
+		}
+		// A zero index only creates the batch if there still is none
+		ok, _, err := p.kv.CAS(&api.KVPair{Key: key, Value: data, ModifyIndex: index}, (&api.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errBatchConflict
+}
+
+// encodeBatch serializes a set of records as a gzip-compressed gob stream
+func encodeBatch(batch map[string]*Record) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(batch); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeBatch is the inverse of encodeBatch
+func decodeBatch(data []byte) (map[string]*Record, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	batch := make(map[string]*Record)
+	if err := gob.NewDecoder(zr).Decode(&batch); err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
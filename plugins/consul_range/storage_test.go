@@ -1,15 +1,124 @@
 package consulrangeplugin
 
 import (
+	"context"
 	"encoding/json"
+	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// memKV is an in-memory kvStore used to test storage without a Consul agent
+type memKV struct {
+	sync.Mutex
+	data map[string][]byte
+	puts int
+	// locks maps locked keys to the session holding them
+	locks map[string]string
+	// index is bumped by every write, modified holds the index a key was last written at
+	index    uint64
+	modified map[string]uint64
+}
+
+func newMemKV() *memKV {
+	return &memKV{data: make(map[string][]byte), locks: make(map[string]string), modified: make(map[string]uint64)}
+}
+
+// write records a change to key. Must be called with the lock held.
+func (m *memKV) write(key string) {
+	m.index++
+	m.modified[key] = m.index
+}
+
+// Get supports blocking queries, waiting for any write past q.WaitIndex
+func (m *memKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	if q != nil && q.WaitIndex > 0 {
+		for m.index <= q.WaitIndex {
+			if err := q.Context().Err(); err != nil {
+				return nil, nil, err
+			}
+			m.Unlock()
+			time.Sleep(time.Millisecond)
+			m.Lock()
+		}
+	}
+	meta := &api.QueryMeta{LastIndex: m.index}
+	v, ok := m.data[key]
+	if !ok {
+		return nil, meta, nil
+	}
+	return &api.KVPair{Key: key, Value: append([]byte(nil), v...), ModifyIndex: m.modified[key]}, meta, nil
+}
+
+func (m *memKV) List(prefix string, _ *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	var pairs api.KVPairs
+	for k, v := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			pairs = append(pairs, &api.KVPair{Key: k, Value: append([]byte(nil), v...)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs, &api.QueryMeta{}, nil
+}
+
+func (m *memKV) Put(p *api.KVPair, _ *api.WriteOptions) (*api.WriteMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.puts++
+	m.write(p.Key)
+	m.data[p.Key] = append([]byte(nil), p.Value...)
+	return &api.WriteMeta{}, nil
+}
+
+func (m *memKV) Delete(key string, _ *api.WriteOptions) (*api.WriteMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.write(key)
+	delete(m.data, key)
+	delete(m.locks, key)
+	return &api.WriteMeta{}, nil
+}
+
+func (m *memKV) Acquire(p *api.KVPair, _ *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	if holder, ok := m.locks[p.Key]; ok && holder != p.Session {
+		return false, &api.WriteMeta{}, nil
+	}
+	m.locks[p.Key] = p.Session
+	m.write(p.Key)
+	m.data[p.Key] = append([]byte(nil), p.Value...)
+	return true, &api.WriteMeta{}, nil
+}
+
+// CAS writes p if its key was last written at p.ModifyIndex, or doesn't exist if 0
+func (m *memKV) CAS(p *api.KVPair, _ *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	m.Lock()
+	defer m.Unlock()
+	_, exists := m.data[p.Key]
+	if (p.ModifyIndex == 0 && exists) || (p.ModifyIndex != 0 && (!exists || m.modified[p.Key] != p.ModifyIndex)) {
+		return false, &api.WriteMeta{}, nil
+	}
+	m.puts++
+	m.write(p.Key)
+	m.data[p.Key] = append([]byte(nil), p.Value...)
+	return true, &api.WriteMeta{}, nil
+}
+
 // testConsulSetup creates a PluginState with a Consul client configured to talk to a
 // local Consul agent. It also clears any previous keys under the test prefix.
 func testConsulSetup(t *testing.T) *PluginState {
@@ -20,6 +129,10 @@ func testConsulSetup(t *testing.T) *PluginState {
 	if err != nil {
 		t.Fatalf("failed to create consul client: %v", err)
 	}
+	// Skip rather than fail when there is no agent to talk to.
+	if _, err := client.Status().Leader(); err != nil {
+		t.Skipf("no local consul agent available: %v", err)
+	}
 	prefix := "test/leases/"
 	// Clean up any keys under the test prefix.
 	_, err = client.KV().DeleteTree(prefix, nil)
@@ -28,6 +141,7 @@ func testConsulSetup(t *testing.T) *PluginState {
 	}
 	return &PluginState{
 		consulClient:   client,
+		kv:             client.KV(),
 		consulKVPrefix: prefix,
 	}
 }
@@ -40,12 +154,12 @@ var records = []struct {
 	mac string
 	ip  *Record
 }{
-	{"02:00:00:00:00:00", &Record{IP: net.IPv4(10, 0, 0, 0), Expires: int64(expire), Hostname: "zero"}},
-	{"02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), Expires: int64(expire), Hostname: "one"}},
-	{"02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 2), Expires: int64(expire), Hostname: "two"}},
-	{"02:00:00:00:00:03", &Record{IP: net.IPv4(10, 0, 0, 3), Expires: int64(expire), Hostname: "three"}},
-	{"02:00:00:00:00:04", &Record{IP: net.IPv4(10, 0, 0, 4), Expires: int64(expire), Hostname: "four"}},
-	{"02:00:00:00:00:05", &Record{IP: net.IPv4(10, 0, 0, 5), Expires: int64(expire), Hostname: "five"}},
+	{"02:00:00:00:00:00", &Record{IP: net.IPv4(10, 0, 0, 0), Expires: expire, Hostname: "zero"}},
+	{"02:00:00:00:00:01", &Record{IP: net.IPv4(10, 0, 0, 1), Expires: expire, Hostname: "one"}},
+	{"02:00:00:00:00:02", &Record{IP: net.IPv4(10, 0, 0, 2), Expires: expire, Hostname: "two"}},
+	{"02:00:00:00:00:03", &Record{IP: net.IPv4(10, 0, 0, 3), Expires: expire, Hostname: "three"}},
+	{"02:00:00:00:00:04", &Record{IP: net.IPv4(10, 0, 0, 4), Expires: expire, Hostname: "four"}},
+	{"02:00:00:00:00:05", &Record{IP: net.IPv4(10, 0, 0, 5), Expires: expire, Hostname: "five"}},
 }
 
 // TestLoadRecords manually writes a set of JSON-encoded lease records into Consul using a single
@@ -53,10 +167,9 @@ var records = []struct {
 func TestLoadRecords(t *testing.T) {
 	// Set up our test Consul state.
 	ps := testConsulSetup(t)
-	consulURL := "127.0.0.1:8500"
 	prefix := ps.consulKVPrefix
 
-	kv := ps.consulClient.KV()
+	kv := ps.kv
 	// Insert each test record into Consul.
 	for _, rec := range records {
 		key := prefix + rec.mac
@@ -75,7 +188,7 @@ func TestLoadRecords(t *testing.T) {
 	}
 
 	// Now load all records under the prefix with our loadRecords helper.
-	loadedRecords, err := loadRecords(consulURL, prefix)
+	loadedRecords, err := loadRecords(ps.kv, prefix)
 	if err != nil {
 		t.Fatalf("failed to load records: %v", err)
 	}
@@ -101,7 +214,7 @@ func TestWriteRecords(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to parse mac %q: %v", rec.mac, err)
 		}
-		if err := ps.saveIPAddress(hw, rec.ip); err != nil {
+		if err := ps.saveIPAddress(context.Background(), hw, rec.ip); err != nil {
 			t.Errorf("failed to save IP for %q: %v", hw, err)
 		}
 		// saveIPAddress uses mac.String() as the key suffix.
@@ -109,10 +222,321 @@ func TestWriteRecords(t *testing.T) {
 	}
 
 	// Load records back from Consul.
-	loadedRecords, err := loadRecords("127.0.0.1:8500", ps.consulKVPrefix)
+	loadedRecords, err := loadRecords(ps.kv, ps.consulKVPrefix)
 	if err != nil {
 		t.Fatalf("failed to load records: %v", err)
 	}
 
 	assert.Equal(t, expected, loadedRecords, "Loaded records differ from expected")
 }
+
+// TestBatchedRoundTrip saves records in the batched format and checks they load back,
+// using fewer keys than there are records.
+func TestBatchedRoundTrip(t *testing.T) {
+	kv := newMemKV()
+	ps := &PluginState{
+		Recordsv4:      make(map[string]*Record),
+		kv:             kv,
+		consulKVPrefix: "leases",
+		storageFormat:  storageBatched,
+	}
+
+	expected := make(map[string]*Record)
+	for i := 0; i < 64; i++ {
+		hw := net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}
+		rec := &Record{IP: net.IPv4(10, 0, 0, byte(i)).To4(), Expires: expire, Hostname: "host"}
+		if err := ps.saveIPAddress(context.Background(), hw, rec); err != nil {
+			t.Fatalf("failed to save IP for %q: %v", hw, err)
+		}
+		ps.Recordsv4[hw.String()] = rec
+		expected[hw.String()] = rec
+	}
+	assert.LessOrEqual(t, len(kv.data), batchShards, "batched format should use at most one key per shard")
+
+	loadedRecords, err := loadRecords(kv, "leases")
+	if err != nil {
+		t.Fatalf("failed to load records: %v", err)
+	}
+	assert.Equal(t, expected, loadedRecords, "Loaded records differ from expected")
+}
+
+// TestLoadMixedStore loads a store holding both legacy JSON keys and batches
+func TestLoadMixedStore(t *testing.T) {
+	kv := newMemKV()
+	legacy := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases"}
+	batched := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: storageBatched}
+
+	expected := make(map[string]*Record)
+	for i, rec := range records {
+		hw, err := net.ParseMAC(rec.mac)
+		if err != nil {
+			t.Fatalf("failed to parse mac %q: %v", rec.mac, err)
+		}
+		ps := legacy
+		if i%2 == 0 {
+			ps = batched
+		}
+		if err := ps.saveIPAddress(context.Background(), hw, rec.ip); err != nil {
+			t.Fatalf("failed to save IP for %q: %v", hw, err)
+		}
+		ps.Recordsv4[hw.String()] = rec.ip
+		expected[hw.String()] = rec.ip
+	}
+	// A stale legacy copy of a batched record must be shadowed by the batch
+	stale := &Record{IP: net.IPv4(10, 0, 1, 0), Expires: expire, Hostname: "stale"}
+	if err := legacy.saveIPAddress(context.Background(), net.HardwareAddr{2, 0, 0, 0, 0, 0}, stale); err != nil {
+		t.Fatalf("failed to save stale record: %v", err)
+	}
+
+	loadedRecords, err := loadRecords(kv, "leases")
+	if err != nil {
+		t.Fatalf("failed to load records: %v", err)
+	}
+	assert.Equal(t, len(expected), len(loadedRecords))
+	for mac, rec := range expected {
+		if assert.Contains(t, loadedRecords, mac) {
+			assert.True(t, rec.IP.Equal(loadedRecords[mac].IP), "wrong IP for %s", mac)
+			assert.Equal(t, rec.Hostname, loadedRecords[mac].Hostname)
+		}
+	}
+}
+
+// TestBatchedSharedPrefix checks that instances sharing a prefix don't
+// overwrite each other's records in the batches they both write
+func TestBatchedSharedPrefix(t *testing.T) {
+	kv := newMemKV()
+	one := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: storageBatched}
+	two := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: storageBatched}
+
+	expected := make(map[string]*Record)
+	for i := 0; i < 64; i++ {
+		hw := net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}
+		rec := &Record{IP: net.IPv4(10, 0, 0, byte(i)).To4(), Expires: expire, Hostname: "host"}
+		ps := one
+		if i%2 == 0 {
+			ps = two
+		}
+		require.NoError(t, ps.saveIPAddress(context.Background(), hw, rec))
+		ps.Recordsv4[hw.String()] = rec
+		expected[hw.String()] = rec
+	}
+	released := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	delete(one.Recordsv4, released.String())
+	require.NoError(t, one.deleteIPAddress(context.Background(), released))
+	delete(expected, released.String())
+
+	loadedRecords, err := loadRecords(kv, "leases")
+	require.NoError(t, err)
+	assert.Equal(t, expected, loadedRecords)
+}
+
+// racingKV is a memKV on which another instance writes rec for mac to the
+// batch being written, right before the first check-and-set
+type racingKV struct {
+	*memKV
+	other *PluginState
+	mac   net.HardwareAddr
+	rec   *Record
+	raced bool
+}
+
+func (r *racingKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	if !r.raced {
+		r.raced = true
+		if err := r.other.saveIPAddress(context.Background(), r.mac, r.rec); err != nil {
+			return false, nil, err
+		}
+	}
+	return r.memKV.CAS(p, q)
+}
+
+func TestBatchedConcurrentWriteMerged(t *testing.T) {
+	kv := newMemKV()
+	other := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: storageBatched}
+	// Find two MAC addresses sharing a batch
+	mine := net.HardwareAddr{2, 0, 0, 0, 0, 0}
+	theirs := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	for batchShard(theirs.String()) != batchShard(mine.String()) {
+		theirs[5]++
+	}
+	racing := &racingKV{memKV: kv, other: other, mac: theirs, rec: &Record{IP: net.IPv4(10, 0, 0, 2).To4(), Expires: expire}}
+	ps := &PluginState{Recordsv4: make(map[string]*Record), kv: racing, consulKVPrefix: "leases", storageFormat: storageBatched}
+
+	require.NoError(t, ps.saveIPAddress(context.Background(), mine, &Record{IP: net.IPv4(10, 0, 0, 1).To4(), Expires: expire}))
+	assert.True(t, racing.raced)
+
+	loadedRecords, err := loadRecords(kv, "leases")
+	require.NoError(t, err)
+	assert.Len(t, loadedRecords, 2)
+	assert.Contains(t, loadedRecords, mine.String())
+	assert.Contains(t, loadedRecords, theirs.String())
+}
+
+func TestBatchedTooLarge(t *testing.T) {
+	kv := newMemKV()
+	ps := &PluginState{Recordsv4: make(map[string]*Record), kv: kv, consulKVPrefix: "leases", storageFormat: storageBatched, metrics: newMetrics()}
+	// Random hostnames don't compress, a few make a batch over the limit
+	rng := rand.New(rand.NewSource(1))
+	shard := batchShard("02:00:00:00:00:00")
+	saved := 0
+	var err error
+	for i := 0; i < 256 && err == nil; i++ {
+		hw := net.HardwareAddr{2, 0, 0, 0, 0, byte(i)}
+		if batchShard(hw.String()) != shard {
+			continue
+		}
+		hostname := make([]byte, consulMaxValueSize/4)
+		rng.Read(hostname)
+		err = ps.saveIPAddress(context.Background(), hw, &Record{IP: net.IPv4(10, 0, 0, byte(i)).To4(), Expires: expire, Hostname: string(hostname)})
+		if err == nil {
+			saved++
+		}
+	}
+	assert.ErrorIs(t, err, errRecordEncoding)
+	assert.Equal(t, 3, saved)
+	for key, value := range kv.data {
+		assert.LessOrEqual(t, len(value), consulMaxValueSize, "%s is too large", key)
+	}
+}
+
+// TestConsulTimeout checks that a Consul write that doesn't complete within the
+// per-request timeout is aborted instead of holding the request
+func TestLoadRecordsSkipsInvalidValues(t *testing.T) {
+	p := testPluginState(t)
+	for key, value := range map[string]string{
+		"leases/02:00:00:00:00:01":     `{"ip":"10.0.0.1","expires":1735689600,"hostname":"one"}`,
+		"leases/02:00:00:00:00:02":     `not json`,
+		"leases/02:00:00:00:00:03":     `{"owner":"another application"}`,
+		"leases/02:00:00:00:00:04":     `{"ip":"10.0.0.4","expires":1735689600}`,
+		"leases/02:00:00:00:00:05":     `["a", "list"]`,
+		"leases/" + batchKeyDir + "/0": `garbage`,
+	} {
+		_, err := p.kv.Put(&api.KVPair{Key: key, Value: []byte(value)}, nil)
+		require.NoError(t, err)
+	}
+
+	stored, skipped, err := p.loadRecords()
+	require.NoError(t, err)
+	assert.Equal(t, 4, skipped)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "one", stored["02:00:00:00:00:01"].Hostname)
+	assert.Equal(t, "10.0.0.4", stored["02:00:00:00:00:04"].IP.String())
+	assert.Equal(t, uint64(4), p.metrics.invalidRecords.Value())
+}
+
+func TestConsulTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	config := api.DefaultConfig()
+	config.Address = srv.Listener.Addr().String()
+	client, err := api.NewClient(config)
+	require.NoError(t, err)
+
+	p := testPluginState(t)
+	p.kv = client.KV()
+	p.consulTimeout = 50 * time.Millisecond
+
+	ctx, cancel := p.requestContext()
+	defer cancel()
+	start := time.Now()
+	err = p.saveIPAddress(ctx, net.HardwareAddr{2, 0, 0, 0, 0, 1}, &Record{IP: net.IPv4(10, 0, 0, 1)})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second, "write was not aborted on deadline")
+}
+
+// TestSaveIPAddressEncodingFailure checks that a record that can't be
+// serialized is reported apart from Consul errors, and never written
+func TestSaveIPAddressEncodingFailure(t *testing.T) {
+	p := testPluginState(t)
+	kv := p.kv.(*memKV)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+
+	// An IP of invalid length fails to marshal
+	err := p.saveIPAddress(context.Background(), mac, &Record{IP: net.IP{10, 0, 0}})
+	require.Error(t, err)
+	assert.ErrorIs(t, err, errRecordEncoding)
+	assert.Equal(t, uint64(1), p.metrics.encodingFailures.Value())
+	assert.Equal(t, 0, kv.puts)
+
+	p.kv = denyingKV{kv}
+	err = p.saveIPAddress(context.Background(), mac, &Record{IP: net.IPv4(10, 0, 0, 1)})
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, errRecordEncoding)
+	assert.Equal(t, uint64(1), p.metrics.encodingFailures.Value())
+}
+
+func TestLoadMergedRecordsFromReadPrefixes(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseReadPrefixOption(p, "/old-leases/"))
+	require.NoError(t, parseReadPrefixOption(p, "older-leases"))
+	for key, value := range map[string]string{
+		"leases/02:00:00:00:00:01":       `{"ip":"10.0.0.1","expires":1735689600,"hostname":"new"}`,
+		"old-leases/02:00:00:00:00:01":   `{"ip":"10.0.0.9","expires":1735689600,"hostname":"old"}`,
+		"old-leases/02:00:00:00:00:02":   `{"ip":"10.0.0.2","expires":1735689600,"hostname":"old"}`,
+		"older-leases/02:00:00:00:00:02": `{"ip":"10.0.0.8","expires":1735689600,"hostname":"older"}`,
+		"older-leases/02:00:00:00:00:03": `{"ip":"10.0.0.3","expires":1735689600,"hostname":"older"}`,
+	} {
+		_, err := p.kv.Put(&api.KVPair{Key: key, Value: []byte(value)}, nil)
+		require.NoError(t, err)
+	}
+
+	records, skipped, err := p.loadMergedRecords()
+	require.NoError(t, err)
+	assert.Zero(t, skipped)
+	require.Len(t, records, 3)
+	assert.Equal(t, "new", records["02:00:00:00:00:01"].Hostname, "the primary prefix wins")
+	assert.Equal(t, "10.0.0.1", records["02:00:00:00:00:01"].IP.String())
+	assert.Equal(t, "old", records["02:00:00:00:00:02"].Hostname, "earlier read-only prefixes win")
+	assert.Equal(t, "older", records["02:00:00:00:00:03"].Hostname)
+
+	// Writes only go to the primary prefix
+	puts := p.kv.(*memKV).puts
+	mac, _ := net.ParseMAC("02:00:00:00:00:03")
+	require.NoError(t, p.saveIPAddress(context.Background(), mac, records["02:00:00:00:00:03"]))
+	assert.Equal(t, puts+1, p.kv.(*memKV).puts)
+	assert.Contains(t, p.kv.(*memKV).data, "leases/02:00:00:00:00:03")
+	primary, _, err := p.loadRecords()
+	require.NoError(t, err)
+	assert.Len(t, primary, 2)
+}
+
+func TestReadPrefixOverlap(t *testing.T) {
+	for primary, secondary := range map[string]string{"leases": "leases/old", "leases/new": "leases", "dhcp/leases/": "dhcp/leases"} {
+		p := &PluginState{consulKVPrefix: primary}
+		require.NoError(t, parseReadPrefixOption(p, secondary))
+		assert.Error(t, p.checkReadPrefixes(), secondary)
+	}
+	p := &PluginState{consulKVPrefix: "leases"}
+	require.NoError(t, parseReadPrefixOption(p, "leases-old"))
+	assert.NoError(t, p.checkReadPrefixes())
+	assert.Error(t, parseReadPrefixOption(p, "leases-old/"), "duplicate")
+}
+
+func TestPrettyJSONRoundTrip(t *testing.T) {
+	for _, pretty := range []string{"false", "true"} {
+		t.Run("pretty="+pretty, func(t *testing.T) {
+			p := testPluginState(t)
+			require.NoError(t, parsePrettyJSONOption(p, pretty))
+			kv := p.kv.(*memKV)
+			mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+			rec := &Record{IP: net.IPv4(10, 0, 0, 1), Expires: 1700000000, Hostname: "printer"}
+			require.NoError(t, p.saveIPAddress(context.Background(), mac, rec))
+
+			data := kv.data["leases/"+mac.String()]
+			assert.Equal(t, pretty == "true", strings.Contains(string(data), "\n  \"ip\""), string(data))
+			loaded, err := loadRecords(kv, "leases")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]*Record{mac.String(): rec}, loaded)
+		})
+	}
+	assert.Error(t, parsePrettyJSONOption(&PluginState{}, "indented"))
+}
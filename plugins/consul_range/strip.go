@@ -0,0 +1,60 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionFilter removes options from the responses to clients of a user class,
+// or to all clients if class is empty
+type optionFilter struct {
+	class string
+	codes []dhcpv4.OptionCode
+}
+
+// parseStripOptionsOption adds a filter given as "[<class>:]<code>,<code>...".
+// Message type, pad and end can't be stripped, responses would be invalid.
+func parseStripOptionsOption(p *PluginState, value string) error {
+	var class string
+	codes := value
+	if i := strings.LastIndexByte(value, ':'); i >= 0 {
+		class, codes = value[:i], value[i+1:]
+		if class == "" {
+			return fmt.Errorf("invalid option filter %q, want [<class>:]<code>,<code>...", value)
+		}
+	}
+	f := optionFilter{class: class}
+	for _, s := range strings.Split(codes, ",") {
+		code, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid option code %q in option filter %q: %w", s, value, err)
+		}
+		switch uint8(code) {
+		case dhcpv4.OptionPad.Code(), dhcpv4.OptionDHCPMessageType.Code(), dhcpv4.OptionEnd.Code():
+			return fmt.Errorf("option %d cannot be stripped", code)
+		}
+		f.codes = append(f.codes, dhcpv4.GenericOptionCode(code))
+	}
+	p.optionFilters = append(p.optionFilters, f)
+	return nil
+}
+
+// stripOptions removes from resp the options filtered for the client of req
+func (p *PluginState) stripOptions(req, resp *dhcpv4.DHCPv4) {
+	if resp == nil || len(p.optionFilters) == 0 {
+		return
+	}
+	classes := req.UserClass()
+	for _, f := range p.optionFilters {
+		if f.class != "" && !slices.Contains(classes, f.class) {
+			continue
+		}
+		for _, code := range f.codes {
+			resp.Options.Del(code)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripOptions(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseStripOptionsOption(p, "42,43"))
+	require.NoError(t, parseStripOptionsOption(p, "lab:6"))
+
+	for _, tc := range []struct {
+		name     string
+		mods     []dhcpv4.Modifier
+		stripped []dhcpv4.OptionCode
+		kept     []dhcpv4.OptionCode
+	}{
+		{
+			name:     "all clients",
+			stripped: []dhcpv4.OptionCode{dhcpv4.OptionNTPServers, dhcpv4.OptionVendorSpecificInformation},
+			kept:     []dhcpv4.OptionCode{dhcpv4.OptionDomainNameServer, dhcpv4.OptionRouter, dhcpv4.OptionIPAddressLeaseTime},
+		},
+		{
+			name:     "class",
+			mods:     []dhcpv4.Modifier{dhcpv4.WithUserClass("lab", false)},
+			stripped: []dhcpv4.OptionCode{dhcpv4.OptionNTPServers, dhcpv4.OptionVendorSpecificInformation, dhcpv4.OptionDomainNameServer},
+			kept:     []dhcpv4.OptionCode{dhcpv4.OptionRouter, dhcpv4.OptionIPAddressLeaseTime},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, resp := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(len(tc.mods))}, tc.mods...)
+			// Options set by plugins earlier in the chain
+			resp.UpdateOption(dhcpv4.OptNTPServers(net.IPv4(10, 0, 1, 1)))
+			resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, []byte{1, 1, 1}))
+			resp.UpdateOption(dhcpv4.OptDNS(net.IPv4(10, 0, 1, 2)))
+			resp.UpdateOption(dhcpv4.OptRouter(net.IPv4(10, 0, 0, 254)))
+
+			resp, _ = p.Handler4(req, resp)
+			require.NotNil(t, resp)
+			for _, code := range tc.stripped {
+				assert.False(t, resp.Options.Has(code), "option %s not stripped", code)
+			}
+			for _, code := range tc.kept {
+				assert.True(t, resp.Options.Has(code), "option %s stripped", code)
+			}
+		})
+	}
+}
+
+func TestParseStripOptionsOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseStripOptionsOption(p, "a:b:15"))
+	assert.Equal(t, []optionFilter{{class: "a:b", codes: []dhcpv4.OptionCode{dhcpv4.GenericOptionCode(15)}}}, p.optionFilters)
+	for _, value := range []string{"", ":15", "15,", "256", "dns", "53", "lab:0,255"} {
+		assert.Error(t, parseStripOptionsOption(p, value), value)
+	}
+}
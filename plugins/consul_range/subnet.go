@@ -0,0 +1,117 @@
+package consulrangeplugin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func parseSubnetOption(p *PluginState, value string) error {
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("not an IPv4 subnet: %s", value)
+	}
+	p.subnet = subnet
+	return nil
+}
+
+// subnetBoundaries returns the network and broadcast addresses of an IPv4 subnet
+func subnetBoundaries(subnet *net.IPNet) (network, broadcast net.IP) {
+	network = subnet.IP.To4()
+	mask := binary.BigEndian.Uint32(net.IP(subnet.Mask).To4())
+	broadcast = make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(broadcast, binary.BigEndian.Uint32(network)|^mask)
+	return network, broadcast
+}
+
+// applySubnet checks that the range lies within the configured subnet, if any,
+// and excludes the subnet's network and broadcast addresses from allocation.
+func (p *PluginState) applySubnet() error {
+	if p.subnet == nil {
+		return nil
+	}
+	if !p.subnet.Contains(p.rangeStart) || !p.subnet.Contains(p.rangeEnd) {
+		return fmt.Errorf("range %s-%s is not within subnet %s", p.rangeStart, p.rangeEnd, p.subnet)
+	}
+	network, broadcast := subnetBoundaries(p.subnet)
+	for _, ip := range []net.IP{network, broadcast} {
+		if err := p.exclude(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exclude takes ip out of the pool if it is within the range, so that it is
+// never allocated. Excluded addresses are not considered part of the range.
+func (p *PluginState) exclude(ip net.IP) error {
+	if _, ok := p.excluded[ip.String()]; ok || !p.inRange(ip) {
+		return nil
+	}
+	got, err := p.allocator.Allocate(net.IPNet{IP: ip})
+	if err != nil {
+		return fmt.Errorf("could not exclude %s from allocation: %w", ip, err)
+	}
+	if !got.IP.Equal(ip) {
+		_ = p.allocator.Free(got)
+		return fmt.Errorf("could not exclude %s from allocation, it is already allocated", ip)
+	}
+	if p.excluded == nil {
+		p.excluded = make(map[string]struct{})
+	}
+	p.excluded[ip.String()] = struct{}{}
+	log.Printf("Excluded %s from allocation", ip)
+	return nil
+}
+
+func parseServeSubnetOption(p *PluginState, value string) error {
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("not an IPv4 subnet: %s", value)
+	}
+	p.serveSubnet = subnet
+	return nil
+}
+
+// ingressAddr returns an address of the subnet a request comes from. Relayed
+// requests come from the relay agent's subnet, given by giaddr; local ones
+// from the subnet of the range.
+func (p *PluginState) ingressAddr(req *dhcpv4.DHCPv4) net.IP {
+	if relayed(req) {
+		return req.GatewayIPAddr
+	}
+	return p.rangeStart
+}
+
+// relayed reports whether a message is exchanged through a relay agent
+func relayed(m *dhcpv4.DHCPv4) bool {
+	return m.GatewayIPAddr != nil && !m.GatewayIPAddr.IsUnspecified()
+}
+
+// setReplyFlags sets the relay address and broadcast flag of resp, which tell
+// how it reaches the client; sending it is left to the server. A relayed reply
+// goes back through the relay, which broadcasts it to the client if the client
+// asked for it with the broadcast flag, as it can't receive unicasts before it
+// is configured (RFC 2131, section 4.1). NAKs are always broadcast, see nak.
+func setReplyFlags(req, resp *dhcpv4.DHCPv4) {
+	resp.GatewayIPAddr = req.GatewayIPAddr
+	if req.IsBroadcast() {
+		resp.SetBroadcast()
+	} else {
+		resp.SetUnicast()
+	}
+}
+
+// servesSubnet reports whether the request comes from the subnet this instance
+// serves, if restricted
+func (p *PluginState) servesSubnet(req *dhcpv4.DHCPv4) bool {
+	return p.serveSubnet == nil || p.serveSubnet.Contains(p.ingressAddr(req))
+}
@@ -0,0 +1,156 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredhcp/coredhcp/plugins/allocators/bitmap"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnetBoundariesNeverAllocated(t *testing.T) {
+	p := testPluginState(t)
+	p.rangeStart = net.IPv4(10, 0, 0, 0).To4()
+	p.rangeEnd = net.IPv4(10, 0, 0, 15).To4()
+	var err error
+	p.allocator, err = bitmap.NewIPv4Allocator(p.rangeStart, p.rangeEnd)
+	require.NoError(t, err)
+	require.NoError(t, parseSubnetOption(p, "10.0.0.0/28"))
+	require.NoError(t, p.applySubnet())
+
+	for i := 0; i < 14; i++ {
+		req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, byte(i + 1)})
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp, "allocation %d failed", i)
+		assert.False(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 0)), "network address allocated")
+		assert.False(t, resp.YourIPAddr.Equal(net.IPv4(10, 0, 0, 15)), "broadcast address allocated")
+	}
+	// Only the network and broadcast addresses are left, and they can't be handed out
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 15})
+	resp, _ := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+}
+
+func TestRequestedBoundaryAddressIgnored(t *testing.T) {
+	p := testPluginState(t)
+	p.rangeStart = net.IPv4(10, 0, 0, 0).To4()
+	p.rangeEnd = net.IPv4(10, 0, 0, 15).To4()
+	var err error
+	p.allocator, err = bitmap.NewIPv4Allocator(p.rangeStart, p.rangeEnd)
+	require.NoError(t, err)
+	require.NoError(t, parseSubnetOption(p, "10.0.0.0/28"))
+	require.NoError(t, p.applySubnet())
+
+	// New clients get the next free address whatever they ask for
+	for i, requested := range []net.IP{
+		net.IPv4(10, 0, 0, 15),
+		net.IPv4(10, 0, 0, 0),
+		net.IPv4bcast,
+		net.IPv4zero,
+	} {
+		for _, typ := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+			mac := net.HardwareAddr{2, 0, 0, 0, byte(typ), byte(i + 1)}
+			req, stub := testRequest(t, mac, dhcpv4.WithMessageType(typ), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(requested)))
+			resp, _ := p.Handler4(req, stub)
+			require.NotNil(t, resp, "%s of %s", typ, requested)
+			assert.True(t, p.inRange(resp.YourIPAddr), "%s of %s got %s", typ, requested, resp.YourIPAddr)
+			assert.False(t, resp.YourIPAddr.Equal(requested), "%s of %s was honored", typ, requested)
+		}
+	}
+}
+
+func TestSubnetMustContainRange(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseSubnetOption(p, "10.0.0.0/29"))
+	assert.Error(t, p.applySubnet(), "range 10.0.0.1-10.0.0.10 is not within 10.0.0.0/29")
+
+	assert.Error(t, parseSubnetOption(p, "2001:db8::/64"))
+	assert.Error(t, parseSubnetOption(p, "10.0.0.0"))
+}
+
+func TestHandler4ServeSubnet(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseServeSubnetOption(p, "10.0.0.0/24"))
+
+	// Relayed from within the subnet
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1}, dhcpv4.WithGatewayIP(net.IPv4(10, 0, 0, 254)))
+	resp, stop := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.False(t, stop)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+
+	// Local requests come from the subnet of the range
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.2", resp.YourIPAddr.String())
+
+	// Relayed from another subnet, passed through untouched
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 3}, dhcpv4.WithGatewayIP(net.IPv4(10, 0, 1, 254)))
+	want := stub.ToBytes()
+	resp, stop = p.Handler4(req, stub)
+	assert.False(t, stop, "requests from other subnets must be passed to the next plugin")
+	require.NotNil(t, resp)
+	assert.Equal(t, want, resp.ToBytes(), "requests from other subnets must not be modified")
+	assert.NotContains(t, p.Recordsv4, "02:00:00:00:00:03")
+}
+
+func TestHandler4ServeSubnetExcludesLocal(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseServeSubnetOption(p, "192.168.0.0/16"))
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	resp, stop := p.Handler4(req, stub)
+	assert.False(t, stop)
+	require.NotNil(t, resp)
+	assert.Empty(t, p.Recordsv4)
+}
+
+func TestHandler4ReplyFlags(t *testing.T) {
+	relay := dhcpv4.WithGatewayIP(net.IPv4(192, 168, 1, 1))
+	for _, tc := range []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		broadcast bool
+	}{
+		{"direct broadcast", []dhcpv4.Modifier{dhcpv4.WithBroadcast(true)}, true},
+		{"direct unicast", []dhcpv4.Modifier{dhcpv4.WithBroadcast(false)}, false},
+		{"relayed broadcast", []dhcpv4.Modifier{relay, dhcpv4.WithBroadcast(true)}, true},
+		{"relayed unicast", []dhcpv4.Modifier{relay, dhcpv4.WithBroadcast(false)}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := testPluginState(t)
+			req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1}, tc.modifiers...)
+			// A previous plugin may have changed them
+			stub.GatewayIPAddr = net.IPv4zero
+			if tc.broadcast {
+				stub.SetUnicast()
+			} else {
+				stub.SetBroadcast()
+			}
+			resp, _ := p.Handler4(req, stub)
+			require.NotNil(t, resp)
+			assert.Equal(t, tc.broadcast, resp.IsBroadcast())
+			assert.True(t, resp.GatewayIPAddr.Equal(req.GatewayIPAddr), "the reply must go back through the relay")
+		})
+	}
+}
+
+func TestHandler4RelayedNakIsBroadcast(t *testing.T) {
+	p := testPluginState(t)
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		dhcpv4.WithGatewayIP(net.IPv4(192, 168, 1, 1)), dhcpv4.WithBroadcast(false), dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 5)))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.True(t, resp.IsBroadcast())
+	assert.Equal(t, "192.168.1.1", resp.GatewayIPAddr.String())
+
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1}, dhcpv4.WithBroadcast(false), dhcpv4.WithClientIP(net.IPv4(10, 0, 0, 5)))
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, dhcpv4.MessageTypeNak, resp.MessageType())
+	assert.False(t, resp.IsBroadcast(), "the server broadcasts direct NAKs itself")
+}
@@ -0,0 +1,81 @@
+package consulrangeplugin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// subnetLease is the lease time granted to the clients of a subnet
+type subnetLease struct {
+	subnet    *net.IPNet
+	leaseTime time.Duration
+}
+
+// parseSubnetLeaseOption adds the lease time granted to the clients of a
+// subnet instead of the lease duration argument, given as "<CIDR>:<duration>"
+func parseSubnetLeaseOption(p *PluginState, value string) error {
+	cidr, duration, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("invalid subnet lease time %q, want <CIDR>:<duration>", value)
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if subnet.IP.To4() == nil {
+		return fmt.Errorf("not an IPv4 subnet: %s", cidr)
+	}
+	leaseTime, err := parseLeaseTime(duration)
+	if err != nil {
+		return err
+	}
+	if leaseTime <= 0 {
+		return fmt.Errorf("lease time must be positive, got %s", leaseTime)
+	}
+	for _, other := range p.subnetLeases {
+		if other.subnet.String() == subnet.String() {
+			return fmt.Errorf("duplicate lease time for %s", subnet)
+		}
+	}
+	p.subnetLeases = append(p.subnetLeases, subnetLease{subnet: subnet, leaseTime: leaseTime})
+	// Most specific subnets first
+	slices.SortStableFunc(p.subnetLeases, func(a, b subnetLease) int {
+		la, _ := a.subnet.Mask.Size()
+		lb, _ := b.subnet.Mask.Size()
+		return lb - la
+	})
+	return nil
+}
+
+// checkSubnetLeases checks the per-subnet lease times against the options
+// constraining the lease time
+func (p *PluginState) checkSubnetLeases() error {
+	for _, s := range p.subnetLeases {
+		if s.leaseTime == infiniteLeaseTime && p.backpressureFree > 0 {
+			return errors.New("backpressure cannot shorten infinite leases")
+		}
+		if err := p.checkLeaseTimeFloor(s.leaseTime); err != nil {
+			return fmt.Errorf("lease time of %s: %w", s.subnet, err)
+		}
+	}
+	return nil
+}
+
+// leaseTimeFor returns the lease time of the most specific subnet containing
+// the address req came in on, or the lease duration argument.
+// Must be called with the plugin lock held, the lease time can be changed.
+func (p *PluginState) leaseTimeFor(req *dhcpv4.DHCPv4) time.Duration {
+	from := p.ingressAddr(req)
+	for _, s := range p.subnetLeases {
+		if s.subnet.Contains(from) {
+			return s.leaseTime
+		}
+	}
+	return p.LeaseTime
+}
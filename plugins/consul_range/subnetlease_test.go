@@ -0,0 +1,44 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubnetLeaseTime(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseSubnetLeaseOption(p, "192.168.0.0/16:4h"))
+	require.NoError(t, parseSubnetLeaseOption(p, "192.168.2.0/24:10m"))
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	granted := func(giaddr net.IP) time.Duration {
+		req, stub := testRequest(t, mac, dhcpv4.WithGatewayIP(giaddr))
+		resp, _ := p.Handler4(req, stub)
+		require.NotNil(t, resp)
+		return resp.IPAddressLeaseTime(0)
+	}
+
+	assert.Equal(t, 10*time.Minute, granted(net.IPv4(192, 168, 2, 1)))
+	// The same MAC relayed from another subnet
+	delete(p.Recordsv4, mac.String())
+	assert.Equal(t, 4*time.Hour, granted(net.IPv4(192, 168, 1, 1)))
+	delete(p.Recordsv4, mac.String())
+	assert.Equal(t, time.Hour, granted(net.IPv4(172, 16, 0, 1)), "other subnets get the default")
+}
+
+func TestParseSubnetLeaseOption(t *testing.T) {
+	p := testPluginState(t)
+	for _, value := range []string{"192.168.0.0/16", "192.168.0.0/16:soon", "192.168.0.0/16:-1h", "::/0:1h"} {
+		assert.Error(t, parseSubnetLeaseOption(p, value), value)
+	}
+	require.NoError(t, parseSubnetLeaseOption(p, "192.168.0.0/16:infinite"))
+	assert.Error(t, parseSubnetLeaseOption(p, "192.168.0.0/16:1h"), "duplicate subnet")
+
+	require.NoError(t, parseLeaseTimeFloorOption(p, "1h"))
+	require.NoError(t, parseSubnetLeaseOption(p, "10.1.0.0/16:30m"))
+	assert.ErrorIs(t, p.checkSubnetLeases(), errLeaseTimeFloor)
+}
@@ -0,0 +1,89 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Limits on the tags of a record, which are stored along with it in Consul
+const (
+	maxTags        = 32
+	maxTagKeyLen   = 64
+	maxTagValueLen = 256
+)
+
+// validateTags checks that tags fit in the limits above
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("too many tags, at most %d are allowed", maxTags)
+	}
+	for k, v := range tags {
+		if k == "" {
+			return errors.New("tag names cannot be empty")
+		}
+		if len(k) > maxTagKeyLen {
+			return fmt.Errorf("tag name %q is longer than %d bytes", k, maxTagKeyLen)
+		}
+		if len(v) > maxTagValueLen {
+			return fmt.Errorf("value of tag %q is longer than %d bytes", k, maxTagValueLen)
+		}
+	}
+	return nil
+}
+
+// setTags replaces the tags of the lease of mac and persists them. The map is
+// replaced rather than modified, as copies of the record handed out by leases
+// share it.
+func (p *PluginState) setTags(ctx context.Context, mac net.HardwareAddr, tags map[string]string) (lease, error) {
+	p.Lock()
+	defer p.Unlock()
+	rec, ok := p.Recordsv4[mac.String()]
+	if !ok {
+		return lease{}, fmt.Errorf("%w for MAC %s", errNoLease, p.logMAC(mac.String()))
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+	old := rec.Tags
+	rec.Tags = tags
+	if err := p.saveIPAddress(ctx, mac, rec); err != nil {
+		rec.Tags = old
+		return lease{}, err
+	}
+	return lease{MAC: p.logMAC(mac.String()), Record: *rec, Infinite: rec.infinite()}, nil
+}
+
+// serveTags replaces the tags of the lease of the MAC address in the path with
+// the JSON object in the body
+func (p *PluginState) serveTags(w http.ResponseWriter, r *http.Request) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	var tags map[string]string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&tags); err != nil {
+		http.Error(w, "invalid tags, want a JSON object of strings: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTags(tags); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := p.setTags(r.Context(), mac, tags)
+	if errors.Is(err, errNoLease) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Warningf("Failed to write lease: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package consulrangeplugin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// putTags PUTs body to the tags endpoint of mac and returns the status
+func putTags(t *testing.T, srv *httptest.Server, mac, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/leases/"+mac+"/tags", strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+testHTTPToken)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestTagsSurviveRenewal(t *testing.T) {
+	p := testPluginState(t)
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	require.Equal(t, http.StatusOK, putTags(t, srv, mac.String(), `{"owner":"netops","location":"rack3"}`))
+	want := map[string]string{"owner": "netops", "location": "rack3"}
+
+	// A renewal rewrites the record
+	p.Recordsv4[mac.String()].Expires = 0
+	puts := p.kv.(*memKV).puts
+	req, stub = testRequest(t, mac)
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	require.Greater(t, p.kv.(*memKV).puts, puts, "the renewal was not persisted")
+
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, want, stored[mac.String()].Tags)
+
+	res, err := http.Get(srv.URL + "/leases/" + resp.YourIPAddr.String())
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var l lease
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&l))
+	assert.Equal(t, want, l.Tags)
+
+	// An empty object clears them
+	require.Equal(t, http.StatusOK, putTags(t, srv, mac.String(), `{}`))
+	stored, err = loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Nil(t, stored[mac.String()].Tags)
+}
+
+func TestTagsErrors(t *testing.T) {
+	p := testPluginState(t)
+	testLease(t, p, net.HardwareAddr{2, 0, 0, 0, 0, 1}, net.IPv4(10, 0, 0, 1))
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusNotFound, putTags(t, srv, "02:00:00:00:00:02", `{"a":"b"}`))
+	assert.Equal(t, http.StatusBadRequest, putTags(t, srv, "not-a-mac", `{"a":"b"}`))
+	assert.Equal(t, http.StatusBadRequest, putTags(t, srv, "02:00:00:00:00:01", `{"a":1}`))
+	assert.Equal(t, http.StatusBadRequest, putTags(t, srv, "02:00:00:00:00:01", `{"":"b"}`))
+	assert.Equal(t, http.StatusBadRequest, putTags(t, srv, "02:00:00:00:00:01", `{"a":"`+strings.Repeat("x", maxTagValueLen+1)+`"}`))
+	assert.Nil(t, p.Recordsv4["02:00:00:00:00:01"].Tags)
+}
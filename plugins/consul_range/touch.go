@@ -0,0 +1,58 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// touch extends the lease of mac by a lease time from now, as a renewal
+// would, on behalf of an external monitor seeing the client active. A lease
+// already running longer is left as is. The extension is persisted.
+func (p *PluginState) touch(ctx context.Context, mac net.HardwareAddr) (lease, error) {
+	p.Lock()
+	defer p.Unlock()
+	rec, ok := p.Recordsv4[mac.String()]
+	if !ok {
+		return lease{}, fmt.Errorf("%w for MAC %s", errNoLease, p.logMAC(mac.String()))
+	}
+	now := p.now()
+	if rec.expiredAt(now) {
+		return lease{}, fmt.Errorf("%w for MAC %s, it expired", errNoLease, p.logMAC(mac.String()))
+	}
+	if rec.needsExtension(now, p.LeaseTime) {
+		expires := rec.Expires
+		rec.Expires = expiresAt(now, p.LeaseTime)
+		if err := p.saveIPAddress(ctx, mac, rec); err != nil {
+			rec.Expires = expires
+			return lease{}, err
+		}
+		p.emit(eventRenew, mac.String(), rec)
+		log.Printf("Extended lease %s for active MAC %s", rec.IP, p.logMAC(mac.String()))
+	}
+	return lease{MAC: p.logMAC(mac.String()), Record: *rec, Infinite: rec.infinite()}, nil
+}
+
+// serveTouch extends the lease of the MAC address in the path, see touch
+func (p *PluginState) serveTouch(w http.ResponseWriter, r *http.Request) {
+	mac, ok := p.pathClient(w, r)
+	if !ok {
+		return
+	}
+	l, err := p.touch(r.Context(), mac)
+	if errors.Is(err, errNoLease) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log.Warningf("Failed to write lease: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTouchExtendsLease(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 5))
+	rec.Expires = expiresAt(clock.Now(), p.LeaseTime)
+	require.NoError(t, p.saveIPAddress(context.Background(), mac, rec))
+	granted := rec.Expires
+
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	clock.Advance(40 * time.Minute)
+	status, l := postPin(t, srv, mac.String(), "touch")
+	require.Equal(t, http.StatusOK, status)
+	want := expiresAt(clock.Now(), p.LeaseTime)
+	assert.Greater(t, want, granted)
+	assert.Equal(t, want, l.Expires)
+	assert.Equal(t, want, p.Recordsv4[mac.String()].Expires)
+	stored, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+	assert.Equal(t, want, stored[mac.String()].Expires, "the extension must be persisted")
+
+	// A lease running longer isn't shortened
+	puts := p.kv.(*memKV).puts
+	status, l = postPin(t, srv, mac.String(), "touch")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, want, l.Expires)
+	assert.Equal(t, puts, p.kv.(*memKV).puts)
+}
+
+func TestTouchWithoutLease(t *testing.T) {
+	p := testPluginState(t)
+	clock := newFakeClock()
+	p.clock = clock.Now
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+
+	status, _ := postPin(t, srv, "02:00:00:00:00:01", "touch")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = postPin(t, srv, "not-a-mac", "touch")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// An expired lease can't be revived
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	rec := testLease(t, p, mac, net.IPv4(10, 0, 0, 6))
+	rec.Expires = int(clock.Now().Add(-time.Minute).Unix())
+	status, _ = postPin(t, srv, mac.String(), "touch")
+	assert.Equal(t, http.StatusNotFound, status)
+}
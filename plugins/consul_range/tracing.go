@@ -0,0 +1,348 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// traceQueueSize bounds the number of finished spans waiting for export
+	traceQueueSize = 4096
+	// traceBatchSize is the number of spans exported at most per request
+	traceBatchSize = 256
+	// traceFlushInterval is how often spans are exported
+	traceFlushInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+func parseOTLPEndpointOption(p *PluginState, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("OTLP endpoint must be http or https: %s", value)
+	}
+	p.otlpEndpoint = value
+	return nil
+}
+
+// tracer records OpenTelemetry spans and exports them in the background to an
+// OTLP/HTTP collector, JSON encoded. Spans that can't be queued are dropped,
+// tracing never blocks request handling. A nil tracer records nothing.
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	queue    chan *span
+	interval time.Duration
+}
+
+func newTracer(endpoint string, interval time.Duration) *tracer {
+	t := &tracer{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, traceQueueSize),
+		interval: interval,
+	}
+	go t.run()
+	return t
+}
+
+// span is an operation being traced
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu     sync.Mutex
+	finish time.Time
+	attrs  map[string]string
+	failed bool
+}
+
+type spanKey struct{}
+
+// spanFrom returns the span carried by ctx, if any
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// withSpan returns ctx carrying s, so that spans started from it are its children
+func withSpan(ctx context.Context, s *span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// start starts a span named name, the child of the span carried by ctx if any
+func (t *tracer) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.id
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.id[:])
+	return withSpan(ctx, s), s
+}
+
+// set sets attribute key of s
+func (s *span) set(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// fail records that the operation of s failed with err, if not nil
+func (s *span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.attrs["error.message"] = err.Error()
+}
+
+// end finishes s and queues it for export
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.finish = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		log.Debugf("Trace queue full, dropping span %s", s.name)
+	}
+}
+
+// otlpSpan is a span in the OTLP JSON encoding
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+// encode returns s in the OTLP JSON encoding
+func (s *span) encode() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.id[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.finish.UnixNano(), 10),
+	}
+	if s.parentID != ([8]byte{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	o.Status.Code = spanStatusOK
+	if s.failed {
+		o.Status.Code = spanStatusError
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.attrs)) {
+		a := otlpAttribute{Key: k}
+		a.Value.StringValue = s.attrs[k]
+		o.Attributes = append(o.Attributes, a)
+	}
+	return o
+}
+
+// run exports the queued spans in batches
+func (t *tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			log.Warningf("Could not export %d spans to %s: %v", len(batch), t.endpoint, err)
+		}
+		batch = nil
+	}
+}
+
+// export POSTs spans to the collector as an OTLP ExportTraceServiceRequest
+func (t *tracer) export(spans []*span) error {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		encoded = append(encoded, s.encode())
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []any{map[string]any{
+				"key": "service.name", "value": map[string]string{"stringValue": "coredhcp"},
+			}}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "plugins/consulrange"},
+				"spans": encoded,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	res, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// traceRequest records the handling of req by handle as a server span,
+// carrying the client's MAC address, the address it was given and the outcome
+func (p *PluginState) traceRequest(req *dhcpv4.DHCPv4, handle func(context.Context) (*dhcpv4.DHCPv4, bool)) (*dhcpv4.DHCPv4, bool) {
+	ctx, s := p.tracer.start(context.Background(), "consulrange.Handler4", spanKindServer)
+	out, stop := handle(ctx)
+	s.set("dhcp.mac", p.logMAC(req.ClientHWAddr.String()))
+	s.set("dhcp.message_type", strings.ToLower(req.MessageType().String()))
+	if out == nil {
+		s.set("dhcp.outcome", "dropped")
+	} else {
+		// The message type may be left for another plugin to set
+		outcome := "reply"
+		if t := out.MessageType(); t != dhcpv4.MessageTypeNone {
+			outcome = strings.ToLower(t.String())
+		}
+		s.set("dhcp.outcome", outcome)
+		if out.YourIPAddr != nil && !out.YourIPAddr.IsUnspecified() {
+			s.set("dhcp.ip", out.YourIPAddr.String())
+		}
+	}
+	s.end()
+	return out, stop
+}
+
+// tracedKV is a kvStore recording the operations made while handling a
+// request as client spans of the request's span
+type tracedKV struct {
+	kv     kvStore
+	tracer *tracer
+}
+
+// op starts the span of an operation on key made with ctx, if ctx is traced
+func (t *tracedKV) op(ctx context.Context, name, key string) *span {
+	if spanFrom(ctx) == nil {
+		return nil
+	}
+	_, s := t.tracer.start(ctx, name, spanKindClient)
+	s.set("consul.key", key)
+	return s
+}
+
+func (t *tracedKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	s := t.op(q.Context(), "consul.kv.get", key)
+	pair, meta, err := t.kv.Get(key, q)
+	s.fail(err)
+	s.end()
+	return pair, meta, err
+}
+
+func (t *tracedKV) List(prefix string, q *api.QueryOptions) (api.KVPairs, *api.QueryMeta, error) {
+	s := t.op(q.Context(), "consul.kv.list", prefix)
+	pairs, meta, err := t.kv.List(prefix, q)
+	s.fail(err)
+	s.end()
+	return pairs, meta, err
+}
+
+func (t *tracedKV) Put(p *api.KVPair, q *api.WriteOptions) (*api.WriteMeta, error) {
+	s := t.op(q.Context(), "consul.kv.put", p.Key)
+	meta, err := t.kv.Put(p, q)
+	s.fail(err)
+	s.end()
+	return meta, err
+}
+
+func (t *tracedKV) Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error) {
+	s := t.op(w.Context(), "consul.kv.delete", key)
+	meta, err := t.kv.Delete(key, w)
+	s.fail(err)
+	s.end()
+	return meta, err
+}
+
+func (t *tracedKV) Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	s := t.op(q.Context(), "consul.kv.acquire", p.Key)
+	ok, meta, err := t.kv.Acquire(p, q)
+	s.fail(err)
+	s.end()
+	return ok, meta, err
+}
+
+func (t *tracedKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	s := t.op(q.Context(), "consul.kv.cas", p.Key)
+	ok, meta, err := t.kv.CAS(p, q)
+	s.fail(err)
+	s.end()
+	return ok, meta, err
+}
@@ -0,0 +1,129 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collector is an OTLP/HTTP endpoint keeping the spans exported to it
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+// named returns the spans exported with the given name
+func (c *collector) named(name string) []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []otlpSpan
+	for _, s := range c.spans {
+		if s.Name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func attributes(s otlpSpan) map[string]string {
+	attrs := make(map[string]string)
+	for _, a := range s.Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	return attrs
+}
+
+func TestTracesExported(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	p := testPluginState(t)
+	require.NoError(t, parseOTLPEndpointOption(p, srv.URL+"/v1/traces"))
+	p.tracer = newTracer(p.otlpEndpoint, 10*time.Millisecond)
+	p.kv = &tracedKV{kv: p.kv, tracer: p.tracer}
+
+	req, stub := testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 1})
+	stub.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	resp, _ := p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	p.awaitingHandoff = true
+	req, stub = testRequest(t, net.HardwareAddr{2, 0, 0, 0, 0, 2}, dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover))
+	resp, _ = p.Handler4(req, stub)
+	require.Nil(t, resp)
+	// Background operations aren't traced
+	_, err := loadRecords(p.kv, p.consulKVPrefix)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return len(c.named("consulrange.Handler4")) == 2 }, 5*time.Second, 10*time.Millisecond)
+	handled := c.named("consulrange.Handler4")
+	assert.Equal(t, map[string]string{
+		"dhcp.mac":          "02:00:00:00:00:01",
+		"dhcp.message_type": "request",
+		"dhcp.outcome":      "ack",
+		"dhcp.ip":           "10.0.0.1",
+	}, attributes(handled[0]))
+	assert.Equal(t, spanKindServer, handled[0].Kind)
+	assert.Empty(t, handled[0].ParentSpanID)
+	assert.Equal(t, map[string]string{
+		"dhcp.mac":          "02:00:00:00:00:02",
+		"dhcp.message_type": "discover",
+		"dhcp.outcome":      "dropped",
+	}, attributes(handled[1]))
+	assert.NotEqual(t, handled[0].TraceID, handled[1].TraceID)
+
+	require.Eventually(t, func() bool { return len(c.named("consul.kv.put")) > 0 }, 5*time.Second, 10*time.Millisecond)
+	put := c.named("consul.kv.put")[0]
+	assert.Equal(t, handled[0].TraceID, put.TraceID)
+	assert.Equal(t, handled[0].SpanID, put.ParentSpanID)
+	assert.Equal(t, spanKindClient, put.Kind)
+	assert.Equal(t, "leases/02:00:00:00:00:01", attributes(put)["consul.key"])
+	assert.Equal(t, spanStatusOK, put.Status.Code)
+	assert.Empty(t, c.named("consul.kv.list"))
+}
+
+func TestNilTracerRecordsNothing(t *testing.T) {
+	var tr *tracer
+	ctx, s := tr.start(context.Background(), "noop", spanKindServer)
+	assert.Nil(t, s)
+	assert.Nil(t, spanFrom(ctx))
+	s.set("key", "value")
+	s.fail(assert.AnError)
+	s.end()
+}
+
+func TestParseOTLPEndpointOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseOTLPEndpointOption(p, "http://collector:4318/v1/traces"))
+	assert.Equal(t, "http://collector:4318/v1/traces", p.otlpEndpoint)
+	assert.Error(t, parseOTLPEndpointOption(p, "collector:4318"))
+}
@@ -0,0 +1,62 @@
+package consulrangeplugin
+
+import "time"
+
+// ttlSet is a set of at most size keys, each forgotten ttl after it was added.
+// A zero ttl or size disables it: nothing is added. It is not safe for
+// concurrent use, its owners protect it with the plugin lock.
+type ttlSet[K comparable] struct {
+	ttl     time.Duration
+	size    int
+	entries map[K]*ttlEntry
+}
+
+// ttlEntry is a key held by a ttlSet
+type ttlEntry struct {
+	added time.Time
+	// hits is free for the owner of the set to count events of the key with
+	hits int
+}
+
+// get returns the entry of k, unless there is none or it was added ttl or
+// more before now
+func (s *ttlSet[K]) get(k K, now time.Time) (*ttlEntry, bool) {
+	e, ok := s.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if now.Sub(e.added) >= s.ttl {
+		delete(s.entries, k)
+		return nil, false
+	}
+	return e, true
+}
+
+// add adds k at now, replacing its entry if it had one. If the set is full
+// once expired entries are pruned, k is not added and add returns nil.
+func (s *ttlSet[K]) add(k K, now time.Time) *ttlEntry {
+	if s.ttl == 0 {
+		return nil
+	}
+	if s.entries == nil {
+		s.entries = make(map[K]*ttlEntry)
+	}
+	if _, ok := s.entries[k]; !ok && len(s.entries) >= s.size {
+		for key, e := range s.entries {
+			if now.Sub(e.added) >= s.ttl {
+				delete(s.entries, key)
+			}
+		}
+		if len(s.entries) >= s.size {
+			return nil
+		}
+	}
+	e := &ttlEntry{added: now}
+	s.entries[k] = e
+	return e
+}
+
+// len returns the number of keys held, expired ones included until pruned
+func (s *ttlSet[K]) len() int {
+	return len(s.entries)
+}
@@ -0,0 +1,57 @@
+package consulrangeplugin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLSetExpires(t *testing.T) {
+	s := ttlSet[string]{ttl: time.Second, size: 10}
+	now := time.Now()
+	require.NotNil(t, s.add("a", now))
+	e, ok := s.get("a", now.Add(999*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, now, e.added)
+	_, ok = s.get("a", now.Add(time.Second))
+	assert.False(t, ok)
+	assert.Zero(t, s.len(), "expired keys are forgotten when looked up")
+	_, ok = s.get("b", now)
+	assert.False(t, ok)
+
+	// Adding again restarts the key
+	s.add("a", now)
+	e = s.add("a", now.Add(time.Second))
+	e.hits++
+	e, ok = s.get("a", now.Add(1500*time.Millisecond))
+	require.True(t, ok)
+	assert.Equal(t, 1, e.hits)
+}
+
+func TestTTLSetBounded(t *testing.T) {
+	s := ttlSet[int]{ttl: time.Second, size: 10}
+	now := time.Now()
+	for i := range 20 {
+		added := s.add(i, now)
+		assert.Equal(t, i < 10, added != nil, fmt.Sprint(i))
+	}
+	assert.Equal(t, 10, s.len())
+	// Keys held can still be added again
+	assert.NotNil(t, s.add(5, now))
+
+	// Expired keys make room
+	assert.NotNil(t, s.add(15, now.Add(time.Second)))
+	assert.Equal(t, 1, s.len())
+}
+
+func TestTTLSetDisabled(t *testing.T) {
+	now := time.Now()
+	for _, s := range []ttlSet[string]{{size: 10}, {ttl: time.Second}} {
+		assert.Nil(t, s.add("a", now))
+		_, ok := s.get("a", now)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,70 @@
+package consulrangeplugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func parseWarmupOption(p *PluginState, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	if d < 0 {
+		return fmt.Errorf("warmup cannot be negative: %s", d)
+	}
+	p.warmup = d
+	return nil
+}
+
+// startWarmup holds off serving for the warmup period. The leases and
+// reservations are loaded before the plugin is set up; with reconciliation
+// enabled, a first pass also completes before requests are served, however
+// long it takes. Requests are dropped until then, and /healthz reports the
+// plugin as not ready.
+func (p *PluginState) startWarmup() {
+	p.Lock()
+	p.warmingUp = true
+	p.Unlock()
+	log.Printf("Warming up for %s before serving", p.warmup)
+
+	go func() {
+		deadline := time.Now().Add(p.warmup)
+		if p.reconcileInterval > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), p.reconcileInterval)
+			if _, err := p.reconcile(ctx); err != nil {
+				log.Warningf("Reconciliation during warmup failed: %v", err)
+			}
+			cancel()
+		}
+		time.Sleep(time.Until(deadline))
+		p.Lock()
+		p.warmingUp = false
+		p.Unlock()
+		log.Printf("Warmup complete, serving requests")
+	}()
+}
+
+// ready reports whether the plugin serves requests
+func (p *PluginState) ready() bool {
+	p.Lock()
+	defer p.Unlock()
+	return !p.warmingUp
+}
+
+// serveHealthz answers 200 once the plugin serves requests, 503 while it warms
+// up. The body tells whether it is in maintenance.
+func (p *PluginState) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if !p.ready() {
+		http.Error(w, "warming up", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if p.inMaintenance() {
+		_, _ = w.Write([]byte("maintenance\n"))
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,50 @@
+package consulrangeplugin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmupRefusesUntilComplete(t *testing.T) {
+	p := testPluginState(t)
+	require.NoError(t, parseWarmupOption(p, "100ms"))
+	p.startWarmup()
+	srv := httptest.NewServer(p.httpHandler())
+	defer srv.Close()
+	healthz := func() int {
+		res, err := http.Get(srv.URL + "/healthz")
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 1}
+	req, stub := testRequest(t, mac)
+	resp, stop := p.Handler4(req, stub)
+	assert.Nil(t, resp)
+	assert.True(t, stop)
+	assert.Empty(t, p.Recordsv4)
+	assert.Equal(t, uint64(1), p.metrics.warmupDropped.Value())
+	assert.Equal(t, http.StatusServiceUnavailable, healthz())
+
+	require.Eventually(t, p.ready, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, healthz())
+	req, stub = testRequest(t, mac)
+	resp, _ = p.Handler4(req, stub)
+	require.NotNil(t, resp)
+	assert.Equal(t, "10.0.0.1", resp.YourIPAddr.String())
+}
+
+func TestParseWarmupOption(t *testing.T) {
+	p := &PluginState{}
+	require.NoError(t, parseWarmupOption(p, "5s"))
+	assert.Equal(t, 5*time.Second, p.warmup)
+	assert.Error(t, parseWarmupOption(p, "-1s"))
+	assert.Error(t, parseWarmupOption(p, "soon"))
+}
@@ -0,0 +1,131 @@
+package consulrangeplugin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the request body
+	webhookSignatureHeader = "X-Coredhcp-Signature"
+	// webhookQueueSize bounds the number of events waiting for delivery
+	webhookQueueSize = 1024
+	// webhookAttempts is the number of times delivery of an event is tried
+	webhookAttempts = 5
+	// webhookBackoff is the delay before the first retry, doubled on every further retry
+	webhookBackoff = time.Second
+)
+
+func parseWebhookOption(p *PluginState, value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook URL must be http or https: %s", value)
+	}
+	p.webhookURL = value
+	return nil
+}
+
+func parseWebhookSecretOption(p *PluginState, value string) error {
+	if value == "" {
+		return errors.New("webhook secret cannot be empty")
+	}
+	p.webhookSecret = []byte(value)
+	return nil
+}
+
+// webhook is a leaseHook POSTing expire and release events as signed JSON.
+// Delivery happens in the background, so that it never blocks the caller.
+type webhook struct {
+	url     string
+	secret  []byte
+	client  *http.Client
+	queue   chan []byte
+	backoff time.Duration
+}
+
+func newWebhook(url string, secret []byte) *webhook {
+	w := &webhook{
+		url:     url,
+		secret:  secret,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan []byte, webhookQueueSize),
+		backoff: webhookBackoff,
+	}
+	go w.run()
+	return w
+}
+
+// LeaseEvent queues expire and release events for delivery
+func (w *webhook) LeaseEvent(ev leaseEvent) {
+	if ev.Type != eventExpire && ev.Type != eventRelease {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorf("Could not marshal webhook payload: %v", err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		log.WithField("dead_letter", string(body)).Errorf("Webhook queue full, dropping event")
+	}
+}
+
+// run delivers queued events, retrying with exponential backoff. Events that
+// can't be delivered are written to the dead-letter log.
+func (w *webhook) run() {
+	for body := range w.queue {
+		delay := w.backoff
+		var err error
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = w.deliver(body); err == nil {
+				break
+			}
+			if attempt < webhookAttempts {
+				log.Warningf("Webhook delivery attempt %d failed, retrying in %s: %v", attempt, delay, err)
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+		if err != nil {
+			log.WithField("dead_letter", string(body)).Errorf("Webhook delivery failed permanently: %v", err)
+		}
+	}
+}
+
+// signature returns the HMAC-SHA256 of body, as sent in the signature header
+func (w *webhook) signature(body []byte) string {
+	h := hmac.New(sha256.New, w.secret)
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (w *webhook) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, w.signature(body))
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package consulrangeplugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSignedDelivery(t *testing.T) {
+	secret := []byte("s3cret")
+	var failures atomic.Int32
+	failures.Store(2)
+	received := make(chan leaseEvent, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first deliveries to exercise the retries
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), r.Header.Get(webhookSignatureHeader))
+		var ev leaseEvent
+		require.NoError(t, json.Unmarshal(body, &ev))
+		received <- ev
+	}))
+	defer srv.Close()
+
+	w := newWebhook(srv.URL, secret)
+	w.backoff = time.Millisecond
+
+	// Only expire and release events are delivered
+	w.LeaseEvent(leaseEvent{Type: eventAllocate, MAC: "02:00:00:00:00:01", IP: net.IPv4(10, 0, 0, 1)})
+	w.LeaseEvent(leaseEvent{Type: eventExpire, MAC: "02:00:00:00:00:02", IP: net.IPv4(10, 0, 0, 2).To4(), Expires: expire})
+
+	select {
+	case ev := <-received:
+		assert.Equal(t, eventExpire, ev.Type)
+		assert.Equal(t, "02:00:00:00:00:02", ev.MAC)
+		assert.True(t, ev.IP.Equal(net.IPv4(10, 0, 0, 2)))
+		assert.Equal(t, expire, ev.Expires)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
+
+func TestWebhookDoesNotBlock(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer srv.Close()
+
+	w := newWebhook(srv.URL, []byte("s3cret"))
+	start := time.Now()
+	for i := 0; i < webhookQueueSize+10; i++ {
+		w.LeaseEvent(leaseEvent{Type: eventRelease, MAC: "02:00:00:00:00:01"})
+	}
+	assert.Less(t, time.Since(start), time.Second, "queueing events must not block")
+}
@@ -17,6 +17,16 @@
 // its value is also passed as OPT_BOOTFILE_PARAM (option 60), so it will be
 // duplicated between option 59 and 60.
 //
+// For TFTP URLs whose host is an IPv4 address, that address is also set as
+// the next server (siaddr), which some PXE firmwares use instead of option 66.
+//
+// For DHCPv4, further arguments of the form <arch>=<URL> select the NBP by the
+// client system architecture (option 93), e.g. 0 for BIOS, 7 for UEFI x64 and
+// 11 for UEFI ARM64, as the values of RFC 4578 and the IANA registry. The first
+// architecture reported by the client that is mapped selects the NBP. Clients
+// with an unknown or no architecture get the NBP of the URL passed alone, or
+// none if it is omitted.
+//
 // Example usage:
 //
 // server6:
@@ -26,17 +36,25 @@
 // server4:
 //   - plugins:
 //   - nbp: tftp://10.0.0.254/nbp
+//
+// server4:
+//   - plugins:
+//   - nbp: tftp://10.0.0.254/pxelinux.0 7=tftp://10.0.0.254/bootx64.efi 11=tftp://10.0.0.253/bootaa64.efi
 package nbp
 
 import (
 	"fmt"
+	"net"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
 )
 
 var log = logger.GetLogger("plugins/nbp")
@@ -50,9 +68,18 @@ var Plugin = plugins.Plugin{
 
 var (
 	opt59, opt60 dhcpv6.Option
-	opt66, opt67 *dhcpv4.Option
+	// nbp4 is the NBP of clients whose architecture isn't in archNBP4, nil if none
+	nbp4     *nbp4Options
+	archNBP4 map[iana.Arch]*nbp4Options
 )
 
+// nbp4Options holds the DHCPv4 options and header field describing an NBP
+type nbp4Options struct {
+	opt66, opt67 *dhcpv4.Option
+	// nextServer is the address of the TFTP server, nil unless it was given as one
+	nextServer net.IP
+}
+
 func parseArgs(args ...string) (*url.URL, error) {
 	if len(args) != 1 {
 		return nil, fmt.Errorf("Exactly one argument must be passed to NBP plugin, got %d", len(args))
@@ -77,12 +104,13 @@ func setup6(args ...string) (handler.Handler6, error) {
 	return nbpHandler6, nil
 }
 
-func setup4(args ...string) (handler.Handler4, error) {
-	u, err := parseArgs(args...)
+// parseNBP4 splits the URL of an NBP into the DHCPv4 options conveying it
+func parseNBP4(arg string) (*nbp4Options, error) {
+	u, err := url.Parse(arg)
 	if err != nil {
 		return nil, err
 	}
-
+	var n nbp4Options
 	var otsn, obfn dhcpv4.Option
 	switch u.Scheme {
 	case "http", "https", "ftp":
@@ -90,11 +118,60 @@ func setup4(args ...string) (handler.Handler4, error) {
 	default:
 		otsn = dhcpv4.OptTFTPServerName(u.Host)
 		obfn = dhcpv4.OptBootFileName(u.Path)
-		opt66 = &otsn
+		n.opt66 = &otsn
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			n.nextServer = ip.To4()
+		}
 	}
+	n.opt67 = &obfn
+	return &n, nil
+}
 
-	opt67 = &obfn
-	log.Printf("loaded NBP plugin for DHCPv4.")
+// parseArch parses the architecture of an <arch>=<URL> argument, returning
+// false if arg isn't one
+func parseArch(arg string) (iana.Arch, string, bool) {
+	arch, u, ok := strings.Cut(arg, "=")
+	if !ok {
+		return 0, "", false
+	}
+	code, err := strconv.ParseUint(arch, 10, 16)
+	if err != nil {
+		return 0, "", false
+	}
+	return iana.Arch(code), u, true
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("At least one argument must be passed to NBP plugin")
+	}
+	var def *nbp4Options
+	archs := make(map[iana.Arch]*nbp4Options)
+	for _, arg := range args {
+		arch, u, ok := parseArch(arg)
+		if !ok {
+			if def != nil {
+				return nil, fmt.Errorf("At most one NBP URL without an architecture can be passed to NBP plugin, got %q", arg)
+			}
+			n, err := parseNBP4(arg)
+			if err != nil {
+				return nil, err
+			}
+			def = n
+			continue
+		}
+		if _, ok := archs[arch]; ok {
+			return nil, fmt.Errorf("Duplicate NBP URL for architecture %d", arch)
+		}
+		n, err := parseNBP4(u)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid NBP URL for architecture %d: %w", arch, err)
+		}
+		archs[arch] = n
+	}
+
+	nbp4, archNBP4 = def, archs
+	log.Printf("loaded NBP plugin for DHCPv4 with %d architectures.", len(archs))
 	return nbpHandler4, nil
 }
 
@@ -124,18 +201,33 @@ func nbpHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	return resp, true
 }
 
+// selectNBP4 returns the NBP for the first architecture of the client that
+// has one, or the default
+func selectNBP4(req *dhcpv4.DHCPv4) *nbp4Options {
+	for _, arch := range req.ClientArch() {
+		if n, ok := archNBP4[arch]; ok {
+			return n
+		}
+	}
+	return nbp4
+}
+
 func nbpHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if opt67 == nil {
+	n := selectNBP4(req)
+	if n == nil {
 		// nothing to do
 		return resp, true
 	}
-	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && opt66 != nil {
-		resp.Options.Update(*opt66)
-		log.Debugf("Added NBP %s / %s to request", opt66, opt67)
+	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && n.opt66 != nil {
+		resp.Options.Update(*n.opt66)
+		log.Debugf("Added NBP %s / %s to request", n.opt66, n.opt67)
 	}
 	if req.IsOptionRequested(dhcpv4.OptionBootfileName) {
-		resp.Options.Update(*opt67)
-		log.Debugf("Added NBP %s to request", opt67)
+		resp.Options.Update(*n.opt67)
+		if n.nextServer != nil {
+			resp.ServerIPAddr = n.nextServer
+		}
+		log.Debugf("Added NBP %s to request", n.opt67)
 	}
 	return resp, true
 }
@@ -0,0 +1,101 @@
+// Copyright 2018-present the CoreDHCP Authors. All rights reserved
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package nbp
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func request4(t *testing.T, archs ...iana.Arch) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	t.Helper()
+	mods := []dhcpv4.Modifier{dhcpv4.WithRequestedOptions(dhcpv4.OptionTFTPServerName, dhcpv4.OptionBootfileName)}
+	if len(archs) > 0 {
+		mods = append(mods, dhcpv4.WithOption(dhcpv4.OptClientArch(archs...)))
+	}
+	req, err := dhcpv4.NewDiscovery(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}, mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, stub
+}
+
+func TestNBP4ByArch(t *testing.T) {
+	if _, err := setup4(
+		"tftp://10.0.0.254/pxelinux.0",
+		"7=tftp://10.0.0.253/bootx64.efi",
+		"11=tftp://10.0.0.252/bootaa64.efi",
+		"16=http://boot.example.com/bootx64.efi",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		archs      []iana.Arch
+		server     string
+		file       string
+		nextServer net.IP
+	}{
+		{"no arch", nil, "10.0.0.254", "/pxelinux.0", net.IPv4(10, 0, 0, 254)},
+		{"bios", []iana.Arch{iana.INTEL_X86PC}, "10.0.0.254", "/pxelinux.0", net.IPv4(10, 0, 0, 254)},
+		{"uefi x64", []iana.Arch{iana.EFI_X86_64}, "10.0.0.253", "/bootx64.efi", net.IPv4(10, 0, 0, 253)},
+		{"uefi arm64", []iana.Arch{iana.EFI_ARM64}, "10.0.0.252", "/bootaa64.efi", net.IPv4(10, 0, 0, 252)},
+		{"uefi http", []iana.Arch{iana.EFI_X86_64_HTTP}, "", "http://boot.example.com/bootx64.efi", nil},
+		{"first mapped arch", []iana.Arch{iana.EFI_ITANIUM, iana.EFI_ARM64, iana.EFI_X86_64}, "10.0.0.252", "/bootaa64.efi", net.IPv4(10, 0, 0, 252)},
+		{"unknown arch", []iana.Arch{iana.EFI_ITANIUM}, "10.0.0.254", "/pxelinux.0", net.IPv4(10, 0, 0, 254)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, stub := request4(t, tc.archs...)
+			resp, _ := nbpHandler4(req, stub)
+			if resp == nil {
+				t.Fatal("plugin did not return a message")
+			}
+			if got := resp.TFTPServerName(); got != tc.server {
+				t.Errorf("Found TFTP server %q, expected %q", got, tc.server)
+			}
+			if got := resp.BootFileNameOption(); got != tc.file {
+				t.Errorf("Found boot file %q, expected %q", got, tc.file)
+			}
+			if tc.nextServer != nil && !resp.ServerIPAddr.Equal(tc.nextServer) {
+				t.Errorf("Found next server %s, expected %s", resp.ServerIPAddr, tc.nextServer)
+			}
+		})
+	}
+}
+
+func TestNBP4UnknownArchSkipped(t *testing.T) {
+	if _, err := setup4("7=tftp://10.0.0.253/bootx64.efi"); err != nil {
+		t.Fatal(err)
+	}
+	req, stub := request4(t, iana.INTEL_X86PC)
+	resp, _ := nbpHandler4(req, stub)
+	if resp.Options.Has(dhcpv4.OptionBootfileName) || resp.Options.Has(dhcpv4.OptionTFTPServerName) {
+		t.Errorf("Added NBP options for an unmapped architecture: %v", resp.Options)
+	}
+	if resp.ServerIPAddr != nil && !resp.ServerIPAddr.IsUnspecified() {
+		t.Errorf("Set next server %s for an unmapped architecture", resp.ServerIPAddr)
+	}
+}
+
+func TestSetup4InvalidArgs(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"tftp://10.0.0.254/a", "tftp://10.0.0.254/b"},
+		{"7=tftp://10.0.0.254/a", "7=tftp://10.0.0.254/b"},
+		{"7=tftp://10.0.0.254/%zz"},
+	} {
+		if _, err := setup4(args...); err == nil {
+			t.Errorf("setup4(%q) succeeded, expected an error", args)
+		}
+	}
+}